@@ -1,176 +1,294 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
-	"path"
 	"path/filepath"
 	"runtime/pprof"
 	"strings"
 
 	"github.com/akalin/gopar/par1"
 	"github.com/akalin/gopar/par2"
+	"github.com/akalin/gopar/parformat"
 	"github.com/akalin/gopar/rsec16"
 )
 
-type par1LogEncoderDelegate struct{}
+type par1LogEncoderDelegate struct {
+	out io.Writer
+}
 
-func (par1LogEncoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int, err error) {
+func (d par1LogEncoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int, err error) {
 	if err != nil {
-		fmt.Printf("[%d/%d] Loading data file %q failed: %+v\n", i, n, path, err)
+		fmt.Fprintf(d.out, "[%d/%d] Loading data file %q failed: %+v\n", i, n, path, err)
 	} else {
-		fmt.Printf("[%d/%d] Loaded data file %q (%d bytes)\n", i, n, path, byteCount)
+		fmt.Fprintf(d.out, "[%d/%d] Loaded data file %q (%d bytes)\n", i, n, path, byteCount)
 	}
 }
 
-func (par1LogEncoderDelegate) OnVolumeFileWrite(i, n int, path string, dataByteCount, byteCount int, err error) {
+// Progress is reported too often to be worth logging.
+func (par1LogEncoderDelegate) OnParityProgress(processedByteCount, byteCount int) {}
+
+func (d par1LogEncoderDelegate) OnVolumeFileWrite(i, n int, path string, dataByteCount, byteCount int, err error) {
 	if err != nil {
-		fmt.Printf("[%d/%d] Writing volume file %q failed: %+v\n", i, n, path, err)
+		fmt.Fprintf(d.out, "[%d/%d] Writing volume file %q failed: %+v\n", i, n, path, err)
 	} else {
-		fmt.Printf("[%d/%d] Wrote volume file %q (%d data bytes, %d bytes)\n", i, n, path, dataByteCount, byteCount)
+		fmt.Fprintf(d.out, "[%d/%d] Wrote volume file %q (%d data bytes, %d bytes)\n", i, n, path, dataByteCount, byteCount)
 	}
 }
 
-type par1LogDecoderDelegate struct{}
+type par1LogDecoderDelegate struct {
+	out io.Writer
+}
+
+func (d par1LogDecoderDelegate) OnHeaderLoad(headerInfo string) {
+	fmt.Fprintf(d.out, "Loaded header: %s\n", headerInfo)
+}
 
-func (par1LogDecoderDelegate) OnHeaderLoad(headerInfo string) {
-	fmt.Printf("Loaded header: %s\n", headerInfo)
+func (d par1LogDecoderDelegate) OnFileEntryLoad(i, n int, filename, entryInfo string) {
+	fmt.Fprintf(d.out, "[%d/%d] Loaded entry for %q: %s\n", i, n, filename, entryInfo)
 }
 
-func (par1LogDecoderDelegate) OnFileEntryLoad(i, n int, filename, entryInfo string) {
-	fmt.Printf("[%d/%d] Loaded entry for %q: %s\n", i, n, filename, entryInfo)
+func (d par1LogDecoderDelegate) OnCommentLoad(comment []byte) {
+	fmt.Fprintf(d.out, "Comment: %q\n", comment)
 }
 
-func (par1LogDecoderDelegate) OnCommentLoad(comment []byte) {
-	fmt.Printf("Comment: %q\n", comment)
+func (d par1LogDecoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int, corrupt bool, err error) {
+	if err != nil {
+		if corrupt {
+			fmt.Fprintf(d.out, "[%d/%d] Loading data file %q failed; marking as corrupt and skipping: %+v\n", i, n, path, err)
+		} else {
+			fmt.Fprintf(d.out, "[%d/%d] Loading data file %q failed: %+v\n", i, n, path, err)
+		}
+	} else {
+		fmt.Fprintf(d.out, "[%d/%d] Loaded data file %q (%d bytes)\n", i, n, path, byteCount)
+	}
 }
 
-func (par1LogDecoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int, corrupt bool, err error) {
+func (d par1LogDecoderDelegate) OnCheckedOnlyFileLoad(i, n int, path string, byteCount int, corrupt bool, err error) {
 	if err != nil {
 		if corrupt {
-			fmt.Printf("[%d/%d] Loading data file %q failed; marking as corrupt and skipping: %+v\n", i, n, path, err)
+			fmt.Fprintf(d.out, "[%d/%d] Checking file %q failed; it can't be repaired, since it's not saved in the volume set: %+v\n", i, n, path, err)
 		} else {
-			fmt.Printf("[%d/%d] Loading data file %q failed: %+v\n", i, n, path, err)
+			fmt.Fprintf(d.out, "[%d/%d] Checking file %q failed: %+v\n", i, n, path, err)
 		}
 	} else {
-		fmt.Printf("[%d/%d] Loaded data file %q (%d bytes)\n", i, n, path, byteCount)
+		fmt.Fprintf(d.out, "[%d/%d] Checked file %q (%d bytes)\n", i, n, path, byteCount)
 	}
 }
 
-func (par1LogDecoderDelegate) OnDataFileWrite(i, n int, path string, byteCount int, err error) {
+// Progress is reported too often to be worth logging.
+func (par1LogDecoderDelegate) OnDataFileHashProgress(path string, hashedByteCount, byteCount int) {}
+
+func (par1LogDecoderDelegate) OnParityProgress(processedByteCount, byteCount int) {}
+
+func (d par1LogDecoderDelegate) OnDataFileWrite(i, n int, path string, byteCount int, err error) {
 	if err != nil {
-		fmt.Printf("[%d/%d] Writing data file %q failed: %+v\n", i, n, path, err)
+		fmt.Fprintf(d.out, "[%d/%d] Writing data file %q failed: %+v\n", i, n, path, err)
 	} else {
-		fmt.Printf("[%d/%d] Wrote data file %q (%d bytes)\n", i, n, path, byteCount)
+		fmt.Fprintf(d.out, "[%d/%d] Wrote data file %q (%d bytes)\n", i, n, path, byteCount)
 	}
 }
 
-func (par1LogDecoderDelegate) OnVolumeFileLoad(i uint64, path string, storedSetHash, computedSetHash [16]byte, dataByteCount int, err error) {
+func (d par1LogDecoderDelegate) OnVolumeFileLoad(i uint64, path string, storedSetHash, computedSetHash [16]byte, dataByteCount int, err error) {
 	if os.IsNotExist(err) {
 		// Do nothing.
 	} else if err != nil {
-		fmt.Printf("[%d] Loading volume file %q failed: %+v\n", i, path, err)
+		fmt.Fprintf(d.out, "[%d] Loading volume file %q failed: %+v\n", i, path, err)
 	} else {
-		fmt.Printf("[%d] Loaded volume file %q (%d data bytes)\n", i, path, dataByteCount)
+		fmt.Fprintf(d.out, "[%d] Loaded volume file %q (%d data bytes)\n", i, path, dataByteCount)
 		if storedSetHash != computedSetHash {
-			fmt.Printf("[%d] Warning: stored set hash in %q %x doesn't match computed set hash %x\n", i, path, storedSetHash, computedSetHash)
+			fmt.Fprintf(d.out, "[%d] Warning: stored set hash in %q %x doesn't match computed set hash %x\n", i, path, storedSetHash, computedSetHash)
 		}
 	}
 }
 
-type par2LogEncoderDelegate struct{}
+func (d par1LogDecoderDelegate) OnVolumeFileWrite(i, n int, path string, dataByteCount, byteCount int, err error) {
+	if err != nil {
+		fmt.Fprintf(d.out, "[%d/%d] Writing volume file %q failed: %+v\n", i, n, path, err)
+	} else {
+		fmt.Fprintf(d.out, "[%d/%d] Wrote volume file %q (%d data bytes, %d bytes)\n", i, n, path, dataByteCount, byteCount)
+	}
+}
+
+type par2LogEncoderDelegate struct {
+	out io.Writer
+}
 
-func (par2LogEncoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int, err error) {
+func (d par2LogEncoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int, err error) {
 	if err != nil {
-		fmt.Printf("[%d/%d] Loading data file %q failed: %+v\n", i, n, path, err)
+		fmt.Fprintf(d.out, "[%d/%d] Loading data file %q failed: %+v\n", i, n, path, err)
 	} else {
-		fmt.Printf("[%d/%d] Loaded data file %q (%d bytes)\n", i, n, path, byteCount)
+		fmt.Fprintf(d.out, "[%d/%d] Loaded data file %q (%d bytes)\n", i, n, path, byteCount)
 	}
 }
 
-func (par2LogEncoderDelegate) OnIndexFileWrite(path string, byteCount int, err error) {
+// Progress is reported too often to be worth logging.
+func (par2LogEncoderDelegate) OnDataFileHashProgress(path string, hashedByteCount, byteCount int) {}
+
+func (par2LogEncoderDelegate) OnMatrixProgress(rowsApplied, rowCount int) {}
+
+func (d par2LogEncoderDelegate) OnIndexFileWrite(path string, byteCount int, err error) {
 	if err != nil {
-		fmt.Printf("Writing index file %q failed: %+v\n", path, err)
+		fmt.Fprintf(d.out, "Writing index file %q failed: %+v\n", path, err)
 	} else {
-		fmt.Printf("Wrote index file %q (%d bytes)\n", path, byteCount)
+		fmt.Fprintf(d.out, "Wrote index file %q (%d bytes)\n", path, byteCount)
 	}
 }
 
-func (par2LogEncoderDelegate) OnRecoveryFileWrite(start, count, total int, path string, dataByteCount, byteCount int, err error) {
+func (d par2LogEncoderDelegate) OnRecoveryFileWrite(start, count, total int, path string, dataByteCount, byteCount int, err error) {
 	if err != nil {
-		fmt.Printf("[%d+%d/%d] Writing recovery file %q failed: %+v\n", start, count, total, path, err)
+		fmt.Fprintf(d.out, "[%d+%d/%d] Writing recovery file %q failed: %+v\n", start, count, total, path, err)
 	} else {
-		fmt.Printf("[%d+%d/%d] Wrote recovery file %q (%d data bytes, %d bytes)\n", start, count, total, path, dataByteCount, byteCount)
+		fmt.Fprintf(d.out, "[%d+%d/%d] Wrote recovery file %q (%d data bytes, %d bytes)\n", start, count, total, path, dataByteCount, byteCount)
 	}
 }
 
-type par2LogDecoderDelegate struct{}
+type par2LogDecoderDelegate struct {
+	out io.Writer
+}
+
+func (d par2LogDecoderDelegate) OnCreatorPacketLoad(clientID string) {
+	fmt.Fprintf(d.out, "Loaded creator packet with client ID %q\n", clientID)
+}
+
+func (d par2LogDecoderDelegate) OnMainPacketLoad(sliceByteCount, recoverySetCount, nonRecoverySetCount int) {
+	fmt.Fprintf(d.out, "Loaded main packet: slice byte count=%d, recovery set size=%d, non-recovery set size=%d\n", sliceByteCount, recoverySetCount, nonRecoverySetCount)
+}
+
+func (d par2LogDecoderDelegate) OnFileDescriptionPacketLoad(fileID [16]byte, filename string, byteCount int) {
+	fmt.Fprintf(d.out, "Loaded file description packet for %q (ID=%x, %d bytes)\n", filename, fileID, byteCount)
+}
+
+func (d par2LogDecoderDelegate) OnIFSCPacketLoad(fileID [16]byte) {
+	fmt.Fprintf(d.out, "Loaded checksums for file with ID %x\n", fileID)
+}
+
+func (d par2LogDecoderDelegate) OnUnicodeFilenamePacketLoad(fileID [16]byte, filename string) {
+	fmt.Fprintf(d.out, "Loaded Unicode filename packet for %q (ID=%x)\n", filename, fileID)
+}
+
+func (d par2LogDecoderDelegate) OnCommentPacketLoad(comment string) {
+	fmt.Fprintf(d.out, "Comment: %q\n", comment)
+}
 
-func (par2LogDecoderDelegate) OnCreatorPacketLoad(clientID string) {
-	fmt.Printf("Loaded creator packet with client ID %q\n", clientID)
+func (d par2LogDecoderDelegate) OnRecoveryPacketLoad(exponent uint16, byteCount int) {
+	fmt.Fprintf(d.out, "Loaded recovery packet: exponent=%d, byte count=%d\n", exponent, byteCount)
 }
 
-func (par2LogDecoderDelegate) OnMainPacketLoad(sliceByteCount, recoverySetCount, nonRecoverySetCount int) {
-	fmt.Printf("Loaded main packet: slice byte count=%d, recovery set size=%d, non-recovery set size=%d\n", sliceByteCount, recoverySetCount, nonRecoverySetCount)
+func (d par2LogDecoderDelegate) OnUnknownPacketLoad(packetType [16]byte, byteCount int) {
+	fmt.Fprintf(d.out, "Loaded unknown packet of type %q and byte count %d\n", packetType, byteCount)
 }
 
-func (par2LogDecoderDelegate) OnFileDescriptionPacketLoad(fileID [16]byte, filename string, byteCount int) {
-	fmt.Printf("Loaded file description packet for %q (ID=%x, %d bytes)\n", filename, fileID, byteCount)
+func (d par2LogDecoderDelegate) OnInvalidMainPacketSkip(setID, computedSetID [16]byte) {
+	fmt.Fprintf(d.out, "Skipped main packet with set ID %x that doesn't match its computed set ID %x\n", setID, computedSetID)
 }
 
-func (par2LogDecoderDelegate) OnIFSCPacketLoad(fileID [16]byte) {
-	fmt.Printf("Loaded checksums for file with ID %x\n", fileID)
+func (d par2LogDecoderDelegate) OnDuplicateMainPacketLoad() {
+	fmt.Fprintf(d.out, "Loaded duplicate main packet\n")
 }
 
-func (par2LogDecoderDelegate) OnRecoveryPacketLoad(exponent uint16, byteCount int) {
-	fmt.Printf("Loaded recovery packet: exponent=%d, byte count=%d\n", exponent, byteCount)
+func (d par2LogDecoderDelegate) OnOtherPacketSkip(setID [16]byte, packetType [16]byte, byteCount int) {
+	fmt.Fprintf(d.out, "Skipped packet with set ID %x of type %q and byte count %d\n", setID, packetType, byteCount)
 }
 
-func (par2LogDecoderDelegate) OnUnknownPacketLoad(packetType [16]byte, byteCount int) {
-	fmt.Printf("Loaded unknown packet of type %q and byte count %d\n", packetType, byteCount)
+func (d par2LogDecoderDelegate) OnCorruptDataSkip(startByteOffset, endByteOffset int) {
+	fmt.Fprintf(d.out, "Skipped corrupt data: bytes %d to %d\n", startByteOffset, endByteOffset-1)
 }
 
-func (par2LogDecoderDelegate) OnOtherPacketSkip(setID [16]byte, packetType [16]byte, byteCount int) {
-	fmt.Printf("Skipped packet with set ID %x of type %q and byte count %d\n", setID, packetType, byteCount)
+func (d par2LogDecoderDelegate) OnMalformedPacketSkip(packetType [16]byte, byteCount int, err error) {
+	fmt.Fprintf(d.out, "Skipped malformed packet of type %q and byte count %d: %+v\n", packetType, byteCount, err)
 }
 
-func (par2LogDecoderDelegate) OnDataFileLoad(i, n int, path string, byteCount, hits, misses int, err error) {
+func (d par2LogDecoderDelegate) OnDataFileLoad(i, n int, path string, byteCount, hits, misses int, err error) {
 	if err != nil {
-		fmt.Printf("[%d/%d] Loading data file %q failed: %+v\n", i, n, path, err)
+		fmt.Fprintf(d.out, "[%d/%d] Loading data file %q failed: %+v\n", i, n, path, err)
 	} else {
-		fmt.Printf("[%d/%d] Loaded data file %q (%d bytes, %d hits, %d misses)\n", i, n, path, byteCount, hits, misses)
+		fmt.Fprintf(d.out, "[%d/%d] Loaded data file %q (%d bytes, %d hits, %d misses)\n", i, n, path, byteCount, hits, misses)
 	}
 }
 
-func (par2LogDecoderDelegate) OnParityFileLoad(i int, path string, err error) {
+func (par2LogDecoderDelegate) OnDataFileScanProgress(path string, scannedByteCount, byteCount, hits, misses int) {
+}
+
+func (d par2LogDecoderDelegate) OnParityFileLoad(i int, path string, err error) {
 	if err != nil {
-		fmt.Printf("[%d] Loading volume file %q failed: %+v\n", i, path, err)
+		fmt.Fprintf(d.out, "[%d] Loading volume file %q failed: %+v\n", i, path, err)
 	} else {
-		fmt.Printf("[%d] Loaded volume file %q\n", i, path)
+		fmt.Fprintf(d.out, "[%d] Loaded volume file %q\n", i, path)
 	}
 }
 
-func (par2LogDecoderDelegate) OnDetectCorruptDataChunk(fileID [16]byte, path string, startByteOffset, endByteOffset int) {
-	fmt.Printf("Corrupt data chunk: %q (ID %x), bytes %d to %d\n", path, fileID, startByteOffset, endByteOffset-1)
+func (d par2LogDecoderDelegate) OnDetectCorruptDataChunk(fileID [16]byte, path string, startByteOffset, endByteOffset int) {
+	fmt.Fprintf(d.out, "Corrupt data chunk: %q (ID %x), bytes %d to %d\n", path, fileID, startByteOffset, endByteOffset-1)
+}
+
+func (d par2LogDecoderDelegate) OnDetectDataFileHashMismatch(fileID [16]byte, path string) {
+	fmt.Fprintf(d.out, "Hash mismatch for %q (ID %x)\n", path, fileID)
+}
+
+func (d par2LogDecoderDelegate) OnDetectDataFileWrongByteCount(fileID [16]byte, path string) {
+	fmt.Fprintf(d.out, "Wrong byte count for %q (ID %x)\n", path, fileID)
+}
+
+func (d par2LogDecoderDelegate) OnCandidateFileLoad(i, n int, path string, byteCount, hits int, err error) {
+	if err != nil {
+		fmt.Fprintf(d.out, "[%d/%d] Loading candidate file %q failed: %+v\n", i, n, path, err)
+	} else {
+		fmt.Fprintf(d.out, "[%d/%d] Loaded candidate file %q (%d bytes, %d hits)\n", i, n, path, byteCount, hits)
+	}
 }
 
-func (par2LogDecoderDelegate) OnDetectDataFileHashMismatch(fileID [16]byte, path string) {
-	fmt.Printf("Hash mismatch for %q (ID %x)\n", path, fileID)
+func (d par2LogDecoderDelegate) OnDetectDataFileElsewhere(fileID [16]byte, path, foundPath string) {
+	fmt.Fprintf(d.out, "Found %q (ID %x) at %q\n", path, fileID, foundPath)
 }
 
-func (par2LogDecoderDelegate) OnDetectDataFileWrongByteCount(fileID [16]byte, path string) {
-	fmt.Printf("Wrong byte count for %q (ID %x)\n", path, fileID)
+func (d par2LogDecoderDelegate) OnNonRecoveryFileLoad(i, n int, path string, byteCount int, status par2.FileStatus, err error) {
+	if err != nil {
+		fmt.Fprintf(d.out, "[%d/%d] Checking non-recovery file %q failed: %+v\n", i, n, path, err)
+	} else if status != par2.FileOK {
+		fmt.Fprintf(d.out, "[%d/%d] Checked non-recovery file %q (%d bytes): %s, and can't be repaired\n", i, n, path, byteCount, status)
+	} else {
+		fmt.Fprintf(d.out, "[%d/%d] Checked non-recovery file %q (%d bytes)\n", i, n, path, byteCount)
+	}
+}
+
+func (d par2LogDecoderDelegate) OnExtraFileLoad(i, n int, path string, byteCount, hits, misses int, err error) {
+	if err != nil {
+		fmt.Fprintf(d.out, "[%d/%d] Loading extra file %q failed: %+v\n", i, n, path, err)
+	} else {
+		fmt.Fprintf(d.out, "[%d/%d] Loaded extra file %q (%d bytes, %d hits, %d misses)\n", i, n, path, byteCount, hits, misses)
+	}
+}
+
+func (par2LogDecoderDelegate) OnMatrixProgress(rowsApplied, rowCount int) {}
+
+func (d par2LogDecoderDelegate) OnDataFileWrite(i, n int, path string, byteCount int, err error) {
+	if err != nil {
+		fmt.Fprintf(d.out, "[%d/%d] Writing data file %q failed: %+v\n", i, n, path, err)
+	} else {
+		fmt.Fprintf(d.out, "[%d/%d] Wrote data file %q (%d bytes)\n", i, n, path, byteCount)
+	}
+}
+
+func (d par2LogDecoderDelegate) OnIndexFileWrite(path string, byteCount int, err error) {
+	if err != nil {
+		fmt.Fprintf(d.out, "Writing index file %q failed: %+v\n", path, err)
+	} else {
+		fmt.Fprintf(d.out, "Wrote index file %q (%d bytes)\n", path, byteCount)
+	}
 }
 
-func (par2LogDecoderDelegate) OnDataFileWrite(i, n int, path string, byteCount int, err error) {
+func (d par2LogDecoderDelegate) OnRecoveryFileWrite(start, count, total int, path string, dataByteCount, byteCount int, err error) {
 	if err != nil {
-		fmt.Printf("[%d/%d] Writing data file %q failed: %+v\n", i, n, path, err)
+		fmt.Fprintf(d.out, "[%d+%d/%d] Writing recovery file %q failed: %+v\n", start, count, total, path, err)
 	} else {
-		fmt.Printf("[%d/%d] Wrote data file %q (%d bytes)\n", i, n, path, byteCount)
+		fmt.Fprintf(d.out, "[%d+%d/%d] Wrote recovery file %q (%d data bytes, %d bytes)\n", start, count, total, path, dataByteCount, byteCount)
 	}
 }
 
@@ -180,10 +298,24 @@ func newFlagSet(name string) *flag.FlagSet {
 	return flagSet
 }
 
+// pathsFlag collects the values of a flag that may be given more
+// than once.
+type pathsFlag []string
+
+func (f *pathsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *pathsFlag) Set(path string) error {
+	*f = append(*f, path)
+	return nil
+}
+
 type globalFlags struct {
 	usage         bool
 	cpuProfile    string
 	numGoroutines int
+	memoryLimitMB int
 }
 
 func getGlobalFlags(name string) (*flag.FlagSet, *globalFlags) {
@@ -194,38 +326,108 @@ func getGlobalFlags(name string) (*flag.FlagSet, *globalFlags) {
 	flagSet.StringVar(&flags.cpuProfile, "cpuprofile", "", "if non-empty, where to write the CPU profile")
 	// TODO: Detect hyperthreading and use only number of physical cores.
 	flagSet.IntVar(&flags.numGoroutines, "g", rsec16.DefaultNumGoroutines(), "number of goroutines to use for encoding/decoding PAR2")
+	flagSet.IntVar(&flags.memoryLimitMB, "m", 0, "if positive, stream PAR2 file data when creating and use at most roughly this many MiB for buffers when creating, repairing, or regenerating; if 0, PAR2 repairing and regenerating use at most roughly 256 MiB")
 
 	return flagSet, &flags
 }
 
 type createFlags struct {
-	sliceByteCount  int
-	numParityShards int
+	sliceByteCount    int
+	sliceCount        int
+	numParityShards   int
+	redundancyPercent int
+	recoveryFileCount int
+	comment           string
+	uniform           bool
+	limited           bool
+	dir               string
+	includes          pathsFlag
+	excludes          pathsFlag
+}
+
+// check returns an error if conflicting flags were given, or if flags
+// only supported for PAR2 files were given for a PAR1 file.
+func (f *createFlags) check(format parformat.Format) error {
+	if f.sliceByteCount != 0 && f.sliceCount != 0 {
+		return errors.New("-s and -b can't both be given")
+	}
+	if f.numParityShards >= 0 && f.redundancyPercent != 0 {
+		return errors.New("-c and -r can't both be given")
+	}
+	if f.uniform && f.limited {
+		return errors.New("-u and -l can't both be given")
+	}
+	if f.recoveryFileCount != 0 && f.limited {
+		return errors.New("-n and -l can't both be given")
+	}
+
+	if format == parformat.PAR2 {
+		return nil
+	}
+	par2Flags := []struct {
+		name string
+		set  bool
+	}{
+		{"-b", f.sliceCount != 0},
+		{"-c 0", f.numParityShards == 0},
+		{"-r", f.redundancyPercent != 0},
+		{"-n", f.recoveryFileCount != 0},
+		{"-comment", f.comment != ""},
+		{"-u", f.uniform},
+		{"-l", f.limited},
+		{"-R", f.dir != ""},
+	}
+	for _, par2Flag := range par2Flags {
+		if par2Flag.set {
+			return fmt.Errorf("%s is only supported for PAR2 files", par2Flag.name)
+		}
+	}
+	return nil
 }
 
 func getCreateFlags(name string) (*flag.FlagSet, *createFlags) {
 	flagSet := newFlagSet(name + " create")
 
 	var flags createFlags
-	flagSet.IntVar(&flags.sliceByteCount, "s", 2000, "block size in bytes (must be a multiple of 4)")
-	flagSet.IntVar(&flags.numParityShards, "c", 3, "number of recovery blocks to create (or files, for PAR1)")
+	flagSet.IntVar(&flags.sliceByteCount, "s", 0, "block size in bytes (must be a multiple of 4); if zero, chosen from -b, or to give at most 2000 data blocks if -b isn't given either")
+	flagSet.IntVar(&flags.sliceCount, "b", 0, "if positive, choose the smallest block size that gives at most this many data blocks, up to 32768 (PAR2 only)")
+	flagSet.IntVar(&flags.numParityShards, "c", -1, "number of recovery blocks to create (or files, for PAR1); if zero, create only an index file for verification (PAR2 only); if negative, chosen from -r, or 3 if -r isn't given either")
+	flagSet.IntVar(&flags.redundancyPercent, "r", 0, "if positive, create this percentage of the number of data blocks as recovery blocks (PAR2 only)")
+	flagSet.IntVar(&flags.recoveryFileCount, "n", 0, "if positive, the number of recovery files to spread the recovery blocks among (PAR2 only)")
+	flagSet.StringVar(&flags.comment, "comment", "", "if non-empty, a comment to store in the PAR2 files (PAR2 only)")
+	flagSet.BoolVar(&flags.uniform, "u", false, "give the recovery files roughly the same number of recovery blocks, instead of doubling numbers (PAR2 only)")
+	flagSet.BoolVar(&flags.limited, "l", false, "give no recovery file more recovery data than the largest data file (PAR2 only)")
+	flagSet.StringVar(&flags.dir, "R", "", "if non-empty, also protect all files under this directory, recursively (PAR2 only)")
+	flagSet.Var(&flags.includes, "include", "a glob that files found with -R must match, either by name or by path relative to the directory; may be given more than once")
+	flagSet.Var(&flags.excludes, "exclude", "a glob for files and directories to skip with -R, matched like -include; may be given more than once")
 
 	return flagSet, &flags
 }
 
 type verifyFlags struct {
 	checkParity bool
+	extraPaths  pathsFlag
+	json        bool
+	sets        bool
 }
 
 func getVerifyFlags(name string) (*flag.FlagSet, *verifyFlags) {
 	flagSet := newFlagSet(name + " verify")
 
 	var flags verifyFlags
+	flagSet.Var(&flags.extraPaths, "extra", "an extra file to scan for data blocks; may be given more than once (PAR2 only)")
+	flagSet.BoolVar(&flags.json, "json", false, "print a machine-readable report to stdout, and the usual output to stderr")
+	flagSet.BoolVar(&flags.sets, "sets", false, "verify each recovery set found in the given directory separately, going by the packets in its PAR2 files instead of their names, and print a summary (PAR2 only)")
 	return flagSet, &flags
 }
 
 type repairFlags struct {
 	checkParity bool
+	writeIndex  bool
+	extraPaths  pathsFlag
+	keepBackup  bool
+	outputDir   string
+	sets        bool
 }
 
 func getRepairFlags(name string) (*flag.FlagSet, *repairFlags) {
@@ -233,6 +435,30 @@ func getRepairFlags(name string) (*flag.FlagSet, *repairFlags) {
 
 	var flags repairFlags
 	flagSet.BoolVar(&flags.checkParity, "checkparity", false, "check parity files before repairing")
+	flagSet.BoolVar(&flags.writeIndex, "writeindex", false, "write out a fresh index file from the packets found (PAR2 only)")
+	flagSet.Var(&flags.extraPaths, "extra", "an extra file to scan for data blocks; may be given more than once (PAR2 only)")
+	flagSet.BoolVar(&flags.keepBackup, "keepbackup", false, "keep each damaged file that is replaced, renamed to name.1, name.2, etc.")
+	flagSet.StringVar(&flags.outputDir, "o", "", "if non-empty, write repaired files under this directory instead of over the originals, which are left alone")
+	flagSet.BoolVar(&flags.sets, "sets", false, "repair each recovery set found in the given directory separately, going by the packets in its PAR2 files instead of their names, and print a summary (PAR2 only)")
+
+	return flagSet, &flags
+}
+
+type regenerateFlags struct {
+	numParityShards   int
+	recoveryFileCount int
+	uniform           bool
+	limited           bool
+}
+
+func getRegenerateFlags(name string) (*flag.FlagSet, *regenerateFlags) {
+	flagSet := newFlagSet(name + " regenerate")
+
+	var flags regenerateFlags
+	flagSet.IntVar(&flags.numParityShards, "c", 0, "number of recovery blocks the set was created with (or files, for PAR1); if 0, inferred from the parity files found")
+	flagSet.IntVar(&flags.recoveryFileCount, "n", 0, "the -n option the set was created with, if any (PAR2 only)")
+	flagSet.BoolVar(&flags.uniform, "u", false, "the set was created with -u (PAR2 only)")
+	flagSet.BoolVar(&flags.limited, "l", false, "the set was created with -l (PAR2 only)")
 
 	return flagSet, &flags
 }
@@ -243,7 +469,8 @@ const (
 	createCommand commandMask = 1 << iota
 	verifyCommand
 	repairCommand
-	allCommands = createCommand | verifyCommand | repairCommand
+	regenerateCommand
+	allCommands = createCommand | verifyCommand | repairCommand | regenerateCommand
 )
 
 func printUsageAndExit(name string, mask commandMask, err error) {
@@ -255,14 +482,19 @@ func printUsageAndExit(name string, mask commandMask, err error) {
 
 	if mask&createCommand != 0 {
 		fmt.Printf("  %s [global options] c(reate) [create options] <PAR file> <data files...>\n", name)
+		fmt.Printf("  %s [global options] c(reate) [create options] -R <dir> <PAR file> [data files...]\n", name)
 	}
 
 	if mask&verifyCommand != 0 {
-		fmt.Printf("  %s [global options] v(erify) [verify options] <PAR file>\n", name)
+		fmt.Printf("  %s [global options] v(erify) [verify options] <PAR file or dir>\n", name)
 	}
 
 	if mask&repairCommand != 0 {
-		fmt.Printf("  %s [global options] f(epair) [repair options] <PAR file>\n", name)
+		fmt.Printf("  %s [global options] f(epair) [repair options] <PAR file or dir>\n", name)
+	}
+
+	if mask&regenerateCommand != 0 {
+		fmt.Printf("  %s [global options] regen(erate) [regenerate options] <PAR file or dir>\n", name)
 	}
 
 	fmt.Printf("\nGlobal options\n")
@@ -291,6 +523,13 @@ func printUsageAndExit(name string, mask commandMask, err error) {
 		repairFlagSet.PrintDefaults()
 	}
 
+	if mask&regenerateCommand != 0 {
+		fmt.Printf("\nRegenerate options\n")
+		regenerateFlagSet, _ := getRegenerateFlags(name)
+		regenerateFlagSet.SetOutput(os.Stdout)
+		regenerateFlagSet.PrintDefaults()
+	}
+
 	fmt.Printf("\n")
 	if err != nil {
 		os.Exit(eInvalidCommandLineArguments)
@@ -309,12 +548,137 @@ type decoder interface {
 	LoadParityData() error
 	Verify() (needsRepair bool, err error)
 	Repair(checkParity bool) ([]string, error)
+	RegenerateParityFiles(count int) ([]string, error)
+}
+
+func getReport(decoder decoder) (interface{}, error) {
+	switch decoder := decoder.(type) {
+	case *par1.Decoder:
+		return decoder.Report()
+	case *par2.Decoder:
+		return decoder.Report()
+	default:
+		return nil, errors.New("unknown decoder type")
+	}
+}
+
+// An errorReport is printed by verify -json in place of the report for
+// a recovery set that couldn't be loaded.
+type errorReport struct {
+	Error string `json:"error"`
+}
+
+// writeJSONReport writes report to w as indented JSON.
+func writeJSONReport(w io.Writer, report interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// matchesAny returns whether relPath or its last element matches any
+// of the given glob patterns.
+func matchesAny(patterns []string, relPath string) (bool, error) {
+	for _, pattern := range patterns {
+		for _, name := range []string{relPath, filepath.Base(relPath)} {
+			matched, err := filepath.Match(pattern, name)
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
 }
 
-func newEncoder(parFile string, filePaths []string, sliceByteCount, numParityShards, numGoroutines int) (encoder, error) {
-	// TODO: Detect file type more robustly.
-	ext := path.Ext(parFile)
-	if ext == ".par2" {
+// findDataFiles returns the paths of the regular files under dir,
+// except for parFile and its recovery volumes, that match any of
+// includes, if non-empty, and none of excludes. A directory that
+// matches any of excludes is skipped entirely.
+func findDataFiles(dir, parFile string, includes, excludes []string) ([]string, error) {
+	parPath, err := filepath.Abs(parFile)
+	if err != nil {
+		return nil, err
+	}
+	volumePrefix := strings.TrimSuffix(parPath, filepath.Ext(parPath)) + ".vol"
+
+	var filePaths []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		excluded, err := matchesAny(excludes, relPath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if excluded {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if excluded || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if absPath == parPath || (strings.HasPrefix(absPath, volumePrefix) && strings.EqualFold(filepath.Ext(absPath), ".par2")) {
+			return nil
+		}
+
+		if len(includes) > 0 {
+			included, err := matchesAny(includes, relPath)
+			if err != nil {
+				return err
+			}
+			if !included {
+				return nil
+			}
+		}
+
+		filePaths = append(filePaths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filePaths, nil
+}
+
+// detectFormat returns the format of parFile, which is detected from
+// its contents if it exists, and its extension otherwise.
+func detectFormat(parFile string) (parformat.Format, error) {
+	format, err := parformat.DetectFile(parFile)
+	if err != nil {
+		return parformat.Unknown, err
+	}
+	if format == parformat.Unknown {
+		return parformat.Unknown, fmt.Errorf("could not detect the format of %q", parFile)
+	}
+	return format, nil
+}
+
+// newEncoder returns an encoder for parFile. The options are used only
+// for PAR2 files.
+func newEncoder(parFile string, filePaths []string, sliceByteCount, numParityShards, numGoroutines int, options par2.EncoderOptions) (encoder, error) {
+	format, err := detectFormat(parFile)
+	if err != nil {
+		return nil, err
+	}
+	if format == parformat.PAR2 {
 		parPath, err := filepath.Abs(parFile)
 		if err != nil {
 			return nil, err
@@ -328,7 +692,7 @@ func newEncoder(parFile string, filePaths []string, sliceByteCount, numParitySha
 			}
 			absFilePaths[i] = absPath
 		}
-		return par2.NewEncoder(par2LogEncoderDelegate{}, basePath, absFilePaths, sliceByteCount, numParityShards, numGoroutines)
+		return par2.NewEncoderWithOptions(par2LogEncoderDelegate{os.Stdout}, basePath, absFilePaths, sliceByteCount, numParityShards, numGoroutines, options)
 	}
 
 	parDir := filepath.Dir(parFile)
@@ -343,16 +707,30 @@ func newEncoder(parFile string, filePaths []string, sliceByteCount, numParitySha
 		fmt.Printf("Warning: PAR and data files not all in the same directory, which a decoder will expect\n")
 	}
 
-	return par1.NewEncoder(par1LogEncoderDelegate{}, filePaths, numParityShards)
+	return par1.NewEncoder(par1LogEncoderDelegate{os.Stdout}, filePaths, numParityShards)
 }
 
-func newDecoder(parFile string, numGoroutines int) (decoder, error) {
-	// TODO: Detect file type more robustly.
-	ext := path.Ext(parFile)
-	if ext == ".par2" {
-		return par2.NewDecoder(par2LogDecoderDelegate{}, parFile, numGoroutines)
+// newDecoder returns a decoder for parFile that logs to out. Only the
+// options that apply to PAR1 files are used for them.
+func newDecoder(parFile string, numGoroutines int, options par2.DecoderOptions, out io.Writer) (decoder, error) {
+	// Only PAR2 decoders can start from a directory.
+	info, err := os.Stat(parFile)
+	isDir := err == nil && info.IsDir()
+	if isDir {
+		return par2.NewDecoderWithOptions(par2LogDecoderDelegate{out}, parFile, numGoroutines, options)
+	}
+
+	format, err := detectFormat(parFile)
+	if err != nil {
+		return nil, err
+	}
+	if format == parformat.PAR2 {
+		return par2.NewDecoderWithOptions(par2LogDecoderDelegate{out}, parFile, numGoroutines, options)
 	}
-	return par1.NewDecoder(par1LogDecoderDelegate{}, parFile)
+	return par1.NewDecoderWithOptions(par1LogDecoderDelegate{out}, parFile, par1.DecoderOptions{
+		KeepBackup: options.KeepBackup,
+		OutputDir:  options.OutputDir,
+	})
 }
 
 // Taken from https://github.com/brenthuisman/libpar2/blob/master/src/libpar2.h#L109 .
@@ -375,6 +753,12 @@ func processVerifyOrRepairError(needsRepair bool, err error) int {
 		case rsec16.NotEnoughParityShardsError:
 			fmt.Fprintf(os.Stderr, "Repair necessary but not possible.\n")
 			return eRepairNotPossible
+		case par1.UnrepairableFilesError:
+			fmt.Fprintf(os.Stderr, "Repair necessary but not possible for checked-only files: %v\n", err.(par1.UnrepairableFilesError).Paths)
+			return eRepairNotPossible
+		case par2.UnrepairableFilesError:
+			fmt.Fprintf(os.Stderr, "Repair necessary but not possible for non-recovery files: %v\n", err.(par2.UnrepairableFilesError).Paths)
+			return eRepairNotPossible
 		default:
 			fmt.Fprintf(os.Stderr, "Error encountered: %s\n", err)
 			return eLogicError
@@ -387,6 +771,66 @@ func processVerifyOrRepairError(needsRepair bool, err error) int {
 	return eSuccess
 }
 
+// describeExitCode returns a short description of the outcome that
+// the given exit code stands for, for the -sets summary.
+func describeExitCode(exitCode int) string {
+	switch exitCode {
+	case eSuccess:
+		return "OK"
+	case eRepairPossible:
+		return "repair necessary and possible"
+	case eRepairNotPossible:
+		return "repair necessary but not possible"
+	case eInsufficientCriticalData:
+		return "not enough critical data"
+	default:
+		return "error"
+	}
+}
+
+// processRecoverySets calls process with a decoder for each recovery
+// set found in dir, and then prints a summary with the outcome for
+// each one to out. It returns the largest exit code returned by
+// process, so that any set that needs repair or couldn't be processed
+// is reflected in it. If onError is non-nil, it's called with any
+// error that keeps the sets from being found, or a set from being
+// processed at all.
+func processRecoverySets(dir string, numGoroutines int, options par2.DecoderOptions, out io.Writer, process func(*par2.Decoder) int, onError func(error)) int {
+	sets, err := par2.FindRecoverySets(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encountered: %s\n", err)
+		if onError != nil {
+			onError(err)
+		}
+		return eInsufficientCriticalData
+	}
+
+	exitCodes := make([]int, len(sets))
+	for i, set := range sets {
+		fmt.Fprintf(out, "[%d/%d] Processing recovery set %x with index file %q (%d PAR2 files)\n", i+1, len(sets), set.SetID, set.IndexPath, len(set.Paths))
+		decoder, err := par2.NewDecoderForRecoverySet(par2LogDecoderDelegate{out}, set, numGoroutines, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encountered: %s\n", err)
+			if onError != nil {
+				onError(err)
+			}
+			exitCodes[i] = eInsufficientCriticalData
+			continue
+		}
+		exitCodes[i] = process(decoder)
+	}
+
+	fmt.Fprintf(out, "\nSummary:\n")
+	maxExitCode := eSuccess
+	for i, set := range sets {
+		fmt.Fprintf(out, "  %x %q: %s\n", set.SetID, set.IndexPath, describeExitCode(exitCodes[i]))
+		if exitCodes[i] > maxExitCode {
+			maxExitCode = exitCodes[i]
+		}
+	}
+	return maxExitCode
+}
+
 func main() {
 	name := filepath.Base(os.Args[0])
 
@@ -439,8 +883,14 @@ func main() {
 		if err == nil {
 			if createFlagSet.NArg() == 0 {
 				err = errors.New("no PAR file specified")
-			} else if createFlagSet.NArg() == 1 {
+			} else if createFlagSet.NArg() == 1 && createFlags.dir == "" {
 				err = errors.New("no data files specified")
+			} else {
+				var format parformat.Format
+				format, err = detectFormat(createFlagSet.Arg(0))
+				if err == nil {
+					err = createFlags.check(format)
+				}
 			}
 		}
 		if err != nil {
@@ -449,7 +899,37 @@ func main() {
 
 		allFiles := createFlagSet.Args()
 		parFile, filePaths := allFiles[0], allFiles[1:]
-		encoder, err := newEncoder(parFile, filePaths, createFlags.sliceByteCount, createFlags.numParityShards, globalFlags.numGoroutines)
+		if createFlags.dir != "" {
+			dirFilePaths, err := findDataFiles(createFlags.dir, parFile, createFlags.includes, createFlags.excludes)
+			if err != nil {
+				panic(err)
+			}
+			if len(filePaths)+len(dirFilePaths) == 0 {
+				printUsageAndExit(name, createCommand, errors.New("no data files found"))
+			}
+			filePaths = append(filePaths, dirFilePaths...)
+		}
+		numParityShards := createFlags.numParityShards
+		if numParityShards < 0 {
+			numParityShards = 0
+			if createFlags.redundancyPercent == 0 {
+				numParityShards = 3
+			}
+		}
+		recoveryFileScheme := par2.VariableRecoveryFiles
+		if createFlags.uniform {
+			recoveryFileScheme = par2.UniformRecoveryFiles
+		} else if createFlags.limited {
+			recoveryFileScheme = par2.LimitedRecoveryFiles
+		}
+		encoder, err := newEncoder(parFile, filePaths, createFlags.sliceByteCount, numParityShards, globalFlags.numGoroutines, par2.EncoderOptions{
+			MemoryLimit:        globalFlags.memoryLimitMB * 1024 * 1024,
+			SliceCount:         createFlags.sliceCount,
+			RedundancyPercent:  createFlags.redundancyPercent,
+			RecoveryFileCount:  createFlags.recoveryFileCount,
+			RecoveryFileScheme: recoveryFileScheme,
+			Comment:            createFlags.comment,
+		})
 		if err != nil {
 			panic(err)
 		}
@@ -474,7 +954,7 @@ func main() {
 	case "v":
 		fallthrough
 	case "verify":
-		verifyFlagSet, _ := getVerifyFlags(name)
+		verifyFlagSet, verifyFlags := getVerifyFlags(name)
 		err := verifyFlagSet.Parse(args)
 		if err == nil && verifyFlagSet.NArg() == 0 {
 			err = errors.New("no PAR file specified")
@@ -485,25 +965,111 @@ func main() {
 
 		parFile := verifyFlagSet.Arg(0)
 
-		decoder, err := newDecoder(parFile, globalFlags.numGoroutines)
+		// Keep stdout clean for the report by sending the
+		// delegate output to stderr instead.
+		out := io.Writer(os.Stdout)
+		if verifyFlags.json {
+			out = os.Stderr
+		}
+
+		// exitWithError exits with the exit code for err,
+		// after printing an error report in place of the
+		// usual one if -json is given.
+		exitWithError := func(err error) {
+			if !verifyFlags.json {
+				panic(err)
+			}
+			exitCode := processVerifyOrRepairError(false, err)
+			err = writeJSONReport(os.Stdout, errorReport{err.Error()})
+			if err != nil {
+				panic(err)
+			}
+			os.Exit(exitCode)
+		}
+
+		options := par2.DecoderOptions{
+			MemoryLimit: globalFlags.memoryLimitMB * 1024 * 1024,
+			ExtraPaths:  verifyFlags.extraPaths,
+		}
+
+		if verifyFlags.sets {
+			// Keep going with the other sets if one can't
+			// be verified, with an error report in place
+			// of the report for each one that can't.
+			var reports []interface{}
+			exitCode := processRecoverySets(parFile, globalFlags.numGoroutines, options, out, func(decoder *par2.Decoder) int {
+				err := decoder.LoadFileData()
+				if err == nil {
+					err = decoder.LoadParityData()
+				}
+				if err != nil {
+					reports = append(reports, errorReport{err.Error()})
+					return processVerifyOrRepairError(false, err)
+				}
+
+				needsRepair, err := decoder.Verify()
+				exitCode := processVerifyOrRepairError(needsRepair, err)
+				if exitCode == eSuccess {
+					fmt.Fprintf(out, "Repair not necessary.\n")
+				}
+
+				if verifyFlags.json {
+					report, err := decoder.Report()
+					if err != nil {
+						reports = append(reports, errorReport{err.Error()})
+					} else {
+						reports = append(reports, report)
+					}
+				}
+				return exitCode
+			}, func(err error) {
+				reports = append(reports, errorReport{err.Error()})
+			})
+
+			if verifyFlags.json {
+				err = writeJSONReport(os.Stdout, reports)
+				if err != nil {
+					panic(err)
+				}
+			}
+			os.Exit(exitCode)
+		}
+
+		decoder, err := newDecoder(parFile, globalFlags.numGoroutines, options, out)
 		if err != nil {
-			panic(err)
+			exitWithError(err)
+		}
+
+		if _, ok := decoder.(*par2.Decoder); !ok && len(verifyFlags.extraPaths) > 0 {
+			printUsageAndExit(name, verifyCommand, errors.New("-extra is only supported for PAR2 files"))
 		}
 
 		err = decoder.LoadFileData()
 		if err != nil {
-			panic(err)
+			exitWithError(err)
 		}
 
 		err = decoder.LoadParityData()
 		if err != nil {
-			panic(err)
+			exitWithError(err)
 		}
 
 		needsRepair, err := decoder.Verify()
 		exitCode := processVerifyOrRepairError(needsRepair, err)
 		if exitCode == eSuccess {
-			fmt.Printf("Repair not necessary.\n")
+			fmt.Fprintf(out, "Repair not necessary.\n")
+		}
+
+		if verifyFlags.json {
+			report, err := getReport(decoder)
+			if err != nil {
+				exitWithError(err)
+			}
+
+			err = writeJSONReport(os.Stdout, report)
+			if err != nil {
+				panic(err)
+			}
 		}
 		os.Exit(exitCode)
 
@@ -521,11 +1087,57 @@ func main() {
 
 		parFile := repairFlagSet.Arg(0)
 
-		decoder, err := newDecoder(parFile, globalFlags.numGoroutines)
+		options := par2.DecoderOptions{
+			MemoryLimit: globalFlags.memoryLimitMB * 1024 * 1024,
+			ExtraPaths:  repairFlags.extraPaths,
+			KeepBackup:  repairFlags.keepBackup,
+			OutputDir:   repairFlags.outputDir,
+		}
+
+		if repairFlags.sets {
+			if repairFlags.writeIndex {
+				printUsageAndExit(name, repairCommand, errors.New("-writeindex is not supported with -sets"))
+			}
+
+			// Keep going with the other sets if one can't
+			// be repaired.
+			exitCode := processRecoverySets(parFile, globalFlags.numGoroutines, options, os.Stdout, func(decoder *par2.Decoder) int {
+				err := decoder.LoadFileData()
+				if err == nil {
+					err = decoder.LoadParityData()
+				}
+				if err != nil {
+					return processVerifyOrRepairError(false, err)
+				}
+
+				repairedPaths, err := decoder.Repair(repairFlags.checkParity)
+				fmt.Printf("Repaired files: %v\n", repairedPaths)
+				return processVerifyOrRepairError(false, err)
+			}, nil)
+			os.Exit(exitCode)
+		}
+
+		decoder, err := newDecoder(parFile, globalFlags.numGoroutines, options, os.Stdout)
 		if err != nil {
 			panic(err)
 		}
 
+		if _, ok := decoder.(*par2.Decoder); !ok && len(repairFlags.extraPaths) > 0 {
+			printUsageAndExit(name, repairCommand, errors.New("-extra is only supported for PAR2 files"))
+		}
+
+		if repairFlags.writeIndex {
+			par2Decoder, ok := decoder.(*par2.Decoder)
+			if !ok {
+				printUsageAndExit(name, repairCommand, errors.New("-writeindex is only supported for PAR2 files"))
+			}
+			err = par2Decoder.WriteIndexFile()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Write index file error: %s\n", err)
+				os.Exit(eFileIOError)
+			}
+		}
+
 		err = decoder.LoadFileData()
 		if err != nil {
 			panic(err)
@@ -542,6 +1154,66 @@ func main() {
 		exitCode := processVerifyOrRepairError(needsRepair, err)
 		os.Exit(exitCode)
 
+	case "regen":
+		fallthrough
+	case "regenerate":
+		regenerateFlagSet, regenerateFlags := getRegenerateFlags(name)
+		err := regenerateFlagSet.Parse(args)
+		if err == nil && regenerateFlagSet.NArg() == 0 {
+			err = errors.New("no PAR file specified")
+		}
+		if err != nil {
+			printUsageAndExit(name, regenerateCommand, err)
+		}
+
+		if regenerateFlags.uniform && regenerateFlags.limited {
+			printUsageAndExit(name, regenerateCommand, errors.New("-u and -l can't both be given"))
+		}
+
+		parFile := regenerateFlagSet.Arg(0)
+
+		decoder, err := newDecoder(parFile, globalFlags.numGoroutines, par2.DecoderOptions{
+			MemoryLimit: globalFlags.memoryLimitMB * 1024 * 1024,
+		}, os.Stdout)
+		if err != nil {
+			panic(err)
+		}
+
+		recoveryFileScheme := par2.VariableRecoveryFiles
+		if regenerateFlags.uniform {
+			recoveryFileScheme = par2.UniformRecoveryFiles
+		} else if regenerateFlags.limited {
+			recoveryFileScheme = par2.LimitedRecoveryFiles
+		}
+		par2Decoder, isPAR2 := decoder.(*par2.Decoder)
+		if !isPAR2 && (regenerateFlags.recoveryFileCount != 0 || recoveryFileScheme != par2.VariableRecoveryFiles) {
+			printUsageAndExit(name, regenerateCommand, errors.New("-n, -u, and -l are only supported for PAR2 files"))
+		}
+
+		err = decoder.LoadFileData()
+		if err != nil {
+			panic(err)
+		}
+
+		err = decoder.LoadParityData()
+		if err != nil {
+			panic(err)
+		}
+
+		var writtenPaths []string
+		if isPAR2 {
+			writtenPaths, err = par2Decoder.RegenerateParityFilesWithOptions(regenerateFlags.numParityShards, par2.RegenerateOptions{
+				RecoveryFileCount:  regenerateFlags.recoveryFileCount,
+				RecoveryFileScheme: recoveryFileScheme,
+			})
+		} else {
+			writtenPaths, err = decoder.RegenerateParityFiles(regenerateFlags.numParityShards)
+		}
+		fmt.Printf("Regenerated files: %v\n", writtenPaths)
+		needsRepair := false
+		exitCode := processVerifyOrRepairError(needsRepair, err)
+		os.Exit(exitCode)
+
 	default:
 		err := fmt.Errorf("unknown command '%s'", cmd)
 		printUsageAndExit(name, allCommands, err)
@@ -1,6 +1,8 @@
 package memfs
 
 import (
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -64,20 +66,85 @@ func (fs MemFS) ReadFile(path string) (data []byte, err error) {
 	return nil, os.ErrNotExist
 }
 
+// ReadFileAt reads len(data) bytes of the file at the given path,
+// which may be absolute or relative (to the working directory),
+// starting at the given offset. It has the same semantics as
+// io.ReaderAt.ReadAt. If the file doesn't exist, os.ErrNotExist is
+// returned.
+func (fs MemFS) ReadFileAt(path string, data []byte, offset int64) (int, error) {
+	fileData, err := fs.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset >= int64(len(fileData)) {
+		return 0, io.EOF
+	}
+	n := copy(data, fileData[offset:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// FileByteCount returns the size of the file at the given path,
+// which may be absolute or relative (to the working directory). If
+// the file doesn't exist, os.ErrNotExist is returned.
+func (fs MemFS) FileByteCount(path string) (int64, error) {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
 // FindWithPrefixAndSuffix returns all files whose path matches the
 // given prefix and suffix, in no particular order. The prefix may be
-// absolute or relative (to the working directory).
+// absolute or relative (to the working directory). As with
+// filepath.Glob, the part of the path between the prefix and suffix
+// can't contain a separator.
 func (fs MemFS) FindWithPrefixAndSuffix(prefix, suffix string) ([]string, error) {
 	absPrefix := toAbsPath(fs.workingDir, prefix)
+	// toAbsPath cleans the path, which removes any trailing
+	// separator.
+	if strings.HasSuffix(prefix, string(filepath.Separator)) && !strings.HasSuffix(absPrefix, string(filepath.Separator)) {
+		absPrefix += string(filepath.Separator)
+	}
 	var matches []string
 	for _, filename := range fs.Paths() {
 		if len(filename) >= len(absPrefix)+len(suffix) && strings.HasPrefix(filename, absPrefix) && strings.HasSuffix(filename, suffix) {
-			matches = append(matches, filename)
+			middle := filename[len(absPrefix) : len(filename)-len(suffix)]
+			if !strings.ContainsRune(middle, filepath.Separator) {
+				matches = append(matches, filename)
+			}
 		}
 	}
 	return matches, nil
 }
 
+// IsDir returns whether the given path, which may be absolute or
+// relative (to the working directory), is a directory, i.e. whether
+// there are any files under it. If the path is neither a file nor a
+// directory, os.ErrNotExist is returned.
+func (fs MemFS) IsDir(path string) (bool, error) {
+	absPath := toAbsPath(fs.workingDir, path)
+	if _, ok := fs.fileData[absPath]; ok {
+		return false, nil
+	}
+	dirPrefix := absPath
+	if !strings.HasSuffix(dirPrefix, string(filepath.Separator)) {
+		dirPrefix += string(filepath.Separator)
+	}
+	for filename := range fs.fileData {
+		if strings.HasPrefix(filename, dirPrefix) {
+			return true, nil
+		}
+	}
+	return false, os.ErrNotExist
+}
+
 // WriteFile sets the data of the file at the given path, which may be
 // absolute or relative (to the working directory). The file may or
 // may not already exist.
@@ -87,6 +154,29 @@ func (fs MemFS) WriteFile(path string, data []byte) error {
 	return nil
 }
 
+// WriteFileAt writes data to the file at the given path, which may be
+// absolute or relative (to the working directory), starting at the
+// given offset. If the file doesn't exist, it is created. If the file
+// is shorter than offset, it is first extended with zeros.
+func (fs MemFS) WriteFileAt(path string, data []byte, offset int64) error {
+	if offset < 0 {
+		return errors.New("negative offset")
+	}
+	absPath := toAbsPath(fs.workingDir, path)
+	oldData := fs.fileData[absPath]
+	byteCount := int64(len(oldData))
+	if end := offset + int64(len(data)); end > byteCount {
+		byteCount = end
+	}
+	// Always make a copy, since oldData may be shared with a
+	// slice that was passed to WriteFile.
+	newData := make([]byte, byteCount)
+	copy(newData, oldData)
+	copy(newData[offset:], data)
+	fs.fileData[absPath] = newData
+	return nil
+}
+
 // FileCount returns the total number of files.
 func (fs MemFS) FileCount() int {
 	return len(fs.fileData)
@@ -114,6 +204,24 @@ func (fs MemFS) RemoveFile(path string) ([]byte, error) {
 	return data, nil
 }
 
+// DeleteFile is like RemoveFile, but doesn't return the removed data.
+func (fs MemFS) DeleteFile(path string) error {
+	_, err := fs.RemoveFile(path)
+	return err
+}
+
+// SameFile returns whether path1 and path2, which may be absolute or
+// relative (to the working directory), refer to the same existing
+// file.
+func (fs MemFS) SameFile(path1, path2 string) (bool, error) {
+	absPath := toAbsPath(fs.workingDir, path1)
+	if absPath != toAbsPath(fs.workingDir, path2) {
+		return false, nil
+	}
+	_, ok := fs.fileData[absPath]
+	return ok, nil
+}
+
 // MoveFile moves the file at oldPath to newPath. oldPath and newPath
 // may be either absolute or relative (to the working directory). If
 // the file doesn't exist at oldPath, os.ErrNotExist is returned.
@@ -125,3 +233,38 @@ func (fs MemFS) MoveFile(oldPath, newPath string) error {
 	// Shouldn't return an error.
 	return fs.WriteFile(newPath, data)
 }
+
+// CopyFileMetadata does nothing, since MemFS doesn't keep any file
+// metadata, except check that the files at srcPath and dstPath, which
+// may be absolute or relative (to the working directory), exist. If
+// either doesn't, os.ErrNotExist is returned.
+func (fs MemFS) CopyFileMetadata(srcPath, dstPath string) error {
+	for _, path := range []string{srcPath, dstPath} {
+		if _, ok := fs.fileData[toAbsPath(fs.workingDir, path)]; !ok {
+			return os.ErrNotExist
+		}
+	}
+	return nil
+}
+
+// SyncFile does nothing, since MemFS isn't backed by storage, except
+// check that the file at the given path, which may be absolute or
+// relative (to the working directory), exists. If it doesn't,
+// os.ErrNotExist is returned.
+func (fs MemFS) SyncFile(path string) error {
+	if _, ok := fs.fileData[toAbsPath(fs.workingDir, path)]; !ok {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// SyncDir does nothing, since MemFS isn't backed by storage.
+func (fs MemFS) SyncDir(path string) error {
+	return nil
+}
+
+// MkdirAll does nothing, since directories exist in a MemFS exactly
+// when they have files in them.
+func (fs MemFS) MkdirAll(path string) error {
+	return nil
+}
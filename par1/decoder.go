@@ -1,12 +1,19 @@
 package par1
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/klauspost/reedsolomon"
 )
@@ -22,7 +29,15 @@ type Decoder struct {
 	indexFile   string
 	indexVolume volume
 
-	fileData [][]byte
+	volumePaths []string
+	keepBackup  bool
+	outputDir   string
+
+	fileData     [][]byte
+	fileStatuses []FileStatus
+	// checkedOnlyStatuses holds the statuses of the files that
+	// aren't saved in the volume set, in entry order.
+	checkedOnlyStatuses []FileStatus
 
 	shardByteCount int
 	parityData     [][]byte
@@ -35,11 +50,45 @@ type DecoderDelegate interface {
 	OnFileEntryLoad(i, n int, filename, entryInfo string)
 	OnCommentLoad(comment []byte)
 	OnDataFileLoad(i, n int, path string, byteCount int, corrupt bool, err error)
+	// OnCheckedOnlyFileLoad is like OnDataFileLoad, but for a
+	// file that isn't saved in the volume set, so it's only
+	// checked against its hashes, and can't be repaired.
+	OnCheckedOnlyFileLoad(i, n int, path string, byteCount int, corrupt bool, err error)
+	// OnDataFileHashProgress is called as the data file at path,
+	// which has byteCount bytes, is hashed.
+	OnDataFileHashProgress(path string, hashedByteCount, byteCount int)
+	// OnParityProgress is called as missing data is
+	// reconstructed, or parity data is checked or computed, with
+	// the number of bytes of each volume processed so far out of
+	// byteCount.
+	OnParityProgress(processedByteCount, byteCount int)
 	OnDataFileWrite(i, n int, path string, byteCount int, err error)
 	OnVolumeFileLoad(i uint64, path string, storedSetHash, computedSetHash [16]byte, dataByteCount int, err error)
+	OnVolumeFileWrite(i, n int, path string, dataByteCount, byteCount int, err error)
+}
+
+// DecoderOptions holds optional parameters for creating a
+// Decoder. The zero value gives the default behavior.
+type DecoderOptions struct {
+	// VolumePaths lists extra files, or directories whose files
+	// are all extra files, among which to look for parity
+	// volumes, in addition to the files in the directory of the
+	// index file.
+	VolumePaths []string
+	// Repair always writes repaired data to a temporary file
+	// first, and only moves it into place once it's been synced,
+	// giving it the mode and modification time of the damaged
+	// file it replaces. If KeepBackup is true, the damaged file
+	// is kept, like par2cmdline does, by moving it to the first
+	// free path of the form name.1, name.2, and so on.
+	KeepBackup bool
+	// If OutputDir is non-empty, Repair leaves the data files
+	// alone, and instead writes the files it repairs to
+	// OutputDir, creating it if needed.
+	OutputDir string
 }
 
-func newDecoder(fileIO fileIO, delegate DecoderDelegate, indexFile string) (*Decoder, error) {
+func newDecoder(fileIO fileIO, delegate DecoderDelegate, indexFile string, options DecoderOptions) (*Decoder, error) {
 	indexVolume, err := func() (volume, error) {
 		bytes, err := fileIO.ReadFile(indexFile)
 		if err != nil {
@@ -73,7 +122,8 @@ func newDecoder(fileIO fileIO, delegate DecoderDelegate, indexFile string) (*Dec
 	return &Decoder{
 		fileIO, delegate,
 		indexFile, indexVolume,
-		nil,
+		options.VolumePaths, options.KeepBackup, options.OutputDir,
+		nil, nil, nil,
 		0, nil,
 	}, nil
 }
@@ -81,7 +131,13 @@ func newDecoder(fileIO fileIO, delegate DecoderDelegate, indexFile string) (*Dec
 // NewDecoder reads the given index file, which usually has a .PAR
 // extension.
 func NewDecoder(delegate DecoderDelegate, indexFile string) (*Decoder, error) {
-	return newDecoder(defaultFileIO{}, delegate, indexFile)
+	return NewDecoderWithOptions(delegate, indexFile, DecoderOptions{})
+}
+
+// NewDecoderWithOptions is like NewDecoder, but also takes a
+// DecoderOptions.
+func NewDecoderWithOptions(delegate DecoderDelegate, indexFile string, options DecoderOptions) (*Decoder, error) {
+	return newDecoder(defaultFileIO{}, delegate, indexFile, options)
 }
 
 func sixteenKHash(data []byte) [md5.Size]byte {
@@ -101,13 +157,73 @@ func (d *Decoder) getFilePath(entry fileEntry) (string, error) {
 	return filepath.Join(basePath, filename), nil
 }
 
-// LoadFileData loads existing file data into memory.
+// getRepairedFilePath returns the path that Repair writes the file
+// for the given entry to.
+func (d *Decoder) getRepairedFilePath(entry fileEntry) (string, error) {
+	if d.outputDir == "" {
+		return d.getFilePath(entry)
+	}
+
+	filename := entry.filename
+	if filepath.Base(filename) != filename {
+		return "", errors.New("bad filename")
+	}
+	return filepath.Join(d.outputDir, filename), nil
+}
+
+// UnrepairableFilesError is returned by Verify and Repair if any
+// files that aren't saved in the volume set, and so are only checked,
+// are missing or damaged.
+type UnrepairableFilesError struct {
+	Paths []string
+}
+
+func (e UnrepairableFilesError) Error() string {
+	return fmt.Sprintf("%d checked-only file(s) missing or damaged, which can't be repaired: %v", len(e.Paths), e.Paths)
+}
+
+// savedEntries returns the entries for the files saved in the volume
+// set, which correspond to d.fileData.
+func (d *Decoder) savedEntries() []fileEntry {
+	var entries []fileEntry
+	for _, entry := range d.indexVolume.entries {
+		if entry.header.Status.savedInVolumeSet() {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// checkedOnlyEntries returns the entries for the files that aren't
+// saved in the volume set, which correspond to
+// d.checkedOnlyStatuses.
+func (d *Decoder) checkedOnlyEntries() []fileEntry {
+	var entries []fileEntry
+	for _, entry := range d.indexVolume.entries {
+		if !entry.header.Status.savedInVolumeSet() {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// LoadFileData loads existing file data into memory. Files that
+// aren't saved in the volume set are checked too, but their data
+// isn't kept.
 func (d *Decoder) LoadFileData() error {
+	return d.LoadFileDataContext(context.Background())
+}
+
+// LoadFileDataContext is like LoadFileData, but it stops and returns
+// ctx.Err() if ctx is done before all the file data is loaded.
+func (d *Decoder) LoadFileDataContext(ctx context.Context) error {
 	fileData := make([][]byte, 0, len(d.indexVolume.entries))
+	fileStatuses := make([]FileStatus, 0, len(d.indexVolume.entries))
+	var checkedOnlyStatuses []FileStatus
 
 	for i, entry := range d.indexVolume.entries {
-		if !entry.header.Status.savedInVolumeSet() {
-			continue
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
 		path, err := d.getFilePath(entry)
@@ -115,34 +231,58 @@ func (d *Decoder) LoadFileData() error {
 			return err
 		}
 
-		data, corrupt, err := func() ([]byte, bool, error) {
+		data, byteCount, corrupt, err := func() ([]byte, int, bool, error) {
 			data, err := d.fileIO.ReadFile(path)
 			if os.IsNotExist(err) {
-				return nil, true, err
+				return nil, 0, true, err
 			} else if err != nil {
-				return nil, false, err
+				return nil, 0, false, err
 			} else if sixteenKHash(data) != entry.header.SixteenKHash {
-				return nil, true, errors.New("hash mismatch (16k)")
-			} else if md5.Sum(data) != entry.header.Hash {
-				return nil, true, errors.New("hash mismatch")
+				return nil, len(data), true, errors.New("hash mismatch (16k)")
 			}
-			return data, false, nil
+
+			hash, err := hashData(ctx, data, func(hashedByteCount, byteCount int) {
+				d.delegate.OnDataFileHashProgress(path, hashedByteCount, byteCount)
+			})
+			if err != nil {
+				return nil, len(data), false, err
+			} else if hash != entry.header.Hash {
+				return nil, len(data), true, errors.New("hash mismatch")
+			}
+			return data, len(data), false, nil
 		}()
-		d.delegate.OnDataFileLoad(i+1, len(d.indexVolume.entries), path, len(data), corrupt, err)
-		if corrupt {
-			fileData = append(fileData, nil)
-			continue
-		} else if err != nil {
+		saved := entry.header.Status.savedInVolumeSet()
+		if saved {
+			d.delegate.OnDataFileLoad(i+1, len(d.indexVolume.entries), path, len(data), corrupt, err)
+		} else {
+			d.delegate.OnCheckedOnlyFileLoad(i+1, len(d.indexVolume.entries), path, len(data), corrupt, err)
+		}
+		if err != nil && !corrupt {
 			return err
 		}
 
+		status := FileOK
+		if os.IsNotExist(err) {
+			status = FileMissing
+		} else if corrupt && uint64(byteCount) != entry.header.FileBytes {
+			status = FileWrongByteCount
+		} else if corrupt {
+			status = FileDamaged
+		}
+
+		if !saved {
+			checkedOnlyStatuses = append(checkedOnlyStatuses, status)
+			continue
+		}
+
 		// We use nil to mark missing entries, but ReadFile
 		// might return nil, so convert that to a non-nil
 		// empty slice.
-		if data == nil {
+		if !corrupt && data == nil {
 			data = make([]byte, 0)
 		}
 		fileData = append(fileData, data)
+		fileStatuses = append(fileStatuses, status)
 	}
 
 	if len(fileData) == 0 {
@@ -150,6 +290,28 @@ func (d *Decoder) LoadFileData() error {
 	}
 
 	d.fileData = fileData
+	d.fileStatuses = fileStatuses
+	d.checkedOnlyStatuses = checkedOnlyStatuses
+	return nil
+}
+
+// checkCheckedOnlyFiles returns an UnrepairableFilesError if any of
+// the files that are only checked aren't intact.
+func (d *Decoder) checkCheckedOnlyFiles() error {
+	var paths []string
+	for i, entry := range d.checkedOnlyEntries() {
+		if d.checkedOnlyStatuses[i] == FileOK {
+			continue
+		}
+		path, err := d.getFilePath(entry)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) > 0 {
+		return UnrepairableFilesError{paths}
+	}
 	return nil
 }
 
@@ -159,78 +321,236 @@ func (d *Decoder) volumePath(volumeNumber uint64) string {
 	}
 	ext := path.Ext(d.indexFile)
 	base := d.indexFile[:len(d.indexFile)-len(ext)]
-	return base + fmt.Sprintf(".p%02d", volumeNumber)
+	return base + volumeExtension(volumeNumber, isUpperExtension(ext))
+}
+
+// listFiles returns the files directly in the directory at dir,
+// sorted.
+func (d *Decoder) listFiles(dir string) ([]string, error) {
+	prefix := dir
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	matches, err := d.fileIO.FindWithPrefixAndSuffix(prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	var files []string
+	for _, match := range matches {
+		isDir, err := d.fileIO.IsDir(match)
+		if err != nil {
+			return nil, err
+		}
+		if !isDir {
+			files = append(files, filepath.Join(dir, filepath.Base(match)))
+		}
+	}
+	return files, nil
+}
+
+// findVolumePaths returns the volume number of each of the given
+// files that is named like a parity volume of the index file, keyed
+// by path. Names are matched case-insensitively, and files named
+// like a data file in the set (e.g., file.r01 for a split RAR
+// archive) are never treated as parity volumes.
+func (d *Decoder) findVolumePaths(files []string) map[string]uint64 {
+	indexName := filepath.Base(d.indexFile)
+	indexBase := indexName[:len(indexName)-len(filepath.Ext(indexName))]
+
+	dataFilenames := make(map[string]bool)
+	for _, entry := range d.indexVolume.entries {
+		dataFilenames[strings.ToLower(entry.filename)] = true
+	}
+
+	volumeNumbers := make(map[string]uint64)
+	for _, file := range files {
+		name := filepath.Base(file)
+		ext := filepath.Ext(name)
+		if !strings.EqualFold(name[:len(name)-len(ext)], indexBase) || dataFilenames[strings.ToLower(name)] {
+			continue
+		}
+		if volumeNumber, ok := parseVolumeExtension(ext); ok {
+			volumeNumbers[file] = volumeNumber
+		}
+	}
+	return volumeNumbers
+}
+
+// findVolumeCandidates returns the files that may be parity volumes,
+// without duplicates, along with the volume numbers that
+// findVolumePaths gives them. The files in the directory of the index
+// file come first, with the ones named like parity volumes before the
+// rest, and then come the files given by the VolumePaths option.
+func (d *Decoder) findVolumeCandidates() ([]string, map[string]uint64, error) {
+	files, err := d.listFiles(filepath.Dir(d.indexFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	volumeNumbers := d.findVolumePaths(files)
+	// Prefer files named exactly like volumePath, then files
+	// named like it up to case, then everything else.
+	rank := func(file string) int {
+		volumeNumber, ok := volumeNumbers[file]
+		if !ok {
+			return 2
+		} else if filepath.Base(file) != filepath.Base(d.volumePath(volumeNumber)) {
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return rank(files[i]) < rank(files[j])
+	})
+
+	for _, path := range d.volumePaths {
+		isDir, err := d.fileIO.IsDir(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isDir {
+			files = append(files, path)
+			continue
+		}
+		dirFiles, err := d.listFiles(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, dirFiles...)
+	}
+
+	seen := map[string]bool{filepath.Clean(d.indexFile): true}
+	var candidates []string
+	for _, file := range files {
+		if !seen[filepath.Clean(file)] {
+			seen[filepath.Clean(file)] = true
+			candidates = append(candidates, file)
+		}
+	}
+	return candidates, volumeNumbers, nil
+}
+
+// readVolumeHeader reads just the header of the file at path, and
+// returns false if the file is too short to have one, or if it
+// doesn't look like a PAR1 header.
+func (d *Decoder) readVolumeHeader(path string) (header, bool, error) {
+	headerBytes := make([]byte, binary.Size(header{}))
+	n, err := d.fileIO.ReadFileAt(path, headerBytes, 0)
+	if err == io.EOF {
+		return header{}, false, nil
+	} else if err != nil {
+		return header{}, false, err
+	}
+
+	h, err := readHeader(bytes.NewBuffer(headerBytes[:n]))
+	if err != nil {
+		return header{}, false, nil
+	}
+	return h, true, nil
 }
 
 // LoadParityData searches for parity volumes and loads them into
-// memory.
+// memory. Every file in the directory of the index file, and every
+// file given by the VolumePaths option, is checked, and any file
+// with the PAR1 ID and the set hash of the index file is used as the
+// parity volume given by the volume number in its header, whatever
+// its name. Volumes that are damaged, e.g. ones whose control hash
+// doesn't match, are reported to OnVolumeFileLoad and left out.
 func (d *Decoder) LoadParityData() error {
-	// TODO: Support searching for volume data without relying on
-	// filenames.
+	return d.LoadParityDataContext(context.Background())
+}
+
+// LoadParityDataContext is like LoadParityData, but it stops and
+// returns ctx.Err() if ctx is done before all the parity volumes are
+// loaded.
+func (d *Decoder) LoadParityDataContext(ctx context.Context) error {
+	// Only files saved in the volume set are data shards, so
+	// checked-only files don't count against the 256 shards.
+	savedCount := uint64(len(d.savedEntries()))
+	maxParityVolumeCount := 256 - savedCount
+	if maxParityVolumeCount > maxVolumeNumber {
+		maxParityVolumeCount = maxVolumeNumber
+	}
 
-	// TODO: Count only files saved in volume set.
-	fileCount := d.indexVolume.header.FileCount
-	maxParityVolumeCount := 256 - fileCount
-	// TODO: Support more than 99 parity volumes.
-	if maxParityVolumeCount > 99 {
-		maxParityVolumeCount = 99
+	candidates, volumeNumbers, err := d.findVolumeCandidates()
+	if err != nil {
+		return err
 	}
 
 	shardByteCount := 0
 	parityData := make([][]byte, maxParityVolumeCount)
 	var maxI uint64
-	for i := uint64(0); i < maxParityVolumeCount; i++ {
-		// TODO: Find the file case-insensitively.
-		volumeNumber := i + 1
-		volumePath := d.volumePath(volumeNumber)
-		parityVolume, byteCount, err := func() (volume, int, error) {
-			volumeBytes, err := d.fileIO.ReadFile(volumePath)
-			if os.IsNotExist(err) {
-				return volume{}, 0, err
-			} else if err != nil {
-				return volume{}, 0, err
+	for _, volumePath := range candidates {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Files that aren't parity volumes of this set are
+		// skipped, and only reported if they're named like
+		// one.
+		h, ok, err := d.readVolumeHeader(volumePath)
+		if err == nil && ok && h.SetHash != d.indexVolume.header.SetHash {
+			err = errors.New("unexpected set hash for parity volume")
+		} else if err == nil && ok && h.VolumeNumber > maxParityVolumeCount {
+			err = errors.New("unexpected volume number for parity volume")
+		}
+		if err != nil || !ok {
+			if volumeNumber, named := volumeNumbers[volumePath]; named {
+				if err == nil {
+					err = errors.New("not a PAR1 volume")
+				}
+				d.delegate.OnVolumeFileLoad(volumeNumber, volumePath, h.SetHash, [16]byte{}, 0, err)
 			}
+			continue
+		}
+
+		// Skip copies of the index volume, and later copies of
+		// parity volumes that were already loaded.
+		volumeNumber := h.VolumeNumber
+		if volumeNumber == 0 || parityData[volumeNumber-1] != nil {
+			continue
+		}
+
+		volumeBytes, err := d.fileIO.ReadFile(volumePath)
+		if err != nil {
+			d.delegate.OnVolumeFileLoad(volumeNumber, volumePath, h.SetHash, [16]byte{}, 0, err)
+			return err
+		}
 
+		parityVolume, byteCount, err := func() (volume, int, error) {
+			// This checks the control hash, which covers
+			// everything but the ID, the version number, and
+			// the control hash itself.
 			parityVolume, err := readVolume(volumeBytes)
-			// TODO: Check set hash.
 			if err != nil {
-				// TODO: Relax this check.
 				return volume{}, 0, err
 			}
 
 			byteCount := len(parityVolume.data)
 
-			if parityVolume.header.SetHash != d.indexVolume.header.SetHash {
-				// TODO: Relax this check.
-				return volume{}, byteCount, errors.New("unexpected set hash for parity volume")
-			}
-
-			if parityVolume.header.VolumeNumber != uint64(i+1) {
-				// TODO: Relax this check.
-				return volume{}, byteCount, errors.New("unexpected volume number for parity volume")
-			}
-
 			if byteCount == 0 {
-				// TODO: Relax this check.
 				return volume{}, byteCount, errors.New("no parity data in volume")
 			}
-			if shardByteCount == 0 {
-				shardByteCount = byteCount
-			} else if byteCount != shardByteCount {
-				// TODO: Relax this check.
+			if shardByteCount != 0 && byteCount != shardByteCount {
 				return volume{}, byteCount, errors.New("mismatched parity data byte counts")
 			}
 			return parityVolume, byteCount, nil
 		}()
 		d.delegate.OnVolumeFileLoad(volumeNumber, volumePath, parityVolume.header.SetHash, parityVolume.setHash, byteCount, err)
-		if os.IsNotExist(err) {
+		if err != nil {
+			// Leave out damaged volumes, so that they're not
+			// used to reconstruct anything. A good copy of
+			// the same volume may still turn up later.
 			continue
-		} else if err != nil {
-			return err
 		}
 
+		shardByteCount = byteCount
+		i := volumeNumber - 1
 		parityData[i] = parityVolume.data
-		maxI = i
+		if i > maxI {
+			maxI = i
+		}
 	}
 
 	d.shardByteCount = shardByteCount
@@ -264,8 +584,17 @@ func (d *Decoder) newReedSolomon() (reedsolomon.Encoder, error) {
 
 // Verify checks whether repair is needed. It returns a bool for
 // needsRepair and an error; if error is non-nil, needsRepair may
-// or may not be filled in.
+// or may not be filled in. needsRepair covers only the files saved
+// in the volume set; if any files that are only checked are missing
+// or damaged, an UnrepairableFilesError is returned, with
+// needsRepair filled in.
 func (d *Decoder) Verify() (needsRepair bool, err error) {
+	return d.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, but it stops and returns ctx.Err() if
+// ctx is done before the parity data is checked.
+func (d *Decoder) VerifyContext(ctx context.Context) (needsRepair bool, err error) {
 	shards := d.buildShards()
 
 	needsRepair = false
@@ -281,8 +610,14 @@ func (d *Decoder) Verify() (needsRepair bool, err error) {
 		return needsRepair, err
 	}
 
-	_, err = rs.Verify(shards)
-	return needsRepair, err
+	err = forEachChunk(ctx, d.shardByteCount, func(start, end int) error {
+		_, err := rs.Verify(chunkShards(shards, start, end))
+		return err
+	}, d.delegate.OnParityProgress)
+	if err != nil {
+		return needsRepair, err
+	}
+	return needsRepair, d.checkCheckedOnlyFiles()
 }
 
 // Repair tries to repair any missing or corrupted data, using the
@@ -290,8 +625,21 @@ func (d *Decoder) Verify() (needsRepair bool, err error) {
 // successfully repaired (relative to the indexFile passed to
 // NewDecoder) in no particular order, which is present even if an
 // error is returned. If checkParity is true, extra checking is done
-// of the reconstructed parity data.
+// of the reconstructed parity data. Missing parity volumes aren't
+// repaired; use RegenerateParityFiles afterwards for that. Files
+// that are only checked can't be repaired, so if any of them are
+// missing or damaged, an UnrepairableFilesError is returned after the
+// other files are repaired.
+//
+// If an output directory was given in the DecoderOptions, the
+// repaired files are written there instead.
 func (d *Decoder) Repair(checkParity bool) ([]string, error) {
+	return d.RepairContext(context.Background(), checkParity)
+}
+
+// RepairContext is like Repair, but it stops and returns ctx.Err() if
+// ctx is done before the repair is finished.
+func (d *Decoder) RepairContext(ctx context.Context, checkParity bool) ([]string, error) {
 	shards := d.buildShards()
 
 	rs, err := d.newReedSolomon()
@@ -299,30 +647,58 @@ func (d *Decoder) Repair(checkParity bool) ([]string, error) {
 		return nil, err
 	}
 
-	err = rs.Reconstruct(shards)
-	if err != nil {
-		return nil, err
+	// Reconstruct a chunk of each missing shard at a time into
+	// buffers for the whole shards.
+	reconstructedShards := make([][]byte, len(shards))
+	for i, shard := range shards {
+		if shard == nil {
+			reconstructedShards[i] = make([]byte, d.shardByteCount)
+		}
 	}
-
-	if checkParity {
-		ok, err := rs.Verify(shards)
+	err = forEachChunk(ctx, d.shardByteCount, func(start, end int) error {
+		chunks := chunkShards(shards, start, end)
+		err := rs.Reconstruct(chunks)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		if !ok {
-			return nil, errors.New("repair failed")
+		if checkParity {
+			ok, err := rs.Verify(chunks)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				return errors.New("repair failed")
+			}
+		}
+
+		for i, shard := range reconstructedShards {
+			if shard != nil {
+				copy(shard[start:end], chunks[i])
+			}
+		}
+		return nil
+	}, d.delegate.OnParityProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, shard := range reconstructedShards {
+		if shard != nil {
+			shards[i] = shard
 		}
 	}
 
 	var repairedPaths []string
 
+	savedEntries := d.savedEntries()
 	for i, data := range d.fileData {
 		if data != nil {
 			continue
 		}
 
-		entry := d.indexVolume.entries[i]
+		entry := savedEntries[i]
 		data = shards[i][:entry.header.FileBytes]
 		if sixteenKHash(data) != entry.header.SixteenKHash {
 			return repairedPaths, errors.New("hash mismatch (16k) in reconstructed data")
@@ -330,12 +706,29 @@ func (d *Decoder) Repair(checkParity bool) ([]string, error) {
 			return repairedPaths, errors.New("hash mismatch in reconstructed data")
 		}
 
-		path, err := d.getFilePath(entry)
+		path, err := d.getRepairedFilePath(entry)
 		if err != nil {
 			return repairedPaths, err
 		}
 
-		err = d.fileIO.WriteFile(path, data)
+		// With an output directory, the metadata still comes
+		// from the original file.
+		metadataPath, err := d.getFilePath(entry)
+		if err != nil {
+			return repairedPaths, err
+		}
+
+		tempPath := repairTempPath(path)
+		err = d.fileIO.MkdirAll(filepath.Dir(path))
+		if err == nil {
+			err = d.fileIO.WriteFile(tempPath, data)
+			if err != nil {
+				_ = d.fileIO.DeleteFile(tempPath)
+			}
+		}
+		if err == nil {
+			err = replaceFile(d.fileIO, tempPath, path, metadataPath, d.keepBackup)
+		}
 		d.delegate.OnDataFileWrite(i+1, len(d.fileData), path, len(data), err)
 		if err != nil {
 			return repairedPaths, err
@@ -343,10 +736,175 @@ func (d *Decoder) Repair(checkParity bool) ([]string, error) {
 
 		repairedPaths = append(repairedPaths, path)
 		d.fileData[i] = data
+		d.fileStatuses[i] = FileOK
+	}
+
+	return repairedPaths, d.checkCheckedOnlyFiles()
+}
+
+// repairTempPath returns the path that the repaired data for the file
+// at path is written to before it's moved into place.
+func repairTempPath(path string) string {
+	return path + ".gopar.tmp"
+}
+
+// backUpFile moves the file at path, if any, to the first path of the
+// form path.1, path.2, and so on that isn't taken.
+func backUpFile(fileIO fileIO, path string) error {
+	_, err := fileIO.FileByteCount(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i := 1; ; i++ {
+		backupPath := path + "." + strconv.Itoa(i)
+		_, err := fileIO.FileByteCount(backupPath)
+		if os.IsNotExist(err) {
+			return fileIO.MoveFile(path, backupPath)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// replaceFile moves the file at tempPath to path, after giving it the
+// mode and modification time of the file at metadataPath, if any, and
+// syncing it, so that path never refers to a partially written file. The
+// directory is then synced, so that the move isn't lost in a crash.
+// If keepBackup is true, the file at path is backed up instead of
+// being replaced. If anything fails, the file at tempPath is removed.
+func replaceFile(fileIO fileIO, tempPath, path, metadataPath string, keepBackup bool) error {
+	err := func() error {
+		err := fileIO.CopyFileMetadata(metadataPath, tempPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		err = fileIO.SyncFile(tempPath)
+		if err != nil {
+			return err
+		}
+
+		if keepBackup {
+			err = backUpFile(fileIO, path)
+			if err != nil {
+				return err
+			}
+		}
+
+		return fileIO.MoveFile(tempPath, path)
+	}()
+	if err != nil {
+		// The original error is more useful than any
+		// error from removing the file.
+		_ = fileIO.DeleteFile(tempPath)
+		return err
+	}
+
+	return fileIO.SyncDir(filepath.Dir(path))
+}
+
+// RegenerateParityFiles writes out the parity volumes that are
+// missing, exactly as Encoder.Write would have written them, so that
+// they stay in the same volume set. Returns a list of paths to the
+// parity volumes that were written, in order.
+//
+// volumeCount is the number of parity volumes that the volume set
+// was created with. If it is zero, it's inferred from the parity
+// volumes that are present, which misses the last ones if they're
+// all missing.
+//
+// The data files must all be intact, so LoadFileData and
+// LoadParityData must be called first, and then Repair if needed.
+func (d *Decoder) RegenerateParityFiles(volumeCount int) ([]string, error) {
+	return d.RegenerateParityFilesContext(context.Background(), volumeCount)
+}
+
+// RegenerateParityFilesContext is like RegenerateParityFiles, but it
+// stops and returns ctx.Err() if ctx is done before the parity data
+// is computed.
+func (d *Decoder) RegenerateParityFilesContext(ctx context.Context, volumeCount int) ([]string, error) {
+	if len(d.fileData) == 0 {
+		return nil, errors.New("no file data found")
+	}
+
+	shardByteCount := 0
+	for _, data := range d.fileData {
+		if data == nil {
+			return nil, errors.New("data files need repair")
+		}
+		if len(data) > shardByteCount {
+			shardByteCount = len(data)
+		}
+	}
+
+	foundVolumeCount := 0
+	for i, data := range d.parityData {
+		if data != nil {
+			foundVolumeCount = i + 1
+		}
+	}
+	if volumeCount == 0 {
+		volumeCount = foundVolumeCount
+		if volumeCount == 0 {
+			return nil, errors.New("no parity volumes found")
+		}
+	} else if volumeCount < foundVolumeCount {
+		return nil, errors.New("volume count too small")
+	}
+
+	if d.shardByteCount != 0 && d.shardByteCount != shardByteCount {
+		return nil, errors.New("mismatched parity data byte counts")
+	}
+	d.shardByteCount = shardByteCount
+	if len(d.parityData) < volumeCount {
+		d.parityData = append(d.parityData, make([][]byte, volumeCount-len(d.parityData))...)
+	}
+	shards := d.buildShards()
+	for i := range d.parityData {
+		shards[len(d.fileData)+i] = make([]byte, d.shardByteCount)
+	}
+
+	rs, err := d.newReedSolomon()
+	if err != nil {
+		return nil, err
+	}
+
+	err = forEachChunk(ctx, d.shardByteCount, func(start, end int) error {
+		return rs.Encode(chunkShards(shards, start, end))
+	}, d.delegate.OnParityProgress)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: Repair missing parity volumes, too, and then make
-	// sure d.Verify() passes.
+	var writtenPaths []string
+	for i, data := range d.parityData {
+		if data != nil {
+			continue
+		}
+
+		// Only the volume number and the data differ from
+		// the index volume.
+		vol := d.indexVolume
+		vol.header.VolumeNumber = uint64(i + 1)
+		vol.data = shards[len(d.fileData)+i]
+		volBytes, err := writeVolume(vol)
+		if err != nil {
+			return writtenPaths, err
+		}
+
+		volumePath := d.volumePath(vol.header.VolumeNumber)
+		err = d.fileIO.WriteFile(volumePath, volBytes)
+		d.delegate.OnVolumeFileWrite(i+1, len(d.parityData), volumePath, len(vol.data), len(volBytes), err)
+		if err != nil {
+			return writtenPaths, err
+		}
+
+		writtenPaths = append(writtenPaths, volumePath)
+		d.parityData[i] = vol.data
+	}
 
-	return repairedPaths, nil
+	return writtenPaths, nil
 }
@@ -1,9 +1,12 @@
 package par1
 
 import (
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"math/rand"
+	"os"
 	"path"
 	"path/filepath"
 	"sort"
@@ -28,6 +31,15 @@ func (io testFileIO) ReadFile(path string) (data []byte, err error) {
 	return io.fileIO.ReadFile(path)
 }
 
+func (io testFileIO) ReadFileAt(path string, data []byte, offset int64) (n int, err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("ReadFileAt(%s, %d bytes, %d) => (%d, %v)", path, len(data), offset, n, err)
+	}()
+	return io.fileIO.ReadFileAt(path, data, offset)
+}
+
 func (io testFileIO) WriteFile(path string, data []byte) (err error) {
 	io.t.Helper()
 	defer func() {
@@ -37,6 +49,87 @@ func (io testFileIO) WriteFile(path string, data []byte) (err error) {
 	return io.fileIO.WriteFile(path, data)
 }
 
+func (io testFileIO) FileByteCount(path string) (byteCount int64, err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("FileByteCount(%s) => (%d, %v)", path, byteCount, err)
+	}()
+	return io.fileIO.FileByteCount(path)
+}
+
+func (io testFileIO) IsDir(path string) (isDir bool, err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("IsDir(%s) => (%t, %v)", path, isDir, err)
+	}()
+	return io.fileIO.IsDir(path)
+}
+
+func (io testFileIO) FindWithPrefixAndSuffix(prefix, suffix string) (matches []string, err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("FindWithPrefixAndSuffix(%s, %s) => (%d files, %v)", prefix, suffix, len(matches), err)
+	}()
+	return io.fileIO.FindWithPrefixAndSuffix(prefix, suffix)
+}
+
+func (io testFileIO) MoveFile(oldPath, newPath string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("MoveFile(%s, %s) => %v", oldPath, newPath, err)
+	}()
+	return io.fileIO.MoveFile(oldPath, newPath)
+}
+
+func (io testFileIO) CopyFileMetadata(srcPath, dstPath string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("CopyFileMetadata(%s, %s) => %v", srcPath, dstPath, err)
+	}()
+	return io.fileIO.CopyFileMetadata(srcPath, dstPath)
+}
+
+func (io testFileIO) SyncFile(path string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("SyncFile(%s) => %v", path, err)
+	}()
+	return io.fileIO.SyncFile(path)
+}
+
+func (io testFileIO) SyncDir(path string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("SyncDir(%s) => %v", path, err)
+	}()
+	return io.fileIO.SyncDir(path)
+}
+
+func (io testFileIO) DeleteFile(path string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("DeleteFile(%s) => %v", path, err)
+	}()
+	return io.fileIO.DeleteFile(path)
+}
+
+func (io testFileIO) MkdirAll(path string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("MkdirAll(%s) => %v", path, err)
+	}()
+	return io.fileIO.MkdirAll(path)
+}
+
 type testDecoderDelegate struct {
 	t *testing.T
 }
@@ -61,6 +154,21 @@ func (d testDecoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int
 	d.t.Logf("OnDataFileLoad(%d, %d, %s, byteCount=%d, corrupt=%t, %v)", i, n, path, byteCount, corrupt, err)
 }
 
+func (d testDecoderDelegate) OnCheckedOnlyFileLoad(i, n int, path string, byteCount int, corrupt bool, err error) {
+	d.t.Helper()
+	d.t.Logf("OnCheckedOnlyFileLoad(%d, %d, %s, byteCount=%d, corrupt=%t, %v)", i, n, path, byteCount, corrupt, err)
+}
+
+func (d testDecoderDelegate) OnDataFileHashProgress(path string, hashedByteCount, byteCount int) {
+	d.t.Helper()
+	d.t.Logf("OnDataFileHashProgress(%s, hashedByteCount=%d, byteCount=%d)", path, hashedByteCount, byteCount)
+}
+
+func (d testDecoderDelegate) OnParityProgress(processedByteCount, byteCount int) {
+	d.t.Helper()
+	d.t.Logf("OnParityProgress(%d, %d)", processedByteCount, byteCount)
+}
+
 func (d testDecoderDelegate) OnDataFileWrite(i, n int, path string, byteCount int, err error) {
 	d.t.Helper()
 	d.t.Logf("OnDataFileWrite(%d, %d, %s, byteCount=%d, %v)", i, n, path, byteCount, err)
@@ -71,6 +179,11 @@ func (d testDecoderDelegate) OnVolumeFileLoad(i uint64, path string, storedSetHa
 	d.t.Logf("OnVolumeFileLoad(%d, %s, storedSetHash=%x, computedSetHash=%x, dataByteCount=%d, %v)", i, path, storedSetHash, computedSetHash, dataByteCount, err)
 }
 
+func (d testDecoderDelegate) OnVolumeFileWrite(i, n int, path string, dataByteCount, byteCount int, err error) {
+	d.t.Helper()
+	d.t.Logf("OnVolumeFileWrite(%d, %d, %s, dataByteCount=%d, byteCount=%d, %v)", i, n, path, dataByteCount, byteCount, err)
+}
+
 func toSortedStrings(arr []string) []string {
 	arrCopy := make([]string, len(arr))
 	copy(arrCopy, arr)
@@ -174,7 +287,11 @@ func makeDecoderMemFS(workingDir string) memfs.MemFS {
 }
 
 func newDecoderForTest(t *testing.T, fs memfs.MemFS, indexFile string) (*Decoder, error) {
-	return newDecoder(testFileIO{t, fs}, testDecoderDelegate{t}, indexFile)
+	return newDecoderWithOptionsForTest(t, fs, indexFile, DecoderOptions{})
+}
+
+func newDecoderWithOptionsForTest(t *testing.T, fs memfs.MemFS, indexFile string, options DecoderOptions) (*Decoder, error) {
+	return newDecoder(testFileIO{t, fs}, testDecoderDelegate{t}, indexFile, options)
 }
 
 func testVerify(t *testing.T, workingDir string, useAbsPath bool) {
@@ -291,8 +408,195 @@ func TestSetHashMismatch(t *testing.T) {
 	require.NoError(t, err)
 	err = decoder.LoadFileData()
 	require.NoError(t, err)
+	// The volume is skipped, since it's not part of the set.
 	err = decoder.LoadParityData()
-	require.Equal(t, errors.New("unexpected set hash for parity volume"), err)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(decoder.parityData))
+	require.NotNil(t, decoder.parityData[0])
+	require.Nil(t, decoder.parityData[1])
+	require.NotNil(t, decoder.parityData[2])
+}
+
+func TestFindVolumesByContent(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+
+	buildPARData(t, fs, 4)
+
+	// Rename one volume, swap the names of two others, and move
+	// the last one to another directory.
+	require.NoError(t, fs.MoveFile("file.p01", "renamed.bin"))
+	require.NoError(t, fs.MoveFile("file.p02", "tmp"))
+	require.NoError(t, fs.MoveFile("file.p03", "file.p02"))
+	require.NoError(t, fs.MoveFile("tmp", "file.p03"))
+	require.NoError(t, fs.MoveFile("file.p04", filepath.Join("other", "vol")))
+	_, err := fs.RemoveFile("file.r01")
+	require.NoError(t, err)
+	_, err = fs.RemoveFile("file.r02")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "file.par")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, 3, len(decoder.parityData))
+
+	decoder, err = newDecoderWithOptionsForTest(t, fs, "file.par", DecoderOptions{
+		VolumePaths: []string{"other"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, 4, len(decoder.parityData))
+	for _, data := range decoder.parityData {
+		require.NotNil(t, data)
+	}
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.r01", "file.r02"}, toSortedStrings(repairedPaths))
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+}
+
+func TestDamagedParityVolume(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+
+	buildPARData(t, fs, 3)
+
+	// Damage a copy of the data, since fs.ReadFile doesn't
+	// return a copy.
+	p02Data, err := fs.ReadFile("file.p02")
+	require.NoError(t, err)
+	damagedP02Data := append([]byte(nil), p02Data...)
+	damagedP02Data[len(damagedP02Data)-1]++
+	require.NoError(t, fs.WriteFile("file.p02", damagedP02Data))
+
+	r01Data, err := fs.RemoveFile("file.r01")
+	require.NoError(t, err)
+	r02Data, err := fs.RemoveFile("file.r02")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "file.par")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, 3, len(decoder.parityData))
+	require.Nil(t, decoder.parityData[1])
+
+	// Two data files are missing, but only two parity volumes
+	// are usable.
+	repairedPaths, err := decoder.Repair(false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.r01", "file.r02"}, toSortedStrings(repairedPaths))
+
+	repairedR01Data, err := fs.ReadFile("file.r01")
+	require.NoError(t, err)
+	require.Equal(t, r01Data, repairedR01Data)
+	repairedR02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	require.Equal(t, r02Data, repairedR02Data)
+
+	// A good copy of the damaged volume is used instead.
+	require.NoError(t, fs.WriteFile("copy.bin", p02Data))
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, p02Data[len(p02Data)-len(decoder.parityData[1]):], decoder.parityData[1])
+}
+
+func TestCheckedOnlyFiles(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+
+	encoder, err := newEncoderWithOptionsForTest(t, fs, []string{"file.r01", "file.r02", "file.r03", "file.r04"}, 2, EncoderOptions{
+		CheckedOnlyPaths: []string{"file.rar"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.NoError(t, encoder.Write("file.par"))
+
+	decoder, err := newDecoderForTest(t, fs, "file.par")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, 4, len(decoder.fileData))
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+
+	// Damage a copy of the data, since fs.ReadFile doesn't
+	// return a copy.
+	rarData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	damagedRARData := append([]byte(nil), rarData...)
+	damagedRARData[0]++
+	require.NoError(t, fs.WriteFile("file.rar", damagedRARData))
+	_, err = fs.RemoveFile("file.r01")
+	require.NoError(t, err)
+
+	require.NoError(t, decoder.LoadFileData())
+	report, err := decoder.Report()
+	require.NoError(t, err)
+	require.Equal(t, FileReport{"file.rar", 4, FileDamaged, []ByteRange{{0, 4}}, true}, report.Files[4])
+	require.Equal(t, 1, report.UnrepairableFileCount)
+	require.Equal(t, 1, report.NeededRecoveryBlockCount)
+	require.True(t, report.NeedsRepair)
+	require.False(t, report.RepairPossible)
+
+	// The other files are still repaired.
+	repairedPaths, err := decoder.Repair(false)
+	require.Equal(t, UnrepairableFilesError{[]string{"file.rar"}}, err)
+	require.Equal(t, []string{"file.r01"}, repairedPaths)
+
+	needsRepair, err = decoder.Verify()
+	require.Equal(t, UnrepairableFilesError{[]string{"file.rar"}}, err)
+	require.False(t, needsRepair)
+}
+
+func TestCheckedOnlyFilesParityVolumeCount(t *testing.T) {
+	// Use filenames that don't look like volumes, since there
+	// are enough volumes to get to the .r volumes.
+	fs := memfs.MakeMemFS(memfs.RootDir(), map[string][]byte{
+		"a.dat": {0x1, 0x2, 0x3, 0x4},
+		"b.dat": {0x5, 0x6, 0x7},
+		"c.dat": {0x8, 0x9, 0xa, 0xb, 0xc},
+		"d.dat": {0xd},
+		"e.dat": {0xe, 0xf},
+	})
+
+	// With four saved files, there can be 252 parity volumes,
+	// even though there are five files in total.
+	encoder, err := newEncoderWithOptionsForTest(t, fs, []string{"a.dat", "b.dat", "c.dat", "d.dat"}, 252, EncoderOptions{
+		CheckedOnlyPaths: []string{"e.dat"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.NoError(t, encoder.Write("set.par"))
+
+	// Keep only the last volume, so that the repair has to use
+	// it.
+	for i := 1; i < 252; i++ {
+		_, err := fs.RemoveFile("set" + volumeExtension(uint64(i), false))
+		require.NoError(t, err)
+	}
+	aData, err := fs.RemoveFile("a.dat")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "set.par")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, 252, len(decoder.parityData))
+	require.NotNil(t, decoder.parityData[251])
+
+	repairedPaths, err := decoder.Repair(false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.dat"}, repairedPaths)
+
+	repairedAData, err := fs.ReadFile("a.dat")
+	require.NoError(t, err)
+	require.Equal(t, aData, repairedAData)
 }
 
 func testRepair(t *testing.T, workingDir string, useAbsPath bool) {
@@ -349,3 +653,342 @@ func testRepair(t *testing.T, workingDir string, useAbsPath bool) {
 func TestRepair(t *testing.T) {
 	runOnExampleWorkingDirs(t, testRepair)
 }
+
+func TestRepairKeepBackup(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+
+	buildPARData(t, fs, 3)
+
+	decoder, err := newDecoderWithOptionsForTest(t, fs, "file.par", DecoderOptions{KeepBackup: true})
+	require.NoError(t, err)
+
+	r02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	r02DataCopy := make([]byte, len(r02Data))
+	copy(r02DataCopy, r02Data)
+	r02Data[len(r02Data)-1]++
+	damagedR02Data := make([]byte, len(r02Data))
+	copy(damagedR02Data, r02Data)
+	_, err = fs.RemoveFile("file.r04")
+	require.NoError(t, err)
+
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.r02", "file.r04"}, toSortedStrings(repairedPaths))
+
+	repairedR02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	require.Equal(t, r02DataCopy, repairedR02Data)
+	backupData, err := fs.ReadFile("file.r02.1")
+	require.NoError(t, err)
+	require.Equal(t, damagedR02Data, backupData)
+	// Nothing was there to back up for the missing file.
+	_, err = fs.ReadFile("file.r04.1")
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.ReadFile(repairTempPath("file.r02"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRepairOutputDir(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+
+	buildPARData(t, fs, 3)
+
+	outputDir := filepath.Join(workingDir, "out")
+	decoder, err := newDecoderWithOptionsForTest(t, fs, "file.par", DecoderOptions{OutputDir: outputDir})
+	require.NoError(t, err)
+
+	r02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	r02DataCopy := make([]byte, len(r02Data))
+	copy(r02DataCopy, r02Data)
+	r02Data[len(r02Data)-1]++
+	r04Data, err := fs.RemoveFile("file.r04")
+	require.NoError(t, err)
+
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	expectedRepairedPaths := []string{
+		filepath.Join(outputDir, "file.r02"),
+		filepath.Join(outputDir, "file.r04"),
+	}
+	require.Equal(t, toSortedStrings(expectedRepairedPaths), toSortedStrings(repairedPaths))
+
+	repairedR02Data, err := fs.ReadFile(filepath.Join(outputDir, "file.r02"))
+	require.NoError(t, err)
+	require.Equal(t, r02DataCopy, repairedR02Data)
+	repairedR04Data, err := fs.ReadFile(filepath.Join(outputDir, "file.r04"))
+	require.NoError(t, err)
+	require.Equal(t, r04Data, repairedR04Data)
+
+	// The original files should be left alone.
+	damagedR02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	require.Equal(t, r02Data, damagedR02Data)
+	_, err = fs.ReadFile("file.r04")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRegenerateParityFiles(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+
+	buildPARData(t, fs, 3)
+
+	p01Data, err := fs.RemoveFile("file.p01")
+	require.NoError(t, err)
+	p03Data, err := fs.RemoveFile("file.p03")
+	require.NoError(t, err)
+	_, err = fs.RemoveFile("file.r01")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "file.par")
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	_, err = decoder.RegenerateParityFiles(0)
+	require.Equal(t, errors.New("data files need repair"), err)
+
+	_, err = decoder.Repair(false)
+	require.NoError(t, err)
+
+	// The last volume is missing, so only the first one is
+	// regenerated when the volume count is inferred.
+	writtenPaths, err := decoder.RegenerateParityFiles(0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.p01"}, writtenPaths)
+	regeneratedP01Data, err := fs.ReadFile("file.p01")
+	require.NoError(t, err)
+	require.Equal(t, p01Data, regeneratedP01Data)
+
+	writtenPaths, err = decoder.RegenerateParityFiles(3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.p03"}, writtenPaths)
+	regeneratedP03Data, err := fs.ReadFile("file.p03")
+	require.NoError(t, err)
+	require.Equal(t, p03Data, regeneratedP03Data)
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+
+	_, err = decoder.RegenerateParityFiles(2)
+	require.Equal(t, errors.New("volume count too small"), err)
+}
+
+func TestManyParityVolumes(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+
+	encoder, err := newEncoderForTest(t, fs, fs.Paths(), 150)
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.NoError(t, encoder.Write("file.par"))
+
+	for _, filename := range []string{"file.p99", "file.q00", "file.q50"} {
+		_, err := fs.ReadFile(filename)
+		require.NoError(t, err, filename)
+	}
+	_, err = fs.ReadFile("file.q51")
+	require.True(t, os.IsNotExist(err))
+
+	// Keep only the volumes past 99, so that the repair has to
+	// use the .q volumes. file.r01 is a data file, and must not
+	// be mistaken for volume 201.
+	for i := 1; i <= 99; i++ {
+		_, err := fs.RemoveFile(fmt.Sprintf("file.p%02d", i))
+		require.NoError(t, err)
+	}
+	r01Data, err := fs.RemoveFile("file.r01")
+	require.NoError(t, err)
+	rarData, err := fs.RemoveFile("file.rar")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "file.par")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, 150, len(decoder.parityData))
+	require.Nil(t, decoder.parityData[0])
+	require.NotNil(t, decoder.parityData[149])
+
+	repairedPaths, err := decoder.Repair(false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.r01", "file.rar"}, toSortedStrings(repairedPaths))
+
+	repairedR01Data, err := fs.ReadFile("file.r01")
+	require.NoError(t, err)
+	require.Equal(t, r01Data, repairedR01Data)
+	repairedRARData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	require.Equal(t, rarData, repairedRARData)
+}
+
+func TestFindVolumesCaseInsensitively(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+
+	buildPARData(t, fs, 3)
+
+	require.NoError(t, fs.MoveFile("file.par", "FILE.PAR"))
+	require.NoError(t, fs.MoveFile("file.p01", "FILE.P01"))
+	require.NoError(t, fs.MoveFile("file.p02", "File.p02"))
+	p03Data, err := fs.RemoveFile("file.p03")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "FILE.PAR")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, 2, len(decoder.parityData))
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+
+	// Regenerated volumes match the case of the index file.
+	writtenPaths, err := decoder.RegenerateParityFiles(3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"FILE.P03"}, writtenPaths)
+	regeneratedP03Data, err := fs.ReadFile("FILE.P03")
+	require.NoError(t, err)
+	require.Equal(t, p03Data, regeneratedP03Data)
+}
+
+func TestReport(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+
+	buildPARData(t, fs, 3)
+
+	decoder, err := newDecoderForTest(t, fs, "file.par")
+	require.NoError(t, err)
+
+	_, err = decoder.Report()
+	require.Equal(t, errors.New("no file data found"), err)
+
+	r01Data, err := fs.ReadFile("file.r01")
+	require.NoError(t, err)
+	r01Data[0]++
+	r02Data, err := fs.RemoveFile("file.r02")
+	require.NoError(t, err)
+	require.NoError(t, fs.WriteFile("file.r02", r02Data[:4]))
+	_, err = fs.RemoveFile("file.r04")
+	require.NoError(t, err)
+
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	report, err := decoder.Report()
+	require.NoError(t, err)
+	require.Equal(t, Report{
+		Files: []FileReport{
+			{"file.r01", 3, FileDamaged, []ByteRange{{0, 3}}, false},
+			{"file.r02", 5, FileWrongByteCount, []ByteRange{{0, 5}}, false},
+			{"file.r03", 0, FileOK, nil, false},
+			{"file.r04", 1, FileMissing, []ByteRange{{0, 1}}, false},
+			{"file.rar", 4, FileOK, nil, false},
+		},
+		DataBlockCount:           5,
+		UsableDataBlockCount:     2,
+		UsableRecoveryBlockCount: 3,
+		NeededRecoveryBlockCount: 3,
+		NeedsRepair:              true,
+		RepairPossible:           true,
+	}, report)
+
+	_, err = fs.RemoveFile("file.p02")
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	report, err = decoder.Report()
+	require.NoError(t, err)
+	require.Equal(t, 2, report.UsableRecoveryBlockCount)
+	require.False(t, report.RepairPossible)
+}
+
+// progressDecoderDelegate records the progress reported to it, and
+// calls cancel, if it's non-nil, on the first parity progress.
+type progressDecoderDelegate struct {
+	testDecoderDelegate
+	hashProgress   [][2]int
+	parityProgress [][2]int
+	cancel         func()
+}
+
+func (d *progressDecoderDelegate) OnDataFileHashProgress(path string, hashedByteCount, byteCount int) {
+	if path == "file.rar" {
+		d.hashProgress = append(d.hashProgress, [2]int{hashedByteCount, byteCount})
+	}
+}
+
+func (d *progressDecoderDelegate) OnParityProgress(processedByteCount, byteCount int) {
+	d.parityProgress = append(d.parityProgress, [2]int{processedByteCount, byteCount})
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+func TestRepairContext(t *testing.T) {
+	// Use a file big enough to be processed in several chunks.
+	rarData := make([]byte, 2*chunkByteCount+100)
+	rand.New(rand.NewSource(1)).Read(rarData)
+	fs := memfs.MakeMemFS(memfs.RootDir(), map[string][]byte{
+		"file.rar": rarData,
+		"file.r01": {0x1, 0x2, 0x3},
+	})
+
+	buildPARData(t, fs, 2)
+
+	rarDataCopy := append([]byte(nil), rarData...)
+	damagedRARData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	damagedRARData[len(damagedRARData)-1]++
+
+	ctx, cancel := context.WithCancel(context.Background())
+	delegate := &progressDecoderDelegate{testDecoderDelegate{t}, nil, nil, cancel}
+	decoder, err := newDecoder(testFileIO{t, fs}, delegate, "file.par", DecoderOptions{})
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileDataContext(ctx))
+	require.NoError(t, decoder.LoadParityDataContext(ctx))
+	byteCount := len(rarData)
+	require.Equal(t, [][2]int{{chunkByteCount, byteCount}, {2 * chunkByteCount, byteCount}, {byteCount, byteCount}}, delegate.hashProgress)
+
+	_, err = decoder.RepairContext(ctx, true)
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, [][2]int{{chunkByteCount, byteCount}}, delegate.parityProgress)
+	data, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	require.Equal(t, damagedRARData, data)
+
+	_, err = decoder.VerifyContext(ctx)
+	require.Equal(t, context.Canceled, err)
+	err = decoder.LoadFileDataContext(ctx)
+	require.Equal(t, context.Canceled, err)
+	err = decoder.LoadParityDataContext(ctx)
+	require.Equal(t, context.Canceled, err)
+
+	delegate.cancel = nil
+	delegate.parityProgress = nil
+	repairedPaths, err := decoder.RepairContext(context.Background(), true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.rar"}, repairedPaths)
+	require.Equal(t, [][2]int{{chunkByteCount, byteCount}, {2 * chunkByteCount, byteCount}, {byteCount, byteCount}}, delegate.parityProgress)
+	data, err = fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	require.Equal(t, rarDataCopy, data)
+}
@@ -1,11 +1,12 @@
 package par1
 
 import (
+	"context"
 	"crypto/md5"
 	"errors"
-	"fmt"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/klauspost/reedsolomon"
 )
@@ -17,48 +18,83 @@ type Encoder struct {
 	fileIO   fileIO
 	delegate EncoderDelegate
 
-	filePaths   []string
-	volumeCount int
+	filePaths        []string
+	checkedOnlyPaths []string
+	volumeCount      int
 
-	shardByteCount int
-	fileData       [][]byte
-	parityData     [][]byte
+	shardByteCount     int
+	fileData           [][]byte
+	checkedOnlyEntries []fileEntry
+	parityData         [][]byte
 }
 
 // EncoderDelegate holds methods that are called during the encode
 // process.
 type EncoderDelegate interface {
 	OnDataFileLoad(i, n int, path string, byteCount int, err error)
+	// OnParityProgress is called as the parity data is computed,
+	// with the number of bytes of each parity volume computed so
+	// far out of byteCount.
+	OnParityProgress(processedByteCount, byteCount int)
 	OnVolumeFileWrite(i, n int, path string, dataByteCount, byteCount int, err error)
 }
 
-func newEncoder(fileIO fileIO, delegate EncoderDelegate, filePaths []string, volumeCount int) (*Encoder, error) {
+// EncoderOptions holds optional parameters for creating an
+// Encoder. The zero value gives the default behavior.
+type EncoderOptions struct {
+	// CheckedOnlyPaths lists files to include in the set without
+	// saving them in the volume set, so that they're checked
+	// against their hashes when verifying, but can't be repaired.
+	CheckedOnlyPaths []string
+}
+
+func newEncoder(fileIO fileIO, delegate EncoderDelegate, filePaths []string, volumeCount int, options EncoderOptions) (*Encoder, error) {
 	filenames := make(map[string]bool)
-	for _, p := range filePaths {
+	for _, p := range append(append([]string(nil), filePaths...), options.CheckedOnlyPaths...) {
 		filename := filepath.Base(p)
 		if filenames[filename] {
 			return nil, errors.New("filename collision")
 		}
 		filenames[filename] = true
 	}
+	if volumeCount > maxVolumeNumber {
+		return nil, errors.New("too many parity volumes")
+	}
 	// TODO: Check len(filePaths) and volumeCount.
-	return &Encoder{fileIO, delegate, filePaths, volumeCount, 0, nil, nil}, nil
+	return &Encoder{fileIO, delegate, filePaths, options.CheckedOnlyPaths, volumeCount, 0, nil, nil, nil}, nil
 }
 
 // NewEncoder creates an encoder with the given list of file paths,
 // and with the given number of intended parity volumes.
 func NewEncoder(delegate EncoderDelegate, filePaths []string, volumeCount int) (*Encoder, error) {
-	return newEncoder(defaultFileIO{}, delegate, filePaths, volumeCount)
+	return NewEncoderWithOptions(delegate, filePaths, volumeCount, EncoderOptions{})
+}
+
+// NewEncoderWithOptions is like NewEncoder, but also takes an
+// EncoderOptions.
+func NewEncoderWithOptions(delegate EncoderDelegate, filePaths []string, volumeCount int, options EncoderOptions) (*Encoder, error) {
+	return newEncoder(defaultFileIO{}, delegate, filePaths, volumeCount, options)
 }
 
 // LoadFileData loads the file data into memory.
 func (e *Encoder) LoadFileData() error {
+	return e.LoadFileDataContext(context.Background())
+}
+
+// LoadFileDataContext is like LoadFileData, but it stops and returns
+// ctx.Err() if ctx is done before all the file data is loaded.
+func (e *Encoder) LoadFileDataContext(ctx context.Context) error {
+	fileCount := len(e.filePaths) + len(e.checkedOnlyPaths)
 	shardByteCount := 0
 	fileData := make([][]byte, len(e.filePaths))
 	for i, path := range e.filePaths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		var err error
 		fileData[i], err = e.fileIO.ReadFile(path)
-		e.delegate.OnDataFileLoad(i+1, len(e.filePaths), path, len(fileData[i]), err)
+		e.delegate.OnDataFileLoad(i+1, fileCount, path, len(fileData[i]), err)
 		if err != nil {
 			return err
 		}
@@ -68,11 +104,44 @@ func (e *Encoder) LoadFileData() error {
 		}
 	}
 
+	// Only the entries of the checked-only files are needed,
+	// so their data isn't kept.
+	checkedOnlyEntries := make([]fileEntry, len(e.checkedOnlyPaths))
+	for i, path := range e.checkedOnlyPaths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		data, err := e.fileIO.ReadFile(path)
+		e.delegate.OnDataFileLoad(len(e.filePaths)+i+1, fileCount, path, len(data), err)
+		if err != nil {
+			return err
+		}
+		checkedOnlyEntries[i] = makeFileEntry(path, data, false)
+	}
+
 	e.shardByteCount = shardByteCount
 	e.fileData = fileData
+	e.checkedOnlyEntries = checkedOnlyEntries
 	return nil
 }
 
+// makeFileEntry returns the entry for the file at path with the
+// given data.
+func makeFileEntry(path string, data []byte, saved bool) fileEntry {
+	var status fileEntryStatus
+	status.setSavedInVolumeSet(saved)
+	return fileEntry{
+		header: fileEntryHeader{
+			Status:       status,
+			FileBytes:    uint64(len(data)),
+			Hash:         md5.Sum(data),
+			SixteenKHash: sixteenKHash(data),
+		},
+		filename: filepath.Base(path),
+	}
+}
+
 func (e *Encoder) buildShards() [][]byte {
 	shards := make([][]byte, len(e.fileData)+e.volumeCount)
 	for i, data := range e.fileData {
@@ -89,6 +158,13 @@ func (e *Encoder) buildShards() [][]byte {
 
 // ComputeParityData computes the parity data for the files.
 func (e *Encoder) ComputeParityData() error {
+	return e.ComputeParityDataContext(context.Background())
+}
+
+// ComputeParityDataContext is like ComputeParityData, but it stops
+// and returns ctx.Err() if ctx is done before the parity data is
+// computed.
+func (e *Encoder) ComputeParityDataContext(ctx context.Context) error {
 	shards := e.buildShards()
 
 	rs, err := reedsolomon.New(len(e.fileData), e.volumeCount, reedsolomon.WithPAR1Matrix())
@@ -96,7 +172,9 @@ func (e *Encoder) ComputeParityData() error {
 		return err
 	}
 
-	err = rs.Encode(shards)
+	err = forEachChunk(ctx, e.shardByteCount, func(start, end int) error {
+		return rs.Encode(chunkShards(shards, start, end))
+	}, e.delegate.OnParityProgress)
 	if err != nil {
 		return err
 	}
@@ -109,22 +187,13 @@ func (e *Encoder) Write(indexPath string) error {
 	var entries []fileEntry
 	var setHashInput []byte
 	for i, k := range e.filePaths {
-		data := e.fileData[i]
-		var status fileEntryStatus
-		status.setSavedInVolumeSet(true)
-		hash := md5.Sum(data)
-		entry := fileEntry{
-			header: fileEntryHeader{
-				Status:       status,
-				FileBytes:    uint64(len(data)),
-				Hash:         hash,
-				SixteenKHash: sixteenKHash(data),
-			},
-			filename: filepath.Base(k),
-		}
+		entry := makeFileEntry(k, e.fileData[i], true)
 		entries = append(entries, entry)
-		setHashInput = append(setHashInput, hash[:]...)
+		setHashInput = append(setHashInput, entry.header.Hash[:]...)
 	}
+	// The set hash covers only the files saved in the volume
+	// set.
+	entries = append(entries, e.checkedOnlyEntries...)
 
 	vTemplate := volume{
 		header: header{
@@ -146,6 +215,21 @@ func (e *Encoder) Write(indexPath string) error {
 	ext := path.Ext(indexPath)
 	base := indexPath[:len(indexPath)-len(ext)]
 
+	// Volume names can collide with those of split RAR archives
+	// (.r00, .r01, etc.), so check for that before writing
+	// anything.
+	dataFilenames := make(map[string]bool)
+	for _, entry := range entries {
+		dataFilenames[strings.ToLower(entry.filename)] = true
+	}
+	volumePaths := make([]string, len(e.parityData))
+	for i := range e.parityData {
+		volumePaths[i] = base + volumeExtension(uint64(i+1), false)
+		if dataFilenames[strings.ToLower(filepath.Base(volumePaths[i]))] {
+			return errors.New("parity volume filename collides with data filename")
+		}
+	}
+
 	realIndexPath := base + ".par"
 	err = e.fileIO.WriteFile(realIndexPath, indexVolumeBytes)
 	e.delegate.OnVolumeFileWrite(0, len(e.parityData), realIndexPath, len(indexVolume.data), len(indexVolumeBytes), err)
@@ -162,8 +246,7 @@ func (e *Encoder) Write(indexPath string) error {
 			return err
 		}
 
-		// TODO: Handle more than 99 parity files.
-		volumePath := fmt.Sprintf("%s.p%02d", base, i+1)
+		volumePath := volumePaths[i]
 		err = e.fileIO.WriteFile(volumePath, volBytes)
 		e.delegate.OnVolumeFileWrite(i+1, len(e.parityData), volumePath, len(vol.data), len(volBytes), err)
 		if err != nil {
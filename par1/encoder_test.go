@@ -1,7 +1,9 @@
 package par1
 
 import (
+	"crypto/md5"
 	"errors"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -19,6 +21,11 @@ func (d testEncoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int
 	d.t.Logf("OnDataFileLoad(%d, %d, byteCount=%d, %s, %v)", i, n, byteCount, path, err)
 }
 
+func (d testEncoderDelegate) OnParityProgress(processedByteCount, byteCount int) {
+	d.t.Helper()
+	d.t.Logf("OnParityProgress(%d, %d)", processedByteCount, byteCount)
+}
+
 func (d testEncoderDelegate) OnVolumeFileWrite(i, n int, path string, dataByteCount, byteCount int, err error) {
 	d.t.Helper()
 	d.t.Logf("OnVolumeFileWrite(%d, %d, %s, dataByteCount=%d, byteCount=%d, %v)", i, n, path, dataByteCount, byteCount, err)
@@ -35,7 +42,11 @@ func makeEncoderMemFS(workingDir string) memfs.MemFS {
 }
 
 func newEncoderForTest(t *testing.T, fs memfs.MemFS, filePaths []string, volumeCount int) (*Encoder, error) {
-	return newEncoder(testFileIO{t, fs}, testEncoderDelegate{t}, filePaths, volumeCount)
+	return newEncoderWithOptionsForTest(t, fs, filePaths, volumeCount, EncoderOptions{})
+}
+
+func newEncoderWithOptionsForTest(t *testing.T, fs memfs.MemFS, filePaths []string, volumeCount int, options EncoderOptions) (*Encoder, error) {
+	return newEncoder(testFileIO{t, fs}, testEncoderDelegate{t}, filePaths, volumeCount, options)
 }
 
 func TestEncodeParity(t *testing.T) {
@@ -79,6 +90,74 @@ func TestEncodeParityFilenameCollision(t *testing.T) {
 	require.Equal(t, errors.New("filename collision"), err)
 }
 
+func TestEncodeTooManyParityVolumes(t *testing.T) {
+	fs := makeEncoderMemFS(memfs.RootDir())
+
+	_, err := newEncoderForTest(t, fs, fs.Paths(), 256)
+	require.Equal(t, errors.New("too many parity volumes"), err)
+}
+
+func TestWriteParityVolumeCollision(t *testing.T) {
+	fs := makeEncoderMemFS(memfs.RootDir())
+
+	encoder, err := newEncoderForTest(t, fs, fs.Paths(), 210)
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+
+	// Volume 201 would be file.r01.
+	err = encoder.Write("file.par")
+	require.Equal(t, errors.New("parity volume filename collides with data filename"), err)
+	_, err = fs.ReadFile("file.par")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestWriteParityCheckedOnly(t *testing.T) {
+	fs := makeEncoderMemFS(memfs.RootDir())
+
+	checkedOnlyPath := filepath.Join("dir1", "file.r01")
+	var paths []string
+	for _, path := range fs.Paths() {
+		if path != filepath.Join(memfs.RootDir(), checkedOnlyPath) {
+			paths = append(paths, path)
+		}
+	}
+
+	_, err := newEncoderWithOptionsForTest(t, fs, paths, 3, EncoderOptions{
+		CheckedOnlyPaths: []string{filepath.Join("dir5", "file.rar")},
+	})
+	require.Equal(t, errors.New("filename collision"), err)
+
+	encoder, err := newEncoderWithOptionsForTest(t, fs, paths, 3, EncoderOptions{
+		CheckedOnlyPaths: []string{checkedOnlyPath},
+	})
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.Equal(t, 4, len(encoder.fileData))
+	require.NoError(t, encoder.Write("file.par"))
+
+	indexBytes, err := fs.ReadFile("file.par")
+	require.NoError(t, err)
+	indexVolume, err := readVolume(indexBytes)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(indexVolume.entries))
+
+	// Only the saved files go into the set hash.
+	var setHashInput []byte
+	for i, entry := range indexVolume.entries {
+		if i < 4 {
+			require.True(t, entry.header.Status.savedInVolumeSet())
+			setHashInput = append(setHashInput, entry.header.Hash[:]...)
+		} else {
+			require.False(t, entry.header.Status.savedInVolumeSet())
+			require.Equal(t, "file.r01", entry.filename)
+			require.Equal(t, md5.Sum([]byte{0x5, 0x6, 0x7, 0x8}), entry.header.Hash)
+		}
+	}
+	require.Equal(t, md5.Sum(setHashInput), indexVolume.header.SetHash)
+}
+
 func testWriteParity(t *testing.T, workingDir string, useAbsPath bool) {
 	fs := makeEncoderMemFS(workingDir)
 
@@ -104,7 +183,7 @@ func testWriteParity(t *testing.T, workingDir string, useAbsPath bool) {
 		require.NoError(t, fs.MoveFile(path, filepath.Base(path)))
 	}
 
-	decoder, err := newDecoder(testFileIO{t, fs}, testDecoderDelegate{t}, parPath)
+	decoder, err := newDecoder(testFileIO{t, fs}, testDecoderDelegate{t}, parPath, DecoderOptions{})
 	require.NoError(t, err)
 
 	err = decoder.LoadFileData()
@@ -1,10 +1,37 @@
 package par1
 
-import "io/ioutil"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
 
 type fileIO interface {
 	ReadFile(path string) ([]byte, error)
+	// ReadFileAt has the same semantics as io.ReaderAt.ReadAt.
+	ReadFileAt(path string, data []byte, offset int64) (int, error)
+	FileByteCount(path string) (int64, error)
+	IsDir(path string) (bool, error)
+	FindWithPrefixAndSuffix(prefix, suffix string) ([]string, error)
 	WriteFile(path string, data []byte) error
+	// MoveFile moves the file at oldPath to newPath, replacing
+	// any file already there.
+	MoveFile(oldPath, newPath string) error
+	// CopyFileMetadata gives the file at dstPath the mode and
+	// modification time of the file at srcPath.
+	CopyFileMetadata(srcPath, dstPath string) error
+	// SyncFile commits the contents of the file at path to
+	// stable storage.
+	SyncFile(path string) error
+	// SyncDir commits the entries of the directory at path, such
+	// as files just moved into it, to stable storage.
+	SyncDir(path string) error
+	// DeleteFile removes the file at path.
+	DeleteFile(path string) error
+	// MkdirAll creates the directory at path, along with any
+	// missing parents, unless it already exists.
+	MkdirAll(path string) error
 }
 
 type defaultFileIO struct{}
@@ -13,6 +40,96 @@ func (io defaultFileIO) ReadFile(path string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
+func (io defaultFileIO) ReadFileAt(path string, data []byte, offset int64) (n int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return f.ReadAt(data, offset)
+}
+
+func (io defaultFileIO) FileByteCount(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (io defaultFileIO) IsDir(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+func (io defaultFileIO) FindWithPrefixAndSuffix(prefix, suffix string) ([]string, error) {
+	return filepath.Glob(prefix + "*" + suffix)
+}
+
 func (io defaultFileIO) WriteFile(path string, data []byte) error {
 	return ioutil.WriteFile(path, data, 0600)
 }
+
+func (io defaultFileIO) MoveFile(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (io defaultFileIO) CopyFileMetadata(srcPath, dstPath string) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dstPath, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+}
+
+func (io defaultFileIO) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (io defaultFileIO) SyncDir(path string) (err error) {
+	// Directories can't be synced on Windows.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return f.Sync()
+}
+
+func (io defaultFileIO) DeleteFile(path string) error {
+	return os.Remove(path)
+}
+
+func (io defaultFileIO) SyncFile(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return f.Sync()
+}
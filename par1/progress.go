@@ -0,0 +1,69 @@
+package par1
+
+import (
+	"context"
+	"crypto/md5"
+)
+
+// chunkByteCount is the number of bytes that are hashed, or of each
+// shard that are encoded, at a time, so that the work can be
+// interrupted and its progress reported.
+const chunkByteCount = 1024 * 1024
+
+// forEachChunk calls fn on consecutive ranges [start, end) of at
+// most chunkByteCount bytes covering [0, byteCount), or on the single
+// empty range if byteCount is zero. It returns ctx.Err() instead if
+// ctx is done before a range is started, and it calls progress, if
+// it's non-nil, after each range with the number of bytes processed
+// so far.
+func forEachChunk(ctx context.Context, byteCount int, fn func(start, end int) error, progress func(processedByteCount, byteCount int)) error {
+	for start := 0; start == 0 || start < byteCount; start += chunkByteCount {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + chunkByteCount
+		if end > byteCount {
+			end = byteCount
+		}
+		err := fn(start, end)
+		if err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(end, byteCount)
+		}
+	}
+	return nil
+}
+
+// chunkShards returns the [start, end) range of each shard, leaving
+// nil shards nil.
+func chunkShards(shards [][]byte, start, end int) [][]byte {
+	chunks := make([][]byte, len(shards))
+	for i, shard := range shards {
+		if shard != nil {
+			chunks[i] = shard[start:end]
+		}
+	}
+	return chunks
+}
+
+// hashData is like md5.Sum, except that it stops and returns
+// ctx.Err() if ctx is done before all of data is hashed, and calls
+// progress, if it's non-nil, as data is hashed.
+func hashData(ctx context.Context, data []byte, progress func(hashedByteCount, byteCount int)) ([md5.Size]byte, error) {
+	var hash [md5.Size]byte
+	h := md5.New()
+	err := forEachChunk(ctx, len(data), func(start, end int) error {
+		// hash.Hash.Write never returns an error.
+		_, _ = h.Write(data[start:end])
+		return nil
+	}, progress)
+	if err != nil {
+		return hash, err
+	}
+	h.Sum(hash[:0])
+	return hash, nil
+}
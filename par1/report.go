@@ -0,0 +1,122 @@
+package par1
+
+import "errors"
+
+// A FileStatus is the state of a data file, as given in a Report.
+type FileStatus string
+
+const (
+	// FileOK means that the data file is intact.
+	FileOK FileStatus = "ok"
+	// FileMissing means that the data file doesn't exist.
+	FileMissing FileStatus = "missing"
+	// FileWrongByteCount means that the data file doesn't have
+	// the expected byte count.
+	FileWrongByteCount FileStatus = "wrong-size"
+	// FileDamaged means that the data file has the expected byte
+	// count, but its contents don't match its hash.
+	FileDamaged FileStatus = "damaged"
+)
+
+// A ByteRange is the range [Start, End) of bytes in a file.
+type ByteRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// A FileReport describes the state of a data file.
+type FileReport struct {
+	Path      string     `json:"path"`
+	ByteCount int        `json:"byteCount"`
+	Status    FileStatus `json:"status"`
+	// CorruptRanges lists the byte ranges of the data file
+	// whose data is missing or corrupt. Since PAR1 has no
+	// per-block checksums, this is the whole file for any file
+	// that isn't intact.
+	CorruptRanges []ByteRange `json:"corruptRanges,omitempty"`
+	// CheckedOnly is true if the data file isn't saved in the
+	// volume set, so it's only checked against its hashes, and
+	// can't be repaired.
+	CheckedOnly bool `json:"checkedOnly,omitempty"`
+}
+
+// A Report describes the state of a volume set, as found by
+// LoadFileData and LoadParityData. For PAR1, each data file is a
+// single data block, and each parity volume is a single recovery
+// block.
+type Report struct {
+	Files []FileReport `json:"files"`
+	// DataBlockCount is the number of data blocks in the volume
+	// set, and UsableDataBlockCount is the number of them that
+	// are intact.
+	DataBlockCount       int `json:"dataBlockCount"`
+	UsableDataBlockCount int `json:"usableDataBlockCount"`
+	// UsableRecoveryBlockCount is the number of parity volumes
+	// that were loaded successfully.
+	UsableRecoveryBlockCount int `json:"usableRecoveryBlockCount"`
+	// NeededRecoveryBlockCount is the number of recovery blocks
+	// needed to reconstruct the data blocks that aren't intact.
+	NeededRecoveryBlockCount int `json:"neededRecoveryBlockCount"`
+	// UnrepairableFileCount is the number of checked-only data
+	// files that aren't intact. If it's non-zero, NeedsRepair is
+	// true and RepairPossible is false.
+	UnrepairableFileCount int  `json:"unrepairableFileCount"`
+	NeedsRepair           bool `json:"needsRepair"`
+	RepairPossible        bool `json:"repairPossible"`
+}
+
+// Report returns a Report describing the state of the volume set.
+// LoadFileData and LoadParityData must be called first.
+func (d *Decoder) Report() (Report, error) {
+	if len(d.fileData) == 0 {
+		return Report{}, errors.New("no file data found")
+	}
+
+	var report Report
+	i, j := 0, 0
+	for _, entry := range d.indexVolume.entries {
+		path, err := d.getFilePath(entry)
+		if err != nil {
+			return Report{}, err
+		}
+
+		byteCount := int(entry.header.FileBytes)
+		fileReport := FileReport{
+			Path:      path,
+			ByteCount: byteCount,
+		}
+		if !entry.header.Status.savedInVolumeSet() {
+			fileReport.Status = d.checkedOnlyStatuses[j]
+			fileReport.CheckedOnly = true
+			j++
+		} else {
+			fileReport.Status = d.fileStatuses[i]
+			if d.fileData[i] != nil {
+				report.UsableDataBlockCount++
+			}
+			i++
+		}
+		if fileReport.Status != FileOK {
+			if byteCount > 0 {
+				fileReport.CorruptRanges = []ByteRange{{0, byteCount}}
+			}
+			if fileReport.CheckedOnly {
+				report.UnrepairableFileCount++
+			}
+			report.NeedsRepair = true
+		}
+		report.Files = append(report.Files, fileReport)
+	}
+
+	report.DataBlockCount = len(d.fileData)
+	for _, data := range d.parityData {
+		if data != nil {
+			report.UsableRecoveryBlockCount++
+		}
+	}
+	report.NeededRecoveryBlockCount = report.DataBlockCount - report.UsableDataBlockCount
+	// Any set of intact data and parity blocks at least as large
+	// as the number of data blocks suffices for reconstruction.
+	report.RepairPossible = report.UsableRecoveryBlockCount >= report.NeededRecoveryBlockCount && report.UnrepairableFileCount == 0
+	return report, nil
+}
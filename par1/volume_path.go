@@ -0,0 +1,54 @@
+package par1
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxVolumeNumber is the largest parity volume number that the
+// volume extension scheme can express.
+const maxVolumeNumber = 255
+
+// volumeExtension returns the extension of the file for the parity
+// volume with the given number. Volumes 1 to 99 use .p01 to .p99,
+// volumes 100 to 199 use .q00 to .q99, and volumes 200 to 255 use
+// .r00 to .r55. If upper is true, the letter is uppercase.
+func volumeExtension(volumeNumber uint64, upper bool) string {
+	if volumeNumber == 0 || volumeNumber > maxVolumeNumber {
+		panic(fmt.Sprintf("unexpected volume number %d", volumeNumber))
+	}
+	letter := 'p' + rune(volumeNumber/100)
+	if upper {
+		letter -= 'a' - 'A'
+	}
+	return fmt.Sprintf(".%c%02d", letter, volumeNumber%100)
+}
+
+// parseVolumeExtension returns the parity volume number for the given
+// extension, ignoring case, and whether the extension is a valid
+// parity volume extension.
+func parseVolumeExtension(ext string) (uint64, bool) {
+	if len(ext) != 4 || ext[0] != '.' {
+		return 0, false
+	}
+	letter := strings.ToLower(ext[1:2])
+	if letter < "p" || letter > "r" {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(ext[2:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	volumeNumber := 100*uint64(letter[0]-'p') + n
+	if volumeNumber == 0 || volumeNumber > maxVolumeNumber {
+		return 0, false
+	}
+	return volumeNumber, true
+}
+
+// isUpperExtension returns whether the given extension has no
+// lowercase letters and at least one uppercase one, e.g. .PAR.
+func isUpperExtension(ext string) bool {
+	return ext != strings.ToLower(ext) && ext == strings.ToUpper(ext)
+}
@@ -0,0 +1,48 @@
+package par1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolumeExtension(t *testing.T) {
+	for _, test := range []struct {
+		volumeNumber uint64
+		upper        bool
+		ext          string
+	}{
+		{1, false, ".p01"},
+		{99, false, ".p99"},
+		{100, false, ".q00"},
+		{199, true, ".Q99"},
+		{200, false, ".r00"},
+		{255, true, ".R55"},
+	} {
+		require.Equal(t, test.ext, volumeExtension(test.volumeNumber, test.upper))
+		volumeNumber, ok := parseVolumeExtension(test.ext)
+		require.True(t, ok)
+		require.Equal(t, test.volumeNumber, volumeNumber)
+	}
+
+	require.Panics(t, func() { volumeExtension(0, false) })
+	require.Panics(t, func() { volumeExtension(256, false) })
+}
+
+func TestParseVolumeExtension(t *testing.T) {
+	for _, ext := range []string{".p00", ".r56", ".s00", ".par", ".p1", ".p001", "p01.", ".p+1"} {
+		_, ok := parseVolumeExtension(ext)
+		require.False(t, ok, ext)
+	}
+
+	volumeNumber, ok := parseVolumeExtension(".Q05")
+	require.True(t, ok)
+	require.Equal(t, uint64(105), volumeNumber)
+}
+
+func TestIsUpperExtension(t *testing.T) {
+	require.True(t, isUpperExtension(".PAR"))
+	require.False(t, isUpperExtension(".par"))
+	require.False(t, isUpperExtension(".Par"))
+	require.False(t, isUpperExtension(".123"))
+}
@@ -2,6 +2,7 @@ package par1
 
 import (
 	"crypto/md5"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -62,3 +63,23 @@ func TestVolumeRoundTrip(t *testing.T) {
 	}
 	require.Equal(t, v, roundTripVolume)
 }
+
+func TestReadVolumeInvalidControlHash(t *testing.T) {
+	v := volume{
+		header: header{
+			ID:            expectedID,
+			VersionNumber: makeVersionNumber(expectedVersion),
+			VolumeNumber:  1,
+		},
+		data: []byte{0x1, 0x2},
+	}
+
+	volumeBytes, err := writeVolume(v)
+	require.NoError(t, err)
+	_, err = readVolume(volumeBytes)
+	require.NoError(t, err)
+
+	volumeBytes[len(volumeBytes)-1]++
+	_, err = readVolume(volumeBytes)
+	require.Equal(t, errors.New("invalid control hash"), err)
+}
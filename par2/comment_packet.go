@@ -0,0 +1,36 @@
+package par2
+
+import (
+	"crypto/md5"
+	"errors"
+)
+
+var asciiCommentPacketType = packetType{'P', 'A', 'R', ' ', '2', '.', '0', '\x00', 'C', 'o', 'm', 'm', 'A', 'S', 'C', '\x00'}
+
+var unicodeCommentPacketType = packetType{'P', 'A', 'R', ' ', '2', '.', '0', '\x00', 'C', 'o', 'm', 'm', 'U', 'n', 'i', '\x00'}
+
+func readASCIICommentPacket(body []byte) string {
+	return decodeNullPaddedASCIIString(body)
+}
+
+func writeASCIICommentPacket(comment string) ([]byte, error) {
+	return encodeASCIIString(comment)
+}
+
+// readUnicodeCommentPacket skips over the hash of the corresponding
+// ASCII comment packet, which isn't needed, since the Unicode comment
+// is preferred anyway.
+func readUnicodeCommentPacket(body []byte) (string, error) {
+	if len(body) < md5.Size {
+		return "", errors.New("unicode comment packet too short")
+	}
+
+	return decodeNullPaddedUTF16LEString(body[md5.Size:]), nil
+}
+
+// writeUnicodeCommentPacket writes the hash of the corresponding
+// ASCII comment packet as zeros, since one is written only when there
+// isn't an ASCII comment packet.
+func writeUnicodeCommentPacket(comment string) []byte {
+	return append(make([]byte, md5.Size), encodeUTF16LEString(comment)...)
+}
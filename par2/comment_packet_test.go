@@ -0,0 +1,53 @@
+package par2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestASCIICommentPacketRoundTrip(t *testing.T) {
+	comment := "some comment"
+	packetBytes, err := writeASCIICommentPacket(comment)
+	require.NoError(t, err)
+	require.Equal(t, comment, readASCIICommentPacket(padPacketBytes(packetBytes)))
+}
+
+func TestUnicodeCommentPacketRoundTrip(t *testing.T) {
+	comment := "コメント"
+	roundTripComment, err := readUnicodeCommentPacket(padPacketBytes(writeUnicodeCommentPacket(comment)))
+	require.NoError(t, err)
+	require.Equal(t, comment, roundTripComment)
+}
+
+func TestFilePrefersUnicodeComment(t *testing.T) {
+	sliceByteCount := 8
+	fileID1, fileDescriptionPacket1, ifscPacket1, _ := computeDataFileInfo(sliceByteCount, "file1.txt", []byte("contents 1"))
+
+	asciiCommentPacketBytes, err := writeASCIICommentPacket("ASCII comment")
+	require.NoError(t, err)
+	file := file{
+		clientID: "test client",
+		mainPacket: &mainPacket{
+			sliceByteCount: sliceByteCount,
+			recoverySet:    []fileID{fileID1},
+		},
+		fileDescriptionPackets: map[fileID]fileDescriptionPacket{
+			fileID1: fileDescriptionPacket1,
+		},
+		ifscPackets: map[fileID]ifscPacket{
+			fileID1: ifscPacket1,
+		},
+		comment: "Unicode コメント",
+		unknownPackets: map[packetType][][]byte{
+			asciiCommentPacketType: {padPacketBytes(asciiCommentPacketBytes)},
+		},
+	}
+
+	setID, fileBytes, err := writeFile(file)
+	require.NoError(t, err)
+
+	_, roundTripFile, err := readFile(testDecoderDelegate{t}, &setID, fileBytes)
+	require.NoError(t, err)
+	require.Equal(t, "Unicode コメント", roundTripFile.comment)
+}
@@ -3,31 +3,143 @@ package par2
 import (
 	"crypto/md5"
 	"encoding/binary"
+	"hash"
 	"hash/crc32"
 )
 
-func computeDataFileInfo(sliceByteCount int, filename string, data []byte) (fileID, fileDescriptionPacket, ifscPacket, [][]byte) {
-	hash := md5.Sum(data)
-	sixteenKHash := sixteenKHash(data)
-	fileID := computeFileID(sixteenKHash, uint64(len(data)), []byte(filename))
+// fileHasher computes the hash and the 16k hash of a file, from data
+// that is written to it piece by piece.
+type fileHasher struct {
+	byteCount    int
+	hash         hash.Hash
+	sixteenKHash hash.Hash
+}
+
+func newFileHasher() *fileHasher {
+	return &fileHasher{
+		hash:         md5.New(),
+		sixteenKHash: md5.New(),
+	}
+}
+
+// Write implements io.Writer, and never returns an error.
+func (h *fileHasher) Write(data []byte) (int, error) {
+	// The hash.Hash implementations never return errors.
+	_, _ = h.hash.Write(data)
+	if h.byteCount < 16*1024 {
+		sixteenKData := data
+		if h.byteCount+len(sixteenKData) > 16*1024 {
+			sixteenKData = sixteenKData[:16*1024-h.byteCount]
+		}
+		_, _ = h.sixteenKHash.Write(sixteenKData)
+	}
+	h.byteCount += len(data)
+	return len(data), nil
+}
+
+func (h *fileHasher) sums() (hash, sixteenKHash [md5.Size]byte) {
+	h.hash.Sum(hash[:0])
+	h.sixteenKHash.Sum(sixteenKHash[:0])
+	return hash, sixteenKHash
+}
+
+// dataFileHasher computes the checksums needed for the file
+// description and input file slice checksum packets of a data file,
+// from data that is written to it piece by piece.
+type dataFileHasher struct {
+	fileHasher
+
+	sliceByteCount     int
+	sliceHash          hash.Hash
+	sliceCRC32         uint32
+	currSliceByteCount int
+	checksumPairs      []checksumPair
+}
+
+func newDataFileHasher(sliceByteCount int) *dataFileHasher {
+	return &dataFileHasher{
+		fileHasher:     *newFileHasher(),
+		sliceByteCount: sliceByteCount,
+		sliceHash:      md5.New(),
+	}
+}
+
+// Write implements io.Writer, and never returns an error.
+func (h *dataFileHasher) Write(data []byte) (int, error) {
+	n, _ := h.fileHasher.Write(data)
+
+	for len(data) > 0 {
+		sliceData := data
+		if h.currSliceByteCount+len(sliceData) > h.sliceByteCount {
+			sliceData = sliceData[:h.sliceByteCount-h.currSliceByteCount]
+		}
+		h.writeSliceData(sliceData)
+		data = data[len(sliceData):]
+		if h.currSliceByteCount == h.sliceByteCount {
+			h.finishSlice()
+		}
+	}
+	return n, nil
+}
+
+func (h *dataFileHasher) writeSliceData(data []byte) {
+	_, _ = h.sliceHash.Write(data)
+	h.sliceCRC32 = crc32.Update(h.sliceCRC32, crc32.IEEETable, data)
+	h.currSliceByteCount += len(data)
+}
+
+func (h *dataFileHasher) finishSlice() {
+	var md5Hash [md5.Size]byte
+	h.sliceHash.Sum(md5Hash[:0])
+	var crc32Bytes [4]byte
+	binary.LittleEndian.PutUint32(crc32Bytes[:], h.sliceCRC32)
+	h.checksumPairs = append(h.checksumPairs, checksumPair{
+		MD5:   md5Hash,
+		CRC32: crc32Bytes,
+	})
+	h.sliceHash.Reset()
+	h.sliceCRC32 = 0
+	h.currSliceByteCount = 0
+}
+
+// finish pads out the last slice, if necessary, and returns the
+// computed file ID and packets for the data written so far.
+func (h *dataFileHasher) finish(filename string) (fileID, fileDescriptionPacket, ifscPacket) {
+	if h.currSliceByteCount > 0 {
+		var zeros [4096]byte
+		for h.currSliceByteCount < h.sliceByteCount {
+			padByteCount := h.sliceByteCount - h.currSliceByteCount
+			if padByteCount > len(zeros) {
+				padByteCount = len(zeros)
+			}
+			h.writeSliceData(zeros[:padByteCount])
+		}
+		h.finishSlice()
+	}
+
+	hash, sixteenKHash := h.sums()
+	fileID := computeFileID(sixteenKHash, uint64(h.byteCount), []byte(filename))
 	fileDescriptionPacket := fileDescriptionPacket{
 		hash:         hash,
 		sixteenKHash: sixteenKHash,
-		byteCount:    len(data),
+		byteCount:    h.byteCount,
 		filename:     filename,
 	}
+	return fileID, fileDescriptionPacket, ifscPacket{h.checksumPairs}
+}
+
+// computeDataShards splits data into slices, padding the last one.
+func computeDataShards(sliceByteCount int, data []byte) [][]byte {
 	var dataShards [][]byte
-	var checksumPairs []checksumPair
 	for i := 0; i < len(data); i += sliceByteCount {
-		slice := sliceAndPadByteArray(data, i, i+sliceByteCount)
-		dataShards = append(dataShards, slice)
-		crc32 := crc32.ChecksumIEEE(slice)
-		var crc32Bytes [4]byte
-		binary.LittleEndian.PutUint32(crc32Bytes[:], crc32)
-		checksumPairs = append(checksumPairs, checksumPair{
-			MD5:   md5.Sum(slice),
-			CRC32: crc32Bytes,
-		})
+		dataShards = append(dataShards, sliceAndPadByteArray(data, i, i+sliceByteCount))
 	}
-	return fileID, fileDescriptionPacket, ifscPacket{checksumPairs}, dataShards
+	return dataShards
+}
+
+func computeDataFileInfo(sliceByteCount int, filename string, data []byte) (fileID, fileDescriptionPacket, ifscPacket, [][]byte) {
+	h := newDataFileHasher(sliceByteCount)
+	_, _ = h.Write(data)
+	fileID, fileDescriptionPacket, ifscPacket := h.finish(filename)
+	return fileID, fileDescriptionPacket, ifscPacket, computeDataShards(sliceByteCount, data)
 }
@@ -2,46 +2,44 @@ package par2
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
-	"io/ioutil"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/akalin/gopar/rsec16"
 )
 
-type fileIO interface {
-	ReadFile(path string) ([]byte, error)
-	FindWithPrefixAndSuffix(prefix, suffix string) ([]string, error)
-	WriteFile(path string, data []byte) error
-}
-
-type defaultFileIO struct{}
-
-func (io defaultFileIO) ReadFile(path string) ([]byte, error) {
-	return ioutil.ReadFile(path)
-}
-
-func (io defaultFileIO) FindWithPrefixAndSuffix(prefix, suffix string) ([]string, error) {
-	return filepath.Glob(prefix + "*" + suffix)
-}
-
-func (io defaultFileIO) WriteFile(path string, data []byte) error {
-	return ioutil.WriteFile(path, data, 0600)
+type decoderInputFileInfo struct {
+	fileID   fileID
+	filename string
+	// Empty if there's no Unicode filename packet for the file.
+	unicodeFilename string
+	byteCount       int
+	sixteenKHash    [md5.Size]byte
+	hash            [md5.Size]byte
+	checksumPairs   []checksumPair
 }
 
-type decoderInputFileInfo struct {
-	fileID        fileID
-	filename      string
-	byteCount     int
-	sixteenKHash  [md5.Size]byte
-	hash          [md5.Size]byte
-	checksumPairs []checksumPair
+// name returns the path of the file relative to the recovery set,
+// preferring the filename from its Unicode filename packet, if any,
+// since the one from its file description packet can only be ASCII.
+func (info decoderInputFileInfo) name() string {
+	if info.unicodeFilename != "" {
+		return info.unicodeFilename
+	}
+	return info.filename
 }
 
 func decoderInputFileInfoIDs(infos []decoderInputFileInfo) []fileID {
@@ -52,20 +50,23 @@ func decoderInputFileInfoIDs(infos []decoderInputFileInfo) []fileID {
 	return fileIDs
 }
 
-func makeDecoderInputFileInfos(fileIDs []fileID, fileDescriptionPackets map[fileID]fileDescriptionPacket, ifscPackets map[fileID]ifscPacket) ([]decoderInputFileInfo, error) {
+func makeDecoderInputFileInfos(fileIDs []fileID, fileDescriptionPackets map[fileID]fileDescriptionPacket, ifscPackets map[fileID]ifscPacket, unicodeFilenames map[fileID]string) ([]decoderInputFileInfo, error) {
 	var decoderInputFileInfos []decoderInputFileInfo
 	for _, fileID := range fileIDs {
 		descriptionPacket, ok := fileDescriptionPackets[fileID]
 		if !ok {
 			return nil, errors.New("file description packet not found")
 		}
+		// Empty files have no input file slice checksum
+		// packet.
 		ifscPacket, ok := ifscPackets[fileID]
-		if !ok {
+		if !ok && descriptionPacket.byteCount > 0 {
 			return nil, errors.New("input file slice checksum packet not found")
 		}
 		decoderInputFileInfos = append(decoderInputFileInfos, decoderInputFileInfo{
 			fileID,
 			descriptionPacket.filename,
+			unicodeFilenames[fileID],
 			descriptionPacket.byteCount,
 			descriptionPacket.sixteenKHash,
 			descriptionPacket.hash,
@@ -121,13 +122,39 @@ func makeChecksumShardLocationMap(sliceByteCount int, infos []decoderInputFileIn
 	return m
 }
 
+// A shardSource is the location of a copy of a slice's data, which
+// is empty if no copy was found. The copy may be cut off by the end
+// of its file, in which case the rest of the data is zeros.
+type shardSource struct {
+	path  string
+	start int
+}
+
+func (s shardSource) found() bool {
+	return s.path != ""
+}
+
+// read fills data with the bytes of the copy starting at offset
+// within the slice.
+func (s shardSource) read(fileIO fileIO, data []byte, offset int) error {
+	return readFileAtPadded(fileIO, s.path, data, int64(s.start+offset))
+}
+
+func foundShards(sources []shardSource) []bool {
+	found := make([]bool, len(sources))
+	for i, source := range sources {
+		found[i] = source.found()
+	}
+	return found
+}
+
 type shardIntegrityInfo struct {
-	data      []byte
+	source    shardSource
 	locations shardLocationSet
 }
 
 func (info shardIntegrityInfo) ok(location shardLocation) bool {
-	return len(info.data) != 0 && info.locations[location]
+	return info.source.found() && info.locations[location]
 }
 
 type fileIntegrityInfo struct {
@@ -136,6 +163,9 @@ type fileIntegrityInfo struct {
 	hashMismatch      bool
 	hasWrongByteCount bool
 	shardInfos        []shardIntegrityInfo
+	// If the file isn't intact, foundPath is the path of an
+	// intact copy of it among the candidate files, if any.
+	foundPath string
 }
 
 func (info fileIntegrityInfo) allShardsOK(sliceByteCount int) bool {
@@ -162,21 +192,83 @@ type Decoder struct {
 	delegate DecoderDelegate
 
 	indexPath string
+	// If non-nil, the paths of the recovery volumes, which are
+	// otherwise the files named like the index file with a
+	// .volNN+NN suffix.
+	volumePaths []string
 
 	setID          recoverySetID
 	clientID       string
+	comment        string
 	sliceByteCount int
 	recoverySet    []decoderInputFileInfo
 	nonRecoverySet []decoderInputFileInfo
 
-	numGoroutines int
+	numGoroutines  int
+	memoryLimit    int
+	candidatePaths []string
+	extraPaths     []string
+	keepBackup     bool
+	outputDir      string
 
 	checksumToLocation checksumShardLocationMap
 
 	// Indexed the same as recoverySet.
 	fileIntegrityInfos []fileIntegrityInfo
+	// Indexed the same as nonRecoverySet.
+	nonRecoveryStatuses []FileStatus
+
+	// Indexed by exponent.
+	parityShards []shardSource
+	// The filenames of the parity files in which corrupt data
+	// was skipped.
+	damagedParityFiles map[string]bool
+}
 
-	parityShards [][]byte
+// DefaultDecoderMemoryLimit is the memory limit used by a Decoder if
+// DecoderOptions.MemoryLimit is zero.
+const DefaultDecoderMemoryLimit = 256 * 1024 * 1024
+
+// DecoderOptions holds optional parameters for creating a
+// Decoder. The zero value gives the default behavior.
+type DecoderOptions struct {
+	// The Decoder never loads whole files into memory; data files
+	// are scanned through a bounded window, and only the locations
+	// of the slices and recovery data found are kept. Repair and
+	// RegenerateParityFiles also process the slices in as many
+	// passes as needed to keep the buffers they allocate within
+	// roughly MemoryLimit bytes, or DefaultDecoderMemoryLimit
+	// bytes if MemoryLimit is zero.
+	MemoryLimit int
+	// CandidatePaths lists extra files, or directories whose
+	// files are all extra files, among which to look for data
+	// files that are missing or damaged, e.g. because they were
+	// renamed. A candidate file with the byte count and hashes
+	// of such a data file is used in its place, and Repair moves
+	// it into place, or copies it if it's needed elsewhere too.
+	// A candidate file with the same byte count that matches
+	// only some of the slices of such a data file supplies
+	// those slices.
+	CandidatePaths []string
+	// ExtraPaths lists arbitrary extra files to scan for slices
+	// of the recovery set, which may be found at any offset,
+	// e.g. pieces of data files from split or joined downloads,
+	// or partly overwritten copies of data files.
+	ExtraPaths []string
+	// Repair always writes repaired data to a temporary file
+	// first, and only moves it into place once it's been checked
+	// and synced, giving it the mode and modification time of
+	// the damaged file it replaces. If KeepBackup is true, the
+	// damaged file is kept, like par2cmdline does, by moving it
+	// to the first free path of the form name.1, name.2, and so
+	// on.
+	KeepBackup bool
+	// If OutputDir is non-empty, Repair leaves the data files
+	// alone, and instead writes the files it repairs under
+	// OutputDir, at the same paths relative to it as they have
+	// relative to the index file, creating directories as
+	// needed.
+	OutputDir string
 }
 
 // DecoderDelegate holds methods that are called during the decode
@@ -186,68 +278,303 @@ type DecoderDelegate interface {
 	OnMainPacketLoad(sliceByteCount, recoverySetCount, nonRecoverySetCount int)
 	OnFileDescriptionPacketLoad(fileID [16]byte, filename string, byteCount int)
 	OnIFSCPacketLoad(fileID [16]byte)
+	OnUnicodeFilenamePacketLoad(fileID [16]byte, filename string)
+	// OnCommentPacketLoad is called for both ASCII and Unicode
+	// comment packets.
+	OnCommentPacketLoad(comment string)
 	OnRecoveryPacketLoad(exponent uint16, byteCount int)
 	OnUnknownPacketLoad(packetType [16]byte, byteCount int)
 	OnOtherPacketSkip(setID [16]byte, packetType [16]byte, byteCount int)
+	// OnInvalidMainPacketSkip is called when a main packet is
+	// skipped because the recovery set ID computed from it
+	// doesn't match the one in its header.
+	OnInvalidMainPacketSkip(setID, computedSetID [16]byte)
+	// OnDuplicateMainPacketLoad is called when a main packet
+	// identical to the one already loaded is found. Conflicting
+	// main packets cause an error instead.
+	OnDuplicateMainPacketLoad()
+	OnCorruptDataSkip(startByteOffset, endByteOffset int)
+	// OnMalformedPacketSkip is called when a packet whose hash
+	// matches is skipped because its body can't be read, e.g.
+	// if it was written by a buggy client.
+	OnMalformedPacketSkip(packetType [16]byte, byteCount int, err error)
 	OnDataFileLoad(i, n int, path string, byteCount, hits, misses int, err error)
+	// OnDataFileScanProgress is called as the file at path, which
+	// has byteCount bytes, is scanned for slices, with the number
+	// of bytes scanned so far, and the number of hits and misses
+	// so far, as for OnDataFileLoad.
+	OnDataFileScanProgress(path string, scannedByteCount, byteCount, hits, misses int)
 	OnParityFileLoad(i int, path string, err error)
 	OnDetectCorruptDataChunk(fileID [16]byte, path string, startByteOffset, endByteOffset int)
 	OnDetectDataFileHashMismatch(fileID [16]byte, path string)
 	OnDetectDataFileWrongByteCount(fileID [16]byte, path string)
+	OnCandidateFileLoad(i, n int, path string, byteCount, hits int, err error)
+	OnDetectDataFileElsewhere(fileID [16]byte, path, foundPath string)
+	OnExtraFileLoad(i, n int, path string, byteCount, hits, misses int, err error)
+	// OnNonRecoveryFileLoad is called when a file in the
+	// non-recovery set is checked against its hashes, with the
+	// status it was found to have. Such files can't be repaired.
+	OnNonRecoveryFileLoad(i, n int, path string, byteCount int, status FileStatus, err error)
+	// OnMatrixProgress is called as missing data is
+	// reconstructed and parity data is computed, with the number
+	// of matrix rows applied so far out of rowCount. Each row is
+	// applied once per piece of each slice.
+	OnMatrixProgress(rowsApplied, rowCount int)
 	OnDataFileWrite(i, n int, path string, byteCount int, err error)
+	OnIndexFileWrite(path string, byteCount int, err error)
+	OnRecoveryFileWrite(start, count, total int, path string, dataByteCount, byteCount int, err error)
+}
+
+var volumeFileSuffixRegexp = regexp.MustCompile(`(?i)\.vol\d+\+\d+(\.par2)$`)
+
+var volumeFileExponentRangeRegexp = regexp.MustCompile(`(?i)\.vol(\d+)\+(\d+)\.par2$`)
+
+// findIndexPath returns the path of the index file for the given
+// path, which may be the index file itself, one of its recovery
+// volumes, or a directory containing them, in which case they must
+// be for a single recovery set.
+func findIndexPath(fileIO fileIO, path string) (string, error) {
+	isDir, err := fileIO.IsDir(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if !isDir {
+		if m := volumeFileSuffixRegexp.FindStringSubmatchIndex(path); m != nil {
+			// Keep the extension, with its case.
+			return path[:m[0]] + path[m[2]:], nil
+		}
+		return path, nil
+	}
+
+	dirPrefix := path
+	if !strings.HasSuffix(dirPrefix, string(filepath.Separator)) {
+		dirPrefix += string(filepath.Separator)
+	}
+	matches, err := fileIO.FindWithPrefixAndSuffix(dirPrefix, ".par2")
+	if err != nil {
+		return "", err
+	}
+
+	var indexPath string
+	for _, match := range matches {
+		matchIndexPath, err := findIndexPath(fileIO, match)
+		if err != nil {
+			return "", err
+		}
+		if indexPath != "" && matchIndexPath != indexPath {
+			return "", errors.New("found PAR2 files for more than one recovery set")
+		}
+		indexPath = matchIndexPath
+	}
+
+	if indexPath == "" {
+		return "", errors.New("no PAR2 files found")
+	}
+
+	return indexPath, nil
+}
+
+// criticalPacketDelegate is used when reading the critical packets
+// from recovery volumes, whose recovery packets are reported later
+// by LoadParityData.
+type criticalPacketDelegate struct {
+	DecoderDelegate
+}
+
+func (criticalPacketDelegate) OnRecoveryPacketLoad(exponent uint16, byteCount int) {}
+
+func hasAllCriticalPackets(f file) bool {
+	if len(f.clientID) == 0 || f.mainPacket == nil {
+		return false
+	}
+
+	for _, fileID := range append(append([]fileID{}, f.mainPacket.recoverySet...), f.mainPacket.nonRecoverySet...) {
+		fileDescriptionPacket, ok := f.fileDescriptionPackets[fileID]
+		if !ok {
+			return false
+		}
+		if _, ok := f.ifscPackets[fileID]; !ok && fileDescriptionPacket.byteCount > 0 {
+			return false
+		}
+	}
+
+	return true
 }
 
-func newDecoder(fileIO fileIO, delegate DecoderDelegate, indexPath string, numGoroutines int) (*Decoder, error) {
-	indexBytes, err := fileIO.ReadFile(indexPath)
+// findVolumePaths returns the paths of the files named like the index
+// file at indexPath with a .volNN+NN suffix, sorted.
+func findVolumePaths(fileIO fileIO, indexPath string) ([]string, error) {
+	ext := path.Ext(indexPath)
+	base := indexPath[:len(indexPath)-len(ext)]
+	volumePaths, err := fileIO.FindWithPrefixAndSuffix(base+".", ext)
 	if err != nil {
 		return nil, err
 	}
+	sort.Strings(volumePaths)
+	return volumePaths, nil
+}
+
+// readCriticalPackets reads the creator, main, file description, and
+// input file slice checksum packets of a recovery set from the index
+// file at indexPath. If any of them are missing, e.g. if the index
+// file is missing or damaged, it then looks for them in the given
+// recovery volumes, skipping any that can't be read. If expectedSetID
+// is nil, the recovery set is the one of the first packet found.
+func readCriticalPackets(fileIO fileIO, delegate DecoderDelegate, indexPath string, volumePaths []string, expectedSetID *recoverySetID) (recoverySetID, file, error) {
+	setID := expectedSetID
+	criticalPackets := file{
+		fileDescriptionPackets: make(map[fileID]fileDescriptionPacket),
+		ifscPackets:            make(map[fileID]ifscPacket),
+		unicodeFilenames:       make(map[fileID]string),
+	}
+	var firstErr error
+	for i, path := range append([]string{indexPath}, volumePaths...) {
+		fileDelegate := delegate
+		if i > 0 {
+			fileDelegate = criticalPacketDelegate{delegate}
+		}
+
+		fileSetID, f, err := func() (recoverySetID, file, error) {
+			byteCount, err := fileIO.FileByteCount(path)
+			if err != nil {
+				return recoverySetID{}, file{}, err
+			}
+
+			// Pass in a map so that recovery data isn't
+			// loaded.
+			return readFileAt(fileDelegate, setID, fileReaderAt{fileIO, path}, byteCount, make(map[exponent]recoveryDataLocation))
+		}()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if setID == nil {
+			setID = &fileSetID
+		}
+		if len(criticalPackets.clientID) == 0 {
+			criticalPackets.clientID = f.clientID
+		}
+		if criticalPackets.mainPacket == nil {
+			criticalPackets.mainPacket = f.mainPacket
+		}
+		for fileID, packet := range f.fileDescriptionPackets {
+			if _, ok := criticalPackets.fileDescriptionPackets[fileID]; !ok {
+				criticalPackets.fileDescriptionPackets[fileID] = packet
+			}
+		}
+		for fileID, packet := range f.ifscPackets {
+			if _, ok := criticalPackets.ifscPackets[fileID]; !ok {
+				criticalPackets.ifscPackets[fileID] = packet
+			}
+		}
+		// The Unicode filename and comment packets aren't
+		// critical, but they're picked up from the same files.
+		for fileID, filename := range f.unicodeFilenames {
+			if _, ok := criticalPackets.unicodeFilenames[fileID]; !ok {
+				criticalPackets.unicodeFilenames[fileID] = filename
+			}
+		}
+		if len(criticalPackets.comment) == 0 {
+			criticalPackets.comment = f.comment
+		}
+
+		if hasAllCriticalPackets(criticalPackets) {
+			break
+		}
+	}
+
+	if setID == nil {
+		return recoverySetID{}, file{}, firstErr
+	}
+
+	if criticalPackets.mainPacket == nil {
+		return recoverySetID{}, file{}, errors.New("no main packet found")
+	}
 
-	setID, indexFile, err := readFile(delegate, nil, indexBytes)
+	if len(criticalPackets.clientID) == 0 {
+		return recoverySetID{}, file{}, errors.New("no creator packet found")
+	}
+
+	return *setID, criticalPackets, nil
+}
+
+func newDecoder(fileIO fileIO, delegate DecoderDelegate, path string, numGoroutines int, options DecoderOptions) (*Decoder, error) {
+	indexPath, err := findIndexPath(fileIO, path)
 	if err != nil {
 		return nil, err
 	}
 
-	if indexFile.mainPacket == nil {
-		// TODO: Relax this check.
-		return nil, errors.New("no main packet found")
+	return newDecoderForIndexPath(fileIO, delegate, indexPath, nil, nil, numGoroutines, options)
+}
+
+func newDecoderForRecoverySet(fileIO fileIO, delegate DecoderDelegate, set RecoverySet, numGoroutines int, options DecoderOptions) (*Decoder, error) {
+	// Make this non-nil even if there are no recovery volumes,
+	// so that they aren't looked for by name.
+	volumePaths := []string{}
+	for _, path := range set.Paths {
+		if path != set.IndexPath {
+			volumePaths = append(volumePaths, path)
+		}
+	}
+	sort.Strings(volumePaths)
+
+	setID := recoverySetID(set.SetID)
+	return newDecoderForIndexPath(fileIO, delegate, set.IndexPath, volumePaths, &setID, numGoroutines, options)
+}
+
+// newDecoderForIndexPath returns a Decoder for the recovery set with
+// the index file at indexPath. If volumePaths is nil, the recovery
+// volumes are looked for by name, as with findVolumePaths.
+func newDecoderForIndexPath(fileIO fileIO, delegate DecoderDelegate, indexPath string, volumePaths []string, expectedSetID *recoverySetID, numGoroutines int, options DecoderOptions) (*Decoder, error) {
+	if options.MemoryLimit < 0 {
+		return nil, errors.New("invalid memory limit")
+	}
+	memoryLimit := options.MemoryLimit
+	if memoryLimit == 0 {
+		memoryLimit = DefaultDecoderMemoryLimit
+	}
+
+	criticalVolumePaths := volumePaths
+	if criticalVolumePaths == nil {
+		var err error
+		criticalVolumePaths, err = findVolumePaths(fileIO, indexPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if len(indexFile.recoveryPackets) > 0 {
-		// TODO: Relax this check.
-		return nil, errors.New("recovery packets found in index file")
+	setID, indexFile, err := readCriticalPackets(fileIO, delegate, indexPath, criticalVolumePaths, expectedSetID)
+	if err != nil {
+		return nil, err
 	}
 
-	recoverySet, err := makeDecoderInputFileInfos(indexFile.mainPacket.recoverySet, indexFile.fileDescriptionPackets, indexFile.ifscPackets)
+	recoverySet, err := makeDecoderInputFileInfos(indexFile.mainPacket.recoverySet, indexFile.fileDescriptionPackets, indexFile.ifscPackets, indexFile.unicodeFilenames)
 	if err != nil {
 		return nil, err
 	}
 
-	nonRecoverySet, err := makeDecoderInputFileInfos(indexFile.mainPacket.nonRecoverySet, indexFile.fileDescriptionPackets, indexFile.ifscPackets)
+	nonRecoverySet, err := makeDecoderInputFileInfos(indexFile.mainPacket.nonRecoverySet, indexFile.fileDescriptionPackets, indexFile.ifscPackets, indexFile.unicodeFilenames)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Decoder{
 		fileIO, delegate,
-		indexPath,
+		indexPath, volumePaths,
 		setID,
-		indexFile.clientID, indexFile.mainPacket.sliceByteCount,
+		indexFile.clientID, indexFile.comment, indexFile.mainPacket.sliceByteCount,
 		recoverySet, nonRecoverySet,
-		numGoroutines,
-		nil,
-		nil,
+		numGoroutines, memoryLimit, options.CandidatePaths, options.ExtraPaths, options.KeepBackup, options.OutputDir,
 		nil,
+		nil, nil,
+		nil, nil,
 	}, nil
 }
 
-func sixteenKHash(data []byte) [md5.Size]byte {
-	if len(data) < 16*1024 {
-		return md5.Sum(data)
-	}
-	return md5.Sum(data[:16*1024])
-}
-
 func sliceAndPadByteArray(bs []byte, start, end int) []byte {
 	padLength := 0
 	if end > len(bs) {
@@ -261,17 +588,69 @@ func sliceAndPadByteArray(bs []byte, start, end int) []byte {
 	return slice
 }
 
-func fillShardInfos(sliceByteCount int, data []byte, checksumToLocation checksumShardLocationMap, fileID fileID, fileIntegrityInfos []fileIntegrityInfo, fileIDIndices map[fileID]int) (int, int) {
-	hits := 0
-	misses := 0
+// fillShardInfos looks for slices in the data read from r, which is
+// the data of the file at path, keeping at most bufByteCount bytes of
+// it in memory at a time. bufByteCount must be greater than
+// sliceByteCount. If progress is non-nil, it's called each time more
+// data is read in, with the number of bytes scanned so far and the
+// hits and misses so far.
+func fillShardInfos(sliceByteCount int, r io.Reader, bufByteCount int, checksumToLocation checksumShardLocationMap, fileID fileID, path string, fileIntegrityInfos []fileIntegrityInfo, fileIDIndices map[fileID]int, progress func(scannedByteCount, hits, misses int)) (hits, misses int, err error) {
+	// buf holds the data starting at bufStart.
+	buf := make([]byte, 0, bufByteCount)
+	bufStart := 0
+	eof := false
+	// fill discards the data before keepStart, and then reads
+	// in as much data as fits in buf.
+	fill := func(keepStart int) error {
+		n := copy(buf[:cap(buf)], buf[keepStart-bufStart:])
+		m, err := io.ReadFull(r, buf[n:cap(buf)])
+		buf = buf[:n+m]
+		bufStart = keepStart
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+			return nil
+		}
+		return err
+	}
 
+	paddedSlice := make([]byte, sliceByteCount)
 	justMissed := false
 	window := newCRC32Window(sliceByteCount)
 	var crcSlice uint32
-	for j := 0; j < len(data); {
-		slice := sliceAndPadByteArray(data, j, j+sliceByteCount)
+	for j := 0; ; {
+		if !eof && j+sliceByteCount > bufStart+len(buf) {
+			keepStart := j
+			if justMissed {
+				// The previous byte is needed to
+				// update crcSlice.
+				keepStart = j - 1
+			}
+			err := fill(keepStart)
+			if err != nil {
+				return hits, misses, err
+			}
+			if progress != nil {
+				progress(j, hits, misses)
+			}
+		}
+
+		k := j - bufStart
+		if k >= len(buf) {
+			break
+		}
+
+		var slice []byte
+		if k+sliceByteCount <= len(buf) {
+			slice = buf[k : k+sliceByteCount]
+		} else {
+			n := copy(paddedSlice, buf[k:])
+			for i := n; i < len(paddedSlice); i++ {
+				paddedSlice[i] = 0
+			}
+			slice = paddedSlice
+		}
 		if justMissed {
-			crcSlice = window.update(crcSlice, data[j-1], slice[len(slice)-1])
+			crcSlice = window.update(crcSlice, buf[k-1], slice[len(slice)-1])
 		} else {
 			crcSlice = crc32.ChecksumIEEE(slice)
 		}
@@ -287,9 +666,9 @@ func fillShardInfos(sliceByteCount int, data []byte, checksumToLocation checksum
 		for foundLocation := range foundLocations {
 			integrityInfo := fileIntegrityInfos[fileIDIndices[foundLocation.fileID]]
 			shardInfo := &integrityInfo.shardInfos[foundLocation.start/sliceByteCount]
-			if shardInfo.data == nil {
+			if !shardInfo.source.found() {
 				*shardInfo = shardIntegrityInfo{
-					slice,
+					shardSource{path, j},
 					shardLocationSet{},
 				}
 			}
@@ -301,44 +680,364 @@ func fillShardInfos(sliceByteCount int, data []byte, checksumToLocation checksum
 		hits++
 	}
 
-	return hits, misses
+	return hits, misses, nil
 }
 
 func (d *Decoder) getFilePath(info decoderInputFileInfo) string {
 	// TODO: Make this configurable.
 	basePath := filepath.Dir(d.indexPath)
-	return filepath.Join(basePath, info.filename)
+	return filepath.Join(basePath, info.name())
+}
+
+// getRepairedFilePath returns the path that Repair writes the file
+// with the given info to.
+func (d *Decoder) getRepairedFilePath(info decoderInputFileInfo) string {
+	if d.outputDir == "" {
+		return d.getFilePath(info)
+	}
+	return filepath.Join(d.outputDir, info.name())
 }
 
-func (d *Decoder) fillFileIntegrityInfos(checksumToLocation checksumShardLocationMap, fileIntegrityInfos []fileIntegrityInfo, fileIDIndices map[fileID]int, i int, info decoderInputFileInfo) (int, int, int, error) {
+func (d *Decoder) fillFileIntegrityInfos(ctx context.Context, checksumToLocation checksumShardLocationMap, fileIntegrityInfos []fileIntegrityInfo, fileIDIndices map[fileID]int, i int, info decoderInputFileInfo) (int, int, int, error) {
 	path := d.getFilePath(info)
-	data, err := d.fileIO.ReadFile(path)
+	fileByteCount, err := d.fileIO.FileByteCount(path)
 	if os.IsNotExist(err) {
 		fileIntegrityInfos[i].missing = true
 		return 0, 0, 0, nil
 	} else if err != nil {
-		return len(data), 0, 0, err
+		return 0, 0, 0, err
+	}
+	intFileByteCount, err := fileByteCountToInt(fileByteCount)
+	if err != nil {
+		return 0, 0, 0, err
 	}
 
-	hits, misses := fillShardInfos(d.sliceByteCount, data, checksumToLocation, info.fileID, fileIntegrityInfos, fileIDIndices)
+	h := newFileHasher()
+	r := io.TeeReader(&progressReader{ctx: ctx, r: io.NewSectionReader(fileReaderAt{d.fileIO, path}, 0, fileByteCount)}, h)
+	hits, misses, err := fillShardInfos(d.sliceByteCount, r, d.scanBufferByteCount(), checksumToLocation, info.fileID, path, fileIntegrityInfos, fileIDIndices, d.scanProgressFunc(path, intFileByteCount))
+	if err != nil {
+		return h.byteCount, hits, misses, err
+	}
 
-	hashMismatch := sixteenKHash(data) != info.sixteenKHash || md5.Sum(data) != info.hash
+	byteCount := h.byteCount
+	hash, sixteenKHash := h.sums()
+	hashMismatch := sixteenKHash != info.sixteenKHash || hash != info.hash
 	fileIntegrityInfos[i].hashMismatch = hashMismatch
 	if hashMismatch {
 		d.delegate.OnDetectDataFileHashMismatch(info.fileID, path)
 	}
 
-	hasWrongByteCount := len(data) != info.byteCount
+	hasWrongByteCount := byteCount != info.byteCount
 	fileIntegrityInfos[i].hasWrongByteCount = hasWrongByteCount
 	if hasWrongByteCount {
 		d.delegate.OnDetectDataFileWrongByteCount(info.fileID, path)
 	}
 
-	return len(data), hits, misses, nil
+	return byteCount, hits, misses, nil
+}
+
+// checkNonRecoveryFile hashes the file in the non-recovery set with
+// the given info, and returns its byte count and status.
+func (d *Decoder) checkNonRecoveryFile(ctx context.Context, info decoderInputFileInfo) (int, FileStatus, error) {
+	path := d.getFilePath(info)
+	fileByteCount, err := d.fileIO.FileByteCount(path)
+	if os.IsNotExist(err) {
+		return 0, FileMissing, nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	intFileByteCount, err := fileByteCountToInt(fileByteCount)
+	if err != nil {
+		return 0, "", err
+	}
+
+	h := newFileHasher()
+	r := &progressReader{
+		ctx: ctx,
+		r:   io.NewSectionReader(fileReaderAt{d.fileIO, path}, 0, fileByteCount),
+		onRead: func(byteCount int) {
+			d.delegate.OnDataFileScanProgress(path, byteCount, intFileByteCount, 0, 0)
+		},
+	}
+	_, err = io.CopyBuffer(h, r, make([]byte, d.scanBufferByteCount()))
+	if err != nil {
+		return h.byteCount, "", err
+	}
+
+	status := FileOK
+	hash, sixteenKHash := h.sums()
+	if sixteenKHash != info.sixteenKHash || hash != info.hash {
+		d.delegate.OnDetectDataFileHashMismatch(info.fileID, path)
+		status = FileDamaged
+	}
+	if h.byteCount != info.byteCount {
+		d.delegate.OnDetectDataFileWrongByteCount(info.fileID, path)
+		status = FileWrongByteCount
+	}
+	return h.byteCount, status, nil
+}
+
+// UnrepairableFilesError is returned by Verify and Repair if any
+// files in the non-recovery set, which are only checked against
+// their hashes, are missing or damaged. Empty files are excluded,
+// since Repair can always recreate them.
+type UnrepairableFilesError struct {
+	Paths []string
+}
+
+func (e UnrepairableFilesError) Error() string {
+	return fmt.Sprintf("%d non-recovery file(s) missing or damaged, which can't be repaired: %v", len(e.Paths), e.Paths)
+}
+
+// checkNonRecoveryFiles returns an UnrepairableFilesError if any of
+// the files in the non-recovery set aren't intact.
+func (d *Decoder) checkNonRecoveryFiles() error {
+	var paths []string
+	for i, info := range d.nonRecoverySet {
+		if info.byteCount > 0 && d.nonRecoveryStatuses[i] != FileOK {
+			paths = append(paths, d.getFilePath(info))
+		}
+	}
+	if len(paths) > 0 {
+		return UnrepairableFilesError{paths}
+	}
+	return nil
+}
+
+// emptyFilesNeedRepair returns whether any empty file in the
+// non-recovery set is missing or damaged.
+func (d *Decoder) emptyFilesNeedRepair() bool {
+	for i, info := range d.nonRecoverySet {
+		if info.byteCount == 0 && d.nonRecoveryStatuses[i] != FileOK {
+			return true
+		}
+	}
+	return false
+}
+
+// repairNonRecoveryFiles recreates the empty files in the
+// non-recovery set that are missing or damaged, appending their paths
+// to repairedPaths, and then returns checkNonRecoveryFiles() for the
+// rest.
+func (d *Decoder) repairNonRecoveryFiles(repairedPaths []string) ([]string, error) {
+	for i, info := range d.nonRecoverySet {
+		if info.byteCount > 0 || d.nonRecoveryStatuses[i] == FileOK {
+			continue
+		}
+
+		path := d.getRepairedFilePath(info)
+		err := d.fileIO.MkdirAll(filepath.Dir(path))
+		if err == nil {
+			err = d.fileIO.WriteFile(repairTempPath(path), nil)
+			if err != nil {
+				_ = d.fileIO.DeleteFile(repairTempPath(path))
+			}
+		}
+		if err == nil {
+			err = replaceFile(d.fileIO, repairTempPath(path), path, d.getFilePath(info), d.keepBackup)
+		}
+		d.delegate.OnDataFileWrite(i+1, len(d.nonRecoverySet), path, 0, err)
+		if err != nil {
+			return repairedPaths, err
+		}
+
+		d.nonRecoveryStatuses[i] = FileOK
+		repairedPaths = append(repairedPaths, path)
+	}
+
+	return repairedPaths, d.checkNonRecoveryFiles()
+}
+
+// findCandidateFiles returns the candidate files, with each candidate
+// directory replaced by the files directly in it.
+func (d *Decoder) findCandidateFiles() ([]string, error) {
+	var candidateFiles []string
+	for _, path := range d.candidatePaths {
+		isDir, err := d.fileIO.IsDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isDir {
+			candidateFiles = append(candidateFiles, path)
+			continue
+		}
+
+		prefix := path
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		matches, err := d.fileIO.FindWithPrefixAndSuffix(prefix, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			isDir, err := d.fileIO.IsDir(match)
+			if err != nil {
+				return nil, err
+			}
+			if !isDir {
+				candidateFiles = append(candidateFiles, match)
+			}
+		}
+	}
+	return candidateFiles, nil
+}
+
+// matchCandidateFile compares the candidate file at path as a whole
+// against the data files that aren't intact and have the same byte
+// count, and records the whole files it matches, along with their
+// slices. If it doesn't match any, e.g. if it's a truncated, extended,
+// or damaged copy, it's scanned for slices anywhere in it instead,
+// like an extra file. It returns the byte count of the candidate file
+// and the number of matching slices.
+func (d *Decoder) matchCandidateFile(ctx context.Context, path string, checksumToLocation checksumShardLocationMap, fileIntegrityInfos []fileIntegrityInfo, fileIDIndices map[fileID]int) (int, int, error) {
+	fileByteCount, err := d.fileIO.FileByteCount(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	byteCount, err := fileByteCountToInt(fileByteCount)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var targets []int
+	for i, info := range d.recoverySet {
+		integrityInfo := fileIntegrityInfos[i]
+		if info.byteCount == byteCount && integrityInfo.foundPath == "" && !integrityInfo.ok(d.sliceByteCount) {
+			targets = append(targets, i)
+		}
+	}
+
+	var matches []int
+	if len(targets) > 0 {
+		h := newDataFileHasher(d.sliceByteCount)
+		r := &progressReader{ctx: ctx, r: io.NewSectionReader(fileReaderAt{d.fileIO, path}, 0, fileByteCount)}
+		_, err = io.CopyBuffer(h, r, make([]byte, d.scanBufferByteCount()))
+		if err != nil {
+			return byteCount, 0, err
+		}
+		_, fileDescriptionPacket, _ := h.finish(path)
+		for _, i := range targets {
+			info := d.recoverySet[i]
+			if fileDescriptionPacket.sixteenKHash == info.sixteenKHash && fileDescriptionPacket.hash == info.hash {
+				matches = append(matches, i)
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		_, hits, _, err := d.scanExtraFile(ctx, path, checksumToLocation, fileIntegrityInfos, fileIDIndices)
+		return byteCount, hits, err
+	}
+
+	hits := 0
+	for _, i := range matches {
+		info := d.recoverySet[i]
+		for j := range info.checksumPairs {
+			hits++
+			shardInfo := &fileIntegrityInfos[i].shardInfos[j]
+			if !shardInfo.source.found() {
+				// This is less than byteCount, so it
+				// fits in an int.
+				shardInfo.source = shardSource{path, j * d.sliceByteCount}
+			}
+		}
+
+		fileIntegrityInfos[i].foundPath = path
+		d.delegate.OnDetectDataFileElsewhere(info.fileID, d.getFilePath(info), path)
+	}
+
+	return byteCount, hits, nil
 }
 
-// LoadFileData loads existing file data into memory.
+// scanExtraFile looks for slices of the recovery set anywhere in the
+// extra file at path. It returns the byte count of the extra file and
+// the number of hits and misses.
+func (d *Decoder) scanExtraFile(ctx context.Context, path string, checksumToLocation checksumShardLocationMap, fileIntegrityInfos []fileIntegrityInfo, fileIDIndices map[fileID]int) (int, int, int, error) {
+	fileByteCount, err := d.fileIO.FileByteCount(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	byteCount, err := fileByteCountToInt(fileByteCount)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Extra files aren't in the recovery set, so the locations
+	// of the slices found in them use the zero file ID.
+	r := &progressReader{ctx: ctx, r: io.NewSectionReader(fileReaderAt{d.fileIO, path}, 0, fileByteCount)}
+	hits, misses, err := fillShardInfos(d.sliceByteCount, r, d.scanBufferByteCount(), checksumToLocation, fileID{}, path, fileIntegrityInfos, fileIDIndices, d.scanProgressFunc(path, byteCount))
+	return byteCount, hits, misses, err
+}
+
+// scanProgressFunc returns the progress function to pass to
+// fillShardInfos for the file at path with the given byte count.
+func (d *Decoder) scanProgressFunc(path string, byteCount int) func(int, int, int) {
+	return func(scannedByteCount, hits, misses int) {
+		d.delegate.OnDataFileScanProgress(path, scannedByteCount, byteCount, hits, misses)
+	}
+}
+
+// scanBufferByteCount returns the size of the window used to scan
+// through data files.
+func (d *Decoder) scanBufferByteCount() int {
+	bufByteCount := streamBufferByteCount
+	if bufByteCount > d.memoryLimit {
+		bufByteCount = d.memoryLimit
+	}
+	if bufByteCount < 2*d.sliceByteCount {
+		bufByteCount = 2 * d.sliceByteCount
+	}
+	return bufByteCount
+}
+
+// corruptByteRanges returns the maximal byte ranges of the given
+// file covered by slices that weren't found in place.
+func (d *Decoder) corruptByteRanges(info decoderInputFileInfo, integrityInfo fileIntegrityInfo) []ByteRange {
+	// The offsets are computed as int64s, but they're clamped
+	// to the byte count of the file, so they fit in an int.
+	var ranges []ByteRange
+	byteCount := int64(info.byteCount)
+	corruptStartByteOffset := int64(-1)
+	corruptEndByteOffset := int64(-1)
+	for j, shardInfo := range integrityInfo.shardInfos {
+		startByteOffset := int64(j) * int64(d.sliceByteCount)
+		endByteOffset := startByteOffset + int64(d.sliceByteCount)
+		if endByteOffset > byteCount {
+			endByteOffset = byteCount
+		}
+		if shardInfo.ok(shardLocation{info.fileID, int(startByteOffset)}) {
+			if corruptStartByteOffset != -1 {
+				ranges = append(ranges, ByteRange{int(corruptStartByteOffset), int(corruptEndByteOffset)})
+				corruptStartByteOffset = -1
+				corruptEndByteOffset = -1
+			}
+		} else {
+			if corruptStartByteOffset == -1 {
+				corruptStartByteOffset = startByteOffset
+			}
+			corruptEndByteOffset = endByteOffset
+		}
+	}
+
+	if corruptStartByteOffset != -1 {
+		ranges = append(ranges, ByteRange{int(corruptStartByteOffset), info.byteCount})
+	}
+	return ranges
+}
+
+// LoadFileData scans through the existing data files, and any
+// candidate and extra files, and records where the slices of the
+// recovery set can be found. It also checks the files in the
+// non-recovery set against their hashes.
 func (d *Decoder) LoadFileData() error {
+	return d.LoadFileDataContext(context.Background())
+}
+
+// LoadFileDataContext is like LoadFileData, but it stops and returns
+// ctx.Err() if ctx is done before all the files are scanned.
+func (d *Decoder) LoadFileDataContext(ctx context.Context) error {
 	checksumToLocation := makeChecksumShardLocationMap(d.sliceByteCount, d.recoverySet)
 
 	fileIntegrityInfos := make([]fileIntegrityInfo, len(d.recoverySet))
@@ -353,7 +1052,7 @@ func (d *Decoder) LoadFileData() error {
 
 	for i, info := range d.recoverySet {
 		path := d.getFilePath(info)
-		byteCount, hits, misses, err := d.fillFileIntegrityInfos(checksumToLocation, fileIntegrityInfos, fileIDIndices, i, info)
+		byteCount, hits, misses, err := d.fillFileIntegrityInfos(ctx, checksumToLocation, fileIntegrityInfos, fileIDIndices, i, info)
 		d.delegate.OnDataFileLoad(i+1, len(d.recoverySet), path, byteCount, hits, misses, err)
 		if err != nil {
 			return err
@@ -373,41 +1072,53 @@ func (d *Decoder) LoadFileData() error {
 	}
 
 	for i, info := range d.recoverySet {
-		integrityInfo := fileIntegrityInfos[i]
-		corruptStartByteOffset := -1
-		corruptEndByteOffset := -1
-		for j, shardInfo := range integrityInfo.shardInfos {
-			startByteOffset := j * d.sliceByteCount
-			endByteOffset := startByteOffset + d.sliceByteCount
-			if endByteOffset > info.byteCount {
-				endByteOffset = info.byteCount
-			}
-			if shardInfo.ok(shardLocation{info.fileID, startByteOffset}) {
-				if corruptStartByteOffset != -1 {
-					d.delegate.OnDetectCorruptDataChunk(info.fileID, d.getFilePath(info), corruptStartByteOffset, corruptEndByteOffset)
-					corruptStartByteOffset = -1
-					corruptEndByteOffset = -1
-				}
-			} else {
-				if corruptStartByteOffset == -1 {
-					corruptStartByteOffset = startByteOffset
-				}
-				corruptEndByteOffset = endByteOffset
-			}
+		for _, r := range d.corruptByteRanges(info, fileIntegrityInfos[i]) {
+			d.delegate.OnDetectCorruptDataChunk(info.fileID, d.getFilePath(info), r.Start, r.End)
+		}
+	}
+
+	candidateFiles, err := d.findCandidateFiles()
+	if err != nil {
+		return err
+	}
+
+	for i, path := range candidateFiles {
+		byteCount, hits, err := d.matchCandidateFile(ctx, path, checksumToLocation, fileIntegrityInfos, fileIDIndices)
+		d.delegate.OnCandidateFileLoad(i+1, len(candidateFiles), path, byteCount, hits, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, path := range d.extraPaths {
+		byteCount, hits, misses, err := d.scanExtraFile(ctx, path, checksumToLocation, fileIntegrityInfos, fileIDIndices)
+		d.delegate.OnExtraFileLoad(i+1, len(d.extraPaths), path, byteCount, hits, misses, err)
+		if err != nil {
+			return err
 		}
+	}
 
-		if corruptStartByteOffset != -1 {
-			d.delegate.OnDetectCorruptDataChunk(info.fileID, d.getFilePath(info), corruptStartByteOffset, info.byteCount)
+	nonRecoveryStatuses := make([]FileStatus, len(d.nonRecoverySet))
+	for i, info := range d.nonRecoverySet {
+		path := d.getFilePath(info)
+		byteCount, status, err := d.checkNonRecoveryFile(ctx, info)
+		d.delegate.OnNonRecoveryFileLoad(i+1, len(d.nonRecoverySet), path, byteCount, status, err)
+		if err != nil {
+			return err
 		}
+		nonRecoveryStatuses[i] = status
 	}
 
 	d.checksumToLocation = checksumToLocation
 	d.fileIntegrityInfos = fileIntegrityInfos
+	d.nonRecoveryStatuses = nonRecoveryStatuses
 	return nil
 }
 
 type recoveryDelegate struct {
 	d DecoderDelegate
+	// Set to true if any corrupt data is skipped.
+	corrupt *bool
 }
 
 func (recoveryDelegate) OnCreatorPacketLoad(clientID string) {}
@@ -419,6 +1130,10 @@ func (recoveryDelegate) OnFileDescriptionPacketLoad(fileID [16]byte, filename st
 
 func (recoveryDelegate) OnIFSCPacketLoad(fileID [16]byte) {}
 
+func (recoveryDelegate) OnUnicodeFilenamePacketLoad(fileID [16]byte, filename string) {}
+
+func (recoveryDelegate) OnCommentPacketLoad(comment string) {}
+
 func (r recoveryDelegate) OnRecoveryPacketLoad(exponent uint16, byteCount int) {
 	r.d.OnRecoveryPacketLoad(exponent, byteCount)
 }
@@ -429,9 +1144,30 @@ func (r recoveryDelegate) OnUnknownPacketLoad(packetType [16]byte, byteCount int
 
 func (recoveryDelegate) OnOtherPacketSkip(setID [16]byte, packetType [16]byte, byteCount int) {}
 
+func (r recoveryDelegate) OnInvalidMainPacketSkip(setID, computedSetID [16]byte) {
+	r.d.OnInvalidMainPacketSkip(setID, computedSetID)
+}
+
+func (recoveryDelegate) OnDuplicateMainPacketLoad() {}
+
+func (r recoveryDelegate) OnCorruptDataSkip(startByteOffset, endByteOffset int) {
+	*r.corrupt = true
+	r.d.OnCorruptDataSkip(startByteOffset, endByteOffset)
+}
+
+func (r recoveryDelegate) OnMalformedPacketSkip(packetType [16]byte, byteCount int, err error) {
+	*r.corrupt = true
+	r.d.OnMalformedPacketSkip(packetType, byteCount, err)
+}
+
 func (recoveryDelegate) OnDataFileLoad(i, n int, path string, byteCount, hits, misses int, err error) {
 }
 
+func (recoveryDelegate) OnDataFileScanProgress(path string, scannedByteCount, byteCount, hits, misses int) {
+}
+
+func (recoveryDelegate) OnMatrixProgress(rowsApplied, rowCount int) {}
+
 func (recoveryDelegate) OnParityFileLoad(i int, path string, err error) {}
 
 func (recoveryDelegate) OnDetectCorruptDataChunk(fileID [16]byte, path string, startByteOffset, endByteOffset int) {
@@ -441,29 +1177,66 @@ func (recoveryDelegate) OnDetectDataFileHashMismatch(fileID [16]byte, path strin
 
 func (recoveryDelegate) OnDetectDataFileWrongByteCount(fileID [16]byte, path string) {}
 
+func (recoveryDelegate) OnCandidateFileLoad(i, n int, path string, byteCount, hits int, err error) {
+}
+
+func (recoveryDelegate) OnDetectDataFileElsewhere(fileID [16]byte, path, foundPath string) {}
+
+func (recoveryDelegate) OnNonRecoveryFileLoad(i, n int, path string, byteCount int, status FileStatus, err error) {
+}
+
+func (recoveryDelegate) OnExtraFileLoad(i, n int, path string, byteCount, hits, misses int, err error) {
+}
+
 func (recoveryDelegate) OnDataFileWrite(i, n int, path string, byteCount int, err error) {}
 
-// LoadParityData searches for parity volumes and loads them into
-// memory.
+func (recoveryDelegate) OnIndexFileWrite(path string, byteCount int, err error) {}
+
+func (recoveryDelegate) OnRecoveryFileWrite(start, count, total int, path string, dataByteCount, byteCount int, err error) {
+}
+
+// LoadParityData searches for parity volumes and records where their
+// recovery data can be found.
 func (d *Decoder) LoadParityData() error {
-	ext := path.Ext(d.indexPath)
-	base := d.indexPath[:len(d.indexPath)-len(ext)]
-	matches, err := d.fileIO.FindWithPrefixAndSuffix(base+".", ext)
+	return d.LoadParityDataContext(context.Background())
+}
+
+// findVolumePaths returns the paths of the recovery volumes, which
+// are looked for again each time unless they were given.
+func (d *Decoder) findVolumePaths() ([]string, error) {
+	if d.volumePaths != nil {
+		return d.volumePaths, nil
+	}
+	return findVolumePaths(d.fileIO, d.indexPath)
+}
+
+// LoadParityDataContext is like LoadParityData, but it stops and
+// returns ctx.Err() if ctx is done before all the parity volumes are
+// loaded.
+func (d *Decoder) LoadParityDataContext(ctx context.Context) error {
+	matches, err := d.findVolumePaths()
 	if err != nil {
 		return err
 	}
 
-	var parityFiles []file
+	var parityShards []shardSource
+	damagedParityFiles := make(map[string]bool)
 	for i, match := range matches {
-		parityFile, err := func() (*file, error) {
-			volumeBytes, err := d.fileIO.ReadFile(match)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		corrupt := false
+		recoveryDataLocations, err := func() (map[exponent]recoveryDataLocation, error) {
+			byteCount, err := d.fileIO.FileByteCount(match)
 			if err != nil {
 				return nil, err
 			}
 
 			// Ignore all the other packet types other
 			// than recovery packets.
-			_, parityFile, err := readFile(recoveryDelegate{d.delegate}, &d.setID, volumeBytes)
+			recoveryDataLocations := make(map[exponent]recoveryDataLocation)
+			_, parityFile, err := readFileAt(recoveryDelegate{d.delegate, &corrupt}, &d.setID, fileReaderAt{d.fileIO, match}, byteCount, recoveryDataLocations)
 			if _, ok := err.(noPacketsFoundError); ok {
 				return nil, nil
 			} else if err != nil {
@@ -471,60 +1244,92 @@ func (d *Decoder) LoadParityData() error {
 				return nil, err
 			}
 
-			if d.sliceByteCount != parityFile.mainPacket.sliceByteCount {
-				return nil, errors.New("slice byte count mismatch")
-			}
+			// The main packet may have been lost to
+			// corruption, but the set ID still ties the
+			// recovery packets to the recovery set.
+			if parityFile.mainPacket != nil {
+				if d.sliceByteCount != parityFile.mainPacket.sliceByteCount {
+					return nil, errors.New("slice byte count mismatch")
+				}
+
+				if !reflect.DeepEqual(decoderInputFileInfoIDs(d.recoverySet), parityFile.mainPacket.recoverySet) {
+					return nil, errors.New("recovery set mismatch")
+				}
 
-			if !reflect.DeepEqual(decoderInputFileInfoIDs(d.recoverySet), parityFile.mainPacket.recoverySet) {
-				return nil, errors.New("recovery set mismatch")
+				if !reflect.DeepEqual(decoderInputFileInfoIDs(d.nonRecoverySet), parityFile.mainPacket.nonRecoverySet) {
+					return nil, errors.New("non-recovery set mismatch")
+				}
 			}
 
-			if !reflect.DeepEqual(decoderInputFileInfoIDs(d.nonRecoverySet), parityFile.mainPacket.nonRecoverySet) {
-				return nil, errors.New("non-recovery set mismatch")
+			for _, location := range recoveryDataLocations {
+				if location.byteCount != d.sliceByteCount {
+					return nil, errors.New("recovery data byte count mismatch")
+				}
 			}
 
-			return &parityFile, nil
+			return recoveryDataLocations, nil
 		}()
 		d.delegate.OnParityFileLoad(i+1, match, err)
 		if err != nil {
 			return err
 		}
-		if parityFile == nil {
-			continue
-		}
 
-		parityFiles = append(parityFiles, *parityFile)
-	}
+		if corrupt {
+			damagedParityFiles[filepath.Base(match)] = true
+		}
 
-	var parityShards [][]byte
-	for _, file := range parityFiles {
-		for exponent, packet := range file.recoveryPackets {
+		for exponent, location := range recoveryDataLocations {
 			if int(exponent) >= len(parityShards) {
-				parityShards = append(parityShards, make([][]byte, int(exponent+1)-len(parityShards))...)
+				parityShards = append(parityShards, make([]shardSource, int(exponent+1)-len(parityShards))...)
 			}
-			parityShards[exponent] = packet.data
+			parityShards[exponent] = shardSource{match, location.start}
 		}
 	}
 
 	d.parityShards = parityShards
+	d.damagedParityFiles = damagedParityFiles
 	return nil
 }
 
-func (d *Decoder) newCoderAndShards() (rsec16.Coder, [][]byte, error) {
+// dataShardSources returns the sources of the data shards of all the
+// files in the recovery set, in order.
+func (d *Decoder) dataShardSources() ([]shardSource, error) {
 	if len(d.fileIntegrityInfos) == 0 {
-		return rsec16.Coder{}, nil, errors.New("no file integrity info")
-	}
-
-	if len(d.parityShards) == 0 {
-		return rsec16.Coder{}, nil, errors.New("no parity shards")
+		return nil, errors.New("no file integrity info")
 	}
 
-	var dataShards [][]byte
+	var dataShards []shardSource
 	for _, info := range d.fileIntegrityInfos {
 		for _, shardInfo := range info.shardInfos {
-			dataShards = append(dataShards, shardInfo.data)
+			dataShards = append(dataShards, shardInfo.source)
+		}
+	}
+	return dataShards, nil
+}
+
+// allShardsFound returns whether every one of the given shards was
+// found.
+func allShardsFound(sources []shardSource) bool {
+	for _, source := range sources {
+		if !source.found() {
+			return false
 		}
 	}
+	return true
+}
+
+func (d *Decoder) newCoderAndShards() (rsec16.Coder, []shardSource, error) {
+	dataShards, err := d.dataShardSources()
+	if err != nil {
+		return rsec16.Coder{}, nil, err
+	}
+
+	// Nothing can be reconstructed without any parity shards,
+	// e.g. for an index-only set.
+	if len(d.parityShards) == 0 {
+		return rsec16.Coder{}, nil, rsec16.NotEnoughParityShardsError{}
+	}
+
 	coder, err := rsec16.NewCoderPAR2Vandermonde(len(dataShards), len(d.parityShards), d.numGoroutines)
 	if err != nil {
 		return rsec16.Coder{}, nil, err
@@ -535,27 +1340,191 @@ func (d *Decoder) newCoderAndShards() (rsec16.Coder, [][]byte, error) {
 
 // Verify checks whether repair is needed. It returns a bool for
 // needsRepair and an error; if error is non-nil, needsRepair may
-// or may not be filled in.
+// or may not be filled in. needsRepair covers the recovery set and
+// the empty files in the non-recovery set; if any other files in the
+// non-recovery set are missing or damaged, an UnrepairableFilesError
+// is returned, with needsRepair filled in.
+// Parity data is needed only if some data slices weren't found
+// anywhere and need to be reconstructed, in which case
+// rsec16.NotEnoughParityShardsError is returned if there isn't
+// enough of it, e.g. for an index-only set.
 func (d *Decoder) Verify() (needsRepair bool, err error) {
-	coder, dataShards, err := d.newCoderAndShards()
-	if err != nil {
+	return d.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, but it returns ctx.Err() if ctx is
+// done.
+func (d *Decoder) VerifyContext(ctx context.Context) (needsRepair bool, err error) {
+	if err := ctx.Err(); err != nil {
 		return false, err
 	}
 
-	needsRepair = false
-	for _, dataShard := range dataShards {
-		if dataShard == nil {
-			needsRepair = true
-			break
+	if len(d.fileIntegrityInfos) == 0 {
+		return false, errors.New("no file integrity info")
+	}
+
+	// Parity data is needed only if some data slices need to be
+	// reconstructed, so an index-only set can still be verified,
+	// and even repaired if its files were only moved.
+	needsRepair = d.recoverySetNeedsRepair()
+	if needsRepair {
+		dataShards, err := d.dataShardSources()
+		if err != nil {
+			return true, err
+		}
+
+		if !allShardsFound(dataShards) {
+			coder, _, err := d.newCoderAndShards()
+			if err != nil {
+				return true, err
+			}
+
+			err = coder.CanReconstructDataFrom(foundShards(dataShards), foundShards(d.parityShards))
+			if err != nil {
+				return true, err
+			}
 		}
 	}
 
-	err = coder.CanReconstructData(dataShards, d.parityShards)
+	return needsRepair || d.emptyFilesNeedRepair(), d.checkNonRecoveryFiles()
+}
+
+// recoverySetNeedsRepair returns whether any file in the recovery
+// set is missing or damaged.
+func (d *Decoder) recoverySetNeedsRepair() bool {
+	for _, info := range d.fileIntegrityInfos {
+		if !info.ok(d.sliceByteCount) {
+			return true
+		}
+	}
+	return false
+}
+
+// repairPieceByteCount returns the byte count of the pieces of each
+// slice to process per pass during repair, given the number of
+// slice piece buffers needed.
+func (d *Decoder) repairPieceByteCount(bufferCount int) (int, error) {
+	pieceByteCount := d.memoryLimit / bufferCount
+	pieceByteCount -= pieceByteCount % 4
+	if pieceByteCount == 0 {
+		return 0, errors.New("memory limit too small")
+	}
+	if pieceByteCount > d.sliceByteCount {
+		pieceByteCount = d.sliceByteCount
+	}
+	return pieceByteCount, nil
+}
+
+func truncateByteSlices(slices [][]byte, byteCount int) [][]byte {
+	truncated := make([][]byte, len(slices))
+	for i, slice := range slices {
+		truncated[i] = slice[:byteCount]
+	}
+	return truncated
+}
+
+func selectByteSlices(slices [][]byte, indices []int) [][]byte {
+	selected := make([][]byte, len(indices))
+	for i, j := range indices {
+		selected[i] = slices[j]
+	}
+	return selected
+}
+
+// repairTempPath returns the path that the repaired data for the file
+// at path is written to before it's checked and moved into place.
+func repairTempPath(path string) string {
+	return path + ".gopar.tmp"
+}
+
+// backUpFile moves the file at path, if any, to the first path of the
+// form path.1, path.2, and so on that isn't taken.
+func backUpFile(fileIO fileIO, path string) error {
+	_, err := fileIO.FileByteCount(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i := 1; ; i++ {
+		backupPath := path + "." + strconv.Itoa(i)
+		_, err := fileIO.FileByteCount(backupPath)
+		if os.IsNotExist(err) {
+			return fileIO.MoveFile(path, backupPath)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// replaceFile moves the file at tempPath to path, after giving it the
+// mode and modification time of the file at metadataPath, if any, and
+// syncing it, so that path never refers to a partially written file. The
+// directory is then synced, so that the move isn't lost in a crash.
+// If keepBackup is true, the file at path is backed up instead of
+// being replaced. If anything fails, the file at tempPath is removed.
+func replaceFile(fileIO fileIO, tempPath, path, metadataPath string, keepBackup bool) error {
+	err := func() error {
+		err := fileIO.CopyFileMetadata(metadataPath, tempPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		err = fileIO.SyncFile(tempPath)
+		if err != nil {
+			return err
+		}
+
+		if keepBackup {
+			err = backUpFile(fileIO, path)
+			if err != nil {
+				return err
+			}
+		}
+
+		return fileIO.MoveFile(tempPath, path)
+	}()
 	if err != nil {
-		return false, err
+		// The original error is more useful than any
+		// error from removing the file.
+		_ = fileIO.DeleteFile(tempPath)
+		return err
 	}
 
-	return needsRepair, nil
+	return fileIO.SyncDir(filepath.Dir(path))
+}
+
+// isDataFilePath returns whether path refers to the file where any
+// file of the recovery set or the non-recovery set is expected.
+func (d *Decoder) isDataFilePath(path string) (bool, error) {
+	for _, info := range append(append([]decoderInputFileInfo{}, d.recoverySet...), d.nonRecoverySet...) {
+		sameFile, err := d.fileIO.SameFile(path, d.getFilePath(info))
+		if err != nil {
+			return false, err
+		}
+		if sameFile {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// canMoveFoundFile returns whether the data file with the given info
+// was found elsewhere, in a candidate file that can be moved into
+// place, i.e. one that isn't a data file itself, nor a copy of
+// another data file that isn't intact. foundPathCounts holds the
+// number of such data files found at each path.
+func (d *Decoder) canMoveFoundFile(info fileIntegrityInfo, foundPathCounts map[string]int) (bool, error) {
+	if info.foundPath == "" || foundPathCounts[info.foundPath] > 1 {
+		return false, nil
+	}
+
+	isDataFilePath, err := d.isDataFilePath(info.foundPath)
+	if err != nil {
+		return false, err
+	}
+	return !isDataFilePath, nil
 }
 
 // Repair tries to repair any missing or corrupted data, using the
@@ -564,73 +1533,294 @@ func (d *Decoder) Verify() (needsRepair bool, err error) {
 // NewDecoder) in no particular order, which is present even if an
 // error is returned. If checkParity is true, extra checking is done
 // of the reconstructed parity data.
+//
+// The data of each file to be repaired is written a piece of each
+// slice at a time to a temporary file next to it, after creating any
+// missing directories for it, and the temporary file is moved into
+// place only once its hash has been checked. Data files that were
+// found elsewhere among the candidate files are moved into place
+// instead, unless the candidate file is also a data file or a copy of
+// another data file. Missing or damaged recovery files aren't
+// repaired; use RegenerateParityFiles afterwards for that. Files in
+// the non-recovery set can't be repaired, except for empty ones,
+// which are recreated, so if any of them are missing or damaged, an
+// UnrepairableFilesError is returned after the recovery set is
+// repaired.
+//
+// If an output directory was given in the DecoderOptions, the
+// repaired files are written there instead, and nothing is moved.
 func (d *Decoder) Repair(checkParity bool) ([]string, error) {
-	coder, dataShards, err := d.newCoderAndShards()
-	if err != nil {
-		return nil, err
+	return d.RepairContext(context.Background(), checkParity)
+}
+
+// RepairContext is like Repair, but it stops and returns ctx.Err() if
+// ctx is done before the repair is finished. In that case, any data
+// files not yet moved into place are left untouched, and their
+// temporary files are deleted.
+func (d *Decoder) RepairContext(ctx context.Context, checkParity bool) (repairedPaths []string, err error) {
+	// As with Verify, parity data isn't needed if nothing needs
+	// repair, and there's none to check.
+	if len(d.parityShards) == 0 && len(d.fileIntegrityInfos) > 0 && !d.recoverySetNeedsRepair() {
+		return d.repairNonRecoveryFiles(nil)
 	}
 
-	err = coder.ReconstructData(dataShards, d.parityShards)
+	dataShards, err := d.dataShardSources()
 	if err != nil {
 		return nil, err
 	}
 
+	var parityToCheck []int
 	if checkParity {
-		computedParityShards := coder.GenerateParity(dataShards)
-		for i, shard := range d.parityShards {
-			if len(shard) == 0 {
-				continue
+		for i, parityShard := range d.parityShards {
+			if parityShard.found() {
+				parityToCheck = append(parityToCheck, i)
 			}
-
-			eq := reflect.DeepEqual(computedParityShards[i], shard)
-			if !eq {
-				return nil, errors.New("repair failed")
+		}
+	}
+	// There's nothing to check without any parity slices.
+	checkParity = len(parityToCheck) > 0
+
+	// If every data slice was found, e.g. if the damaged files
+	// were only moved, nothing needs to be reconstructed, so the
+	// coder is needed only to check the parity data.
+	var coder rsec16.Coder
+	var reconstructor rsec16.Reconstructor
+	var availableDataShards, missingDataShards, usedParityShards []int
+	if allShardsFound(dataShards) {
+		for j := range dataShards {
+			availableDataShards = append(availableDataShards, j)
+		}
+		if checkParity {
+			coder, _, err = d.newCoderAndShards()
+			if err != nil {
+				return nil, err
 			}
 		}
+	} else {
+		coder, _, err = d.newCoderAndShards()
+		if err != nil {
+			return nil, err
+		}
+
+		reconstructor, err = coder.NewReconstructor(foundShards(dataShards), foundShards(d.parityShards))
+		if err != nil {
+			return nil, err
+		}
+		availableDataShards = reconstructor.AvailableDataShards()
+		missingDataShards = reconstructor.MissingDataShards()
+		usedParityShards = reconstructor.UsedParityShards()
 	}
 
-	wasOK := make([]bool, len(d.fileIntegrityInfos))
+	// Buffers are needed for every data slice, the used parity
+	// slices, and, if checking parity, the computed parity
+	// slices plus one for the parity slice being compared.
+	bufferCount := len(dataShards) + len(usedParityShards)
+	if checkParity {
+		bufferCount += len(d.parityShards) + 1
+	}
+	pieceByteCount, err := d.repairPieceByteCount(bufferCount)
+	if err != nil {
+		return nil, err
+	}
+
+	foundPathCounts := make(map[string]int)
+	for _, info := range d.fileIntegrityInfos {
+		if !info.ok(d.sliceByteCount) && info.foundPath != "" {
+			foundPathCounts[info.foundPath]++
+		}
+	}
 
+	var filesToRepair, filesToMove []int
+	shardStarts := make([]int, len(d.fileIntegrityInfos))
 	k := 0
 	for i, info := range d.fileIntegrityInfos {
-		wasOK[i] = info.ok(d.sliceByteCount)
-		shardCount := len(info.shardInfos)
-		for j, shard := range dataShards[k : k+shardCount] {
-			info.shardInfos[j] = shardIntegrityInfo{
-				data:      shard,
-				locations: d.checksumToLocation.get(crc32.ChecksumIEEE(shard), shard),
+		if !info.ok(d.sliceByteCount) {
+			// Found files are copied instead of moved when
+			// writing elsewhere, to leave them alone.
+			canMove := false
+			if d.outputDir == "" {
+				canMove, err = d.canMoveFoundFile(info, foundPathCounts)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if canMove {
+				filesToMove = append(filesToMove, i)
+			} else {
+				filesToRepair = append(filesToRepair, i)
 			}
 		}
-		k += shardCount
-		d.fileIntegrityInfos[i] = info
+		shardStarts[i] = k
+		k += len(info.shardInfos)
 	}
 
-	var repairedPaths []string
+	// Don't leave any temporary files behind if the repair
+	// fails; the ones already moved into place are gone anyway.
+	defer func() {
+		if err != nil {
+			for _, i := range filesToRepair {
+				_ = d.fileIO.DeleteFile(repairTempPath(d.getRepairedFilePath(d.recoverySet[i])))
+			}
+		}
+	}()
 
-	for i, decoderInputFileInfo := range d.recoverySet {
-		fileIntegrityInfo := d.fileIntegrityInfos[i]
-		if wasOK[i] {
-			continue
+	for _, i := range filesToRepair {
+		path := d.getRepairedFilePath(d.recoverySet[i])
+		err := d.fileIO.MkdirAll(filepath.Dir(path))
+		if err == nil {
+			err = d.fileIO.WriteFile(repairTempPath(path), nil)
+		}
+		if err != nil {
+			d.delegate.OnDataFileWrite(i+1, len(d.recoverySet), path, 0, err)
+			return repairedPaths, err
 		}
+	}
 
-		buf := bytes.NewBuffer(nil)
-		for _, shardInfo := range fileIntegrityInfo.shardInfos {
-			err := binary.Write(buf, binary.LittleEndian, shardInfo.data)
+	// The data, parity, and temporary files are gone through a
+	// piece of each slice at a time, so keep them open until
+	// the temporary files are checked, which must be done before
+	// they're moved into place.
+	fileIO, closeFiles := keepFilesOpen(d.fileIO)
+	defer func() {
+		_ = closeFiles()
+	}()
+
+	dataBuffers := makeByteSlices(len(dataShards), pieceByteCount)
+	usedParityBuffers := makeByteSlices(len(usedParityShards), pieceByteCount)
+	var computedParityBuffers [][]byte
+	var parityBuffer []byte
+	if checkParity {
+		computedParityBuffers = makeByteSlices(len(d.parityShards), pieceByteCount)
+		parityBuffer = make([]byte, pieceByteCount)
+	}
+
+	// Nothing needs to be read if there's nothing to write or
+	// check.
+	passByteCount := d.sliceByteCount
+	if len(filesToRepair) == 0 && !checkParity {
+		passByteCount = 0
+	}
+
+	passCount := (passByteCount + pieceByteCount - 1) / pieceByteCount
+	rowsPerPass := len(missingDataShards)
+	if checkParity {
+		rowsPerPass += len(d.parityShards)
+	}
+	progress := &matrixProgress{
+		rowCount:   passCount * rowsPerPass,
+		onProgress: d.delegate.OnMatrixProgress,
+	}
+
+	for pieceStart := 0; pieceStart < passByteCount; pieceStart += pieceByteCount {
+		if err := ctx.Err(); err != nil {
+			return repairedPaths, err
+		}
+
+		byteCount := pieceByteCount
+		if pieceStart+byteCount > d.sliceByteCount {
+			byteCount = d.sliceByteCount - pieceStart
+		}
+
+		dataPieces := truncateByteSlices(dataBuffers, byteCount)
+		for _, j := range availableDataShards {
+			err := dataShards[j].read(fileIO, dataPieces[j], pieceStart)
+			if err != nil {
+				return repairedPaths, err
+			}
+		}
+
+		usedParityPieces := truncateByteSlices(usedParityBuffers, byteCount)
+		for j, exponent := range usedParityShards {
+			err := d.parityShards[exponent].read(fileIO, usedParityPieces[j], pieceStart)
+			if err != nil {
+				return repairedPaths, err
+			}
+		}
+
+		if len(missingDataShards) > 0 {
+			availableDataPieces := selectByteSlices(dataPieces, availableDataShards)
+			missingDataPieces := selectByteSlices(dataPieces, missingDataShards)
+			err := reconstructor.ReconstructContext(ctx, availableDataPieces, usedParityPieces, missingDataPieces, progress.progressFunc())
+			if err != nil {
+				return repairedPaths, err
+			}
+		}
+
+		if checkParity {
+			computedParityPieces := truncateByteSlices(computedParityBuffers, byteCount)
+			for _, piece := range computedParityPieces {
+				for j := range piece {
+					piece[j] = 0
+				}
+			}
+			err := coder.AccumulateParityContext(ctx, 0, dataPieces, computedParityPieces, progress.progressFunc())
 			if err != nil {
 				return repairedPaths, err
 			}
+			parityPiece := parityBuffer[:byteCount]
+			for _, exponent := range parityToCheck {
+				err := d.parityShards[exponent].read(fileIO, parityPiece, pieceStart)
+				if err != nil {
+					return repairedPaths, err
+				}
+				if !bytes.Equal(computedParityPieces[exponent], parityPiece) {
+					return repairedPaths, errors.New("repair failed")
+				}
+			}
+		}
+
+		for _, i := range filesToRepair {
+			info := d.recoverySet[i]
+			path := d.getRepairedFilePath(info)
+			for j := range d.fileIntegrityInfos[i].shardInfos {
+				offset := int64(j)*int64(d.sliceByteCount) + int64(pieceStart)
+				if offset >= int64(info.byteCount) {
+					continue
+				}
+				piece := dataPieces[shardStarts[i]+j]
+				if offset+int64(len(piece)) > int64(info.byteCount) {
+					piece = piece[:int64(info.byteCount)-offset]
+				}
+				err := fileIO.WriteFileAt(repairTempPath(path), piece, offset)
+				if err != nil {
+					d.delegate.OnDataFileWrite(i+1, len(d.recoverySet), path, 0, err)
+					return repairedPaths, err
+				}
+			}
 		}
+	}
+
+	for _, i := range filesToRepair {
+		info := d.recoverySet[i]
+		tempPath := repairTempPath(d.getRepairedFilePath(info))
 
-		data := buf.Bytes()[:decoderInputFileInfo.byteCount]
-		if sixteenKHash(data) != decoderInputFileInfo.sixteenKHash {
+		h := newFileHasher()
+		_, err := io.Copy(h, &progressReader{ctx: ctx, r: io.NewSectionReader(fileReaderAt{fileIO, tempPath}, 0, int64(info.byteCount))})
+		if err != nil {
+			return repairedPaths, err
+		}
+		hash, sixteenKHash := h.sums()
+		if sixteenKHash != info.sixteenKHash {
 			return repairedPaths, errors.New("hash mismatch (16k) in reconstructed data")
-		} else if md5.Sum(data) != decoderInputFileInfo.hash {
+		} else if hash != info.hash {
 			return repairedPaths, errors.New("hash mismatch in reconstructed data")
 		}
+	}
+
+	err = closeFiles()
+	if err != nil {
+		return repairedPaths, err
+	}
+
+	for _, i := range filesToRepair {
+		info := d.recoverySet[i]
+		path := d.getRepairedFilePath(info)
+		tempPath := repairTempPath(path)
 
-		path := d.getFilePath(decoderInputFileInfo)
-		err = d.fileIO.WriteFile(path, data)
-		d.delegate.OnDataFileWrite(i+1, len(d.recoverySet), path, len(data), err)
+		// With an output directory, the metadata still comes
+		// from the original file.
+		err = replaceFile(d.fileIO, tempPath, path, d.getFilePath(info), d.keepBackup)
+		d.delegate.OnDataFileWrite(i+1, len(d.recoverySet), path, info.byteCount, err)
 		if err != nil {
 			return repairedPaths, err
 		}
@@ -638,14 +1828,414 @@ func (d *Decoder) Repair(checkParity bool) ([]string, error) {
 		repairedPaths = append(repairedPaths, path)
 	}
 
-	// TODO: Repair missing parity volumes, too, and then make
-	// sure d.Verify() passes.
+	for _, i := range filesToMove {
+		info := d.recoverySet[i]
+		path := d.getFilePath(info)
+		foundPath := d.fileIntegrityInfos[i].foundPath
+		err := d.fileIO.MkdirAll(filepath.Dir(path))
+		if err == nil && d.keepBackup {
+			err = backUpFile(d.fileIO, path)
+		}
+		if err == nil {
+			err = d.fileIO.MoveFile(foundPath, path)
+		}
+		// Sync both directories, so that the move isn't lost
+		// in a crash.
+		if err == nil {
+			err = d.fileIO.SyncDir(filepath.Dir(foundPath))
+		}
+		if err == nil {
+			err = d.fileIO.SyncDir(filepath.Dir(path))
+		}
+		d.delegate.OnDataFileWrite(i+1, len(d.recoverySet), path, info.byteCount, err)
+		if err != nil {
+			return repairedPaths, err
+		}
+
+		repairedPaths = append(repairedPaths, path)
+	}
+
+	// All the data files are now intact, so point each slice at
+	// its own file, or its repaired copy.
+	for i, info := range d.recoverySet {
+		path := d.getFilePath(info)
+		if !d.fileIntegrityInfos[i].ok(d.sliceByteCount) {
+			path = d.getRepairedFilePath(info)
+		}
+		d.fileIntegrityInfos[i].missing = false
+		d.fileIntegrityInfos[i].hashMismatch = false
+		d.fileIntegrityInfos[i].hasWrongByteCount = false
+		d.fileIntegrityInfos[i].foundPath = ""
+		for j, checksumPair := range info.checksumPairs {
+			// TODO: Handle overflow.
+			start := j * d.sliceByteCount
+			d.fileIntegrityInfos[i].shardInfos[j] = shardIntegrityInfo{
+				source:    shardSource{path, start},
+				locations: d.checksumToLocation[binary.LittleEndian.Uint32(checksumPair.CRC32[:])][checksumPair.MD5],
+			}
+		}
+	}
+
+	return d.repairNonRecoveryFiles(repairedPaths)
+}
+
+// buildIndexFile returns the set ID and the bytes of an index file
+// built from the critical packets that were loaded, which is exactly
+// the index file that Encoder.Write would have written for them.
+func (d *Decoder) buildIndexFile() (recoverySetID, []byte, error) {
+	mainPacket := mainPacket{
+		sliceByteCount: d.sliceByteCount,
+		recoverySet:    decoderInputFileInfoIDs(d.recoverySet),
+		nonRecoverySet: decoderInputFileInfoIDs(d.nonRecoverySet),
+	}
+	indexFile := file{
+		clientID:               d.clientID,
+		mainPacket:             &mainPacket,
+		fileDescriptionPackets: make(map[fileID]fileDescriptionPacket),
+		ifscPackets:            make(map[fileID]ifscPacket),
+		unicodeFilenames:       make(map[fileID]string),
+		comment:                d.comment,
+	}
+	for _, info := range append(append([]decoderInputFileInfo{}, d.recoverySet...), d.nonRecoverySet...) {
+		indexFile.fileDescriptionPackets[info.fileID] = fileDescriptionPacket{
+			hash:         info.hash,
+			sixteenKHash: info.sixteenKHash,
+			byteCount:    info.byteCount,
+			filename:     info.filename,
+		}
+		indexFile.ifscPackets[info.fileID] = ifscPacket{info.checksumPairs}
+		if info.unicodeFilename != "" {
+			indexFile.unicodeFilenames[info.fileID] = info.unicodeFilename
+		}
+	}
+
+	setID, indexBytes, err := writeFile(indexFile)
+	if err != nil {
+		return recoverySetID{}, nil, err
+	}
+
+	if setID != d.setID {
+		return recoverySetID{}, nil, errors.New("set ID mismatch")
+	}
+
+	return setID, indexBytes, nil
+}
+
+// WriteIndexFile writes out a fresh index file built from the critical
+// packets that were loaded, to the path where the index file of the
+// recovery set is expected. This is useful if the index file was
+// missing or damaged.
+func (d *Decoder) WriteIndexFile() error {
+	_, indexBytes, err := d.buildIndexFile()
+	if err != nil {
+		return err
+	}
+
+	err = d.fileIO.WriteFile(d.indexPath, indexBytes)
+	d.delegate.OnIndexFileWrite(d.indexPath, len(indexBytes), err)
+	return err
+}
+
+// inferParityShardCount returns the number of parity shards that the
+// recovery set was presumably created with, going by the exponent
+// ranges in the names of its recovery files and by the exponents of
+// the recovery data that was loaded.
+func (d *Decoder) inferParityShardCount() (int, error) {
+	parityShardCount := len(d.parityShards)
+
+	matches, err := d.findVolumePaths()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, match := range matches {
+		_, r, ok := parseRecoveryFilename(match)
+		if ok && r.start+r.count > parityShardCount {
+			parityShardCount = r.start + r.count
+		}
+	}
+
+	return parityShardCount, nil
+}
+
+// parseRecoveryFilename returns the part of the given recovery
+// filename before its exponent range, and the exponent range, with
+// the numbers in it in any width.
+func parseRecoveryFilename(filename string) (string, exponentRange, bool) {
+	m := volumeFileExponentRangeRegexp.FindStringSubmatchIndex(filename)
+	if m == nil {
+		return "", exponentRange{}, false
+	}
+	start, err := strconv.Atoi(filename[m[2]:m[3]])
+	if err != nil {
+		return "", exponentRange{}, false
+	}
+	count, err := strconv.Atoi(filename[m[4]:m[5]])
+	if err != nil {
+		return "", exponentRange{}, false
+	}
+	return filename[:m[0]], exponentRange{start, count}, true
+}
+
+// hasRecoveryFile returns whether the recovery file at the given path,
+// or one named the same except for the widths of the numbers in its
+// exponent range, was loaded without any corrupt data and holds the
+// recovery data for all the exponents in r.
+func (d *Decoder) hasRecoveryFile(path string, r exponentRange) bool {
+	// The paths of the parity files that were found may not be
+	// in the same form as the index file path, but they're all
+	// in the same directory, so compare just the filenames.
+	base, _, ok := parseRecoveryFilename(filepath.Base(path))
+	if !ok {
+		return false
+	}
+	for exp := r.start; exp < r.start+r.count; exp++ {
+		if exp >= len(d.parityShards) || !d.parityShards[exp].found() {
+			return false
+		}
+		filename := filepath.Base(d.parityShards[exp].path)
+		if d.damagedParityFiles[filename] {
+			return false
+		}
+		shardBase, shardRange, ok := parseRecoveryFilename(filename)
+		if !ok || shardBase != base || shardRange != r {
+			return false
+		}
+	}
+	return true
+}
+
+// recoveryFileDelegate passes on the calls made while regenerating
+// recovery files to a DecoderDelegate.
+type recoveryFileDelegate struct {
+	d DecoderDelegate
+}
+
+func (recoveryFileDelegate) OnDataFileLoad(i, n int, path string, byteCount int, err error) {}
+
+func (recoveryFileDelegate) OnDataFileHashProgress(path string, hashedByteCount, byteCount int) {}
+
+func (r recoveryFileDelegate) OnMatrixProgress(rowsApplied, rowCount int) {
+	r.d.OnMatrixProgress(rowsApplied, rowCount)
+}
+
+func (r recoveryFileDelegate) OnIndexFileWrite(path string, byteCount int, err error) {
+	r.d.OnIndexFileWrite(path, byteCount, err)
+}
+
+func (r recoveryFileDelegate) OnRecoveryFileWrite(start, count, total int, path string, dataByteCount, byteCount int, err error) {
+	r.d.OnRecoveryFileWrite(start, count, total, path, dataByteCount, byteCount, err)
+}
+
+// RegenerateOptions holds optional parameters for
+// RegenerateParityFilesWithOptions. The zero value gives the default
+// behavior.
+type RegenerateOptions struct {
+	// RecoveryFileCount and RecoveryFileScheme must be the ones
+	// from the EncoderOptions that the recovery set was created
+	// with, so that the recovery packets are split among the
+	// recovery files the same way.
+	RecoveryFileCount  int
+	RecoveryFileScheme RecoveryFileScheme
+}
+
+// RegenerateParityFiles writes out the recovery files of the
+// recovery set that are missing, damaged, or don't hold all their
+// recovery data, using the extension-less part of the index file
+// path as the base name. Each one is written exactly as Encoder.Write
+// would have written it with the default recovery file options, so
+// the set ID stays the same. Returns a list
+// of paths to the recovery files that were written, in order.
+//
+// parityShardCount is the number of parity shards that the recovery
+// set was created with. If it is zero, it's inferred from the names
+// of the recovery files that are present, which misses the last ones
+// if they're all missing.
+//
+// The data files must all be intact, so LoadFileData and
+// LoadParityData must be called first, and then Repair if needed.
+// The recovery data is computed from the data files in pieces, as
+// Encoder does in streaming mode, with the memory limit of the
+// Decoder if there is one.
+func (d *Decoder) RegenerateParityFiles(parityShardCount int) ([]string, error) {
+	return d.RegenerateParityFilesWithOptions(parityShardCount, RegenerateOptions{})
+}
 
-	return repairedPaths, nil
+// RegenerateParityFilesWithOptions is like RegenerateParityFiles, but
+// also takes a RegenerateOptions, for recovery sets created with
+// other recovery file options. It returns an error instead of
+// writing anything if the recovery files that are present don't fit
+// the options.
+func (d *Decoder) RegenerateParityFilesWithOptions(parityShardCount int, options RegenerateOptions) ([]string, error) {
+	return d.RegenerateParityFilesContext(context.Background(), parityShardCount, options)
 }
 
-// NewDecoder reads the given index file, which usually has a .par2
-// extension.
+// RegenerateParityFilesContext is like
+// RegenerateParityFilesWithOptions, but it stops and returns
+// ctx.Err() if ctx is done before all the recovery files are
+// written, in which case the ones being written are left incomplete.
+func (d *Decoder) RegenerateParityFilesContext(ctx context.Context, parityShardCount int, options RegenerateOptions) ([]string, error) {
+	if options.RecoveryFileCount < 0 {
+		return nil, errors.New("invalid recovery file count")
+	}
+
+	if len(d.fileIntegrityInfos) == 0 {
+		return nil, errors.New("no file integrity info")
+	}
+
+	for _, info := range d.fileIntegrityInfos {
+		if !info.ok(d.sliceByteCount) {
+			return nil, errors.New("data files need repair")
+		}
+	}
+
+	if parityShardCount == 0 {
+		var err error
+		parityShardCount, err = d.inferParityShardCount()
+		if err != nil {
+			return nil, err
+		}
+		if parityShardCount == 0 {
+			return nil, errors.New("no recovery files found")
+		}
+	} else if parityShardCount < len(d.parityShards) {
+		return nil, errors.New("parity shard count too small")
+	}
+
+	setID, indexBytes, err := d.buildIndexFile()
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := make(map[fileID]encoderInputFileInfo)
+	dataShardCount := 0
+	for _, info := range d.recoverySet {
+		fileInfos[info.fileID] = encoderInputFileInfo{
+			fileDescriptionPacket: fileDescriptionPacket{
+				hash:         info.hash,
+				sixteenKHash: info.sixteenKHash,
+				byteCount:    info.byteCount,
+				filename:     info.filename,
+			},
+			unicodeFilename: info.unicodeFilename,
+			ifscPacket:      ifscPacket{info.checksumPairs},
+		}
+		dataShardCount += len(info.checksumPairs)
+	}
+
+	e := &Encoder{
+		fileIO:             d.fileIO,
+		delegate:           recoveryFileDelegate{d.delegate},
+		basePath:           filepath.Dir(d.indexPath),
+		sliceByteCount:     d.sliceByteCount,
+		parityShardCount:   parityShardCount,
+		numGoroutines:      d.numGoroutines,
+		memoryLimit:        d.memoryLimit,
+		recoveryFileCount:  options.RecoveryFileCount,
+		recoveryFileScheme: options.RecoveryFileScheme,
+		recoverySet:        decoderInputFileInfoIDs(d.recoverySet),
+		fileInfos:          fileInfos,
+	}
+
+	allRanges, err := e.exponentRanges()
+	if err != nil {
+		return nil, err
+	}
+
+	ext := path.Ext(d.indexPath)
+	base := d.indexPath[:len(d.indexPath)-len(ext)]
+
+	// Rather than write recovery files that don't fit with the
+	// ones that are present, which can happen if the options
+	// don't match the ones the set was created with, give up.
+	volumePaths, err := d.findVolumePaths()
+	if err != nil {
+		return nil, err
+	}
+	for _, volumePath := range volumePaths {
+		volumeBase, r, ok := parseRecoveryFilename(volumePath)
+		// Skip files for other sets whose names start with
+		// the same base name.
+		if !ok || filepath.Base(volumeBase) != filepath.Base(base) {
+			continue
+		}
+		found := false
+		for _, expectedRange := range allRanges {
+			if r == expectedRange {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("recovery files don't match the recovery file options")
+		}
+	}
+
+	allPaths := recoveryFilePaths(base, allRanges)
+	var ranges []exponentRange
+	var paths []string
+	for i, r := range allRanges {
+		if !d.hasRecoveryFile(allPaths[i], r) {
+			ranges = append(ranges, r)
+			paths = append(paths, allPaths[i])
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+
+	e.coder, err = rsec16.NewCoderPAR2Vandermonde(dataShardCount, parityShardCount, d.numGoroutines)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.writeRecoveryFilesStreaming(ctx, paths, setID, indexBytes, ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	// Point the regenerated exponents at their new recovery
+	// files, so that Verify and Repair can use them.
+	if len(d.parityShards) < parityShardCount {
+		d.parityShards = append(d.parityShards, make([]shardSource, parityShardCount-len(d.parityShards))...)
+	}
+	recoveryPacketByteCount := int(sizeOfPacketHeader()) + 4 + d.sliceByteCount
+	var writtenPaths []string
+	for i, r := range ranges {
+		path := paths[i]
+		for j := 0; j < r.count; j++ {
+			// TODO: Handle overflow.
+			start := len(indexBytes) + j*recoveryPacketByteCount + int(sizeOfPacketHeader()) + 4
+			d.parityShards[r.start+j] = shardSource{path, start}
+		}
+		delete(d.damagedParityFiles, filepath.Base(path))
+		writtenPaths = append(writtenPaths, path)
+	}
+
+	return writtenPaths, nil
+}
+
+// NewDecoder reads the critical packets of a recovery set, starting
+// from the given path. This is usually its index file, which usually
+// has a .par2 extension, but it may also be one of its recovery
+// volumes (e.g., file.vol03+04.par2), or a directory containing them,
+// in which case they must all be for the same recovery set. Critical
+// packets that are missing from the index file, e.g. if it's missing
+// or damaged, are looked for in the recovery volumes.
 func NewDecoder(delegate DecoderDelegate, indexFile string, numGoroutines int) (*Decoder, error) {
-	return newDecoder(defaultFileIO{}, delegate, indexFile, numGoroutines)
+	return NewDecoderWithOptions(delegate, indexFile, numGoroutines, DecoderOptions{})
+}
+
+// NewDecoderWithOptions is like NewDecoder, but also takes a
+// DecoderOptions.
+func NewDecoderWithOptions(delegate DecoderDelegate, indexFile string, numGoroutines int, options DecoderOptions) (*Decoder, error) {
+	return newDecoder(defaultFileIO{}, delegate, indexFile, numGoroutines, options)
+}
+
+// NewDecoderForRecoverySet is like NewDecoderWithOptions, but reads
+// the critical packets and the recovery data of the given recovery
+// set, as returned by FindRecoverySets, only from its files, and
+// ignores the packets of any other recovery set in them.
+func NewDecoderForRecoverySet(delegate DecoderDelegate, set RecoverySet, numGoroutines int, options DecoderOptions) (*Decoder, error) {
+	return newDecoderForRecoverySet(defaultFileIO{}, delegate, set, numGoroutines, options)
 }
@@ -1,13 +1,19 @@
 package par2
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/akalin/gopar/memfs"
 	"github.com/akalin/gopar/rsec16"
@@ -47,16 +53,37 @@ func makeTestFillShardInfoInputs(tb testing.TB, sliceByteCount, dataByteCount in
 func TestFillShardInfos(t *testing.T) {
 	sliceByteCount := 4
 	dataByteCount := 50
-	id, data, checksumToLocation, fileIntegrityInfos, fileIDIndices, unrelatedData := makeTestFillShardInfoInputs(t, sliceByteCount, dataByteCount)
-
-	hits, misses := fillShardInfos(sliceByteCount, data, checksumToLocation, id, fileIntegrityInfos, fileIDIndices)
-	expectedHits := (dataByteCount + sliceByteCount - 1) / sliceByteCount
-	require.Equal(t, expectedHits, hits)
-	require.Equal(t, 0, misses)
-
-	hits, misses = fillShardInfos(sliceByteCount, unrelatedData, checksumToLocation, id, fileIntegrityInfos, fileIDIndices)
-	require.Equal(t, 0, hits)
-	require.Equal(t, dataByteCount, misses)
+	for _, bufByteCount := range []int{sliceByteCount + 1, 2 * sliceByteCount, 2 * dataByteCount} {
+		bufByteCount := bufByteCount
+		t.Run(fmt.Sprintf("bufByteCount=%d", bufByteCount), func(t *testing.T) {
+			id, data, checksumToLocation, fileIntegrityInfos, fileIDIndices, unrelatedData := makeTestFillShardInfoInputs(t, sliceByteCount, dataByteCount)
+
+			hits, misses, err := fillShardInfos(sliceByteCount, bytes.NewReader(data), bufByteCount, checksumToLocation, id, "data", fileIntegrityInfos, fileIDIndices, nil)
+			require.NoError(t, err)
+			expectedHits := (dataByteCount + sliceByteCount - 1) / sliceByteCount
+			require.Equal(t, expectedHits, hits)
+			require.Equal(t, 0, misses)
+			for i, shardInfo := range fileIntegrityInfos[0].shardInfos {
+				require.Equal(t, shardSource{"data", i * sliceByteCount}, shardInfo.source)
+			}
+
+			hits, misses, err = fillShardInfos(sliceByteCount, bytes.NewReader(unrelatedData), bufByteCount, checksumToLocation, id, "unrelated", fileIntegrityInfos, fileIDIndices, nil)
+			require.NoError(t, err)
+			require.Equal(t, 0, hits)
+			require.Equal(t, dataByteCount, misses)
+
+			// Shift the data so that the rolling checksum
+			// has to be used across buffer refills.
+			shiftedData := append(unrelatedData[:3:3], data...)
+			hits, misses, err = fillShardInfos(sliceByteCount, bytes.NewReader(shiftedData), bufByteCount, checksumToLocation, id, "shifted", fileIntegrityInfos, fileIDIndices, nil)
+			require.NoError(t, err)
+			require.Equal(t, expectedHits, hits)
+			require.Equal(t, 3, misses)
+			for i, shardInfo := range fileIntegrityInfos[0].shardInfos {
+				require.True(t, shardInfo.locations[shardLocation{id, 3 + i*sliceByteCount}])
+			}
+		})
+	}
 }
 
 func BenchmarkFillShardInfos(b *testing.B) {
@@ -66,14 +93,18 @@ func BenchmarkFillShardInfos(b *testing.B) {
 
 	id, data, checksumToLocation, fileIntegrityInfos, fileIDIndices, unrelatedData := makeTestFillShardInfoInputs(b, sliceByteCount, dataByteCount)
 
+	bufByteCount := streamBufferByteCount
+
 	b.Run("related", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			fillShardInfos(sliceByteCount, data, checksumToLocation, id, fileIntegrityInfos, fileIDIndices)
+			_, _, err := fillShardInfos(sliceByteCount, bytes.NewReader(data), bufByteCount, checksumToLocation, id, "data", fileIntegrityInfos, fileIDIndices, nil)
+			require.NoError(b, err)
 		}
 	})
 	b.Run("unrelated", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			fillShardInfos(sliceByteCount, unrelatedData, checksumToLocation, id, fileIntegrityInfos, fileIDIndices)
+			_, _, err := fillShardInfos(sliceByteCount, bytes.NewReader(unrelatedData), bufByteCount, checksumToLocation, id, "unrelated", fileIntegrityInfos, fileIDIndices, nil)
+			require.NoError(b, err)
 		}
 	})
 }
@@ -92,6 +123,33 @@ func (io testFileIO) ReadFile(path string) (data []byte, err error) {
 	return io.fileIO.ReadFile(path)
 }
 
+func (io testFileIO) ReadFileAt(path string, data []byte, offset int64) (n int, err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("ReadFileAt(%s, %d bytes, %d) => (%d, %v)", path, len(data), offset, n, err)
+	}()
+	return io.fileIO.ReadFileAt(path, data, offset)
+}
+
+func (io testFileIO) FileByteCount(path string) (byteCount int64, err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("FileByteCount(%s) => (%d, %v)", path, byteCount, err)
+	}()
+	return io.fileIO.FileByteCount(path)
+}
+
+func (io testFileIO) IsDir(path string) (isDir bool, err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("IsDir(%s) => (%t, %v)", path, isDir, err)
+	}()
+	return io.fileIO.IsDir(path)
+}
+
 func (io testFileIO) FindWithPrefixAndSuffix(prefix, suffix string) (matches []string, err error) {
 	io.t.Helper()
 	defer func() {
@@ -101,6 +159,15 @@ func (io testFileIO) FindWithPrefixAndSuffix(prefix, suffix string) (matches []s
 	return io.fileIO.FindWithPrefixAndSuffix(prefix, suffix)
 }
 
+func (io testFileIO) SameFile(path1, path2 string) (sameFile bool, err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("SameFile(%s, %s) => (%t, %v)", path1, path2, sameFile, err)
+	}()
+	return io.fileIO.SameFile(path1, path2)
+}
+
 func (io testFileIO) WriteFile(path string, data []byte) (err error) {
 	io.t.Helper()
 	defer func() {
@@ -110,8 +177,78 @@ func (io testFileIO) WriteFile(path string, data []byte) (err error) {
 	return io.fileIO.WriteFile(path, data)
 }
 
+func (io testFileIO) WriteFileAt(path string, data []byte, offset int64) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("WriteFileAt(%s, %d bytes, %d) => %v", path, len(data), offset, err)
+	}()
+	return io.fileIO.WriteFileAt(path, data, offset)
+}
+
+func (io testFileIO) MoveFile(oldPath, newPath string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("MoveFile(%s, %s) => %v", oldPath, newPath, err)
+	}()
+	return io.fileIO.MoveFile(oldPath, newPath)
+}
+
+func (io testFileIO) CopyFileMetadata(srcPath, dstPath string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("CopyFileMetadata(%s, %s) => %v", srcPath, dstPath, err)
+	}()
+	return io.fileIO.CopyFileMetadata(srcPath, dstPath)
+}
+
+func (io testFileIO) SyncFile(path string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("SyncFile(%s) => %v", path, err)
+	}()
+	return io.fileIO.SyncFile(path)
+}
+
+func (io testFileIO) SyncDir(path string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("SyncDir(%s) => %v", path, err)
+	}()
+	return io.fileIO.SyncDir(path)
+}
+
+func (io testFileIO) DeleteFile(path string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("DeleteFile(%s) => %v", path, err)
+	}()
+	return io.fileIO.DeleteFile(path)
+}
+
+func (io testFileIO) MkdirAll(path string) (err error) {
+	io.t.Helper()
+	defer func() {
+		io.t.Helper()
+		io.t.Logf("MkdirAll(%s) => %v", path, err)
+	}()
+	return io.fileIO.MkdirAll(path)
+}
+
 func buildPAR2Data(t *testing.T, fs memfs.MemFS, basePath string, sliceByteCount, parityShardCount int) {
-	var recoverySet []fileID
+	buildPAR2DataWithNonRecoverySet(t, fs, basePath, sliceByteCount, parityShardCount, nil)
+}
+
+// buildPAR2DataWithNonRecoverySet is like buildPAR2Data, except that
+// the files with the given relative paths are put in the
+// non-recovery set.
+func buildPAR2DataWithNonRecoverySet(t *testing.T, fs memfs.MemFS, basePath string, sliceByteCount, parityShardCount int, nonRecoveryPaths []string) {
+	var recoverySet, nonRecoverySet []fileID
 	fileDescriptionPackets := make(map[fileID]fileDescriptionPacket)
 	ifscPackets := make(map[fileID]ifscPacket)
 	dataShardsByID := make(map[fileID][][]byte)
@@ -122,15 +259,26 @@ func buildPAR2Data(t *testing.T, fs memfs.MemFS, basePath string, sliceByteCount
 		relPath, err := filepath.Rel(basePath, path)
 		require.NoError(t, err)
 		fileID, fileDescriptionPacket, ifscPacket, fileDataShards := computeDataFileInfo(sliceByteCount, relPath, data)
-		recoverySet = append(recoverySet, fileID)
+		isNonRecovery := false
+		for _, nonRecoveryPath := range nonRecoveryPaths {
+			isNonRecovery = isNonRecovery || relPath == nonRecoveryPath
+		}
+		if isNonRecovery {
+			nonRecoverySet = append(nonRecoverySet, fileID)
+		} else {
+			recoverySet = append(recoverySet, fileID)
+			dataShardsByID[fileID] = fileDataShards
+		}
 		fileDescriptionPackets[fileID] = fileDescriptionPacket
 		ifscPackets[fileID] = ifscPacket
-		dataShardsByID[fileID] = fileDataShards
 	}
 
 	sort.Slice(recoverySet, func(i, j int) bool {
 		return fileIDLess(recoverySet[i], recoverySet[j])
 	})
+	sort.Slice(nonRecoverySet, func(i, j int) bool {
+		return fileIDLess(nonRecoverySet[i], nonRecoverySet[j])
+	})
 
 	var dataShards [][]byte
 	for _, fileID := range recoverySet {
@@ -149,6 +297,7 @@ func buildPAR2Data(t *testing.T, fs memfs.MemFS, basePath string, sliceByteCount
 	mainPacket := mainPacket{
 		sliceByteCount: sliceByteCount,
 		recoverySet:    recoverySet,
+		nonRecoverySet: nonRecoverySet,
 	}
 
 	indexFile := file{
@@ -176,7 +325,11 @@ func buildPAR2Data(t *testing.T, fs memfs.MemFS, basePath string, sliceByteCount
 }
 
 func newDecoderForTest(t *testing.T, fs memfs.MemFS, indexPath string) (*Decoder, error) {
-	return newDecoder(testFileIO{t, fs}, testDecoderDelegate{t}, indexPath, rsec16.DefaultNumGoroutines())
+	return newDecoderWithOptionsForTest(t, fs, indexPath, DecoderOptions{})
+}
+
+func newDecoderWithOptionsForTest(t *testing.T, fs memfs.MemFS, indexPath string, options DecoderOptions) (*Decoder, error) {
+	return newDecoder(testFileIO{t, fs}, testDecoderDelegate{t}, indexPath, rsec16.DefaultNumGoroutines(), options)
 }
 
 func makeDecoderMemFS(workingDir string) memfs.MemFS {
@@ -292,6 +445,107 @@ func TestSetIDMismatch(t *testing.T) {
 	require.False(t, needsRepair)
 }
 
+func TestLoadParityDataCorruptVolume(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	r02Path := filepath.Join("dir1", "file.r02")
+
+	buildPAR2Data(t, fs, workingDir, 4, 3)
+
+	// Flip a bit in the recovery data, which is at the end of
+	// the volume.
+	vol0Data, err := fs.ReadFile("file.vol00+01.par2")
+	require.NoError(t, err)
+	vol0Data[len(vol0Data)-1] ^= 0x1
+	r02Data, err := fs.RemoveFile(r02Path)
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "file.par2")
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, true, true}, foundShards(decoder.parityShards))
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{r02Path}, repairedPaths)
+	repairedR02Data, err := fs.ReadFile(r02Path)
+	require.NoError(t, err)
+	require.Equal(t, r02Data, repairedR02Data)
+}
+
+func TestDecoderWithoutIndexFile(t *testing.T) {
+	workingDir := filepath.Join(memfs.RootDir(), "dir")
+	r02Path := filepath.Join("dir1", "file.r02")
+
+	for _, tc := range []struct {
+		name      string
+		startPath string
+		damage    func(indexData []byte) []byte
+	}{
+		{"missing,vol", "file.vol01+01.par2", nil},
+		{"missing,dir", ".", nil},
+		{"missing,absDir", workingDir, nil},
+		{"damaged,index", "file.par2", func(indexData []byte) []byte {
+			// Flip a bit in the header of the main
+			// packet, which comes after the creator
+			// packet.
+			mainPacketStart := bytes.Index(indexData[1:], expectedMagic[:]) + 1
+			damagedData := append([]byte{}, indexData...)
+			damagedData[mainPacketStart+8] ^= 0x1
+			return damagedData
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fs := makeDecoderMemFS(workingDir)
+			buildPAR2Data(t, fs, workingDir, 4, 3)
+
+			indexData, err := fs.RemoveFile("file.par2")
+			require.NoError(t, err)
+			if tc.damage != nil {
+				require.NoError(t, fs.WriteFile("file.par2", tc.damage(indexData)))
+			}
+
+			r02Data, err := fs.RemoveFile(r02Path)
+			require.NoError(t, err)
+
+			decoder, err := newDecoderForTest(t, fs, tc.startPath)
+			require.NoError(t, err)
+			err = decoder.LoadFileData()
+			require.NoError(t, err)
+			err = decoder.LoadParityData()
+			require.NoError(t, err)
+
+			repairedPaths, err := decoder.Repair(true)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(repairedPaths))
+			repairedR02Data, err := fs.ReadFile(r02Path)
+			require.NoError(t, err)
+			require.Equal(t, r02Data, repairedR02Data)
+
+			err = decoder.WriteIndexFile()
+			require.NoError(t, err)
+			rewrittenIndexData, err := fs.ReadFile("file.par2")
+			require.NoError(t, err)
+			require.Equal(t, indexData, rewrittenIndexData)
+		})
+	}
+}
+
+func TestDecoderDirWithMultipleSets(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	buildPAR2Data(t, fs, workingDir, 4, 3)
+	require.NoError(t, fs.MoveFile("file.vol00+01.par2", "other.vol00+01.par2"))
+
+	_, err := newDecoderForTest(t, fs, workingDir)
+	require.Equal(t, errors.New("found PAR2 files for more than one recovery set"), err)
+}
+
 func toSortedStrings(arr []string) []string {
 	arrCopy := make([]string, len(arr))
 	copy(arrCopy, arr)
@@ -470,3 +724,1100 @@ func TestRepairSwappedFiles(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, r01Data, repairedR01Data)
 }
+
+func makeMemoryLimitTestMemFS(workingDir string) memfs.MemFS {
+	rand := rand.New(rand.NewSource(1))
+	fileData := make(map[string][]byte)
+	for _, f := range []struct {
+		path      string
+		byteCount int
+	}{
+		{"file.rar", 50},
+		{"file.r01", 33},
+		{"file.r02", 70},
+	} {
+		data := make([]byte, f.byteCount)
+		rand.Read(data)
+		fileData[f.path] = data
+	}
+	return memfs.MakeMemFS(workingDir, fileData)
+}
+
+func TestRepairWithMemoryLimit(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeMemoryLimitTestMemFS(workingDir)
+
+	// This gives 4 + 3 + 5 = 12 data slices.
+	buildPAR2Data(t, fs, workingDir, 16, 4)
+
+	rarData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	rarDataCopy := make([]byte, len(rarData))
+	copy(rarDataCopy, rarData)
+	rarData[20]++
+	r01Data, err := fs.RemoveFile("file.r01")
+	require.NoError(t, err)
+
+	// Repair needs buffers for the 12 data slices, the 4 used
+	// parity slices, and the 4 computed parity slices plus one
+	// more, so this limit gives pieces of 4 bytes.
+	decoder, err := newDecoderWithOptionsForTest(t, fs, "file.par2", DecoderOptions{MemoryLimit: 21 * 4})
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.True(t, needsRepair)
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"file.r01", "file.rar"}, toSortedStrings(repairedPaths))
+	repairedRarData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	require.Equal(t, rarDataCopy, repairedRarData)
+	repairedR01Data, err := fs.ReadFile("file.r01")
+	require.NoError(t, err)
+	require.Equal(t, r01Data, repairedR01Data)
+
+	for _, path := range fs.Paths() {
+		require.NotEqual(t, ".tmp", filepath.Ext(path))
+	}
+
+	needsRepair, err = decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+}
+
+func TestRepairMemoryLimitTooSmall(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeMemoryLimitTestMemFS(workingDir)
+
+	buildPAR2Data(t, fs, workingDir, 16, 4)
+
+	_, err := fs.RemoveFile("file.r01")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderWithOptionsForTest(t, fs, "file.par2", DecoderOptions{MemoryLimit: 16})
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	_, err = decoder.Repair(true)
+	require.Equal(t, errors.New("memory limit too small"), err)
+}
+
+func TestRegenerateParityFiles(t *testing.T) {
+	for _, memoryLimit := range []int{0, 100} {
+		memoryLimit := memoryLimit
+		t.Run(fmt.Sprintf("memoryLimit=%d", memoryLimit), func(t *testing.T) {
+			workingDir := memfs.RootDir()
+			fs := makeMemoryLimitTestMemFS(workingDir)
+			writeParityForTest(t, fs, workingDir, fs.Paths(), 32, 7, EncoderOptions{})
+
+			vol0Data, err := fs.ReadFile("parity.vol00+01.par2")
+			require.NoError(t, err)
+			vol0DataCopy := append([]byte{}, vol0Data...)
+			// Flip a bit in the recovery data, which is
+			// at the end of the volume.
+			vol1Data, err := fs.ReadFile("parity.vol01+02.par2")
+			require.NoError(t, err)
+			vol1DataCopy := append([]byte{}, vol1Data...)
+			vol1Data[len(vol1Data)-1] ^= 0x1
+			vol3Data, err := fs.RemoveFile("parity.vol03+04.par2")
+			require.NoError(t, err)
+			_, err = fs.RemoveFile("file.r01")
+			require.NoError(t, err)
+
+			decoder, err := newDecoderWithOptionsForTest(t, fs, "parity.par2", DecoderOptions{MemoryLimit: memoryLimit})
+			require.NoError(t, err)
+			err = decoder.LoadFileData()
+			require.NoError(t, err)
+			err = decoder.LoadParityData()
+			require.NoError(t, err)
+
+			_, err = decoder.RegenerateParityFiles(0)
+			require.Equal(t, errors.New("data files need repair"), err)
+
+			_, err = decoder.Repair(true)
+			require.NoError(t, err)
+
+			// The last volume is missing, so only the
+			// damaged one is regenerated when the parity
+			// shard count is inferred.
+			writtenPaths, err := decoder.RegenerateParityFiles(0)
+			require.NoError(t, err)
+			require.Equal(t, []string{"parity.vol01+02.par2"}, writtenPaths)
+			regeneratedVol1Data, err := fs.ReadFile("parity.vol01+02.par2")
+			require.NoError(t, err)
+			require.Equal(t, vol1DataCopy, regeneratedVol1Data)
+
+			writtenPaths, err = decoder.RegenerateParityFiles(7)
+			require.NoError(t, err)
+			require.Equal(t, []string{"parity.vol03+04.par2"}, writtenPaths)
+			regeneratedVol3Data, err := fs.ReadFile("parity.vol03+04.par2")
+			require.NoError(t, err)
+			require.Equal(t, vol3Data, regeneratedVol3Data)
+
+			unchangedVol0Data, err := fs.ReadFile("parity.vol00+01.par2")
+			require.NoError(t, err)
+			require.Equal(t, vol0DataCopy, unchangedVol0Data)
+
+			needsRepair, err := decoder.Verify()
+			require.NoError(t, err)
+			require.False(t, needsRepair)
+
+			writtenPaths, err = decoder.RegenerateParityFiles(7)
+			require.NoError(t, err)
+			require.Empty(t, writtenPaths)
+
+			_, err = decoder.RegenerateParityFiles(2)
+			require.Equal(t, errors.New("parity shard count too small"), err)
+		})
+	}
+}
+
+func TestRegenerateUniformParityFiles(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeMemoryLimitTestMemFS(workingDir)
+	writeParityForTest(t, fs, workingDir, fs.Paths(), 32, 7, EncoderOptions{
+		RecoveryFileScheme: UniformRecoveryFiles,
+	})
+
+	vol3Data, err := fs.RemoveFile("parity.vol03+02.par2")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "parity.par2")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+
+	// The recovery files that are present don't fit the
+	// default options, so nothing is written.
+	paths := toSortedStrings(fs.Paths())
+	_, err = decoder.RegenerateParityFiles(7)
+	require.Equal(t, errors.New("recovery files don't match the recovery file options"), err)
+	require.Equal(t, paths, toSortedStrings(fs.Paths()))
+
+	writtenPaths, err := decoder.RegenerateParityFilesWithOptions(0, RegenerateOptions{
+		RecoveryFileScheme: UniformRecoveryFiles,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"parity.vol03+02.par2"}, writtenPaths)
+	regeneratedVol3Data, err := fs.ReadFile("parity.vol03+02.par2")
+	require.NoError(t, err)
+	require.Equal(t, vol3Data, regeneratedVol3Data)
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+}
+
+func TestRecoveryFilenameWidths(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	writeParityForTest(t, fs, workingDir, fs.Paths(), 4, 3, EncoderOptions{})
+
+	// Recovery files are found whatever the widths of the
+	// numbers in their names.
+	require.NoError(t, fs.MoveFile("parity.vol01+02.par2", "parity.vol001+0002.par2"))
+	_, err := fs.RemoveFile("parity.vol00+01.par2")
+	require.NoError(t, err)
+
+	decoder, err := newDecoderForTest(t, fs, "parity.par2")
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+	require.False(t, decoder.parityShards[0].found())
+	require.True(t, decoder.parityShards[1].found())
+	require.True(t, decoder.parityShards[2].found())
+
+	// The renamed recovery file is kept, since only the widths
+	// of the numbers in its name differ.
+	writtenPaths, err := decoder.RegenerateParityFiles(0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"parity.vol00+01.par2"}, writtenPaths)
+}
+
+func TestRepairWithCandidateFiles(t *testing.T) {
+	workingDir := memfs.RootDir()
+	movedPath := filepath.Join("moved", "file.bak")
+	for _, tc := range []struct {
+		name           string
+		candidatePaths []string
+		// If set, file.r02 is made a copy of file.r01
+		// before the recovery set is built.
+		duplicateR01 bool
+		// setUp moves file.r01 out of the way.
+		setUp func(t *testing.T, fs memfs.MemFS)
+		// The candidate file that should be moved, or the
+		// one that should be left as is.
+		movedPath, keptPath string
+	}{
+		{"renamed", []string{"moved"}, false, func(t *testing.T, fs memfs.MemFS) {
+			require.NoError(t, fs.MoveFile("file.r01", movedPath))
+		}, movedPath, ""},
+		{"renamedAndDamaged", []string{"file.bak"}, false, func(t *testing.T, fs memfs.MemFS) {
+			require.NoError(t, fs.MoveFile("file.r01", "file.bak"))
+			bakData, err := fs.ReadFile("file.bak")
+			require.NoError(t, err)
+			// Damage the second slice only.
+			bakData[20] ^= 0x1
+		}, "", "file.bak"},
+		{"shifted", []string{"file.bak"}, false, func(t *testing.T, fs memfs.MemFS) {
+			r01Data, err := fs.RemoveFile("file.r01")
+			require.NoError(t, err)
+			require.NoError(t, fs.WriteFile("file.bak", append([]byte{0x0}, r01Data...)))
+		}, "", "file.bak"},
+		{"dataFile", []string{"."}, true, func(t *testing.T, fs memfs.MemFS) {
+			_, err := fs.RemoveFile("file.r01")
+			require.NoError(t, err)
+		}, "", "file.r02"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fs := makeMemoryLimitTestMemFS(workingDir)
+			r01Data, err := fs.ReadFile("file.r01")
+			require.NoError(t, err)
+			r01Data = append([]byte{}, r01Data...)
+			if tc.duplicateR01 {
+				require.NoError(t, fs.WriteFile("file.r02", append([]byte{}, r01Data...)))
+			}
+
+			buildPAR2Data(t, fs, workingDir, 16, 3)
+
+			// file.r01 has 3 slices, so it can't be
+			// reconstructed from the one remaining
+			// recovery packet alone.
+			for _, path := range []string{"file.vol01+01.par2", "file.vol02+01.par2"} {
+				_, err := fs.RemoveFile(path)
+				require.NoError(t, err)
+			}
+
+			tc.setUp(t, fs)
+			var keptData []byte
+			if tc.keptPath != "" {
+				data, err := fs.ReadFile(tc.keptPath)
+				require.NoError(t, err)
+				keptData = append([]byte{}, data...)
+			}
+
+			decoder, err := newDecoderWithOptionsForTest(t, fs, "file.par2", DecoderOptions{CandidatePaths: tc.candidatePaths})
+			require.NoError(t, err)
+			err = decoder.LoadFileData()
+			require.NoError(t, err)
+			err = decoder.LoadParityData()
+			require.NoError(t, err)
+
+			needsRepair, err := decoder.Verify()
+			require.NoError(t, err)
+			require.True(t, needsRepair)
+
+			repairedPaths, err := decoder.Repair(true)
+			require.NoError(t, err)
+			require.Equal(t, []string{"file.r01"}, repairedPaths)
+
+			repairedR01Data, err := fs.ReadFile("file.r01")
+			require.NoError(t, err)
+			require.Equal(t, r01Data, repairedR01Data)
+			if tc.movedPath != "" {
+				_, err := fs.ReadFile(tc.movedPath)
+				require.True(t, os.IsNotExist(err))
+			}
+			if tc.keptPath != "" {
+				data, err := fs.ReadFile(tc.keptPath)
+				require.NoError(t, err)
+				require.Equal(t, keptData, data)
+			}
+
+			needsRepair, err = decoder.Verify()
+			require.NoError(t, err)
+			require.False(t, needsRepair)
+		})
+	}
+}
+
+func TestRepairWithExtraFiles(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeMemoryLimitTestMemFS(workingDir)
+
+	buildPAR2Data(t, fs, workingDir, 16, 3)
+
+	for _, path := range []string{"file.vol01+01.par2", "file.vol02+01.par2"} {
+		_, err := fs.RemoveFile(path)
+		require.NoError(t, err)
+	}
+
+	// Split file.r02, which has 5 slices, so that only its
+	// third slice is cut in two.
+	r02Data, err := fs.RemoveFile("file.r02")
+	require.NoError(t, err)
+	require.NoError(t, fs.WriteFile("file.r02.001", r02Data[:37]))
+	require.NoError(t, fs.WriteFile("file.r02.002", r02Data[37:]))
+
+	decoder, err := newDecoderForTest(t, fs, "file.par2")
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	_, err = decoder.Verify()
+	require.Equal(t, rsec16.NotEnoughParityShardsError{}, err)
+
+	decoder, err = newDecoderWithOptionsForTest(t, fs, "file.par2", DecoderOptions{
+		ExtraPaths: []string{"file.r02.001", "file.r02.002"},
+	})
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.True(t, needsRepair)
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.r02"}, repairedPaths)
+
+	repairedR02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	require.Equal(t, r02Data, repairedR02Data)
+}
+
+// dirFileIO is a fileIO that keeps track of directories, which memfs
+// doesn't have, so that writing or moving a file into a directory that
+// doesn't exist fails, as it would for defaultFileIO. It also records
+// the directories that are synced.
+type dirFileIO struct {
+	fileIO
+	workingDir string
+	dirs       map[string]bool
+	syncedDirs map[string]bool
+}
+
+// newDirFileIO returns a dirFileIO wrapping fileIO, with the
+// directories of the given files.
+func newDirFileIO(fileIO fileIO, workingDir string, paths []string) dirFileIO {
+	io := dirFileIO{fileIO, workingDir, make(map[string]bool), make(map[string]bool)}
+	for _, path := range paths {
+		io.addDirs(filepath.Dir(io.absPath(path)))
+	}
+	return io
+}
+
+func (io dirFileIO) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(io.workingDir, path)
+}
+
+func (io dirFileIO) addDirs(dir string) {
+	for !io.dirs[dir] {
+		io.dirs[dir] = true
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (io dirFileIO) checkDir(op, path string) error {
+	if !io.dirs[filepath.Dir(io.absPath(path))] {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (io dirFileIO) WriteFile(path string, data []byte) error {
+	if err := io.checkDir("open", path); err != nil {
+		return err
+	}
+	return io.fileIO.WriteFile(path, data)
+}
+
+func (io dirFileIO) WriteFileAt(path string, data []byte, offset int64) error {
+	if err := io.checkDir("open", path); err != nil {
+		return err
+	}
+	return io.fileIO.WriteFileAt(path, data, offset)
+}
+
+func (io dirFileIO) MoveFile(oldPath, newPath string) error {
+	if err := io.checkDir("rename", newPath); err != nil {
+		return err
+	}
+	return io.fileIO.MoveFile(oldPath, newPath)
+}
+
+func (io dirFileIO) SyncDir(path string) error {
+	io.syncedDirs[io.absPath(path)] = true
+	return io.fileIO.SyncDir(path)
+}
+
+func (io dirFileIO) MkdirAll(path string) error {
+	io.addDirs(io.absPath(path))
+	return io.fileIO.MkdirAll(path)
+}
+
+func TestRepairMoveIntoMissingDir(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	r03Dir := filepath.Join("dir2", "dir3")
+	r03Path := filepath.Join(r03Dir, "file.r03")
+	movedPath := filepath.Join("moved", "file.bak")
+
+	buildPAR2Data(t, fs, workingDir, 4, 3)
+
+	r03Data, err := fs.ReadFile(r03Path)
+	require.NoError(t, err)
+	r03Data = append([]byte{}, r03Data...)
+	// dir2 is gone along with file.r03, the only file in it.
+	require.NoError(t, fs.MoveFile(r03Path, movedPath))
+
+	fileIO := newDirFileIO(testFileIO{t, fs}, workingDir, fs.Paths())
+	decoder, err := newDecoder(fileIO, testDecoderDelegate{t}, "file.par2", rsec16.DefaultNumGoroutines(), DecoderOptions{CandidatePaths: []string{"moved"}})
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{r03Path}, repairedPaths)
+
+	repairedR03Data, err := fs.ReadFile(r03Path)
+	require.NoError(t, err)
+	require.Equal(t, r03Data, repairedR03Data)
+	_, err = fs.ReadFile(movedPath)
+	require.True(t, os.IsNotExist(err))
+	require.True(t, fileIO.syncedDirs[filepath.Join(workingDir, "moved")])
+	require.True(t, fileIO.syncedDirs[filepath.Join(workingDir, r03Dir)])
+}
+
+func TestRepairKeepBackup(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := memfs.MakeMemFS(workingDir, map[string][]byte{
+		"file.rar": {0x1, 0x2, 0x3, 0x4, 0x5},
+	})
+
+	buildPAR2Data(t, fs, workingDir, 4, 3)
+
+	rarData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	rarDataCopy := make([]byte, len(rarData))
+	copy(rarDataCopy, rarData)
+	damagedRarData := []byte{0x1, 0x2, 0x3, 0x4, 0x6}
+	require.NoError(t, fs.WriteFile("file.rar", damagedRarData))
+	// An existing backup should be left alone.
+	require.NoError(t, fs.WriteFile("file.rar.1", []byte{0x7}))
+
+	decoder, err := newDecoderWithOptionsForTest(t, fs, "file.par2", DecoderOptions{KeepBackup: true})
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.rar"}, repairedPaths)
+
+	repairedRarData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	require.Equal(t, rarDataCopy, repairedRarData)
+	backupData, err := fs.ReadFile("file.rar.1")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x7}, backupData)
+	backupData, err = fs.ReadFile("file.rar.2")
+	require.NoError(t, err)
+	require.Equal(t, damagedRarData, backupData)
+	_, err = fs.ReadFile(repairTempPath("file.rar"))
+	require.True(t, os.IsNotExist(err))
+}
+
+// failingFileIO is a fileIO whose WriteFileAt or MoveFile calls fail,
+// depending on which of writeErr and moveErr are non-nil.
+type failingFileIO struct {
+	fileIO
+	writeErr error
+	moveErr  error
+}
+
+func (io failingFileIO) WriteFileAt(path string, data []byte, offset int64) error {
+	if io.writeErr != nil {
+		return io.writeErr
+	}
+	return io.fileIO.WriteFileAt(path, data, offset)
+}
+
+func (io failingFileIO) MoveFile(oldPath, newPath string) error {
+	if io.moveErr != nil {
+		return io.moveErr
+	}
+	return io.fileIO.MoveFile(oldPath, newPath)
+}
+
+func TestRepairFailureRemovesTempFiles(t *testing.T) {
+	writeErr := errors.New("write failed")
+	moveErr := errors.New("move failed")
+	for _, tc := range []struct {
+		writeErr error
+		moveErr  error
+	}{
+		{writeErr, nil},
+		{nil, moveErr},
+	} {
+		workingDir := memfs.RootDir()
+		fs := makeDecoderMemFS(workingDir)
+		r02Path := filepath.Join("dir1", "file.r02")
+
+		buildPAR2Data(t, fs, workingDir, 4, 3)
+
+		r02Data, err := fs.ReadFile(r02Path)
+		require.NoError(t, err)
+		r02Data[len(r02Data)-1]++
+
+		fileIO := failingFileIO{testFileIO{t, fs}, tc.writeErr, tc.moveErr}
+		decoder, err := newDecoder(fileIO, testDecoderDelegate{t}, "file.par2", rsec16.DefaultNumGoroutines(), DecoderOptions{})
+		require.NoError(t, err)
+		require.NoError(t, decoder.LoadFileData())
+		require.NoError(t, decoder.LoadParityData())
+
+		expectedErr := tc.writeErr
+		if expectedErr == nil {
+			expectedErr = tc.moveErr
+		}
+		_, err = decoder.Repair(true)
+		require.Equal(t, expectedErr, err)
+
+		_, err = fs.FileByteCount(repairTempPath(r02Path))
+		require.True(t, os.IsNotExist(err))
+		damagedR02Data, err := fs.ReadFile(r02Path)
+		require.NoError(t, err)
+		require.Equal(t, r02Data, damagedR02Data)
+	}
+}
+
+func TestRepairPreservesMetadata(t *testing.T) {
+	for _, useOutputDir := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "gopar")
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, os.RemoveAll(dir))
+		}()
+
+		rarPath := filepath.Join(dir, "file.rar")
+		rarData := []byte{0x1, 0x2, 0x3, 0x4, 0x5}
+		require.NoError(t, ioutil.WriteFile(rarPath, rarData, 0600))
+
+		encoder, err := newEncoder(defaultFileIO{}, testEncoderDelegate{t}, dir, []string{rarPath}, 4, 3, rsec16.DefaultNumGoroutines(), EncoderOptions{})
+		require.NoError(t, err)
+		require.NoError(t, encoder.LoadFileData())
+		require.NoError(t, encoder.ComputeParityData())
+		parPath := filepath.Join(dir, "file.par2")
+		require.NoError(t, encoder.Write(parPath))
+
+		damagedRarData := []byte{0x1, 0x2, 0x3, 0x4, 0x6}
+		require.NoError(t, ioutil.WriteFile(rarPath, damagedRarData, 0600))
+		require.NoError(t, os.Chmod(rarPath, 0640))
+		modTime := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+		require.NoError(t, os.Chtimes(rarPath, modTime, modTime))
+
+		var options DecoderOptions
+		repairedRarPath := rarPath
+		if useOutputDir {
+			options.OutputDir = filepath.Join(dir, "out")
+			repairedRarPath = filepath.Join(options.OutputDir, "file.rar")
+		}
+
+		decoder, err := newDecoder(defaultFileIO{}, testDecoderDelegate{t}, parPath, rsec16.DefaultNumGoroutines(), options)
+		require.NoError(t, err)
+		require.NoError(t, decoder.LoadFileData())
+		require.NoError(t, decoder.LoadParityData())
+
+		repairedPaths, err := decoder.Repair(true)
+		require.NoError(t, err)
+		require.Equal(t, []string{repairedRarPath}, repairedPaths)
+
+		repairedRarData, err := ioutil.ReadFile(repairedRarPath)
+		require.NoError(t, err)
+		require.Equal(t, rarData, repairedRarData)
+		info, err := os.Stat(repairedRarPath)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+		require.True(t, modTime.Equal(info.ModTime()))
+
+		if useOutputDir {
+			// The original file should be left alone.
+			originalRarData, err := ioutil.ReadFile(rarPath)
+			require.NoError(t, err)
+			require.Equal(t, damagedRarData, originalRarData)
+		}
+	}
+}
+
+func TestRepairMissingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopar")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	subDir := filepath.Join(dir, "dir1", "dir2")
+	require.NoError(t, os.MkdirAll(subDir, 0700))
+	rarPath := filepath.Join(subDir, "file.rar")
+	rarData := []byte{0x1, 0x2, 0x3, 0x4, 0x5}
+	require.NoError(t, ioutil.WriteFile(rarPath, rarData, 0600))
+
+	encoder, err := newEncoder(defaultFileIO{}, testEncoderDelegate{t}, dir, []string{rarPath}, 4, 3, rsec16.DefaultNumGoroutines(), EncoderOptions{})
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	parPath := filepath.Join(dir, "file.par2")
+	require.NoError(t, encoder.Write(parPath))
+
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "dir1")))
+
+	decoder, err := newDecoder(defaultFileIO{}, testDecoderDelegate{t}, parPath, rsec16.DefaultNumGoroutines(), DecoderOptions{})
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{rarPath}, repairedPaths)
+
+	repairedRarData, err := ioutil.ReadFile(rarPath)
+	require.NoError(t, err)
+	require.Equal(t, rarData, repairedRarData)
+}
+
+func TestRepairOutputDir(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	r02Path := filepath.Join("dir1", "file.r02")
+	r04Path := filepath.Join("dir4", "dir5", "file.r04")
+
+	buildPAR2Data(t, fs, workingDir, 4, 3)
+
+	r02Data, err := fs.ReadFile(r02Path)
+	require.NoError(t, err)
+	r02DataCopy := make([]byte, len(r02Data))
+	copy(r02DataCopy, r02Data)
+	r02Data[len(r02Data)-1]++
+	r04Data, err := fs.RemoveFile(r04Path)
+	require.NoError(t, err)
+
+	outputDir := filepath.Join(workingDir, "out")
+	decoder, err := newDecoderWithOptionsForTest(t, fs, "file.par2", DecoderOptions{OutputDir: outputDir})
+	require.NoError(t, err)
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	expectedRepairedPaths := []string{
+		filepath.Join(outputDir, r02Path),
+		filepath.Join(outputDir, r04Path),
+	}
+	require.Equal(t, toSortedStrings(expectedRepairedPaths), toSortedStrings(repairedPaths))
+
+	repairedR02Data, err := fs.ReadFile(filepath.Join(outputDir, r02Path))
+	require.NoError(t, err)
+	require.Equal(t, r02DataCopy, repairedR02Data)
+	repairedR04Data, err := fs.ReadFile(filepath.Join(outputDir, r04Path))
+	require.NoError(t, err)
+	require.Equal(t, r04Data, repairedR04Data)
+
+	// The original files should be left alone.
+	damagedR02Data, err := fs.ReadFile(r02Path)
+	require.NoError(t, err)
+	require.Equal(t, r02Data, damagedR02Data)
+	_, err = fs.ReadFile(r04Path)
+	require.True(t, os.IsNotExist(err))
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+}
+
+func TestNonRecoverySet(t *testing.T) {
+	fs := makeDecoderMemFS(memfs.RootDir())
+	r03Path := filepath.Join("dir2", "dir3", "file.r03")
+
+	buildPAR2DataWithNonRecoverySet(t, fs, memfs.RootDir(), 4, 3, []string{r03Path})
+
+	decoder, err := newDecoderForTest(t, fs, "file.par2")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(decoder.nonRecoverySet))
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	require.Equal(t, []FileStatus{FileOK}, decoder.nonRecoveryStatuses)
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+
+	// Damage a copy of the data, since fs.ReadFile doesn't
+	// return a copy.
+	r03Data, err := fs.ReadFile(r03Path)
+	require.NoError(t, err)
+	require.NoError(t, fs.WriteFile(r03Path, []byte{r03Data[0] + 1, r03Data[1]}))
+	_, err = fs.RemoveFile("file.rar")
+	require.NoError(t, err)
+
+	require.NoError(t, decoder.LoadFileData())
+	require.Equal(t, []FileStatus{FileDamaged}, decoder.nonRecoveryStatuses)
+
+	report, err := decoder.Report()
+	require.NoError(t, err)
+	require.Equal(t, FileReport{r03Path, 2, FileDamaged, "", []ByteRange{{0, 2}}, true}, report.Files[len(report.Files)-1])
+	require.Equal(t, 1, report.UnrepairableFileCount)
+	require.True(t, report.NeedsRepair)
+	require.False(t, report.RepairPossible)
+
+	needsRepair, err = decoder.Verify()
+	require.Equal(t, UnrepairableFilesError{[]string{r03Path}}, err)
+	require.True(t, needsRepair)
+
+	// The recovery set is still repaired.
+	repairedPaths, err := decoder.Repair(true)
+	require.Equal(t, UnrepairableFilesError{[]string{r03Path}}, err)
+	require.Equal(t, []string{"file.rar"}, repairedPaths)
+
+	_, err = fs.RemoveFile(r03Path)
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.Equal(t, []FileStatus{FileMissing}, decoder.nonRecoveryStatuses)
+}
+
+func TestIndexOnlySet(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+
+	encoder, err := newEncoderForTest(t, fs, workingDir, fs.Paths(), 4, 0)
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.NoError(t, encoder.Write(filepath.Join(workingDir, "file.par2")))
+
+	decoder, err := newDecoderForTest(t, fs, "file.par2")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.Empty(t, repairedPaths)
+
+	// Damage a copy of the data, since fs.ReadFile doesn't
+	// return a copy.
+	rarData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	require.NoError(t, fs.WriteFile("file.rar", []byte{rarData[0] + 1, rarData[1], rarData[2], rarData[3]}))
+	require.NoError(t, decoder.LoadFileData())
+
+	needsRepair, err = decoder.Verify()
+	require.Equal(t, rsec16.NotEnoughParityShardsError{}, err)
+	require.True(t, needsRepair)
+
+	report, err := decoder.Report()
+	require.NoError(t, err)
+	require.True(t, report.NeedsRepair)
+	require.False(t, report.RepairPossible)
+	require.Equal(t, 0, report.UsableRecoveryBlockCount)
+
+	_, err = decoder.Repair(true)
+	require.Equal(t, rsec16.NotEnoughParityShardsError{}, err)
+
+	// A data file that was only moved can be put back without
+	// any parity data.
+	require.NoError(t, fs.WriteFile("file.rar", nil))
+	require.NoError(t, fs.WriteFile("file.bak", rarData))
+	decoder, err = newDecoderWithOptionsForTest(t, fs, "file.par2", DecoderOptions{CandidatePaths: []string{"file.bak"}})
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+
+	needsRepair, err = decoder.Verify()
+	require.NoError(t, err)
+	require.True(t, needsRepair)
+
+	report, err = decoder.Report()
+	require.NoError(t, err)
+	require.True(t, report.RepairPossible)
+
+	repairedPaths, err = decoder.Repair(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.rar"}, repairedPaths)
+
+	repairedRarData, err := fs.ReadFile("file.rar")
+	require.NoError(t, err)
+	require.Equal(t, rarData, repairedRarData)
+}
+
+func TestEmptyFilesRoundTrip(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	emptyPath := filepath.Join("dir1", "empty")
+	require.NoError(t, fs.WriteFile(emptyPath, nil))
+
+	encoder, err := newEncoderForTest(t, fs, workingDir, fs.Paths(), 4, 3)
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.NoError(t, encoder.Write(filepath.Join(workingDir, "file.par2")))
+
+	decoder, err := newDecoderForTest(t, fs, "file.par2")
+	require.NoError(t, err)
+	require.Equal(t, 5, len(decoder.recoverySet))
+	require.Equal(t, 1, len(decoder.nonRecoverySet))
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+
+	_, err = fs.RemoveFile(emptyPath)
+	require.NoError(t, err)
+	_, err = fs.RemoveFile("file.rar")
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+	require.Equal(t, []FileStatus{FileMissing}, decoder.nonRecoveryStatuses)
+
+	// A missing empty file can always be recreated.
+	needsRepair, err = decoder.Verify()
+	require.NoError(t, err)
+	require.True(t, needsRepair)
+
+	report, err := decoder.Report()
+	require.NoError(t, err)
+	require.Equal(t, FileReport{emptyPath, 0, FileMissing, "", nil, true}, report.Files[len(report.Files)-1])
+	require.Equal(t, 0, report.UnrepairableFileCount)
+	require.True(t, report.RepairPossible)
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.rar", emptyPath}, repairedPaths)
+
+	data, err := fs.ReadFile(emptyPath)
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	require.NoError(t, decoder.LoadFileData())
+	needsRepair, err = decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+}
+
+func TestUnicodeFilenames(t *testing.T) {
+	workingDir := memfs.RootDir()
+	japanesePath := filepath.Join("ディレクトリ", "日本語.txt")
+	accentedPath := "café.bin"
+	fs := memfs.MakeMemFS(workingDir, map[string][]byte{
+		"file.rar":   {0x1, 0x2, 0x3, 0x4},
+		japanesePath: {0x5, 0x6, 0x7},
+		accentedPath: {0x8, 0x9, 0xa, 0xb, 0xc},
+		"caf_.bin":   {0xd},
+	})
+
+	encoder, err := newEncoderWithOptionsForTest(t, fs, workingDir, fs.Paths(), 4, 3, EncoderOptions{Comment: "コメント"})
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.NoError(t, encoder.Write(filepath.Join(workingDir, "file.par2")))
+
+	decoder, err := newDecoderForTest(t, fs, "file.par2")
+	require.NoError(t, err)
+	require.Equal(t, "コメント", decoder.comment)
+	var names []string
+	for _, info := range decoder.recoverySet {
+		names = append(names, info.name())
+	}
+	require.ElementsMatch(t, []string{"file.rar", japanesePath, accentedPath, "caf_.bin"}, names)
+
+	require.NoError(t, decoder.LoadFileData())
+	require.NoError(t, decoder.LoadParityData())
+	needsRepair, err := decoder.Verify()
+	require.NoError(t, err)
+	require.False(t, needsRepair)
+
+	_, err = fs.RemoveFile(japanesePath)
+	require.NoError(t, err)
+	_, err = fs.RemoveFile(accentedPath)
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileData())
+
+	repairedPaths, err := decoder.Repair(true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{japanesePath, accentedPath}, repairedPaths)
+
+	data, err := fs.ReadFile(japanesePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x5, 0x6, 0x7}, data)
+	data, err = fs.ReadFile(accentedPath)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x8, 0x9, 0xa, 0xb, 0xc}, data)
+}
+
+func TestReport(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeMemoryLimitTestMemFS(workingDir)
+
+	buildPAR2Data(t, fs, workingDir, 16, 6)
+
+	decoder, err := newDecoderForTest(t, fs, "file.par2")
+	require.NoError(t, err)
+
+	_, err = decoder.Report()
+	require.Equal(t, errors.New("no file integrity info"), err)
+
+	rarData, err := fs.RemoveFile("file.rar")
+	require.NoError(t, err)
+	require.NoError(t, fs.WriteFile("file.rar", rarData[:49]))
+	_, err = fs.RemoveFile("file.r01")
+	require.NoError(t, err)
+	r02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	r02Data[20]++
+
+	err = decoder.LoadFileData()
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	report, err := decoder.Report()
+	require.NoError(t, err)
+
+	filesByPath := make(map[string]FileReport)
+	for _, fileReport := range report.Files {
+		filesByPath[fileReport.Path] = fileReport
+	}
+	require.Equal(t, map[string]FileReport{
+		"file.rar": {"file.rar", 50, FileWrongByteCount, "", []ByteRange{{48, 50}}, false},
+		"file.r01": {"file.r01", 33, FileMissing, "", []ByteRange{{0, 33}}, false},
+		"file.r02": {"file.r02", 70, FileDamaged, "", []ByteRange{{16, 32}}, false},
+	}, filesByPath)
+	require.Equal(t, 12, report.DataBlockCount)
+	require.Equal(t, 7, report.UsableDataBlockCount)
+	require.Equal(t, 6, report.UsableRecoveryBlockCount)
+	require.Equal(t, 5, report.NeededRecoveryBlockCount)
+	require.True(t, report.NeedsRepair)
+	require.True(t, report.RepairPossible)
+
+	vol0Data, err := fs.RemoveFile("file.vol00+01.par2")
+	require.NoError(t, err)
+	vol1Data, err := fs.RemoveFile("file.vol01+01.par2")
+	require.NoError(t, err)
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+
+	report, err = decoder.Report()
+	require.NoError(t, err)
+	require.Equal(t, 4, report.UsableRecoveryBlockCount)
+	require.True(t, report.NeedsRepair)
+	require.False(t, report.RepairPossible)
+
+	require.NoError(t, fs.WriteFile("file.vol00+01.par2", vol0Data))
+	require.NoError(t, fs.WriteFile("file.vol01+01.par2", vol1Data))
+	err = decoder.LoadParityData()
+	require.NoError(t, err)
+	_, err = decoder.Repair(true)
+	require.NoError(t, err)
+
+	report, err = decoder.Report()
+	require.NoError(t, err)
+	for _, fileReport := range report.Files {
+		require.Equal(t, FileOK, fileReport.Status)
+		require.Empty(t, fileReport.CorruptRanges)
+	}
+	require.Equal(t, 12, report.UsableDataBlockCount)
+	require.Equal(t, 0, report.NeededRecoveryBlockCount)
+	require.False(t, report.NeedsRepair)
+	require.True(t, report.RepairPossible)
+}
+
+// progressDecoderDelegate records the progress reported to it, and
+// calls cancel, if it's non-nil, on the first matrix progress.
+type progressDecoderDelegate struct {
+	testDecoderDelegate
+	scanByteCounts map[string]int
+	matrixProgress [][2]int
+	cancel         func()
+}
+
+func (d *progressDecoderDelegate) OnDataFileScanProgress(path string, scannedByteCount, byteCount, hits, misses int) {
+	d.scanByteCounts[path] = byteCount
+}
+
+func (d *progressDecoderDelegate) OnMatrixProgress(rowsApplied, rowCount int) {
+	d.matrixProgress = append(d.matrixProgress, [2]int{rowsApplied, rowCount})
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+func TestDecoderContext(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeMemoryLimitTestMemFS(workingDir)
+
+	buildPAR2Data(t, fs, workingDir, 16, 3)
+
+	r02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	r02DataCopy := append([]byte(nil), r02Data...)
+	r02Data[0]++
+	r02Data[50]++
+
+	ctx, cancel := context.WithCancel(context.Background())
+	delegate := &progressDecoderDelegate{testDecoderDelegate{t}, make(map[string]int), nil, cancel}
+	decoder, err := newDecoder(testFileIO{t, fs}, delegate, "file.par2", rsec16.DefaultNumGoroutines(), DecoderOptions{})
+	require.NoError(t, err)
+	require.NoError(t, decoder.LoadFileDataContext(ctx))
+	require.NoError(t, decoder.LoadParityDataContext(ctx))
+	require.Equal(t, map[string]int{"file.rar": 50, "file.r01": 33, "file.r02": 70}, delegate.scanByteCounts)
+
+	needsRepair, err := decoder.VerifyContext(ctx)
+	require.NoError(t, err)
+	require.True(t, needsRepair)
+
+	// Two slices are missing, and each row of the matrix to
+	// check parity is applied for each of the 3 parity slices.
+	_, err = decoder.RepairContext(ctx, true)
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, [][2]int{{1, 5}}, delegate.matrixProgress)
+	damagedR02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	require.Equal(t, r02Data, damagedR02Data)
+
+	_, err = decoder.VerifyContext(ctx)
+	require.Equal(t, context.Canceled, err)
+	err = decoder.LoadFileDataContext(ctx)
+	require.Equal(t, context.Canceled, err)
+	err = decoder.LoadParityDataContext(ctx)
+	require.Equal(t, context.Canceled, err)
+
+	delegate.cancel = nil
+	delegate.matrixProgress = nil
+	repairedPaths, err := decoder.RepairContext(context.Background(), true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"file.r02"}, repairedPaths)
+	require.Equal(t, [][2]int{{1, 5}, {2, 5}, {3, 5}, {4, 5}, {5, 5}}, delegate.matrixProgress)
+	repairedR02Data, err := fs.ReadFile("file.r02")
+	require.NoError(t, err)
+	require.Equal(t, r02DataCopy, repairedR02Data)
+}
@@ -1,19 +1,38 @@
 package par2
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/akalin/gopar/rsec16"
 )
 
 type encoderInputFileInfo struct {
 	fileDescriptionPacket fileDescriptionPacket
-	ifscPacket            ifscPacket
-	dataShards            [][]byte
+	// Empty if the filename in fileDescriptionPacket is the
+	// actual one, i.e. if the actual one is ASCII.
+	unicodeFilename string
+	ifscPacket      ifscPacket
+	dataShards      [][]byte
+}
+
+// name returns the path of the file relative to the base path.
+func (info encoderInputFileInfo) name() string {
+	if info.unicodeFilename != "" {
+		return info.unicodeFilename
+	}
+	return info.fileDescriptionPacket.filename
 }
 
 // An Encoder keeps track of all information needed to create parity
@@ -30,28 +49,83 @@ type Encoder struct {
 	parityShardCount int
 
 	numGoroutines int
+	memoryLimit   int
+
+	recoveryFileCount  int
+	recoveryFileScheme RecoveryFileScheme
+
+	comment string
 
-	recoverySet      []fileID
-	recoverySetInfos map[fileID]encoderInputFileInfo
+	recoverySet    []fileID
+	nonRecoverySet []fileID
+	// Holds the info for the files of both sets.
+	fileInfos map[fileID]encoderInputFileInfo
 
+	// Set only when memoryLimit is zero.
 	parityShards [][]byte
+	// Set only when memoryLimit is positive.
+	coder rsec16.Coder
+}
+
+// EncoderOptions holds optional parameters for creating an
+// Encoder. The zero value gives the default behavior.
+type EncoderOptions struct {
+	// If MemoryLimit is positive, the Encoder runs in streaming
+	// mode: file data is read in pieces instead of being loaded
+	// into memory, and parity data is computed while the
+	// recovery files are being written, in as many passes over
+	// the file data as needed to keep the buffers it allocates
+	// within roughly MemoryLimit bytes.
+	MemoryLimit int
+	// If the slice byte count passed to NewEncoderWithOptions is
+	// zero, it's chosen to be the smallest one that splits the
+	// data files into at most SliceCount slices, or 2000 if
+	// SliceCount is zero, like par2cmdline's -b option. There
+	// can be at most 32768 slices.
+	SliceCount int
+	// If RedundancyPercent is positive, the parity shard count
+	// passed to NewEncoderWithOptions must be zero, and it's
+	// instead chosen to be RedundancyPercent percent of the
+	// number of data slices, rounded up, like par2cmdline's -r
+	// option.
+	RedundancyPercent int
+	// If RecoveryFileCount is positive, Write splits the
+	// recovery packets among that many recovery files, like
+	// par2cmdline's -n option.
+	RecoveryFileCount int
+	// RecoveryFileScheme determines how Write splits the
+	// recovery packets among the recovery files.
+	RecoveryFileScheme RecoveryFileScheme
+	// If Comment is non-empty, Write puts it in a comment
+	// packet in every file it writes, which is an ASCII one if
+	// possible, and a Unicode one otherwise.
+	Comment string
 }
 
 // EncoderDelegate holds methods that are called during the encode
 // process.
 type EncoderDelegate interface {
 	OnDataFileLoad(i, n int, path string, byteCount int, err error)
+	// OnDataFileHashProgress is called as the data file at path,
+	// which has byteCount bytes, is read and hashed.
+	OnDataFileHashProgress(path string, hashedByteCount, byteCount int)
+	// OnMatrixProgress is called as parity data is computed,
+	// with the number of matrix rows applied so far out of
+	// rowCount. In streaming mode, each row is applied once per
+	// batch of data slice pieces.
+	OnMatrixProgress(rowsApplied, rowCount int)
 	OnIndexFileWrite(path string, byteCount int, err error)
 	OnRecoveryFileWrite(start, count, total int, path string, dataByteCount, byteCount int, err error)
 }
 
-func newEncoder(fileIO fileIO, delegate EncoderDelegate, basePath string, filePaths []string, sliceByteCount, parityShardCount, numGoroutines int) (*Encoder, error) {
+func newEncoder(fileIO fileIO, delegate EncoderDelegate, basePath string, filePaths []string, sliceByteCount, parityShardCount, numGoroutines int, options EncoderOptions) (*Encoder, error) {
 	if !filepath.IsAbs(basePath) {
 		return nil, errors.New("basePath must be absolute")
 	}
 
-	relFilePaths := make([]string, len(filePaths))
-	for i, path := range filePaths {
+	var relFilePaths []string
+	seenRelPaths := make(map[string]bool)
+	for _, path := range filePaths {
 		var relPath string
 		if !filepath.IsAbs(path) {
 			return nil, errors.New("all elements of filePaths must be absolute")
@@ -60,61 +134,262 @@ func newEncoder(fileIO fileIO, delegate EncoderDelegate, basePath string, filePa
 		if err != nil {
 			return nil, err
 		}
-		if relPath[0] == '.' {
+		// Check for a leading .. path element, and not just
+		// a leading dot, to allow hidden files.
+		if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
 			return nil, errors.New("data files must lie in basePath")
 		}
-		relFilePaths[i] = relPath
+		// A file given more than once would otherwise be
+		// added to the recovery set twice, under the same
+		// file ID.
+		if !seenRelPaths[relPath] {
+			seenRelPaths[relPath] = true
+			relFilePaths = append(relFilePaths, relPath)
+		}
 	}
 
-	// TODO: Check parityShardCount.
-	if sliceByteCount == 0 || sliceByteCount%4 != 0 {
+	if sliceByteCount == 0 || options.RedundancyPercent > 0 {
+		fileByteCounts := make([]int64, len(relFilePaths))
+		for i, relPath := range relFilePaths {
+			byteCount, err := fileIO.FileByteCount(filepath.Join(basePath, relPath))
+			if err != nil {
+				return nil, err
+			}
+			fileByteCounts[i] = byteCount
+		}
+
+		if sliceByteCount == 0 {
+			var err error
+			sliceByteCount, err = computeSliceByteCount(fileByteCounts, options.SliceCount)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if options.RedundancyPercent > 0 {
+			if parityShardCount != 0 {
+				return nil, errors.New("parity shard count and redundancy percent both given")
+			}
+			parityShardCount = computeParityShardCount(countSlices(fileByteCounts, sliceByteCount), options.RedundancyPercent)
+		}
+	}
+
+	if parityShardCount < 0 {
+		return nil, errors.New("invalid parity shard count")
+	}
+
+	if sliceByteCount <= 0 || sliceByteCount%4 != 0 {
 		return nil, errors.New("invalid slice byte count")
 	}
-	return &Encoder{fileIO, delegate, basePath, relFilePaths, sliceByteCount, parityShardCount, numGoroutines, nil, nil, nil}, nil
+
+	if options.MemoryLimit < 0 {
+		return nil, errors.New("invalid memory limit")
+	}
+
+	if options.RecoveryFileCount < 0 {
+		return nil, errors.New("invalid recovery file count")
+	}
+
+	// Check the recovery file options, although the limit
+	// depends on the file data.
+	_, err := computeRecoveryFileRanges(parityShardCount, options.RecoveryFileCount, options.RecoveryFileScheme, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encoder{
+		fileIO, delegate,
+		basePath, relFilePaths,
+		sliceByteCount, parityShardCount,
+		numGoroutines, options.MemoryLimit,
+		options.RecoveryFileCount, options.RecoveryFileScheme,
+		options.Comment,
+		nil, nil, nil,
+		nil, rsec16.Coder{},
+	}, nil
 }
 
 // NewEncoder creates an encoder with the given list of file paths,
 // and with the given number of intended parity volumes. basePath must
 // be absolute. Elements of filePaths must be absolute, and must also
-// lie in basePath.
+// lie in basePath. Paths that are given more than once are only used
+// once. Empty files are put in the non-recovery set, since they have
+// no data to recover.
 func NewEncoder(delegate EncoderDelegate, basePath string, filePaths []string, sliceByteCount, parityShardCount, numGoroutines int) (*Encoder, error) {
-	return newEncoder(defaultFileIO{}, delegate, basePath, filePaths, sliceByteCount, parityShardCount, numGoroutines)
+	return NewEncoderWithOptions(delegate, basePath, filePaths, sliceByteCount, parityShardCount, numGoroutines, EncoderOptions{})
+}
+
+// NewEncoderWithOptions is like NewEncoder, but also takes an
+// EncoderOptions.
+func NewEncoderWithOptions(delegate EncoderDelegate, basePath string, filePaths []string, sliceByteCount, parityShardCount, numGoroutines int, options EncoderOptions) (*Encoder, error) {
+	return newEncoder(defaultFileIO{}, delegate, basePath, filePaths, sliceByteCount, parityShardCount, numGoroutines, options)
 }
 
-// LoadFileData loads the file data into memory.
+// streamBufferByteCount is the size of the buffer used to read
+// through a file in streaming mode, before being capped by the
+// memory limit.
+const streamBufferByteCount = 1024 * 1024
+
+// hashFileData computes the checksums of the data read from r, which
+// is the data of the file at path, and returns its byte count, file
+// ID and info.
+func (e *Encoder) hashFileData(ctx context.Context, path, relPath string, r io.Reader, byteCount int, bufByteCount int) (int, fileID, encoderInputFileInfo, error) {
+	h := newDataFileHasher(e.sliceByteCount)
+	pr := &progressReader{
+		ctx: ctx,
+		r:   r,
+		onRead: func(hashedByteCount int) {
+			e.delegate.OnDataFileHashProgress(path, hashedByteCount, byteCount)
+		},
+	}
+	n, err := io.CopyBuffer(h, pr, make([]byte, bufByteCount))
+	if err != nil {
+		return int(n), fileID{}, encoderInputFileInfo{}, err
+	}
+
+	// File description packets can only hold ASCII filenames,
+	// so any other filename also goes in a Unicode filename
+	// packet.
+	filename := replaceNonASCII(relPath)
+	unicodeFilename := ""
+	if filename != relPath {
+		unicodeFilename = relPath
+	}
+	fileID, fileDescriptionPacket, ifscPacket := h.finish(filename)
+	return int(n), fileID, encoderInputFileInfo{fileDescriptionPacket, unicodeFilename, ifscPacket, nil}, nil
+}
+
+// LoadFileData loads the file data into memory. In streaming mode,
+// it instead only reads through the file data to compute checksums.
 func (e *Encoder) LoadFileData() error {
-	var recoverySet []fileID
-	recoverySetInfos := make(map[fileID]encoderInputFileInfo)
+	return e.LoadFileDataContext(context.Background())
+}
+
+// LoadFileDataContext is like LoadFileData, but it stops and returns
+// ctx.Err() if ctx is done before all the file data is loaded.
+func (e *Encoder) LoadFileDataContext(ctx context.Context) (err error) {
+	// In streaming mode, each file is read a buffer at a time,
+	// so keep it open in the meantime.
+	fileIO, closeFiles := keepFilesOpen(e.fileIO)
+	defer func() {
+		closeErr := closeFiles()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	var recoverySet, nonRecoverySet []fileID
+	fileInfos := make(map[fileID]encoderInputFileInfo)
 
 	for i, relPath := range e.relFilePaths {
 		path := filepath.Join(e.basePath, relPath)
-		data, err := e.fileIO.ReadFile(path)
-		e.delegate.OnDataFileLoad(i+1, len(e.relFilePaths), path, len(data), err)
+		byteCount, fileID, info, err := func() (int, fileID, encoderInputFileInfo, error) {
+			if e.memoryLimit > 0 {
+				fileByteCount, err := e.fileIO.FileByteCount(path)
+				if err != nil {
+					return 0, fileID{}, encoderInputFileInfo{}, err
+				}
+				intFileByteCount, err := fileByteCountToInt(fileByteCount)
+				if err != nil {
+					return 0, fileID{}, encoderInputFileInfo{}, err
+				}
+
+				bufByteCount := streamBufferByteCount
+				if bufByteCount > e.memoryLimit {
+					bufByteCount = e.memoryLimit
+				}
+				r := io.NewSectionReader(fileReaderAt{fileIO, path}, 0, fileByteCount)
+				return e.hashFileData(ctx, path, relPath, r, intFileByteCount, bufByteCount)
+			}
+
+			data, err := e.fileIO.ReadFile(path)
+			if err != nil {
+				return len(data), fileID{}, encoderInputFileInfo{}, err
+			}
+
+			byteCount, fileID, info, err := e.hashFileData(ctx, path, relPath, bytes.NewReader(data), len(data), streamBufferByteCount)
+			info.dataShards = computeDataShards(e.sliceByteCount, data)
+			return byteCount, fileID, info, err
+		}()
+		e.delegate.OnDataFileLoad(i+1, len(e.relFilePaths), path, byteCount, err)
 		if err != nil {
 			return err
 		}
 
-		fileID, fileDescriptionPacket, ifscPacket, dataShards := computeDataFileInfo(e.sliceByteCount, relPath, data)
-		recoverySet = append(recoverySet, fileID)
-		recoverySetInfos[fileID] = encoderInputFileInfo{
-			fileDescriptionPacket, ifscPacket, dataShards,
+		if _, ok := fileInfos[fileID]; ok {
+			return fmt.Errorf("duplicate file ID for %s", path)
 		}
+		// Empty files have no slices, so they go in the
+		// non-recovery set, as the spec says.
+		if byteCount == 0 {
+			nonRecoverySet = append(nonRecoverySet, fileID)
+		} else {
+			recoverySet = append(recoverySet, fileID)
+		}
+		fileInfos[fileID] = info
 	}
 
 	sort.Slice(recoverySet, func(i, j int) bool {
 		return fileIDLess(recoverySet[i], recoverySet[j])
 	})
+	sort.Slice(nonRecoverySet, func(i, j int) bool {
+		return fileIDLess(nonRecoverySet[i], nonRecoverySet[j])
+	})
 
 	e.recoverySet = recoverySet
-	e.recoverySetInfos = recoverySetInfos
+	e.nonRecoverySet = nonRecoverySet
+	e.fileInfos = fileInfos
 	return nil
 }
 
-// ComputeParityData computes the parity data for the files.
+func (e *Encoder) dataShardCount() int {
+	dataShardCount := 0
+	for _, fileID := range e.recoverySet {
+		dataShardCount += len(e.fileInfos[fileID].ifscPacket.checksumPairs)
+	}
+	return dataShardCount
+}
+
+// ComputeParityData computes the parity data for the files. In
+// streaming mode, the parity data is instead computed by Write, so
+// this only checks that it can be done.
 func (e *Encoder) ComputeParityData() error {
+	return e.ComputeParityDataContext(context.Background())
+}
+
+// ComputeParityDataContext is like ComputeParityData, but it stops
+// and returns ctx.Err() if ctx is done before the parity data is
+// computed.
+func (e *Encoder) ComputeParityDataContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(e.recoverySet) == 0 {
+		return errors.New("no non-empty data files")
+	}
+
+	// An index-only set has no parity data to compute.
+	if e.parityShardCount == 0 {
+		return nil
+	}
+
+	if e.memoryLimit > 0 {
+		coder, err := rsec16.NewCoderPAR2Vandermonde(e.dataShardCount(), e.parityShardCount, e.numGoroutines)
+		if err != nil {
+			return err
+		}
+		_, _, err = e.streamingBufferByteCounts()
+		if err != nil {
+			return err
+		}
+		e.coder = coder
+		return nil
+	}
+
 	var dataShards [][]byte
 	for _, fileID := range e.recoverySet {
-		dataShards = append(dataShards, e.recoverySetInfos[fileID].dataShards...)
+		dataShards = append(dataShards, e.fileInfos[fileID].dataShards...)
 	}
 
 	coder, err := rsec16.NewCoderPAR2Vandermonde(len(dataShards), e.parityShardCount, e.numGoroutines)
@@ -122,23 +397,99 @@ func (e *Encoder) ComputeParityData() error {
 		return err
 	}
 
-	e.parityShards = coder.GenerateParity(dataShards)
+	parityShards, err := coder.GenerateParityContext(ctx, dataShards, e.delegate.OnMatrixProgress)
+	if err != nil {
+		return err
+	}
+
+	e.parityShards = parityShards
 	return nil
 }
 
 const clientID = "gopar"
 
+// exponentRange is the range [start, start+count) of the exponents
+// of the recovery packets in a single recovery file.
+type exponentRange struct {
+	start, count int
+}
+
+// computeExponentRanges splits the given number of parity shards
+// into recovery files holding 1, 2, 4, etc. recovery packets.
+func computeExponentRanges(parityShardCount int) []exponentRange {
+	var ranges []exponentRange
+	count := 1
+	for i := 0; i < parityShardCount; {
+		if i+count > parityShardCount {
+			count = parityShardCount - i
+		}
+		ranges = append(ranges, exponentRange{i, count})
+		i += count
+		count *= 2
+	}
+	return ranges
+}
+
+// recoveryFilePaths returns the paths of the recovery files with the
+// given ranges. Like par2cmdline, the exponents and counts in the
+// names are padded to the number of digits of the largest ones, so
+// that the names sort in order, but always to at least two digits.
+func recoveryFilePaths(base string, ranges []exponentRange) []string {
+	startWidth, countWidth := 2, 2
+	for _, r := range ranges {
+		if width := len(strconv.Itoa(r.start)); width > startWidth {
+			startWidth = width
+		}
+		if width := len(strconv.Itoa(r.count)); width > countWidth {
+			countWidth = width
+		}
+	}
+
+	paths := make([]string, len(ranges))
+	for i, r := range ranges {
+		paths[i] = fmt.Sprintf("%s.vol%0*d+%0*d.par2", base, startWidth, r.start, countWidth, r.count)
+	}
+	return paths
+}
+
+// exponentRanges returns how the recovery packets are split among the
+// recovery files.
+func (e *Encoder) exponentRanges() ([]exponentRange, error) {
+	maxByteCount := 0
+	for _, info := range e.fileInfos {
+		if info.fileDescriptionPacket.byteCount > maxByteCount {
+			maxByteCount = info.fileDescriptionPacket.byteCount
+		}
+	}
+	limitCount := (maxByteCount + e.sliceByteCount - 1) / e.sliceByteCount
+	return computeRecoveryFileRanges(e.parityShardCount, e.recoveryFileCount, e.recoveryFileScheme, limitCount)
+}
+
+// Write writes the index file and the recovery files, using the
+// extension-less part of indexPath as the base name.
 func (e *Encoder) Write(indexPath string) error {
+	return e.WriteContext(context.Background(), indexPath)
+}
+
+// WriteContext is like Write, but it stops and returns ctx.Err() if
+// ctx is done before all the files are written. This matters mostly
+// in streaming mode, where the parity data is computed while writing.
+func (e *Encoder) WriteContext(ctx context.Context, indexPath string) error {
 	mainPacket := mainPacket{
 		sliceByteCount: e.sliceByteCount,
 		recoverySet:    e.recoverySet,
+		nonRecoverySet: e.nonRecoverySet,
 	}
 
 	fileDescriptionPackets := make(map[fileID]fileDescriptionPacket)
 	ifscPackets := make(map[fileID]ifscPacket)
-	for fileID, info := range e.recoverySetInfos {
+	unicodeFilenames := make(map[fileID]string)
+	for fileID, info := range e.fileInfos {
 		fileDescriptionPackets[fileID] = info.fileDescriptionPacket
 		ifscPackets[fileID] = info.ifscPacket
+		if info.unicodeFilename != "" {
+			unicodeFilenames[fileID] = info.unicodeFilename
+		}
 	}
 
 	parityFile := file{
@@ -146,9 +497,11 @@ func (e *Encoder) Write(indexPath string) error {
 		mainPacket:             &mainPacket,
 		fileDescriptionPackets: fileDescriptionPackets,
 		ifscPackets:            ifscPackets,
+		unicodeFilenames:       unicodeFilenames,
+		comment:                e.comment,
 	}
 
-	_, parityFileBytes, err := writeFile(parityFile)
+	setID, parityFileBytes, err := writeFile(parityFile)
 	if err != nil {
 		return err
 	}
@@ -164,15 +517,27 @@ func (e *Encoder) Write(indexPath string) error {
 		return err
 	}
 
-	volumeCount := 1
-	for i := 0; i < e.parityShardCount; {
-		recoveryFile := parityFile
-		recoveryFile.recoveryPackets = make(map[exponent]recoveryPacket, volumeCount)
-		if i+volumeCount > e.parityShardCount {
-			volumeCount = e.parityShardCount - i
+	ranges, err := e.exponentRanges()
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	if e.memoryLimit > 0 {
+		return e.writeRecoveryFilesStreaming(ctx, recoveryFilePaths(base, ranges), setID, parityFileBytes, ranges)
+	}
+
+	filenames := recoveryFilePaths(base, ranges)
+	for i, r := range ranges {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		for j := 0; j < volumeCount; j++ {
-			recoveryFile.recoveryPackets[exponent(i+j)] = recoveryPacket{data: e.parityShards[i+j]}
+
+		recoveryFile := parityFile
+		recoveryFile.recoveryPackets = make(map[exponent]recoveryPacket, r.count)
+		for j := 0; j < r.count; j++ {
+			recoveryFile.recoveryPackets[exponent(r.start+j)] = recoveryPacket{data: e.parityShards[r.start+j]}
 		}
 
 		_, recoveryFileBytes, err := writeFile(recoveryFile)
@@ -180,17 +545,208 @@ func (e *Encoder) Write(indexPath string) error {
 			return err
 		}
 
-		// TODO: Figure out how to handle when either i or
-		// volumeCount is >= 100.
-		filename := fmt.Sprintf("%s.vol%02d+%02d.par2", base, i, volumeCount)
+		filename := filenames[i]
 		err = e.fileIO.WriteFile(filename, recoveryFileBytes)
-		e.delegate.OnRecoveryFileWrite(i, volumeCount, e.parityShardCount, filename, len(recoveryFileBytes)-len(parityFileBytes), len(recoveryFileBytes), err)
+		e.delegate.OnRecoveryFileWrite(r.start, r.count, e.parityShardCount, filename, len(recoveryFileBytes)-len(parityFileBytes), len(recoveryFileBytes), err)
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
 
-		i += volumeCount
-		volumeCount *= 2
+// streamingBufferByteCounts returns the byte count of the pieces of
+// each slice to process per pass in streaming mode, and the number
+// of data slice pieces to read in at a time, such that buffers for
+// those plus the parity slice pieces fit in the memory limit.
+func (e *Encoder) streamingBufferByteCounts() (pieceByteCount, dataPieceCount int, err error) {
+	pieceByteCount = e.memoryLimit / (e.parityShardCount + 1)
+	pieceByteCount -= pieceByteCount % 4
+	if pieceByteCount == 0 {
+		return 0, 0, errors.New("memory limit too small")
+	}
+	if pieceByteCount > e.sliceByteCount {
+		pieceByteCount = e.sliceByteCount
+	}
+
+	dataPieceCount = (e.memoryLimit - e.parityShardCount*pieceByteCount) / pieceByteCount
+	if dataShardCount := e.dataShardCount(); dataPieceCount > dataShardCount {
+		dataPieceCount = dataShardCount
+	}
+	return pieceByteCount, dataPieceCount, nil
+}
+
+// accumulateParityPieces adds the contribution of the data slice
+// pieces starting at pieceStart in each slice, read with fileIO, to
+// parityPieces, which are sized to the piece byte count.
+func (e *Encoder) accumulateParityPieces(ctx context.Context, fileIO fileIO, pieceStart int, dataPieces, parityPieces [][]byte, progress *matrixProgress) error {
+	for _, piece := range parityPieces {
+		for i := range piece {
+			piece[i] = 0
+		}
+	}
+
+	dataStart := 0
+	dataPieceCount := 0
+	flush := func() error {
+		err := e.coder.AccumulateParityContext(ctx, dataStart, dataPieces[:dataPieceCount], parityPieces, progress.progressFunc())
+		dataStart += dataPieceCount
+		dataPieceCount = 0
+		return err
+	}
+
+	for _, fileID := range e.recoverySet {
+		info := e.fileInfos[fileID]
+		path := filepath.Join(e.basePath, info.name())
+		for i := range info.ifscPacket.checksumPairs {
+			offset := int64(i)*int64(e.sliceByteCount) + int64(pieceStart)
+			err := readFileAtPadded(fileIO, path, dataPieces[dataPieceCount], offset)
+			if err != nil {
+				return err
+			}
+			dataPieceCount++
+			if dataPieceCount == len(dataPieces) {
+				err := flush()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if dataPieceCount > 0 {
+		return flush()
+	}
+	return nil
+}
+
+func makeByteSlices(count, byteCount int) [][]byte {
+	slices := make([][]byte, count)
+	for i := range slices {
+		slices[i] = make([]byte, byteCount)
+	}
+	return slices
+}
+
+// writeRecoveryFilesStreaming writes the recovery files in streaming
+// mode, with filenames[i] being the path of the one for ranges[i]. It
+// lays out each recovery file exactly as writeFile would,
+// i.e. as parityFileBytes followed by the recovery packets, but it
+// fills in the recovery data piece by piece as it's computed,
+// writing each packet header last, once its hash is known.
+func (e *Encoder) writeRecoveryFilesStreaming(ctx context.Context, filenames []string, setID recoverySetID, parityFileBytes []byte, ranges []exponentRange) error {
+	pieceByteCount, dataPieceCount, err := e.streamingBufferByteCounts()
+	if err != nil {
+		return err
+	}
+
+	// Every parity row is applied once per batch of data slice
+	// pieces in each pass.
+	passCount := (e.sliceByteCount + pieceByteCount - 1) / pieceByteCount
+	batchCount := 0
+	if dataPieceCount > 0 {
+		batchCount = (e.dataShardCount() + dataPieceCount - 1) / dataPieceCount
+	}
+	progress := &matrixProgress{
+		rowCount:   passCount * batchCount * e.parityShardCount,
+		onProgress: e.delegate.OnMatrixProgress,
+	}
+
+	recoveryPacketByteCount := int(sizeOfPacketHeader()) + 4 + e.sliceByteCount
+	// Indexed by exponent.
+	recoveryDataOffsets := make([]int64, e.parityShardCount)
+	packetHashes := make([]hash.Hash, e.parityShardCount)
+	for i, r := range ranges {
+		err := e.fileIO.WriteFile(filenames[i], parityFileBytes)
+		if err != nil {
+			e.delegate.OnRecoveryFileWrite(r.start, r.count, e.parityShardCount, filenames[i], 0, 0, err)
+			return err
+		}
+		for j := 0; j < r.count; j++ {
+			exp := r.start + j
+			recoveryDataOffsets[exp] = int64(len(parityFileBytes)) + int64(j)*int64(recoveryPacketByteCount) + int64(sizeOfPacketHeader()) + 4
+			packetHashes[exp] = md5.New()
+			var expBytes [4]byte
+			binary.LittleEndian.PutUint32(expBytes[:], uint32(exp))
+			_, _ = packetHashes[exp].Write(setID[:])
+			_, _ = packetHashes[exp].Write(recoveryPacketType[:])
+			_, _ = packetHashes[exp].Write(expBytes[:])
+		}
+	}
+
+	// Each data file and recovery file is gone through a piece
+	// of each slice at a time, so keep them open until all the
+	// recovery data is written.
+	fileIO, closeFiles := keepFilesOpen(e.fileIO)
+	defer func() {
+		_ = closeFiles()
+	}()
+
+	dataPieces := makeByteSlices(dataPieceCount, pieceByteCount)
+	parityPieces := makeByteSlices(e.parityShardCount, pieceByteCount)
+	for pieceStart := 0; pieceStart < e.sliceByteCount; pieceStart += pieceByteCount {
+		if pieceStart+pieceByteCount > e.sliceByteCount {
+			n := e.sliceByteCount - pieceStart
+			for i := range dataPieces {
+				dataPieces[i] = dataPieces[i][:n]
+			}
+			for i := range parityPieces {
+				parityPieces[i] = parityPieces[i][:n]
+			}
+		}
+
+		err := e.accumulateParityPieces(ctx, fileIO, pieceStart, dataPieces, parityPieces, progress)
+		if err != nil {
+			return err
+		}
+
+		for i, r := range ranges {
+			for exp := r.start; exp < r.start+r.count; exp++ {
+				_, _ = packetHashes[exp].Write(parityPieces[exp])
+				err := fileIO.WriteFileAt(filenames[i], parityPieces[exp], recoveryDataOffsets[exp]+int64(pieceStart))
+				if err != nil {
+					e.delegate.OnRecoveryFileWrite(r.start, r.count, e.parityShardCount, filenames[i], 0, 0, err)
+					return err
+				}
+			}
+		}
+	}
+
+	err = closeFiles()
+	if err != nil {
+		return err
+	}
+
+	for i, r := range ranges {
+		err := func() error {
+			for exp := r.start; exp < r.start+r.count; exp++ {
+				h := packetHeader{
+					Magic:         expectedMagic,
+					Length:        uint64(recoveryPacketByteCount),
+					RecoverySetID: setID,
+					Type:          recoveryPacketType,
+				}
+				packetHashes[exp].Sum(h.Hash[:0])
+				var buf bytes.Buffer
+				err := writePacketHeader(&buf, h)
+				if err != nil {
+					return err
+				}
+				var expBytes [4]byte
+				binary.LittleEndian.PutUint32(expBytes[:], uint32(exp))
+				buf.Write(expBytes[:])
+				err = e.fileIO.WriteFileAt(filenames[i], buf.Bytes(), recoveryDataOffsets[exp]-int64(buf.Len()))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+		dataByteCount := r.count * recoveryPacketByteCount
+		e.delegate.OnRecoveryFileWrite(r.start, r.count, e.parityShardCount, filenames[i], dataByteCount, len(parityFileBytes)+dataByteCount, err)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
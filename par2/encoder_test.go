@@ -1,6 +1,7 @@
 package par2
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"path/filepath"
@@ -22,6 +23,16 @@ func (d testEncoderDelegate) OnDataFileLoad(i, n int, path string, byteCount int
 	d.t.Logf("OnDataFileLoad(%d, %d, byteCount=%d, %s, %v)", i, n, byteCount, path, err)
 }
 
+func (d testEncoderDelegate) OnDataFileHashProgress(path string, hashedByteCount, byteCount int) {
+	d.t.Helper()
+	d.t.Logf("OnDataFileHashProgress(%s, hashedByteCount=%d, byteCount=%d)", path, hashedByteCount, byteCount)
+}
+
+func (d testEncoderDelegate) OnMatrixProgress(rowsApplied, rowCount int) {
+	d.t.Helper()
+	d.t.Logf("OnMatrixProgress(%d, %d)", rowsApplied, rowCount)
+}
+
 func (d testEncoderDelegate) OnIndexFileWrite(path string, byteCount int, err error) {
 	d.t.Helper()
 	d.t.Logf("OnIndexFileWrite(%s, %d, %v)", path, byteCount, err)
@@ -33,7 +44,11 @@ func (d testEncoderDelegate) OnRecoveryFileWrite(start, count, total int, path s
 }
 
 func newEncoderForTest(t *testing.T, fs memfs.MemFS, basePath string, paths []string, sliceByteCount, parityShardCount int) (*Encoder, error) {
-	return newEncoder(testFileIO{t, fs}, testEncoderDelegate{t}, basePath, paths, sliceByteCount, parityShardCount, rsec16.DefaultNumGoroutines())
+	return newEncoderWithOptionsForTest(t, fs, basePath, paths, sliceByteCount, parityShardCount, EncoderOptions{})
+}
+
+func newEncoderWithOptionsForTest(t *testing.T, fs memfs.MemFS, basePath string, paths []string, sliceByteCount, parityShardCount int, options EncoderOptions) (*Encoder, error) {
+	return newEncoder(testFileIO{t, fs}, testEncoderDelegate{t}, basePath, paths, sliceByteCount, parityShardCount, rsec16.DefaultNumGoroutines(), options)
 }
 
 func makeEncoderMemFS(workingDir string) memfs.MemFS {
@@ -181,3 +196,283 @@ func TestWriteParityFilesOutOfBasePath(t *testing.T) {
 	_, err := newEncoderForTest(t, fs, filepath.Join(dir, "somedir"), paths, sliceByteCount, parityShardCount)
 	require.Equal(t, errors.New("data files must lie in basePath"), err)
 }
+
+func TestEncoderHiddenFiles(t *testing.T) {
+	dir := memfs.RootDir()
+	fs := memfs.MakeMemFS(dir, map[string][]byte{
+		".hidden":                           {0x1, 0x2, 0x3},
+		filepath.Join("dir", ".hidden"):     {0x4, 0x5},
+		filepath.Join("..dir", "file.rar"):  {0x6},
+		filepath.Join(".dir", "..file.rar"): {0x7, 0x8},
+	})
+
+	paths := fs.Paths()
+
+	sliceByteCount := 4
+	parityShardCount := 3
+	encoder, err := newEncoderForTest(t, fs, dir, paths, sliceByteCount, parityShardCount)
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.NoError(t, encoder.Write(filepath.Join(dir, "file.par2")))
+}
+
+func TestRecoveryFilePaths(t *testing.T) {
+	require.Equal(t, []string{
+		"file.vol00+01.par2",
+		"file.vol01+02.par2",
+	}, recoveryFilePaths("file", computeExponentRanges(3)))
+
+	require.Equal(t, []string{
+		"file.vol000+01.par2",
+		"file.vol001+02.par2",
+		"file.vol003+04.par2",
+		"file.vol007+08.par2",
+		"file.vol015+16.par2",
+		"file.vol031+32.par2",
+		"file.vol063+64.par2",
+		"file.vol127+23.par2",
+	}, recoveryFilePaths("file", computeExponentRanges(150)))
+
+	require.Equal(t, []string{
+		"file.vol00+050.par2",
+		"file.vol50+100.par2",
+	}, recoveryFilePaths("file", []exponentRange{{0, 50}, {50, 100}}))
+}
+
+func writeParityForTest(t *testing.T, fs memfs.MemFS, workingDir string, paths []string, sliceByteCount, parityShardCount int, options EncoderOptions) {
+	encoder, err := newEncoderWithOptionsForTest(t, fs, workingDir, paths, sliceByteCount, parityShardCount, options)
+	require.NoError(t, err)
+
+	err = encoder.LoadFileData()
+	require.NoError(t, err)
+
+	err = encoder.ComputeParityData()
+	require.NoError(t, err)
+
+	err = encoder.Write(filepath.Join(workingDir, "parity.par2"))
+	require.NoError(t, err)
+}
+
+func TestEncoderSizingOptions(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := memfs.MakeMemFS(workingDir, map[string][]byte{
+		"file.rar":                        make([]byte, 100),
+		filepath.Join("dir1", "file.r01"): make([]byte, 50),
+		filepath.Join("dir1", "file.r02"): make([]byte, 1),
+	})
+	paths := fs.Paths()
+
+	encoder, err := newEncoderWithOptionsForTest(t, fs, workingDir, paths, 0, 0, EncoderOptions{
+		SliceCount:         10,
+		RedundancyPercent:  50,
+		RecoveryFileScheme: UniformRecoveryFiles,
+		RecoveryFileCount:  2,
+	})
+	require.NoError(t, err)
+	// Slices of 20 bytes give 5 + 3 + 1 = 9 slices.
+	require.Equal(t, 20, encoder.sliceByteCount)
+	require.Equal(t, 5, encoder.parityShardCount)
+
+	require.NoError(t, encoder.LoadFileData())
+	require.NoError(t, encoder.ComputeParityData())
+	require.NoError(t, encoder.Write(filepath.Join(workingDir, "parity.par2")))
+
+	for _, filename := range []string{"parity.par2", "parity.vol00+03.par2", "parity.vol03+02.par2"} {
+		_, err := fs.FileByteCount(filepath.Join(workingDir, filename))
+		require.NoError(t, err, filename)
+	}
+	require.Equal(t, len(paths)+3, fs.FileCount())
+
+	_, err = newEncoderWithOptionsForTest(t, fs, workingDir, paths, 0, 3, EncoderOptions{RedundancyPercent: 50})
+	require.Equal(t, errors.New("parity shard count and redundancy percent both given"), err)
+	_, err = newEncoderWithOptionsForTest(t, fs, workingDir, paths, 4, 3, EncoderOptions{RecoveryFileCount: 4})
+	require.Equal(t, errors.New("more recovery files than recovery blocks"), err)
+}
+
+func TestWriteParityStreaming(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := memfs.MakeMemFS(workingDir, map[string][]byte{
+		"file.rar":                        []byte("a file whose size isn't a multiple of the slice size"),
+		filepath.Join("dir1", "file.r01"): []byte("another file"),
+		filepath.Join("dir1", "file.r02"): []byte("yet another file, a bit longer than the others"),
+	})
+	paths := fs.Paths()
+
+	sliceByteCount := 8
+	parityShardCount := 5
+	writeParityForTest(t, fs, workingDir, paths, sliceByteCount, parityShardCount, EncoderOptions{})
+
+	expectedFiles := make(map[string][]byte)
+	for _, path := range fs.Paths() {
+		if strings.HasPrefix(path, filepath.Join(workingDir, "parity")) {
+			data, err := fs.RemoveFile(path)
+			require.NoError(t, err)
+			expectedFiles[path] = data
+		}
+	}
+	require.Equal(t, 4, len(expectedFiles))
+
+	// The memory limits cover reading more than one slice at a
+	// time, reading one slice at a time, and reading pieces of
+	// slices in several passes.
+	for _, memoryLimit := range []int{1024, 48, 24} {
+		t.Run(fmt.Sprintf("memoryLimit=%d", memoryLimit), func(t *testing.T) {
+			writeParityForTest(t, fs, workingDir, paths, sliceByteCount, parityShardCount, EncoderOptions{MemoryLimit: memoryLimit})
+			for path, expectedData := range expectedFiles {
+				data, err := fs.RemoveFile(path)
+				require.NoError(t, err)
+				require.Equal(t, expectedData, data, path)
+			}
+		})
+	}
+}
+
+func TestWriteIndexOnly(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeEncoderMemFS(workingDir)
+	paths := fs.Paths()
+
+	for _, memoryLimit := range []int{0, 1024} {
+		t.Run(fmt.Sprintf("memoryLimit=%d", memoryLimit), func(t *testing.T) {
+			writeParityForTest(t, fs, workingDir, paths, 4, 0, EncoderOptions{MemoryLimit: memoryLimit})
+
+			var parityPaths []string
+			for _, path := range fs.Paths() {
+				if strings.HasPrefix(path, filepath.Join(workingDir, "parity")) {
+					parityPaths = append(parityPaths, path)
+				}
+			}
+			require.Equal(t, []string{filepath.Join(workingDir, "parity.par2")}, parityPaths)
+			_, err := fs.RemoveFile(parityPaths[0])
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestEncodeInvalidParityShardCount(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeEncoderMemFS(workingDir)
+
+	_, err := newEncoderForTest(t, fs, workingDir, fs.Paths(), 4, -1)
+	require.Equal(t, errors.New("invalid parity shard count"), err)
+}
+
+func TestEncoderEmptyAndDuplicateFiles(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := memfs.MakeMemFS(workingDir, map[string][]byte{
+		"file.rar":                     {0x1, 0x2, 0x3},
+		"empty":                        {},
+		filepath.Join("dir1", "empty"): {},
+	})
+	paths := fs.Paths()
+
+	encoder, err := newEncoderForTest(t, fs, workingDir, append(paths, paths...), 4, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(encoder.relFilePaths))
+
+	require.NoError(t, encoder.LoadFileData())
+	require.Equal(t, 1, len(encoder.recoverySet))
+	require.Equal(t, 2, len(encoder.nonRecoverySet))
+	require.Equal(t, 3, len(encoder.fileInfos))
+
+	encoder, err = newEncoderForTest(t, fs, workingDir, []string{filepath.Join(workingDir, "empty")}, 4, 3)
+	require.NoError(t, err)
+	require.NoError(t, encoder.LoadFileData())
+	require.Equal(t, errors.New("no non-empty data files"), encoder.ComputeParityData())
+}
+
+func TestStreamingMemoryLimitTooSmall(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeEncoderMemFS(workingDir)
+
+	encoder, err := newEncoderWithOptionsForTest(t, fs, workingDir, fs.Paths(), 4, 3, EncoderOptions{MemoryLimit: 15})
+	require.NoError(t, err)
+
+	err = encoder.LoadFileData()
+	require.NoError(t, err)
+
+	err = encoder.ComputeParityData()
+	require.Equal(t, errors.New("memory limit too small"), err)
+}
+
+// progressEncoderDelegate records the progress reported to it, and
+// calls cancel, if it's non-nil, on the first matrix progress.
+type progressEncoderDelegate struct {
+	testEncoderDelegate
+	hashedByteCounts map[string]int
+	matrixProgress   [][2]int
+	cancel           func()
+}
+
+func (d *progressEncoderDelegate) OnDataFileHashProgress(path string, hashedByteCount, byteCount int) {
+	d.hashedByteCounts[path] = hashedByteCount
+}
+
+func (d *progressEncoderDelegate) OnMatrixProgress(rowsApplied, rowCount int) {
+	d.matrixProgress = append(d.matrixProgress, [2]int{rowsApplied, rowCount})
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+func TestEncoderContext(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := memfs.MakeMemFS(workingDir, map[string][]byte{
+		"file.rar":                        []byte("a file whose size isn't a multiple of the slice size"),
+		filepath.Join("dir1", "file.r01"): []byte("another file"),
+		filepath.Join("dir1", "file.r02"): []byte("yet another file, a bit longer than the others"),
+	})
+	paths := fs.Paths()
+
+	// Each parity row is applied once in memory, and once per
+	// data slice piece in streaming mode, since these memory
+	// limits only leave room for one data slice piece at a time.
+	// There are 15 data slices, and a memory limit of 24 splits
+	// each one into 2 pieces.
+	for _, c := range []struct {
+		memoryLimit, rowCount int
+	}{
+		{0, 5}, {48, 5 * 15}, {24, 5 * 15 * 2},
+	} {
+		c := c
+		t.Run(fmt.Sprintf("memoryLimit=%d", c.memoryLimit), func(t *testing.T) {
+			delegate := &progressEncoderDelegate{testEncoderDelegate{t}, make(map[string]int), nil, nil}
+			encoder, err := newEncoder(testFileIO{t, fs}, delegate, workingDir, paths, 8, 5, rsec16.DefaultNumGoroutines(), EncoderOptions{MemoryLimit: c.memoryLimit})
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			require.NoError(t, encoder.LoadFileDataContext(ctx))
+			require.NoError(t, encoder.ComputeParityDataContext(ctx))
+			require.NoError(t, encoder.WriteContext(ctx, filepath.Join(workingDir, "parity.par2")))
+
+			expectedHashedByteCounts := make(map[string]int)
+			for _, path := range paths {
+				data, err := fs.ReadFile(path)
+				require.NoError(t, err)
+				expectedHashedByteCounts[path] = len(data)
+			}
+			require.Equal(t, expectedHashedByteCounts, delegate.hashedByteCounts)
+			require.Equal(t, c.rowCount, len(delegate.matrixProgress))
+			for i, progress := range delegate.matrixProgress {
+				require.Equal(t, [2]int{i + 1, c.rowCount}, progress)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			delegate = &progressEncoderDelegate{testEncoderDelegate{t}, make(map[string]int), nil, cancel}
+			encoder, err = newEncoder(testFileIO{t, fs}, delegate, workingDir, paths, 8, 5, rsec16.DefaultNumGoroutines(), EncoderOptions{MemoryLimit: c.memoryLimit})
+			require.NoError(t, err)
+
+			require.NoError(t, encoder.LoadFileDataContext(ctx))
+			err = encoder.ComputeParityDataContext(ctx)
+			if err == nil {
+				err = encoder.WriteContext(ctx, filepath.Join(workingDir, "parity.par2"))
+			}
+			require.Equal(t, context.Canceled, err)
+			require.Equal(t, [][2]int{{1, c.rowCount}}, delegate.matrixProgress)
+
+			err = encoder.LoadFileDataContext(ctx)
+			require.Equal(t, context.Canceled, err)
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"crypto/md5"
 	"errors"
 	"io"
-	"reflect"
 	"sort"
 )
 
@@ -14,8 +13,15 @@ type file struct {
 	mainPacket             *mainPacket
 	fileDescriptionPackets map[fileID]fileDescriptionPacket
 	ifscPackets            map[fileID]ifscPacket
-	recoveryPackets        map[exponent]recoveryPacket
-	unknownPackets         map[packetType][][]byte
+	// Holds the filenames from the Unicode filename packets,
+	// which are preferred over the ones in the file
+	// description packets.
+	unicodeFilenames map[fileID]string
+	// Holds the comment from the Unicode comment packet, if
+	// any, or else the one from the ASCII comment packet.
+	comment         string
+	recoveryPackets map[exponent]recoveryPacket
+	unknownPackets  map[packetType][][]byte
 }
 
 type noPacketsFoundError struct{}
@@ -25,7 +31,35 @@ func (noPacketsFoundError) Error() string {
 }
 
 func readFile(delegate DecoderDelegate, expectedSetID *recoverySetID, fileBytes []byte) (recoverySetID, file, error) {
-	buf := bytes.NewBuffer(fileBytes)
+	setID, f, err := readFileAt(delegate, expectedSetID, bytes.NewReader(fileBytes), int64(len(fileBytes)), nil)
+	if err != nil {
+		return recoverySetID{}, file{}, err
+	}
+
+	if len(f.clientID) == 0 {
+		return recoverySetID{}, file{}, errors.New("no creator packet found")
+	}
+
+	return setID, f, nil
+}
+
+// A recoveryDataLocation is the location of the data of a recovery
+// packet within a file.
+type recoveryDataLocation struct {
+	start     int
+	byteCount int
+}
+
+// readFileAt is like readFile, but reads the first byteCount bytes of
+// r, and doesn't require a creator packet, since it may be found in
+// another file. Corrupt packets and any other garbage are skipped, as
+// are packets whose hashes match but whose bodies are malformed.
+// Packets that aren't used are hashed a piece at a time instead of
+// being loaded into memory. If recoveryDataLocations is non-nil, the
+// same is done for recovery packets, and the locations of their data
+// are stored in it instead of in the returned file.
+func readFileAt(delegate DecoderDelegate, expectedSetID *recoverySetID, r io.ReaderAt, byteCount int64, recoveryDataLocations map[exponent]recoveryDataLocation) (recoverySetID, file, error) {
+	r = io.NewSectionReader(r, 0, byteCount)
 
 	var setID recoverySetID
 	var hasSetID bool
@@ -36,26 +70,70 @@ func readFile(delegate DecoderDelegate, expectedSetID *recoverySetID, fileBytes
 
 	var foundPacket bool
 	var clientID string
-	var foundClientID bool
 	var mainPacket *mainPacket
+	var mainPacketBody []byte
 	fileDescriptionPackets := make(map[fileID]fileDescriptionPacket)
 	ifscPackets := make(map[fileID]ifscPacket)
+	unicodeFilenames := make(map[fileID]string)
+	var asciiComment, unicodeComment string
+	var hasUnicodeComment bool
 	recoveryPackets := make(map[exponent]recoveryPacket)
 	unknownPackets := make(map[packetType][][]byte)
-	for {
-		packetSetID, packetType, body, err := readNextPacket(buf)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			// TODO: Relax this check.
+	recoveryPacketHashes := make(map[exponent][md5.Size]byte)
+	// Corrupt or cut-off packets are skipped by looking for the
+	// next magic string, and each run of skipped bytes is
+	// reported to the delegate.
+	corruptStart := int64(-1)
+	for offset := int64(0); offset < byteCount; {
+		var skip, locateRecoveryData bool
+		h, body, ok, err := readPacketAt(r, offset, byteCount, func(h packetHeader) bool {
+			skip = hasSetID && recoverySetID(h.RecoverySetID) != setID
+			locateRecoveryData = !skip && packetType(h.Type) == recoveryPacketType && recoveryDataLocations != nil
+			// Only load the body if it's needed, since
+			// it may be large.
+			return !skip && !locateRecoveryData
+		})
+		if err != nil {
 			return recoverySetID{}, file{}, err
 		}
-		if hasSetID {
-			if packetSetID != setID {
-				delegate.OnOtherPacketSkip(packetSetID, packetType, len(body))
+		if !ok {
+			if corruptStart < 0 {
+				corruptStart = offset
+			}
+			offset, err = findPacketMagicAt(r, offset+1, byteCount)
+			if err != nil {
+				return recoverySetID{}, file{}, err
+			}
+			continue
+		}
+		if corruptStart >= 0 {
+			delegate.OnCorruptDataSkip(int(corruptStart), int(offset))
+			corruptStart = -1
+		}
+
+		// TODO: Handle overflow.
+		bodyOffset := offset + int64(sizeOfPacketHeader())
+		bodyByteCount := int64(h.Length - sizeOfPacketHeader())
+		offset = bodyOffset + bodyByteCount
+
+		packetSetID, packetType := recoverySetID(h.RecoverySetID), packetType(h.Type)
+		if skip {
+			delegate.OnOtherPacketSkip(packetSetID, packetType, int(bodyByteCount))
+			continue
+		}
+		if packetType == mainPacketType {
+			// The recovery set ID is the hash of the
+			// padded main packet body, which is what's
+			// read, so a main packet that doesn't hash
+			// to it can't be trusted, either for its
+			// contents or for its set ID.
+			computedSetID := recoverySetID(md5.Sum(body))
+			if computedSetID != packetSetID {
+				delegate.OnInvalidMainPacketSkip(packetSetID, computedSetID)
 				continue
 			}
-		} else {
+		}
+		if !hasSetID {
 			setID = packetSetID
 			hasSetID = true
 		}
@@ -64,27 +142,35 @@ func readFile(delegate DecoderDelegate, expectedSetID *recoverySetID, fileBytes
 		case creatorPacketType:
 			clientID = readCreatorPacket(body)
 			delegate.OnCreatorPacketLoad(clientID)
-			foundClientID = true
 
 		case mainPacketType:
-			// TODO: Handle duplicate main packets.
-			//
-			// TODO: Warn if the recovery set ID computed
-			// from the main packet doesn't equal setID.
+			// Any other main packet should be identical
+			// to the first one, which it mustn't replace.
+			// Since both hash to the set ID, they can
+			// only differ because of an MD5 collision.
+			if mainPacket != nil {
+				if !bytes.Equal(body, mainPacketBody) {
+					return recoverySetID{}, file{}, errors.New("conflicting main packets")
+				}
+				delegate.OnDuplicateMainPacketLoad()
+				continue
+			}
+
 			mainPacketRead, err := readMainPacket(body)
 			if err != nil {
-				// TODO: Relax this check.
-				return recoverySetID{}, file{}, err
+				delegate.OnMalformedPacketSkip(packetType, int(bodyByteCount), err)
+				continue
 			}
 
 			mainPacket = &mainPacketRead
+			mainPacketBody = body
 			delegate.OnMainPacketLoad(mainPacket.sliceByteCount, len(mainPacket.recoverySet), len(mainPacket.nonRecoverySet))
 
 		case fileDescriptionPacketType:
 			fileID, fileDescriptionPacket, err := readFileDescriptionPacket(body)
 			if err != nil {
-				// TODO: Relax this check.
-				return recoverySetID{}, file{}, err
+				delegate.OnMalformedPacketSkip(packetType, int(bodyByteCount), err)
+				continue
 			}
 
 			delegate.OnFileDescriptionPacketLoad(fileID, fileDescriptionPacket.filename, fileDescriptionPacket.byteCount)
@@ -93,27 +179,73 @@ func readFile(delegate DecoderDelegate, expectedSetID *recoverySetID, fileBytes
 		case ifscPacketType:
 			fileID, ifscPacket, err := readIFSCPacket(body)
 			if err != nil {
-				// TODO: Relax this check.
-				return recoverySetID{}, file{}, err
+				delegate.OnMalformedPacketSkip(packetType, int(bodyByteCount), err)
+				continue
 			}
 
 			delegate.OnIFSCPacketLoad(fileID)
 			ifscPackets[fileID] = ifscPacket
 
+		case unicodeFilenamePacketType:
+			fileID, filename, err := readUnicodeFilenamePacket(body)
+			if err != nil {
+				// Unicode filename packets are optional,
+				// so fall back to the ASCII filename.
+				delegate.OnMalformedPacketSkip(packetType, int(bodyByteCount), err)
+				continue
+			}
+
+			delegate.OnUnicodeFilenamePacketLoad(fileID, filename)
+			unicodeFilenames[fileID] = filename
+
+		case asciiCommentPacketType:
+			asciiComment = readASCIICommentPacket(body)
+			delegate.OnCommentPacketLoad(asciiComment)
+
+		case unicodeCommentPacketType:
+			comment, err := readUnicodeCommentPacket(body)
+			if err != nil {
+				// Likewise, fall back to the ASCII
+				// comment, if any.
+				delegate.OnMalformedPacketSkip(packetType, int(bodyByteCount), err)
+				continue
+			}
+
+			delegate.OnCommentPacketLoad(comment)
+			unicodeComment = comment
+			hasUnicodeComment = true
+
 		case recoveryPacketType:
-			exponent, recoveryPacket, err := readRecoveryPacket(body)
+			bodyStart := body
+			if locateRecoveryData {
+				bodyStart = make([]byte, 4)
+				_, err := r.ReadAt(bodyStart, bodyOffset)
+				if err != nil {
+					delegate.OnMalformedPacketSkip(packetType, int(bodyByteCount), err)
+					continue
+				}
+			}
+			exponent, err := readRecoveryPacketExponent(bodyStart, int(bodyByteCount))
 			if err != nil {
-				// TODO: Relax this check.
-				return recoverySetID{}, file{}, err
+				delegate.OnMalformedPacketSkip(packetType, int(bodyByteCount), err)
+				continue
 			}
 
-			delegate.OnRecoveryPacketLoad(uint16(exponent), len(recoveryPacket.data))
-			if existingPacket, ok := recoveryPackets[exponent]; ok {
-				if !reflect.DeepEqual(existingPacket, recoveryPacket) {
-					return recoverySetID{}, file{}, errors.New("recovery packet with duplicate exponent but differing contents")
+			delegate.OnRecoveryPacketLoad(uint16(exponent), int(bodyByteCount)-4)
+			// The packet hash covers the exponent and the
+			// data, so it can be compared instead.
+			if existingHash, ok := recoveryPacketHashes[exponent]; ok && existingHash != h.Hash {
+				return recoverySetID{}, file{}, errors.New("recovery packet with duplicate exponent but differing contents")
+			}
+			recoveryPacketHashes[exponent] = h.Hash
+
+			if locateRecoveryData {
+				recoveryDataLocations[exponent] = recoveryDataLocation{
+					int(bodyOffset) + 4, int(bodyByteCount) - 4,
 				}
+			} else {
+				recoveryPackets[exponent] = recoveryPacket{body[4:]}
 			}
-			recoveryPackets[exponent] = recoveryPacket
 
 		default:
 			delegate.OnUnknownPacketLoad(packetType, len(body))
@@ -121,15 +253,20 @@ func readFile(delegate DecoderDelegate, expectedSetID *recoverySetID, fileBytes
 		}
 	}
 
+	if corruptStart >= 0 {
+		delegate.OnCorruptDataSkip(int(corruptStart), int(byteCount))
+	}
+
 	if !foundPacket {
 		return recoverySetID{}, file{}, noPacketsFoundError{}
 	}
 
-	if !foundClientID {
-		return recoverySetID{}, file{}, errors.New("no creator packet found")
+	comment := asciiComment
+	if hasUnicodeComment {
+		comment = unicodeComment
 	}
 
-	return setID, file{clientID, mainPacket, fileDescriptionPackets, ifscPackets, recoveryPackets, unknownPackets}, nil
+	return setID, file{clientID, mainPacket, fileDescriptionPackets, ifscPackets, unicodeFilenames, comment, recoveryPackets, unknownPackets}, nil
 }
 
 func padPacketBytes(packetBytes []byte) []byte {
@@ -188,6 +325,23 @@ func writeFile(file file) (recoverySetID, []byte, error) {
 			return recoverySetID{}, nil, err
 		}
 
+		if filename, ok := file.unicodeFilenames[fileID]; ok {
+			unicodeFilenamePacketBytes, err := writeUnicodeFilenamePacket(fileID, filename)
+			if err != nil {
+				return recoverySetID{}, nil, err
+			}
+			err = writeNextPacket(buf, setID, unicodeFilenamePacketType, padPacketBytes(unicodeFilenamePacketBytes))
+			if err != nil {
+				return recoverySetID{}, nil, err
+			}
+		}
+
+		// Empty files have no slices, and so no input file
+		// slice checksum packet.
+		if fileDescriptionPacket.byteCount == 0 {
+			continue
+		}
+
 		ifscPacket, ok := file.ifscPackets[fileID]
 		if !ok {
 			return recoverySetID{}, nil, errors.New("could not find input file slice checksum packet")
@@ -203,6 +357,26 @@ func writeFile(file file) (recoverySetID, []byte, error) {
 		}
 	}
 
+	// Only one comment packet is written: an ASCII one if
+	// possible, and a Unicode one otherwise.
+	if len(file.comment) > 0 {
+		if isASCIIString(file.comment) {
+			commentPacketBytes, err := writeASCIICommentPacket(file.comment)
+			if err != nil {
+				return recoverySetID{}, nil, err
+			}
+			err = writeNextPacket(buf, setID, asciiCommentPacketType, padPacketBytes(commentPacketBytes))
+			if err != nil {
+				return recoverySetID{}, nil, err
+			}
+		} else {
+			err = writeNextPacket(buf, setID, unicodeCommentPacketType, padPacketBytes(writeUnicodeCommentPacket(file.comment)))
+			if err != nil {
+				return recoverySetID{}, nil, err
+			}
+		}
+	}
+
 	var exponents []int
 	for exp := range file.recoveryPackets {
 		exponents = append(exponents, int(exp))
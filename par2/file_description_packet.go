@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"path"
+	"strings"
 )
 
 var fileDescriptionPacketType = packetType{'P', 'A', 'R', ' ', '2', '.', '0', '\x00', 'F', 'i', 'l', 'e', 'D', 'e', 's', 'c'}
@@ -45,7 +46,8 @@ func checkFilename(filename string) error {
 		return errors.New("absolute paths not allowed")
 	}
 	filename = path.Clean(filename)
-	if filename[0] == '.' {
+	// Hidden files are fine, but not a leading .. path element.
+	if filename == "." || filename == ".." || strings.HasPrefix(filename, "../") {
 		return errors.New("traversing outside of the current directory is not allowed")
 	}
 	return nil
@@ -66,15 +68,6 @@ func readFileDescriptionPacket(body []byte) (fileID, fileDescriptionPacket, erro
 		return fileID{}, fileDescriptionPacket{}, errors.New("file ID mismatch")
 	}
 
-	if h.Length == 0 {
-		// This isn't specified by the spec, but par2 skips
-		// empty files.
-		//
-		// TODO: Figure out if other programs create empty
-		// files.
-		return fileID{}, fileDescriptionPacket{}, errors.New("empty files not allowed")
-	}
-
 	filename := decodeNullPaddedASCIIString(filenameBytes)
 	err = checkFilename(filename)
 	if err != nil {
@@ -95,7 +88,9 @@ func readFileDescriptionPacket(body []byte) (fileID, fileDescriptionPacket, erro
 }
 
 func writeFileDescriptionPacket(fileID fileID, packet fileDescriptionPacket) ([]byte, error) {
-	if packet.byteCount <= 0 {
+	// Empty files are allowed, although they must be in the
+	// non-recovery set, since they have no slices.
+	if packet.byteCount < 0 {
 		return nil, errors.New("invalid byte count")
 	}
 
@@ -22,3 +22,28 @@ func TestFileDescriptionPacketRoundTrip(t *testing.T) {
 	require.Equal(t, fileID, roundTripFileID)
 	require.Equal(t, packet, roundTripPacket)
 }
+
+func TestEmptyFileDescriptionPacketRoundTrip(t *testing.T) {
+	packet := fileDescriptionPacket{
+		hash:         md5.Sum(nil),
+		sixteenKHash: md5.Sum(nil),
+		byteCount:    0,
+		filename:     "empty.txt",
+	}
+	fileID := computeFileID(packet.sixteenKHash, 0, []byte(packet.filename))
+	packetBytes, err := writeFileDescriptionPacket(fileID, packet)
+	require.NoError(t, err)
+	roundTripFileID, roundTripPacket, err := readFileDescriptionPacket(packetBytes)
+	require.NoError(t, err)
+	require.Equal(t, fileID, roundTripFileID)
+	require.Equal(t, packet, roundTripPacket)
+}
+
+func TestCheckFilename(t *testing.T) {
+	for _, filename := range []string{"file.txt", "subdir/file.txt", ".hidden", "subdir/../file.txt", "..file.txt", ".subdir/..file.txt"} {
+		require.NoError(t, checkFilename(filename), filename)
+	}
+	for _, filename := range []string{"/file.txt", ".", "..", "../file.txt", "subdir/../../file.txt"} {
+		require.Error(t, checkFilename(filename), filename)
+	}
+}
@@ -0,0 +1,335 @@
+package par2
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+type fileIO interface {
+	ReadFile(path string) ([]byte, error)
+	// ReadFileAt has the same semantics as io.ReaderAt.ReadAt.
+	ReadFileAt(path string, data []byte, offset int64) (int, error)
+	FileByteCount(path string) (int64, error)
+	IsDir(path string) (bool, error)
+	FindWithPrefixAndSuffix(prefix, suffix string) ([]string, error)
+	// SameFile returns whether path1 and path2 refer to the same
+	// existing file.
+	SameFile(path1, path2 string) (bool, error)
+	WriteFile(path string, data []byte) error
+	// WriteFileAt writes data at the given offset, creating the
+	// file if it doesn't exist, and leaving the rest of it
+	// untouched otherwise.
+	WriteFileAt(path string, data []byte, offset int64) error
+	// MoveFile moves the file at oldPath to newPath, replacing
+	// any file already there.
+	MoveFile(oldPath, newPath string) error
+	// CopyFileMetadata gives the file at dstPath the mode and
+	// modification time of the file at srcPath.
+	CopyFileMetadata(srcPath, dstPath string) error
+	// SyncFile commits the contents of the file at path to
+	// stable storage.
+	SyncFile(path string) error
+	// SyncDir commits the entries of the directory at path, such
+	// as files just moved into it, to stable storage.
+	SyncDir(path string) error
+	// DeleteFile removes the file at path.
+	DeleteFile(path string) error
+	// MkdirAll creates the directory at path, along with any
+	// missing parents, unless it already exists.
+	MkdirAll(path string) error
+}
+
+type defaultFileIO struct{}
+
+func (io defaultFileIO) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (io defaultFileIO) ReadFileAt(path string, data []byte, offset int64) (n int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return f.ReadAt(data, offset)
+}
+
+func (io defaultFileIO) FileByteCount(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (io defaultFileIO) IsDir(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+func (io defaultFileIO) FindWithPrefixAndSuffix(prefix, suffix string) ([]string, error) {
+	return filepath.Glob(prefix + "*" + suffix)
+}
+
+func (io defaultFileIO) SameFile(path1, path2 string) (bool, error) {
+	info1, err := os.Stat(path1)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	info2, err := os.Stat(path2)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(info1, info2), nil
+}
+
+func (io defaultFileIO) WriteFile(path string, data []byte) error {
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func (io defaultFileIO) WriteFileAt(path string, data []byte, offset int64) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = f.WriteAt(data, offset)
+	return err
+}
+
+func (io defaultFileIO) MoveFile(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (io defaultFileIO) CopyFileMetadata(srcPath, dstPath string) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dstPath, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+}
+
+func (io defaultFileIO) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (io defaultFileIO) SyncDir(path string) (err error) {
+	// Directories can't be synced on Windows.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return f.Sync()
+}
+
+func (io defaultFileIO) DeleteFile(path string) error {
+	return os.Remove(path)
+}
+
+func (io defaultFileIO) SyncFile(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return f.Sync()
+}
+
+// maxOpenFiles is the most files that the fileIO returned by
+// keepFilesOpen keeps open at once, to stay well under the usual
+// limits on open files.
+const maxOpenFiles = 64
+
+// A fileKeeper is a fileIO that can return a fileIO that keeps the
+// files it reads from and writes to with ReadFileAt and WriteFileAt
+// open between calls, until the returned function is called to close
+// them, so that going through a file a piece at a time doesn't open
+// and close it for each piece. The files shouldn't be moved or
+// deleted until then, which fails on Windows for open files.
+type fileKeeper interface {
+	keepFilesOpen() (fileIO, func() error)
+}
+
+// keepFilesOpen returns the result of fileIO.keepFilesOpen if fileIO
+// is a fileKeeper, and otherwise fileIO itself and a function that
+// does nothing. The returned function can be called more than once.
+func keepFilesOpen(fileIO fileIO) (fileIO, func() error) {
+	if keeper, ok := fileIO.(fileKeeper); ok {
+		return keeper.keepFilesOpen()
+	}
+	return fileIO, func() error { return nil }
+}
+
+func (io defaultFileIO) keepFilesOpen() (fileIO, func() error) {
+	openIO := &openFileIO{files: make(map[string]*openFile)}
+	return openIO, openIO.closeFiles
+}
+
+type openFile struct {
+	f        *os.File
+	writable bool
+	lastUse  int
+}
+
+// openFileIO is a defaultFileIO that keeps up to maxOpenFiles files
+// open for ReadFileAt and WriteFileAt, closing the least recently
+// used one when it needs to open another. It isn't safe for
+// concurrent use.
+type openFileIO struct {
+	defaultFileIO
+	files    map[string]*openFile
+	useCount int
+}
+
+// file returns the open file at path, opening it, or reopening it
+// for writing, if needed.
+func (io *openFileIO) file(path string, writable bool) (*os.File, error) {
+	io.useCount++
+	if file, ok := io.files[path]; ok {
+		if file.writable || !writable {
+			file.lastUse = io.useCount
+			return file.f, nil
+		}
+		err := io.closeFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(io.files) >= maxOpenFiles {
+		leastRecentPath := ""
+		for path, file := range io.files {
+			if leastRecentPath == "" || file.lastUse < io.files[leastRecentPath].lastUse {
+				leastRecentPath = path
+			}
+		}
+		err := io.closeFile(leastRecentPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var f *os.File
+	var err error
+	if writable {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	io.files[path] = &openFile{f, writable, io.useCount}
+	return f, nil
+}
+
+func (io *openFileIO) closeFile(path string) error {
+	file := io.files[path]
+	delete(io.files, path)
+	return file.f.Close()
+}
+
+// closeFiles closes all the open files, returning the first error
+// encountered, if any.
+func (io *openFileIO) closeFiles() error {
+	var err error
+	for path := range io.files {
+		closeErr := io.closeFile(path)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (io *openFileIO) ReadFileAt(path string, data []byte, offset int64) (int, error) {
+	f, err := io.file(path, false)
+	if err != nil {
+		return 0, err
+	}
+	return f.ReadAt(data, offset)
+}
+
+func (io *openFileIO) WriteFileAt(path string, data []byte, offset int64) error {
+	f, err := io.file(path, true)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, offset)
+	return err
+}
+
+// fileReaderAt adapts a single file of a fileIO to an io.ReaderAt.
+type fileReaderAt struct {
+	fileIO fileIO
+	path   string
+}
+
+func (r fileReaderAt) ReadAt(data []byte, offset int64) (int, error) {
+	return r.fileIO.ReadFileAt(r.path, data, offset)
+}
+
+// readFileAtPadded fills data with the bytes of the file at path
+// starting at offset, padding with zeros past the end of the file.
+func readFileAtPadded(fileIO fileIO, path string, data []byte, offset int64) error {
+	n, err := fileIO.ReadFileAt(path, data, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := n; i < len(data); i++ {
+		data[i] = 0
+	}
+	return nil
+}
+
+// fileByteCountToInt returns the given file byte count as an int, or
+// an error if it doesn't fit, which can happen for files over 2 GiB
+// on 32-bit platforms.
+func fileByteCountToInt(byteCount int64) (int, error) {
+	if int64(int(byteCount)) != byteCount {
+		return 0, errors.New("file too large for this platform")
+	}
+	return int(byteCount), nil
+}
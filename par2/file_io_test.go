@@ -0,0 +1,67 @@
+package par2
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepFilesOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopar")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	readPath := filepath.Join(dir, "read")
+	require.NoError(t, ioutil.WriteFile(readPath, []byte{0x1, 0x2, 0x3, 0x4}, 0600))
+
+	fileIO, closeFiles := keepFilesOpen(defaultFileIO{})
+	openIO := fileIO.(*openFileIO)
+
+	data := make([]byte, 2)
+	n, err := fileIO.ReadFileAt(readPath, data, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, []byte{0x3, 0x4}, data)
+	n, err = fileIO.ReadFileAt(readPath, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, []byte{0x1, 0x2}, data)
+	require.Equal(t, 1, len(openIO.files))
+
+	// Writing to a file open for reading reopens it.
+	require.NoError(t, fileIO.WriteFileAt(readPath, []byte{0x5}, 4))
+	require.Equal(t, 1, len(openIO.files))
+	require.True(t, openIO.files[readPath].writable)
+	n, err = fileIO.ReadFileAt(readPath, data, 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, []byte{0x4, 0x5}, data)
+
+	// Opening more than maxOpenFiles files closes the least
+	// recently used ones.
+	for i := 0; i < maxOpenFiles; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("write%d", i))
+		require.NoError(t, fileIO.WriteFileAt(path, []byte{byte(i)}, 1))
+	}
+	require.Equal(t, maxOpenFiles, len(openIO.files))
+	_, ok := openIO.files[readPath]
+	require.False(t, ok)
+
+	require.NoError(t, closeFiles())
+	require.Empty(t, openIO.files)
+	// Closing again does nothing.
+	require.NoError(t, closeFiles())
+
+	readData, err := ioutil.ReadFile(readPath)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x1, 0x2, 0x3, 0x4, 0x5}, readData)
+	writeData, err := ioutil.ReadFile(filepath.Join(dir, "write3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x0, 0x3}, writeData)
+}
@@ -1,6 +1,7 @@
 package par2
 
 import (
+	"bytes"
 	"crypto/md5"
 	"testing"
 
@@ -31,6 +32,16 @@ func (d testDecoderDelegate) OnIFSCPacketLoad(fileID [16]byte) {
 	d.t.Logf("OnIFSCPacketLoad(%x)", fileID)
 }
 
+func (d testDecoderDelegate) OnUnicodeFilenamePacketLoad(fileID [16]byte, filename string) {
+	d.t.Helper()
+	d.t.Logf("OnUnicodeFilenamePacketLoad(%x, %s)", fileID, filename)
+}
+
+func (d testDecoderDelegate) OnCommentPacketLoad(comment string) {
+	d.t.Helper()
+	d.t.Logf("OnCommentPacketLoad(%s)", comment)
+}
+
 func (d testDecoderDelegate) OnRecoveryPacketLoad(exponent uint16, byteCount int) {
 	d.t.Helper()
 	d.t.Logf("OnRecoveryPacketLoad(%d, %d)", exponent, byteCount)
@@ -41,16 +52,41 @@ func (d testDecoderDelegate) OnUnknownPacketLoad(packetType [16]byte, byteCount
 	d.t.Logf("OnUnknownPacketLoad(%x, %d)", packetType, byteCount)
 }
 
+func (d testDecoderDelegate) OnInvalidMainPacketSkip(setID, computedSetID [16]byte) {
+	d.t.Helper()
+	d.t.Logf("OnInvalidMainPacketSkip(%x, %x)", setID, computedSetID)
+}
+
+func (d testDecoderDelegate) OnDuplicateMainPacketLoad() {
+	d.t.Helper()
+	d.t.Logf("OnDuplicateMainPacketLoad()")
+}
+
 func (d testDecoderDelegate) OnOtherPacketSkip(setID [16]byte, packetType [16]byte, byteCount int) {
 	d.t.Helper()
 	d.t.Logf("OnOtherPacketSkip(%x, %x, %d)", setID, packetType, byteCount)
 }
 
+func (d testDecoderDelegate) OnCorruptDataSkip(startByteOffset, endByteOffset int) {
+	d.t.Helper()
+	d.t.Logf("OnCorruptDataSkip(startByteOffset=%d, endByteOffset=%d)", startByteOffset, endByteOffset)
+}
+
+func (d testDecoderDelegate) OnMalformedPacketSkip(packetType [16]byte, byteCount int, err error) {
+	d.t.Helper()
+	d.t.Logf("OnMalformedPacketSkip(%q, %d, %v)", packetType, byteCount, err)
+}
+
 func (d testDecoderDelegate) OnDataFileLoad(i, n int, path string, byteCount, hits, misses int, err error) {
 	d.t.Helper()
 	d.t.Logf("OnDataFileLoad(%d, %d, %s, byteCount=%d, hits=%d, misses=%d, %v)", i, n, path, byteCount, hits, misses, err)
 }
 
+func (d testDecoderDelegate) OnDataFileScanProgress(path string, scannedByteCount, byteCount, hits, misses int) {
+	d.t.Helper()
+	d.t.Logf("OnDataFileScanProgress(%s, scannedByteCount=%d, byteCount=%d, hits=%d, misses=%d)", path, scannedByteCount, byteCount, hits, misses)
+}
+
 func (d testDecoderDelegate) OnParityFileLoad(i int, path string, err error) {
 	d.t.Helper()
 	d.t.Logf("OnParityFileLoad(%d, %s, %v)", i, path, err)
@@ -71,11 +107,46 @@ func (d testDecoderDelegate) OnDetectDataFileWrongByteCount(fileID [16]byte, pat
 	d.t.Logf("OnDetectDataFileWrongByteCount(%x, %s)", fileID, path)
 }
 
+func (d testDecoderDelegate) OnCandidateFileLoad(i, n int, path string, byteCount, hits int, err error) {
+	d.t.Helper()
+	d.t.Logf("OnCandidateFileLoad(%d, %d, %s, byteCount=%d, hits=%d, %v)", i, n, path, byteCount, hits, err)
+}
+
+func (d testDecoderDelegate) OnDetectDataFileElsewhere(fileID [16]byte, path, foundPath string) {
+	d.t.Helper()
+	d.t.Logf("OnDetectDataFileElsewhere(%x, %s, %s)", fileID, path, foundPath)
+}
+
+func (d testDecoderDelegate) OnNonRecoveryFileLoad(i, n int, path string, byteCount int, status FileStatus, err error) {
+	d.t.Helper()
+	d.t.Logf("OnNonRecoveryFileLoad(%d, %d, %s, byteCount=%d, %s, %v)", i, n, path, byteCount, status, err)
+}
+
+func (d testDecoderDelegate) OnExtraFileLoad(i, n int, path string, byteCount, hits, misses int, err error) {
+	d.t.Helper()
+	d.t.Logf("OnExtraFileLoad(%d, %d, %s, byteCount=%d, hits=%d, misses=%d, %v)", i, n, path, byteCount, hits, misses, err)
+}
+
+func (d testDecoderDelegate) OnMatrixProgress(rowsApplied, rowCount int) {
+	d.t.Helper()
+	d.t.Logf("OnMatrixProgress(%d, %d)", rowsApplied, rowCount)
+}
+
 func (d testDecoderDelegate) OnDataFileWrite(i, n int, path string, byteCount int, err error) {
 	d.t.Helper()
 	d.t.Logf("OnDataFileWrite(%d, %d, %s, %d, %v)", i, n, path, byteCount, err)
 }
 
+func (d testDecoderDelegate) OnIndexFileWrite(path string, byteCount int, err error) {
+	d.t.Helper()
+	d.t.Logf("OnIndexFileWrite(%s, %d, %v)", path, byteCount, err)
+}
+
+func (d testDecoderDelegate) OnRecoveryFileWrite(start, count, total int, path string, dataByteCount, byteCount int, err error) {
+	d.t.Helper()
+	d.t.Logf("OnRecoveryFileWrite(start=%d, count=%d, total=%d, %s, dataByteCount=%d, byteCount=%d, %v)", start, count, total, path, dataByteCount, byteCount, err)
+}
+
 func TestFileRoundTrip(t *testing.T) {
 	sliceByteCount := 8
 	fileID1, fileDescriptionPacket1, ifscPacket1, _ := computeDataFileInfo(sliceByteCount, "file1.txt", []byte("contents 1"))
@@ -105,6 +176,10 @@ func TestFileRoundTrip(t *testing.T) {
 			fileID2: ifscPacket2,
 			fileID3: ifscPacket3,
 		},
+		unicodeFilenames: map[fileID]string{
+			fileID2: "fïle2.txt",
+		},
+		comment: "test comment",
 		recoveryPackets: map[exponent]recoveryPacket{
 			// TODO: Change this to match sliceByteCount.
 			0: {data: []byte{0xff, 0xaa, 0xfe, 0xab, 0xfd, 0xac, 0xfc, 0xad}},
@@ -131,3 +206,297 @@ func TestFileRoundTrip(t *testing.T) {
 	require.Equal(t, setID, roundTripSetID)
 	require.Equal(t, file, roundTripFile)
 }
+
+type corruptDataRecordingDelegate struct {
+	testDecoderDelegate
+	corruptRanges *[][2]int
+}
+
+func (d corruptDataRecordingDelegate) OnCorruptDataSkip(startByteOffset, endByteOffset int) {
+	d.testDecoderDelegate.OnCorruptDataSkip(startByteOffset, endByteOffset)
+	*d.corruptRanges = append(*d.corruptRanges, [2]int{startByteOffset, endByteOffset})
+}
+
+func TestFileSkipCorruptData(t *testing.T) {
+	sliceByteCount := 8
+	fileID1, fileDescriptionPacket1, ifscPacket1, _ := computeDataFileInfo(sliceByteCount, "file1.txt", []byte("contents 1"))
+
+	mainPacket := mainPacket{
+		sliceByteCount: sliceByteCount,
+		recoverySet:    []fileID{fileID1},
+		nonRecoverySet: []fileID{},
+	}
+
+	recoveryPackets := map[exponent]recoveryPacket{
+		0: {data: []byte{0xff, 0xaa, 0xfe, 0xab, 0xfd, 0xac, 0xfc, 0xad}},
+		1: {data: []byte{0xef, 0xba, 0xee, 0xbb, 0xed, 0xbc, 0xec, 0xbd}},
+		2: {data: []byte{0xdf, 0xca, 0xde, 0xcb, 0xdd, 0xcc, 0xdc, 0xcd}},
+	}
+
+	file := file{
+		clientID:   "test client",
+		mainPacket: &mainPacket,
+		fileDescriptionPackets: map[fileID]fileDescriptionPacket{
+			fileID1: fileDescriptionPacket1,
+		},
+		ifscPackets: map[fileID]ifscPacket{
+			fileID1: ifscPacket1,
+		},
+		recoveryPackets: recoveryPackets,
+	}
+
+	setID, fileBytes, err := writeFile(file)
+	require.NoError(t, err)
+
+	// Recovery packets are written last, in order of exponent.
+	var recoveryPacketStarts []int
+	for i := 0; ; {
+		j := bytes.Index(fileBytes[i:], recoveryPacketType[:])
+		if j < 0 {
+			break
+		}
+		// The packet type is at the end of the header.
+		recoveryPacketStarts = append(recoveryPacketStarts, i+j+len(recoveryPacketType)-int(sizeOfPacketHeader()))
+		i += j + len(recoveryPacketType)
+	}
+	require.Equal(t, 3, len(recoveryPacketStarts))
+
+	// Prepend some garbage, flip a bit in the body of the
+	// packet with exponent 1, and cut off the packet with
+	// exponent 2.
+	garbage := []byte{0x1, 0x2, 0x3}
+	corruptBytes := append(append([]byte{}, garbage...), fileBytes[:len(fileBytes)-1]...)
+	corruptBytes[len(garbage)+recoveryPacketStarts[2]-1] ^= 0x1
+
+	var corruptRanges [][2]int
+	delegate := corruptDataRecordingDelegate{testDecoderDelegate{t}, &corruptRanges}
+	roundTripSetID, roundTripFile, err := readFile(delegate, nil, corruptBytes)
+	require.NoError(t, err)
+	require.Equal(t, setID, roundTripSetID)
+
+	expectedFile := file
+	expectedFile.recoveryPackets = map[exponent]recoveryPacket{
+		0: recoveryPackets[0],
+	}
+	expectedFile.unicodeFilenames = map[fileID]string{}
+	expectedFile.unknownPackets = map[packetType][][]byte{}
+	require.Equal(t, expectedFile, roundTripFile)
+	require.Equal(t, [][2]int{
+		{0, len(garbage)},
+		{len(garbage) + recoveryPacketStarts[1], len(corruptBytes)},
+	}, corruptRanges)
+}
+
+type malformedPacketRecordingDelegate struct {
+	testDecoderDelegate
+	packetTypes *[]packetType
+}
+
+func (d malformedPacketRecordingDelegate) OnMalformedPacketSkip(packetType [16]byte, byteCount int, err error) {
+	d.testDecoderDelegate.OnMalformedPacketSkip(packetType, byteCount, err)
+	*d.packetTypes = append(*d.packetTypes, packetType)
+}
+
+func TestFileSkipMalformedPackets(t *testing.T) {
+	sliceByteCount := 8
+	fileID1, fileDescriptionPacket1, ifscPacket1, _ := computeDataFileInfo(sliceByteCount, "file1.txt", []byte("contents 1"))
+
+	mainPacket := mainPacket{
+		sliceByteCount: sliceByteCount,
+		recoverySet:    []fileID{fileID1},
+		nonRecoverySet: []fileID{},
+	}
+
+	file := file{
+		clientID:   "test client",
+		mainPacket: &mainPacket,
+		fileDescriptionPackets: map[fileID]fileDescriptionPacket{
+			fileID1: fileDescriptionPacket1,
+		},
+		ifscPackets: map[fileID]ifscPacket{
+			fileID1: ifscPacket1,
+		},
+		recoveryPackets: map[exponent]recoveryPacket{
+			0: {data: []byte{0xff, 0xaa, 0xfe, 0xab, 0xfd, 0xac, 0xfc, 0xad}},
+		},
+	}
+
+	setID, fileBytes, err := writeFile(file)
+	require.NoError(t, err)
+
+	// Append packets whose hashes match, but whose bodies are
+	// too short, or, for the recovery packet, whose exponent is
+	// out of range.
+	buf := bytes.NewBuffer(append([]byte{}, fileBytes...))
+	malformedPacketTypes := []packetType{
+		fileDescriptionPacketType,
+		ifscPacketType,
+		recoveryPacketType,
+	}
+	for _, packetType := range malformedPacketTypes {
+		body := []byte{0x0, 0x0, 0x0, 0x0}
+		if packetType == recoveryPacketType {
+			body = []byte{0x0, 0x0, 0x1, 0x0, 0x1, 0x2, 0x3, 0x4}
+		}
+		require.NoError(t, writeNextPacket(buf, setID, packetType, body))
+	}
+
+	var packetTypes []packetType
+	delegate := malformedPacketRecordingDelegate{testDecoderDelegate{t}, &packetTypes}
+	roundTripSetID, roundTripFile, err := readFile(delegate, nil, buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, setID, roundTripSetID)
+
+	expectedFile := file
+	expectedFile.unicodeFilenames = map[fileID]string{}
+	expectedFile.unknownPackets = map[packetType][][]byte{}
+	require.Equal(t, expectedFile, roundTripFile)
+	require.Equal(t, malformedPacketTypes, packetTypes)
+}
+
+func TestFileSkipMalformedUnicodePackets(t *testing.T) {
+	sliceByteCount := 8
+	fileID1, fileDescriptionPacket1, ifscPacket1, _ := computeDataFileInfo(sliceByteCount, "file1.txt", []byte("contents 1"))
+
+	mainPacket := mainPacket{
+		sliceByteCount: sliceByteCount,
+		recoverySet:    []fileID{fileID1},
+		nonRecoverySet: []fileID{},
+	}
+
+	file := file{
+		clientID:   "test client",
+		mainPacket: &mainPacket,
+		fileDescriptionPackets: map[fileID]fileDescriptionPacket{
+			fileID1: fileDescriptionPacket1,
+		},
+		ifscPackets: map[fileID]ifscPacket{
+			fileID1: ifscPacket1,
+		},
+		comment: "ASCII comment",
+	}
+
+	setID, fileBytes, err := writeFile(file)
+	require.NoError(t, err)
+
+	// Append a Unicode filename packet with a filename that
+	// isn't allowed, and a Unicode comment packet that's too
+	// short.
+	buf := bytes.NewBuffer(append([]byte{}, fileBytes...))
+	unicodeFilenameBody := append(append([]byte{}, fileID1[:]...), encodeUTF16LEString("../file1.txt")...)
+	require.NoError(t, writeNextPacket(buf, setID, unicodeFilenamePacketType, unicodeFilenameBody))
+	require.NoError(t, writeNextPacket(buf, setID, unicodeCommentPacketType, []byte{0x1, 0x2, 0x3, 0x4}))
+
+	var packetTypes []packetType
+	delegate := malformedPacketRecordingDelegate{testDecoderDelegate{t}, &packetTypes}
+	roundTripSetID, roundTripFile, err := readFile(delegate, nil, buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, setID, roundTripSetID)
+
+	// The ASCII filename and comment are used instead.
+	expectedFile := file
+	expectedFile.unicodeFilenames = map[fileID]string{}
+	expectedFile.recoveryPackets = map[exponent]recoveryPacket{}
+	expectedFile.unknownPackets = map[packetType][][]byte{}
+	require.Equal(t, expectedFile, roundTripFile)
+	require.Equal(t, []packetType{unicodeFilenamePacketType, unicodeCommentPacketType}, packetTypes)
+}
+
+type mainPacketRecordingDelegate struct {
+	testDecoderDelegate
+	invalidCount   *int
+	duplicateCount *int
+}
+
+func (d mainPacketRecordingDelegate) OnInvalidMainPacketSkip(setID, computedSetID [16]byte) {
+	d.testDecoderDelegate.OnInvalidMainPacketSkip(setID, computedSetID)
+	*d.invalidCount++
+}
+
+func (d mainPacketRecordingDelegate) OnDuplicateMainPacketLoad() {
+	d.testDecoderDelegate.OnDuplicateMainPacketLoad()
+	*d.duplicateCount++
+}
+
+func TestFileMainPackets(t *testing.T) {
+	sliceByteCount := 8
+	fileID1, fileDescriptionPacket1, ifscPacket1, _ := computeDataFileInfo(sliceByteCount, "file1.txt", []byte("contents 1"))
+
+	mainPacket := mainPacket{
+		sliceByteCount: sliceByteCount,
+		recoverySet:    []fileID{fileID1},
+		nonRecoverySet: []fileID{},
+	}
+	mainPacketBytes, err := writeMainPacket(mainPacket)
+	require.NoError(t, err)
+
+	// A main packet for a different slice byte count, but
+	// with the same set ID in its header.
+	otherMainPacket := mainPacket
+	otherMainPacket.sliceByteCount = 2 * sliceByteCount
+	otherMainPacketBytes, err := writeMainPacket(otherMainPacket)
+	require.NoError(t, err)
+
+	f := file{
+		clientID:   "test client",
+		mainPacket: &mainPacket,
+		fileDescriptionPackets: map[fileID]fileDescriptionPacket{
+			fileID1: fileDescriptionPacket1,
+		},
+		ifscPackets: map[fileID]ifscPacket{
+			fileID1: ifscPacket1,
+		},
+	}
+	setID, fileBytes, err := writeFile(f)
+	require.NoError(t, err)
+
+	readWithExtraMainPacket := func(packetSetID recoverySetID, body []byte, before bool, expectedSetID *recoverySetID) (recoverySetID, file, int, int, error) {
+		buf := bytes.NewBuffer(nil)
+		require.NoError(t, writeNextPacket(buf, packetSetID, mainPacketType, padPacketBytes(body)))
+		var allBytes []byte
+		if before {
+			allBytes = append(buf.Bytes(), fileBytes...)
+		} else {
+			allBytes = append(append([]byte{}, fileBytes...), buf.Bytes()...)
+		}
+
+		var invalidCount, duplicateCount int
+		delegate := mainPacketRecordingDelegate{testDecoderDelegate{t}, &invalidCount, &duplicateCount}
+		roundTripSetID, roundTripFile, err := readFile(delegate, expectedSetID, allBytes)
+		return roundTripSetID, roundTripFile, invalidCount, duplicateCount, err
+	}
+
+	// Identical duplicates are accepted.
+	_, roundTripFile, invalidCount, duplicateCount, err := readWithExtraMainPacket(setID, mainPacketBytes, false, &setID)
+	require.NoError(t, err)
+	require.Equal(t, mainPacket, *roundTripFile.mainPacket)
+	require.Equal(t, 0, invalidCount)
+	require.Equal(t, 1, duplicateCount)
+
+	// A main packet that doesn't match the set ID in its
+	// header is skipped wherever it is, and that set ID isn't
+	// used even if it's the first one found.
+	otherSetID := setID
+	otherSetID[0] ^= 0x1
+	for _, packetSetID := range []recoverySetID{setID, otherSetID} {
+		for _, before := range []bool{true, false} {
+			expectedSetID := &setID
+			expectedInvalidCount := 1
+			if packetSetID != setID {
+				expectedSetID = nil
+				// Once the set ID is known, the
+				// packet is skipped as one for
+				// another set instead.
+				if !before {
+					expectedInvalidCount = 0
+				}
+			}
+			roundTripSetID, roundTripFile, invalidCount, duplicateCount, err := readWithExtraMainPacket(packetSetID, otherMainPacketBytes, before, expectedSetID)
+			require.NoError(t, err)
+			require.Equal(t, setID, roundTripSetID)
+			require.Equal(t, mainPacket, *roundTripFile.mainPacket)
+			require.Equal(t, expectedInvalidCount, invalidCount)
+			require.Equal(t, 0, duplicateCount)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"errors"
+	"io"
 	"reflect"
 )
 
@@ -91,6 +92,95 @@ func readNextPacket(buf *bytes.Buffer) (recoverySetID, packetType, []byte, error
 	return h.RecoverySetID, h.Type, bodyCopy, nil
 }
 
+// computePacketHashAt is like computePacketHash, but reads the body
+// from the given section of r a piece at a time.
+func computePacketHashAt(setID recoverySetID, packetType packetType, r io.ReaderAt, bodyOffset, bodyByteCount int64) ([md5.Size]byte, error) {
+	h := md5.New()
+	_, _ = h.Write(setID[:])
+	_, _ = h.Write(packetType[:])
+	n, err := io.Copy(h, io.NewSectionReader(r, bodyOffset, bodyByteCount))
+	if err != nil {
+		return [md5.Size]byte{}, err
+	}
+	if n != bodyByteCount {
+		return [md5.Size]byte{}, errors.New("could not read body")
+	}
+	var hash [md5.Size]byte
+	h.Sum(hash[:0])
+	return hash, nil
+}
+
+// readPacketAt tries to read the packet at the given offset of r,
+// which has byteCount bytes. If the packet is cut off or corrupt, ok
+// is false. The body is always hashed a piece at a time first, and
+// it's then loaded and returned only if its hash matches and
+// loadBody returns true for the packet's header, since the length
+// in the header isn't covered by the hash, so a corrupt one could
+// otherwise cause a huge allocation. A non-nil error is returned
+// only if r itself returns one.
+func readPacketAt(r io.ReaderAt, offset, byteCount int64, loadBody func(packetHeader) bool) (h packetHeader, body []byte, ok bool, err error) {
+	headerByteCount := int64(sizeOfPacketHeader())
+	if offset+headerByteCount > byteCount {
+		return packetHeader{}, nil, false, nil
+	}
+
+	headerBytes := make([]byte, headerByteCount)
+	_, err = r.ReadAt(headerBytes, offset)
+	if err != nil && err != io.EOF {
+		return packetHeader{}, nil, false, err
+	}
+
+	h, err = readPacketHeader(bytes.NewBuffer(headerBytes))
+	if err != nil {
+		return packetHeader{}, nil, false, nil
+	}
+
+	bodyOffset := offset + headerByteCount
+	if h.Length-sizeOfPacketHeader() > uint64(byteCount-bodyOffset) {
+		return packetHeader{}, nil, false, nil
+	}
+	bodyByteCount := int64(h.Length - sizeOfPacketHeader())
+
+	hash, err := computePacketHashAt(h.RecoverySetID, h.Type, r, bodyOffset, bodyByteCount)
+	if err != nil {
+		return packetHeader{}, nil, false, err
+	}
+	if hash != h.Hash {
+		return packetHeader{}, nil, false, nil
+	}
+
+	if loadBody(h) {
+		body = make([]byte, bodyByteCount)
+		_, err = r.ReadAt(body, bodyOffset)
+		if err != nil && err != io.EOF {
+			return packetHeader{}, nil, false, err
+		}
+	}
+
+	return h, body, true, nil
+}
+
+// findPacketMagicAt returns the offset of the first occurrence of the
+// packet magic string in r at or after offset, or byteCount if there
+// isn't one.
+func findPacketMagicAt(r io.ReaderAt, offset, byteCount int64) (int64, error) {
+	buf := make([]byte, 64*1024)
+	for ; offset+int64(len(expectedMagic)) <= byteCount; offset += int64(len(buf) - len(expectedMagic) + 1) {
+		n := len(buf)
+		if int64(n) > byteCount-offset {
+			n = int(byteCount - offset)
+		}
+		_, err := r.ReadAt(buf[:n], offset)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.Index(buf[:n], expectedMagic[:]); i >= 0 {
+			return offset + int64(i), nil
+		}
+	}
+	return byteCount, nil
+}
+
 func writeNextPacket(buf *bytes.Buffer, setID recoverySetID, packetType packetType, body []byte) error {
 	// TODO: Handle overflow.
 	length := sizeOfPacketHeader() + uint64(len(body))
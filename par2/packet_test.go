@@ -2,7 +2,9 @@ package par2
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -58,3 +60,39 @@ func TestPacketsRoundTrip(t *testing.T) {
 	require.Equal(t, packets, roundTripPackets)
 	require.Equal(t, 0, buf.Len())
 }
+
+// zeroPaddedReaderAt reads as data followed by any number of zeros.
+type zeroPaddedReaderAt struct {
+	data []byte
+}
+
+func (r zeroPaddedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	if off < int64(len(r.data)) {
+		copy(p, r.data[off:])
+	}
+	return len(p), nil
+}
+
+func TestReadPacketAtCorruptLength(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeNextPacket(&buf, recoverySetID{0x1}, mainPacketType, []byte{0x1, 0x2, 0x3, 0x4}))
+	data := buf.Bytes()
+
+	// The length isn't covered by the packet hash, so a
+	// corrupt one shouldn't cause the claimed body to be
+	// allocated before the hash is checked.
+	const byteCount = 64 * 1024 * 1024
+	binary.LittleEndian.PutUint64(data[len(expectedMagic):], byteCount)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, body, ok, err := readPacketAt(zeroPaddedReaderAt{data}, 0, byteCount, func(packetHeader) bool { return true })
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Nil(t, body)
+	require.True(t, after.TotalAlloc-before.TotalAlloc < 1024*1024)
+}
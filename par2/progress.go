@@ -0,0 +1,47 @@
+package par2
+
+import (
+	"context"
+	"io"
+
+	"github.com/akalin/gopar/rsec16"
+)
+
+// progressReader wraps an io.Reader so that reading from it fails
+// with ctx.Err() once ctx is done, and so that onRead, if non-nil, is
+// called with the total number of bytes read so far after each read.
+type progressReader struct {
+	ctx       context.Context
+	r         io.Reader
+	onRead    func(byteCount int)
+	byteCount int
+}
+
+func (r *progressReader) Read(data []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(data)
+	r.byteCount += n
+	if r.onRead != nil && n > 0 {
+		r.onRead(r.byteCount)
+	}
+	return n, err
+}
+
+// matrixProgress keeps a running count of the matrix rows applied
+// over several calls into rsec16, and reports it to onProgress.
+type matrixProgress struct {
+	rowsApplied int
+	rowCount    int
+	onProgress  func(rowsApplied, rowCount int)
+}
+
+// progressFunc returns an rsec16.ProgressFunc that adds to the
+// running count.
+func (p *matrixProgress) progressFunc() rsec16.ProgressFunc {
+	return func(int, int) {
+		p.rowsApplied++
+		p.onProgress(p.rowsApplied, p.rowCount)
+	}
+}
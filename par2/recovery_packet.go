@@ -15,16 +15,28 @@ type recoveryPacket struct {
 }
 
 func readRecoveryPacket(body []byte) (exponent, recoveryPacket, error) {
-	if len(body) == 0 || len(body)%4 != 0 {
-		return 0, recoveryPacket{}, errors.New("invalid recovery data byte count")
+	exp, err := readRecoveryPacketExponent(body, len(body))
+	if err != nil {
+		return 0, recoveryPacket{}, err
 	}
 
-	exp := binary.LittleEndian.Uint32(body)
+	return exp, recoveryPacket{body[4:]}, nil
+}
+
+// readRecoveryPacketExponent is like readRecoveryPacket, but takes
+// only the start of the body along with the full body byte count,
+// so that the recovery data doesn't have to be in memory.
+func readRecoveryPacketExponent(bodyStart []byte, bodyByteCount int) (exponent, error) {
+	if bodyByteCount == 0 || bodyByteCount%4 != 0 || len(bodyStart) < 4 {
+		return 0, errors.New("invalid recovery data byte count")
+	}
+
+	exp := binary.LittleEndian.Uint32(bodyStart)
 	if exp > math.MaxUint16 {
-		return 0, recoveryPacket{}, errors.New("exponent out of range")
+		return 0, errors.New("exponent out of range")
 	}
 
-	return exponent(exp), recoveryPacket{body[4:]}, nil
+	return exponent(exp), nil
 }
 
 func writeRecoveryPacket(exp exponent, packet recoveryPacket) ([]byte, error) {
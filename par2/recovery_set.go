@@ -0,0 +1,139 @@
+package par2
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A RecoverySet describes the PAR2 files of a single recovery set, as
+// found by FindRecoverySets.
+type RecoverySet struct {
+	SetID [16]byte
+	// IndexPath is the path of the index file of the recovery
+	// set. If no file without a .volNN+NN suffix has packets for
+	// the set, e.g. if the index file is missing, it's the path
+	// that the index file would have, going by the name of the
+	// first of Paths.
+	IndexPath string
+	// Paths lists all the PAR2 files that have packets for the
+	// recovery set, sorted.
+	Paths []string
+}
+
+// scanRecoverySetIDsAt returns the recovery set IDs of the packets in
+// the first byteCount bytes of r, each mapped to whether a main packet
+// that matches it was found. Corrupt packets and any other garbage are
+// skipped, as with readFileAt.
+func scanRecoverySetIDsAt(r io.ReaderAt, byteCount int64) (map[recoverySetID]bool, error) {
+	r = io.NewSectionReader(r, 0, byteCount)
+
+	setIDs := make(map[recoverySetID]bool)
+	for offset := int64(0); offset < byteCount; {
+		// Only load main packets, which are small, since the
+		// set ID has to be checked against them.
+		h, body, ok, err := readPacketAt(r, offset, byteCount, func(h packetHeader) bool {
+			return packetType(h.Type) == mainPacketType
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			offset, err = findPacketMagicAt(r, offset+1, byteCount)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// TODO: Handle overflow.
+		offset += int64(h.Length)
+
+		setID := recoverySetID(h.RecoverySetID)
+		hasMainPacket := packetType(h.Type) == mainPacketType && recoverySetID(md5.Sum(body)) == setID
+		setIDs[setID] = setIDs[setID] || hasMainPacket
+	}
+	return setIDs, nil
+}
+
+func findRecoverySets(fileIO fileIO, dir string) ([]RecoverySet, error) {
+	dirPrefix := dir
+	if !strings.HasSuffix(dirPrefix, string(filepath.Separator)) {
+		dirPrefix += string(filepath.Separator)
+	}
+	paths, err := fileIO.FindWithPrefixAndSuffix(dirPrefix, ".par2")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	pathsBySetID := make(map[recoverySetID][]string)
+	hasMainPacket := make(map[recoverySetID]bool)
+	for _, path := range paths {
+		byteCount, err := fileIO.FileByteCount(path)
+		if err != nil {
+			return nil, err
+		}
+
+		setIDs, err := scanRecoverySetIDsAt(fileReaderAt{fileIO, path}, byteCount)
+		if err != nil {
+			return nil, err
+		}
+
+		for setID, ok := range setIDs {
+			pathsBySetID[setID] = append(pathsBySetID[setID], path)
+			hasMainPacket[setID] = hasMainPacket[setID] || ok
+		}
+	}
+
+	var sets []RecoverySet
+	for setID, setPaths := range pathsBySetID {
+		// Packets for a set without any main packet, e.g. ones
+		// with a corrupt set ID, can't be used.
+		if !hasMainPacket[setID] {
+			continue
+		}
+
+		var indexPath string
+		for _, path := range setPaths {
+			if !volumeFileSuffixRegexp.MatchString(path) {
+				indexPath = path
+				break
+			}
+		}
+		if indexPath == "" {
+			indexPath, err = findIndexPath(fileIO, setPaths[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		sets = append(sets, RecoverySet{setID, indexPath, setPaths})
+	}
+
+	if len(sets) == 0 {
+		return nil, errors.New("no recovery sets found")
+	}
+
+	sort.Slice(sets, func(i, j int) bool {
+		if sets[i].IndexPath != sets[j].IndexPath {
+			return sets[i].IndexPath < sets[j].IndexPath
+		}
+		return bytes.Compare(sets[i].SetID[:], sets[j].SetID[:]) < 0
+	})
+
+	return sets, nil
+}
+
+// FindRecoverySets groups the packets in all the PAR2 files directly in
+// dir by their recovery set IDs, regardless of the names of the files,
+// and returns the recovery sets found, sorted by index path. Each can
+// then be passed to NewDecoderForRecoverySet, so that sets whose files
+// share a prefix don't interfere with each other.
+func FindRecoverySets(dir string) ([]RecoverySet, error) {
+	return findRecoverySets(defaultFileIO{}, dir)
+}
@@ -0,0 +1,149 @@
+package par2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/akalin/gopar/memfs"
+	"github.com/akalin/gopar/rsec16"
+	"github.com/stretchr/testify/require"
+)
+
+// buildTwoRecoverySets builds two recovery sets in workingDir, one
+// for file.rar and dir1/file.r01 in file.par2, and one for
+// dir1/file.r02 and dir2/dir3/file.r03 in file.part2.par2, whose
+// recovery volumes look like those of the first set by name.
+func buildTwoRecoverySets(t *testing.T, fs memfs.MemFS, workingDir string) {
+	for _, tc := range []struct {
+		indexFilename string
+		paths         []string
+	}{
+		{"file.par2", []string{"file.rar", filepath.Join("dir1", "file.r01")}},
+		{"file.part2.par2", []string{filepath.Join("dir1", "file.r02"), filepath.Join("dir2", "dir3", "file.r03")}},
+	} {
+		var paths []string
+		for _, path := range tc.paths {
+			paths = append(paths, filepath.Join(workingDir, path))
+		}
+		encoder, err := newEncoderForTest(t, fs, workingDir, paths, 4, 3)
+		require.NoError(t, err)
+		require.NoError(t, encoder.LoadFileData())
+		require.NoError(t, encoder.ComputeParityData())
+		require.NoError(t, encoder.Write(filepath.Join(workingDir, tc.indexFilename)))
+	}
+}
+
+func TestScanRecoverySetIDs(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	buildTwoRecoverySets(t, fs, workingDir)
+
+	indexData, err := fs.ReadFile("file.par2")
+	require.NoError(t, err)
+	volumeData, err := fs.ReadFile("file.part2.vol00+01.par2")
+	require.NoError(t, err)
+
+	setID, _, err := readFile(testDecoderDelegate{t}, nil, indexData)
+	require.NoError(t, err)
+	otherSetID, _, err := readFile(testDecoderDelegate{t}, nil, volumeData)
+	require.NoError(t, err)
+
+	data := append(append(append([]byte{}, indexData...), 0x1, 0x2, 0x3), volumeData...)
+	setIDs, err := scanRecoverySetIDsAt(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, map[recoverySetID]bool{setID: true, otherSetID: true}, setIDs)
+
+	// Flip a bit in the body of the main packet of the first
+	// set, and fix up its packet hash, so that it no longer
+	// matches the set ID.
+	mainPacketStart := bytes.Index(indexData[1:], expectedMagic[:]) + 1
+	h, body, ok, err := readPacketAt(bytes.NewReader(indexData), int64(mainPacketStart), int64(len(indexData)), func(packetHeader) bool { return true })
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, mainPacketType, packetType(h.Type))
+	body[0] ^= 0x1
+	var buf bytes.Buffer
+	require.NoError(t, writeNextPacket(&buf, setID, mainPacketType, body))
+	damagedData := append([]byte{}, indexData[:mainPacketStart]...)
+	damagedData = append(damagedData, buf.Bytes()...)
+	damagedData = append(damagedData, indexData[mainPacketStart+buf.Len():]...)
+
+	setIDs, err = scanRecoverySetIDsAt(bytes.NewReader(damagedData), int64(len(damagedData)))
+	require.NoError(t, err)
+	require.Equal(t, map[recoverySetID]bool{setID: false}, setIDs)
+}
+
+func TestFindRecoverySets(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	buildTwoRecoverySets(t, fs, workingDir)
+
+	// The second set is found even without its index file.
+	_, err := fs.RemoveFile("file.part2.par2")
+	require.NoError(t, err)
+
+	sets, err := findRecoverySets(testFileIO{t, fs}, workingDir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sets))
+
+	abs := func(filename string) string {
+		return filepath.Join(workingDir, filename)
+	}
+	require.Equal(t, abs("file.par2"), sets[0].IndexPath)
+	require.Equal(t, []string{
+		abs("file.par2"),
+		abs("file.vol00+01.par2"),
+		abs("file.vol01+02.par2"),
+	}, sets[0].Paths)
+	require.Equal(t, abs("file.part2.par2"), sets[1].IndexPath)
+	require.Equal(t, []string{
+		abs("file.part2.vol00+01.par2"),
+		abs("file.part2.vol01+02.par2"),
+	}, sets[1].Paths)
+	require.NotEqual(t, sets[0].SetID, sets[1].SetID)
+
+	_, err = findRecoverySets(testFileIO{t, fs}, filepath.Join(workingDir, "dir1"))
+	require.EqualError(t, err, "no recovery sets found")
+}
+
+func TestRepairRecoverySets(t *testing.T) {
+	workingDir := memfs.RootDir()
+	fs := makeDecoderMemFS(workingDir)
+	buildTwoRecoverySets(t, fs, workingDir)
+
+	r01Path := filepath.Join("dir1", "file.r01")
+	r02Path := filepath.Join("dir1", "file.r02")
+	r01Data, err := fs.RemoveFile(r01Path)
+	require.NoError(t, err)
+	r02Data, err := fs.RemoveFile(r02Path)
+	require.NoError(t, err)
+
+	sets, err := findRecoverySets(testFileIO{t, fs}, workingDir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sets))
+
+	for i, expectedPath := range []string{r01Path, r02Path} {
+		decoder, err := newDecoderForRecoverySet(testFileIO{t, fs}, testDecoderDelegate{t}, sets[i], rsec16.DefaultNumGoroutines(), DecoderOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 2, len(decoder.recoverySet))
+		require.NoError(t, decoder.LoadFileData())
+		require.NoError(t, decoder.LoadParityData())
+		require.Equal(t, 3, len(decoder.parityShards))
+
+		needsRepair, err := decoder.Verify()
+		require.NoError(t, err)
+		require.True(t, needsRepair)
+
+		repairedPaths, err := decoder.Repair(true)
+		require.NoError(t, err)
+		require.Equal(t, []string{filepath.Join(workingDir, expectedPath)}, repairedPaths)
+	}
+
+	repairedR01Data, err := fs.ReadFile(r01Path)
+	require.NoError(t, err)
+	require.Equal(t, r01Data, repairedR01Data)
+	repairedR02Data, err := fs.ReadFile(r02Path)
+	require.NoError(t, err)
+	require.Equal(t, r02Data, repairedR02Data)
+}
@@ -0,0 +1,166 @@
+package par2
+
+import (
+	"errors"
+
+	"github.com/akalin/gopar/rsec16"
+)
+
+// A FileStatus is the state of a data file, as given in a Report.
+type FileStatus string
+
+const (
+	// FileOK means that the data file is intact.
+	FileOK FileStatus = "ok"
+	// FileMissing means that the data file doesn't exist.
+	FileMissing FileStatus = "missing"
+	// FileWrongByteCount means that the data file doesn't have
+	// the expected byte count.
+	FileWrongByteCount FileStatus = "wrong-size"
+	// FileDamaged means that the data file has the expected byte
+	// count, but some of its data is corrupt.
+	FileDamaged FileStatus = "damaged"
+	// FileFoundElsewhere means that the data file isn't intact,
+	// but an intact copy of it was found among the candidate
+	// files.
+	FileFoundElsewhere FileStatus = "found-elsewhere"
+)
+
+// A ByteRange is the range [Start, End) of bytes in a file.
+type ByteRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// A FileReport describes the state of a data file.
+type FileReport struct {
+	Path      string     `json:"path"`
+	ByteCount int        `json:"byteCount"`
+	Status    FileStatus `json:"status"`
+	// FoundPath is the path of the intact copy of the data file
+	// if Status is FileFoundElsewhere.
+	FoundPath string `json:"foundPath,omitempty"`
+	// CorruptRanges lists the byte ranges of the data file
+	// whose data is missing or corrupt.
+	CorruptRanges []ByteRange `json:"corruptRanges,omitempty"`
+	// NonRecovery is true if the data file is in the
+	// non-recovery set, so it's only checked against its
+	// hashes, and can't be repaired unless it's empty.
+	NonRecovery bool `json:"nonRecovery,omitempty"`
+}
+
+// A Report describes the state of a recovery set, as found by
+// LoadFileData and LoadParityData.
+type Report struct {
+	Files []FileReport `json:"files"`
+	// DataBlockCount is the number of data blocks (slices) in
+	// the recovery set, and UsableDataBlockCount is the number
+	// of them that were found intact anywhere.
+	DataBlockCount       int `json:"dataBlockCount"`
+	UsableDataBlockCount int `json:"usableDataBlockCount"`
+	// UsableRecoveryBlockCount is the number of recovery blocks
+	// that were found intact.
+	UsableRecoveryBlockCount int `json:"usableRecoveryBlockCount"`
+	// NeededRecoveryBlockCount is the number of recovery blocks
+	// needed to reconstruct the data blocks that weren't found.
+	NeededRecoveryBlockCount int `json:"neededRecoveryBlockCount"`
+	// UnrepairableFileCount is the number of non-empty data
+	// files in the non-recovery set that aren't intact. If it's
+	// non-zero, NeedsRepair is true and RepairPossible is false.
+	UnrepairableFileCount int  `json:"unrepairableFileCount"`
+	NeedsRepair           bool `json:"needsRepair"`
+	RepairPossible        bool `json:"repairPossible"`
+}
+
+func (d *Decoder) fileStatus(integrityInfo fileIntegrityInfo) FileStatus {
+	switch {
+	case integrityInfo.ok(d.sliceByteCount):
+		return FileOK
+	case integrityInfo.foundPath != "":
+		return FileFoundElsewhere
+	case integrityInfo.missing:
+		return FileMissing
+	case integrityInfo.hasWrongByteCount:
+		return FileWrongByteCount
+	default:
+		return FileDamaged
+	}
+}
+
+// Report returns a Report describing the state of the recovery set.
+// LoadFileData and LoadParityData must be called first.
+func (d *Decoder) Report() (Report, error) {
+	if len(d.fileIntegrityInfos) == 0 {
+		return Report{}, errors.New("no file integrity info")
+	}
+
+	var report Report
+	var dataShards []shardSource
+	for i, info := range d.recoverySet {
+		integrityInfo := d.fileIntegrityInfos[i]
+		status := d.fileStatus(integrityInfo)
+		fileReport := FileReport{
+			Path:      d.getFilePath(info),
+			ByteCount: info.byteCount,
+			Status:    status,
+			FoundPath: integrityInfo.foundPath,
+		}
+		if status != FileOK {
+			fileReport.CorruptRanges = d.corruptByteRanges(info, integrityInfo)
+			report.NeedsRepair = true
+		}
+		report.Files = append(report.Files, fileReport)
+
+		for _, shardInfo := range integrityInfo.shardInfos {
+			dataShards = append(dataShards, shardInfo.source)
+			if shardInfo.source.found() {
+				report.UsableDataBlockCount++
+			}
+		}
+	}
+
+	for i, info := range d.nonRecoverySet {
+		status := d.nonRecoveryStatuses[i]
+		fileReport := FileReport{
+			Path:        d.getFilePath(info),
+			ByteCount:   info.byteCount,
+			Status:      status,
+			NonRecovery: true,
+		}
+		if status != FileOK {
+			// Empty files can always be recreated.
+			if info.byteCount > 0 {
+				fileReport.CorruptRanges = []ByteRange{{0, info.byteCount}}
+				report.UnrepairableFileCount++
+			}
+			report.NeedsRepair = true
+		}
+		report.Files = append(report.Files, fileReport)
+	}
+
+	report.DataBlockCount = len(dataShards)
+	for _, parityShard := range d.parityShards {
+		if parityShard.found() {
+			report.UsableRecoveryBlockCount++
+		}
+	}
+	report.NeededRecoveryBlockCount = report.DataBlockCount - report.UsableDataBlockCount
+
+	report.RepairPossible = report.NeededRecoveryBlockCount == 0
+	if !report.RepairPossible && report.UsableRecoveryBlockCount >= report.NeededRecoveryBlockCount {
+		coder, err := rsec16.NewCoderPAR2Vandermonde(len(dataShards), len(d.parityShards), d.numGoroutines)
+		if err != nil {
+			return Report{}, err
+		}
+		err = coder.CanReconstructDataFrom(foundShards(dataShards), foundShards(d.parityShards))
+		if _, ok := err.(rsec16.NotEnoughParityShardsError); !ok && err != nil {
+			return Report{}, err
+		}
+		report.RepairPossible = err == nil
+	}
+	if report.UnrepairableFileCount > 0 {
+		report.RepairPossible = false
+	}
+
+	return report, nil
+}
@@ -0,0 +1,161 @@
+package par2
+
+import "errors"
+
+// A RecoveryFileScheme determines how the recovery blocks are split
+// among the recovery files, like par2cmdline's -u and -l options.
+type RecoveryFileScheme int
+
+// The recovery file schemes.
+const (
+	// VariableRecoveryFiles gives the recovery files 1, 2, 4,
+	// etc. recovery blocks each, with the last one getting
+	// whatever is left.
+	VariableRecoveryFiles RecoveryFileScheme = iota
+	// UniformRecoveryFiles gives each recovery file the same
+	// number of recovery blocks, give or take one.
+	UniformRecoveryFiles
+	// LimitedRecoveryFiles is like VariableRecoveryFiles, except
+	// that no recovery file gets more recovery blocks than needed
+	// to cover the largest data file.
+	LimitedRecoveryFiles
+)
+
+// defaultSliceCount is the number of slices that the data files are
+// split into if neither a slice byte count nor a slice count is
+// given, as with par2cmdline.
+const defaultSliceCount = 2000
+
+// maxSliceCount is the maximum number of data slices that
+// rsec16.NewCoderPAR2Vandermonde supports.
+const maxSliceCount = 32768
+
+// countSlices returns the number of slices of the given byte count
+// that files with the given byte counts are split into.
+func countSlices(fileByteCounts []int64, sliceByteCount int) int {
+	sliceCount := 0
+	for _, byteCount := range fileByteCounts {
+		sliceCount += int((byteCount + int64(sliceByteCount) - 1) / int64(sliceByteCount))
+	}
+	return sliceCount
+}
+
+// computeSliceByteCount returns the smallest slice byte count, which
+// must be a multiple of 4, that splits files with the given byte
+// counts into at most sliceCount slices. If sliceCount is zero,
+// defaultSliceCount is used.
+func computeSliceByteCount(fileByteCounts []int64, sliceCount int) (int, error) {
+	if sliceCount == 0 {
+		sliceCount = defaultSliceCount
+	}
+	if sliceCount < 0 || sliceCount > maxSliceCount {
+		return 0, errors.New("invalid slice count")
+	}
+
+	var maxByteCount int64
+	for _, byteCount := range fileByteCounts {
+		if byteCount > maxByteCount {
+			maxByteCount = byteCount
+		}
+	}
+
+	// Binary search on the slice byte count divided by 4, since
+	// the number of slices only goes down as it goes up, and a
+	// slice byte count that covers the largest file gives one
+	// slice per non-empty file.
+	low, high := int64(1), (maxByteCount+3)/4
+	if high < low {
+		high = low
+	}
+	if countSlices(fileByteCounts, int(4*high)) > sliceCount {
+		return 0, errors.New("more non-empty files than slices")
+	}
+	for low < high {
+		mid := low + (high-low)/2
+		if countSlices(fileByteCounts, int(4*mid)) <= sliceCount {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	return int(4 * low), nil
+}
+
+// computeParityShardCount returns the number of parity shards that is
+// redundancyPercent percent of dataShardCount, rounded up.
+func computeParityShardCount(dataShardCount, redundancyPercent int) int {
+	return (dataShardCount*redundancyPercent + 99) / 100
+}
+
+// computeRecoveryFileRanges splits the given number of parity shards
+// into recovery files according to scheme. If fileCount is positive,
+// it's the number of recovery files to use; otherwise, it's as many
+// as computeExponentRanges would use, except for
+// LimitedRecoveryFiles, which uses as many as needed so that no file
+// has more than limitCount recovery packets.
+func computeRecoveryFileRanges(parityShardCount, fileCount int, scheme RecoveryFileScheme, limitCount int) ([]exponentRange, error) {
+	if fileCount > parityShardCount {
+		return nil, errors.New("more recovery files than recovery blocks")
+	}
+
+	switch scheme {
+	case VariableRecoveryFiles:
+		if fileCount == 0 {
+			return computeExponentRanges(parityShardCount), nil
+		}
+		var ranges []exponentRange
+		i, count := 0, 1
+		for len(ranges) < fileCount-1 {
+			// Leave at least one recovery packet for each
+			// of the remaining files.
+			if remaining := fileCount - 1 - len(ranges); i+count > parityShardCount-remaining {
+				count = 1
+			}
+			ranges = append(ranges, exponentRange{i, count})
+			i += count
+			count *= 2
+		}
+		return append(ranges, exponentRange{i, parityShardCount - i}), nil
+
+	case UniformRecoveryFiles:
+		if fileCount == 0 {
+			fileCount = len(computeExponentRanges(parityShardCount))
+		}
+		var ranges []exponentRange
+		i := 0
+		for j := 0; j < fileCount; j++ {
+			count := parityShardCount / fileCount
+			if j < parityShardCount%fileCount {
+				count++
+			}
+			ranges = append(ranges, exponentRange{i, count})
+			i += count
+		}
+		return ranges, nil
+
+	case LimitedRecoveryFiles:
+		if fileCount != 0 {
+			return nil, errors.New("recovery file count not supported with limited recovery files")
+		}
+		if limitCount < 1 {
+			limitCount = 1
+		}
+		var ranges []exponentRange
+		count := 1
+		for i := 0; i < parityShardCount; {
+			if count > limitCount {
+				count = limitCount
+			}
+			if i+count > parityShardCount {
+				count = parityShardCount - i
+			}
+			ranges = append(ranges, exponentRange{i, count})
+			i += count
+			count *= 2
+		}
+		return ranges, nil
+
+	default:
+		return nil, errors.New("unknown recovery file scheme")
+	}
+}
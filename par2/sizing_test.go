@@ -0,0 +1,71 @@
+package par2
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeSliceByteCount(t *testing.T) {
+	sliceByteCount, err := computeSliceByteCount([]int64{100, 50, 1}, 10)
+	require.NoError(t, err)
+	require.Equal(t, 20, sliceByteCount)
+	require.Equal(t, 9, countSlices([]int64{100, 50, 1}, sliceByteCount))
+	require.Equal(t, 12, countSlices([]int64{100, 50, 1}, sliceByteCount-4))
+
+	sliceByteCount, err = computeSliceByteCount([]int64{100, 50, 1}, 3)
+	require.NoError(t, err)
+	require.Equal(t, 100, sliceByteCount)
+
+	sliceByteCount, err = computeSliceByteCount([]int64{4000000}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2000, sliceByteCount)
+
+	sliceByteCount, err = computeSliceByteCount([]int64{0}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 4, sliceByteCount)
+
+	_, err = computeSliceByteCount([]int64{100, 50, 1}, 2)
+	require.Equal(t, errors.New("more non-empty files than slices"), err)
+
+	_, err = computeSliceByteCount([]int64{100}, maxSliceCount+1)
+	require.Equal(t, errors.New("invalid slice count"), err)
+}
+
+func TestComputeParityShardCount(t *testing.T) {
+	require.Equal(t, 0, computeParityShardCount(100, 0))
+	require.Equal(t, 5, computeParityShardCount(100, 5))
+	require.Equal(t, 1, computeParityShardCount(3, 5))
+	require.Equal(t, 4, computeParityShardCount(7, 50))
+}
+
+func TestComputeRecoveryFileRanges(t *testing.T) {
+	testCases := []struct {
+		parityShardCount, fileCount int
+		scheme                      RecoveryFileScheme
+		limitCount                  int
+		expectedRanges              []exponentRange
+	}{
+		{10, 0, VariableRecoveryFiles, 0, []exponentRange{{0, 1}, {1, 2}, {3, 4}, {7, 3}}},
+		{10, 1, VariableRecoveryFiles, 0, []exponentRange{{0, 10}}},
+		{10, 3, VariableRecoveryFiles, 0, []exponentRange{{0, 1}, {1, 2}, {3, 7}}},
+		{3, 3, VariableRecoveryFiles, 0, []exponentRange{{0, 1}, {1, 1}, {2, 1}}},
+		{5, 4, VariableRecoveryFiles, 0, []exponentRange{{0, 1}, {1, 2}, {3, 1}, {4, 1}}},
+		{10, 0, UniformRecoveryFiles, 0, []exponentRange{{0, 3}, {3, 3}, {6, 2}, {8, 2}}},
+		{10, 5, UniformRecoveryFiles, 0, []exponentRange{{0, 2}, {2, 2}, {4, 2}, {6, 2}, {8, 2}}},
+		{10, 0, LimitedRecoveryFiles, 3, []exponentRange{{0, 1}, {1, 2}, {3, 3}, {6, 3}, {9, 1}}},
+		{10, 0, LimitedRecoveryFiles, 0, []exponentRange{{0, 1}, {1, 1}, {2, 1}, {3, 1}, {4, 1}, {5, 1}, {6, 1}, {7, 1}, {8, 1}, {9, 1}}},
+		{0, 0, VariableRecoveryFiles, 0, nil},
+	}
+	for _, tc := range testCases {
+		ranges, err := computeRecoveryFileRanges(tc.parityShardCount, tc.fileCount, tc.scheme, tc.limitCount)
+		require.NoError(t, err, "%+v", tc)
+		require.Equal(t, tc.expectedRanges, ranges, "%+v", tc)
+	}
+
+	_, err := computeRecoveryFileRanges(3, 4, VariableRecoveryFiles, 0)
+	require.Equal(t, errors.New("more recovery files than recovery blocks"), err)
+	_, err = computeRecoveryFileRanges(10, 2, LimitedRecoveryFiles, 3)
+	require.Equal(t, errors.New("recovery file count not supported with limited recovery files"), err)
+}
@@ -1,8 +1,10 @@
 package par2
 
 import (
+	"encoding/binary"
 	"errors"
 	"unicode"
+	"unicode/utf16"
 	"unicode/utf8"
 )
 
@@ -48,3 +50,54 @@ func encodeASCIIString(s string) ([]byte, error) {
 	}
 	return bs, nil
 }
+
+func isASCIIString(s string) bool {
+	for _, c := range s {
+		if c > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceNonASCII returns s with each non-ASCII character replaced
+// by an underscore, for fields that can only hold ASCII, with the
+// full string going elsewhere.
+func replaceNonASCII(s string) string {
+	var outBytes []byte
+	for _, c := range s {
+		if c > unicode.MaxASCII {
+			c = '_'
+		}
+		outBytes = append(outBytes, byte(c))
+	}
+	return string(outBytes)
+}
+
+func decodeNullPaddedUTF16LEString(bs []byte) string {
+	// A trailing odd byte can't be part of a character, so
+	// it's ignored.
+	units := make([]uint16, len(bs)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(bs[2*i:])
+	}
+
+	// Null-terminate if necessary.
+	for i, u := range units {
+		if u == 0 {
+			units = units[:i]
+			break
+		}
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func encodeUTF16LEString(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	bs := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(bs[2*i:], u)
+	}
+	return bs
+}
@@ -48,3 +48,26 @@ func TestEncodeNonASCIIString(t *testing.T) {
 	_, err := encodeASCIIString(s)
 	require.Equal(t, errors.New("invalid ASCII character"), err)
 }
+
+func TestReplaceNonASCII(t *testing.T) {
+	require.Equal(t, "hello world", replaceNonASCII("hello world"))
+	require.Equal(t, "caf_/___.txt", replaceNonASCII("café/日本語.txt"))
+}
+
+func TestUTF16LEStringRoundTrip(t *testing.T) {
+	strings := []string{
+		"hello world",
+		"café/日本語.txt",
+		// Needs a surrogate pair.
+		"\U0001F600",
+	}
+
+	for _, s := range strings {
+		require.Equal(t, s, decodeNullPaddedUTF16LEString(encodeUTF16LEString(s)))
+	}
+}
+
+func TestDecodeUTF16LEStringNullPadding(t *testing.T) {
+	bs := append(encodeUTF16LEString("日本"), 0x0, 0x0, 0x0)
+	require.Equal(t, "日本", decodeNullPaddedUTF16LEString(bs))
+}
@@ -0,0 +1,30 @@
+package par2
+
+import "errors"
+
+var unicodeFilenamePacketType = packetType{'P', 'A', 'R', ' ', '2', '.', '0', '\x00', 'U', 'n', 'i', 'F', 'i', 'l', 'e', 'N'}
+
+func readUnicodeFilenamePacket(body []byte) (fileID, string, error) {
+	var id fileID
+	if len(body) < len(id) {
+		return fileID{}, "", errors.New("unicode filename packet too short")
+	}
+	copy(id[:], body)
+
+	filename := decodeNullPaddedUTF16LEString(body[len(id):])
+	err := checkFilename(filename)
+	if err != nil {
+		return fileID{}, "", err
+	}
+
+	return id, filename, nil
+}
+
+func writeUnicodeFilenamePacket(id fileID, filename string) ([]byte, error) {
+	err := checkFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, id[:]...), encodeUTF16LEString(filename)...), nil
+}
@@ -0,0 +1,30 @@
+package par2
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnicodeFilenamePacketRoundTrip(t *testing.T) {
+	id := fileID{0x1, 0x2}
+	filename := "subdir/日本語.txt"
+	packetBytes, err := writeUnicodeFilenamePacket(id, filename)
+	require.NoError(t, err)
+	roundTripID, roundTripFilename, err := readUnicodeFilenamePacket(padPacketBytes(packetBytes))
+	require.NoError(t, err)
+	require.Equal(t, id, roundTripID)
+	require.Equal(t, filename, roundTripFilename)
+}
+
+func TestUnicodeFilenamePacketInvalid(t *testing.T) {
+	_, _, err := readUnicodeFilenamePacket([]byte{0x1, 0x2})
+	require.Equal(t, errors.New("unicode filename packet too short"), err)
+
+	_, err = writeUnicodeFilenamePacket(fileID{}, "../日本語.txt")
+	require.Error(t, err)
+
+	_, _, err = readUnicodeFilenamePacket(append(make([]byte, 16), encodeUTF16LEString("/日本語.txt")...))
+	require.Error(t, err)
+}
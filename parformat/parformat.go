@@ -0,0 +1,103 @@
+package parformat
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A Format is a PAR file format.
+type Format int
+
+// The formats that can be detected.
+const (
+	Unknown Format = iota
+	PAR1
+	PAR2
+)
+
+func (f Format) String() string {
+	switch f {
+	case PAR1:
+		return "PAR1"
+	case PAR2:
+		return "PAR2"
+	default:
+		return "unknown"
+	}
+}
+
+// MagicByteCount is the number of bytes at the start of a PAR file
+// that Detect looks at.
+const MagicByteCount = 8
+
+// A PAR1 file starts with its header, and a PAR2 file with a packet
+// header.
+var (
+	par1Magic = []byte{'P', 'A', 'R', '\x00', '\x00', '\x00', '\x00', '\x00'}
+	par2Magic = []byte{'P', 'A', 'R', '2', '\x00', 'P', 'K', 'T'}
+)
+
+// Detect returns the format of the PAR file whose data starts with
+// the given bytes, or Unknown if they don't start with the magic
+// bytes of either format.
+func Detect(data []byte) Format {
+	switch {
+	case bytes.HasPrefix(data, par1Magic):
+		return PAR1
+	case bytes.HasPrefix(data, par2Magic):
+		return PAR2
+	default:
+		return Unknown
+	}
+}
+
+var par1ExtensionRegexp = regexp.MustCompile(`(?i)^\.(par|[pqr]\d\d)$`)
+
+// DetectFromExtension returns the format of the PAR file at path
+// implied by its extension, which is .par2 for PAR2, and .par or .p,
+// .q, or .r followed by two digits for PAR1, case-insensitively, or
+// Unknown if it's neither.
+func DetectFromExtension(path string) Format {
+	ext := filepath.Ext(path)
+	switch {
+	case strings.EqualFold(ext, ".par2"):
+		return PAR2
+	case par1ExtensionRegexp.MatchString(ext):
+		return PAR1
+	default:
+		return Unknown
+	}
+}
+
+// DetectFile returns the format of the PAR file at path from its
+// first bytes, falling back to DetectFromExtension if the file
+// doesn't exist, e.g. because it's about to be created, or if its
+// first bytes aren't recognized, e.g. because it's damaged.
+func DetectFile(path string) (format Format, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return DetectFromExtension(path), nil
+	} else if err != nil {
+		return Unknown, err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	data := make([]byte, MagicByteCount)
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Unknown, err
+	}
+	if format := Detect(data[:n]); format != Unknown {
+		return format, nil
+	}
+	return DetectFromExtension(path), nil
+}
@@ -0,0 +1,69 @@
+package parformat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetect(t *testing.T) {
+	require.Equal(t, PAR1, Detect([]byte("PAR\x00\x00\x00\x00\x00\x00\x00\x01\x00")))
+	require.Equal(t, PAR2, Detect([]byte("PAR2\x00PKT\x40\x00")))
+	require.Equal(t, Unknown, Detect([]byte("PAR2\x00PK")))
+	require.Equal(t, Unknown, Detect([]byte("PAR\x00")))
+	require.Equal(t, Unknown, Detect([]byte("Rar!\x1a\x07\x00\x00")))
+	require.Equal(t, Unknown, Detect(nil))
+}
+
+func TestDetectFromExtension(t *testing.T) {
+	require.Equal(t, PAR2, DetectFromExtension("file.par2"))
+	require.Equal(t, PAR2, DetectFromExtension("file.vol00+01.PAR2"))
+	require.Equal(t, PAR1, DetectFromExtension("file.par"))
+	require.Equal(t, PAR1, DetectFromExtension("file.PAR"))
+	require.Equal(t, PAR1, DetectFromExtension("file.p01"))
+	require.Equal(t, PAR1, DetectFromExtension("file.P99"))
+	require.Equal(t, PAR1, DetectFromExtension("file.q00"))
+	require.Equal(t, PAR1, DetectFromExtension("file.R55"))
+	require.Equal(t, Unknown, DetectFromExtension("file.rar"))
+	require.Equal(t, Unknown, DetectFromExtension("file.p1"))
+	require.Equal(t, Unknown, DetectFromExtension("file.s01"))
+	require.Equal(t, Unknown, DetectFromExtension("file"))
+}
+
+func TestDetectFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parformat")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// The contents take precedence over the extension.
+	par2Path := filepath.Join(dir, "file.par")
+	require.NoError(t, ioutil.WriteFile(par2Path, []byte("PAR2\x00PKT\x40\x00"), 0600))
+	format, err := DetectFile(par2Path)
+	require.NoError(t, err)
+	require.Equal(t, PAR2, format)
+
+	par1Path := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(par1Path, []byte("PAR\x00\x00\x00\x00\x00\x00\x00\x01\x00"), 0600))
+	format, err = DetectFile(par1Path)
+	require.NoError(t, err)
+	require.Equal(t, PAR1, format)
+
+	damagedPath := filepath.Join(dir, "damaged.PAR2")
+	require.NoError(t, ioutil.WriteFile(damagedPath, []byte("PA"), 0600))
+	format, err = DetectFile(damagedPath)
+	require.NoError(t, err)
+	require.Equal(t, PAR2, format)
+
+	format, err = DetectFile(filepath.Join(dir, "new.p01"))
+	require.NoError(t, err)
+	require.Equal(t, PAR1, format)
+
+	format, err = DetectFile(filepath.Join(dir, "new.txt"))
+	require.NoError(t, err)
+	require.Equal(t, Unknown, format)
+}
@@ -1,6 +1,7 @@
 package rsec16
 
 import (
+	"context"
 	"errors"
 	"math"
 	"runtime"
@@ -25,6 +26,11 @@ func DefaultNumGoroutines() int {
 	return numGoroutines
 }
 
+// A ProgressFunc is called as a matrix is applied to shards, with the
+// number of rows of the matrix, i.e. output shards, that have been
+// applied so far and the total number of rows.
+type ProgressFunc func(rowsApplied, rowCount int)
+
 // A Coder is an object that can generate parity shards, verify parity
 // shards, and reconstruct data shards from parity shards.
 type Coder struct {
@@ -138,21 +144,62 @@ func NewCoderPAR2Vandermonde(dataShards, parityShards, numGoroutines int) (Coder
 	return Coder{dataShards, parityShards, numGoroutines, parityMatrix}, nil
 }
 
-func (c Coder) applyMatrix(m gf2p16.Matrix, in, out [][]byte) {
-	applyMatrixParallelData(m, in, out, c.numGoroutines)
-}
-
 // GenerateParity takes a list of data shards, which must have length
 // matching the dataShards value passed into NewCoder, and which must
 // have equal-sized byte slices with even length, and returns a list
 // of parityShards parity shards.
 func (c Coder) GenerateParity(data [][]byte) [][]byte {
+	// This can't fail, since the context is never done.
+	parity, _ := c.GenerateParityContext(context.Background(), data, nil)
+	return parity
+}
+
+// GenerateParityContext is like GenerateParity, but it stops and
+// returns ctx.Err() if ctx is done before all the parity shards are
+// generated, and it calls progress, if it's non-nil, after each
+// parity shard is generated.
+func (c Coder) GenerateParityContext(ctx context.Context, data [][]byte, progress ProgressFunc) ([][]byte, error) {
 	parity := make([][]byte, c.parityShards)
 	for i := range parity {
 		parity[i] = make([]byte, len(data[0]))
 	}
-	c.applyMatrix(c.parityMatrix, data, parity)
-	return parity
+	err := applyMatrixParallelData(ctx, c.parityMatrix, data, parity, c.numGoroutines, progress)
+	if err != nil {
+		return nil, err
+	}
+	return parity, nil
+}
+
+// AccumulateParity adds the contribution of the given data shards,
+// which are taken to be the data shards starting at index dataStart,
+// to parity, which must have parityShards equal-sized byte slices
+// matching the size of the data shards. Calling AccumulateParity on
+// zeroed parity shards for consecutive runs of data shards covering
+// all of them gives the same result as GenerateParity. Since each
+// byte offset is independent of the others, this can also be done
+// piecewise on matching subslices of the shards, so parity can be
+// computed without ever having all the data in memory.
+func (c Coder) AccumulateParity(dataStart int, data, parity [][]byte) {
+	// This can't fail, since the context is never done.
+	_ = c.AccumulateParityContext(context.Background(), dataStart, data, parity, nil)
+}
+
+// AccumulateParityContext is like AccumulateParity, but it stops and
+// returns ctx.Err() if ctx is done before all the parity shards are
+// updated, in which case parity is left partially updated, and it
+// calls progress, if it's non-nil, after each parity shard is
+// updated.
+func (c Coder) AccumulateParityContext(ctx context.Context, dataStart int, data, parity [][]byte, progress ProgressFunc) error {
+	if dataStart < 0 || dataStart+len(data) > c.dataShards {
+		panic("invalid data shard range")
+	}
+	if len(parity) != c.parityShards {
+		panic("invalid parity shard count")
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return addMatrixColumnsParallelData(ctx, c.parityMatrix, dataStart, data, parity, c.numGoroutines, progress)
 }
 
 func makeReconstructionMatrix(dataShards int, availableRows, missingRows, usedParityRows []int, parityMatrix gf2p16.Matrix) (gf2p16.Matrix, error) {
@@ -184,16 +231,14 @@ func (NotEnoughParityShardsError) Error() string {
 	return "not enough parity shards"
 }
 
-// reconstructDataHelper implements the logic of both ReconstructData
-// and CanReconstructData.
-func (c Coder) reconstructDataHelper(
-	data, parity [][]byte, doReconstruct bool) error {
-	var availableRows, missingRows []int
-	var input [][]byte
-	for i, dataShard := range data {
-		if dataShard != nil {
+// chooseReconstructionRows returns the indices of the available
+// and missing data shards, and of the parity shards to use to
+// reconstruct the missing ones, given which data and parity shards
+// are available.
+func (c Coder) chooseReconstructionRows(hasData, hasParity []bool) (availableRows, missingRows, usedParityRows []int, err error) {
+	for i, ok := range hasData {
+		if ok {
 			availableRows = append(availableRows, i)
-			input = append(input, dataShard)
 		} else {
 			missingRows = append(missingRows, i)
 		}
@@ -201,37 +246,62 @@ func (c Coder) reconstructDataHelper(
 
 	if len(missingRows) == 0 {
 		// Nothing to reconstruct.
-		return nil
+		return availableRows, nil, nil, nil
 	}
 
-	var usedParityRows []int
-	for i := 0; i < len(parity) && len(input) < c.dataShards; i++ {
-		if parity[i] != nil {
+	for i := 0; i < len(hasParity) && len(availableRows)+len(usedParityRows) < c.dataShards; i++ {
+		if hasParity[i] {
 			usedParityRows = append(usedParityRows, i)
-			input = append(input, parity[i])
 		}
 	}
 
-	if len(input) < c.dataShards {
-		return NotEnoughParityShardsError{}
+	if len(availableRows)+len(usedParityRows) < c.dataShards {
+		return nil, nil, nil, NotEnoughParityShardsError{}
 	}
 
+	return availableRows, missingRows, usedParityRows, nil
+}
+
+func hasShards(shards [][]byte) []bool {
+	has := make([]bool, len(shards))
+	for i, shard := range shards {
+		has[i] = shard != nil
+	}
+	return has
+}
+
+// reconstructDataHelper implements the logic of both ReconstructData
+// and CanReconstructData.
+func (c Coder) reconstructDataHelper(
+	data, parity [][]byte, doReconstruct bool) error {
 	if !doReconstruct {
-		return nil
+		return c.CanReconstructDataFrom(hasShards(data), hasShards(parity))
 	}
 
-	reconstructionMatrix, err := makeReconstructionMatrix(c.dataShards, availableRows, missingRows, usedParityRows, c.parityMatrix)
+	r, err := c.NewReconstructor(hasShards(data), hasShards(parity))
 	if err != nil {
 		return err
 	}
 
-	reconstructedData := make([][]byte, len(missingRows))
+	if len(r.missingRows) == 0 {
+		return nil
+	}
+
+	var availableData, usedParity [][]byte
+	for _, i := range r.availableRows {
+		availableData = append(availableData, data[i])
+	}
+	for _, i := range r.usedParityRows {
+		usedParity = append(usedParity, parity[i])
+	}
+
+	reconstructedData := make([][]byte, len(r.missingRows))
 	for i := range reconstructedData {
-		reconstructedData[i] = make([]byte, len(input[0]))
+		reconstructedData[i] = make([]byte, len(usedParity[0]))
 	}
-	c.applyMatrix(reconstructionMatrix, input, reconstructedData)
-	for i, r := range missingRows {
-		data[r] = reconstructedData[i]
+	r.Reconstruct(availableData, usedParity, reconstructedData)
+	for i, j := range r.missingRows {
+		data[j] = reconstructedData[i]
 	}
 	return nil
 }
@@ -257,3 +327,93 @@ func (c Coder) CanReconstructData(data, parity [][]byte) error {
 	doReconstruct := false
 	return c.reconstructDataHelper(data, parity, doReconstruct)
 }
+
+// CanReconstructDataFrom is like CanReconstructData, but takes
+// whether each data and parity shard is available instead of the
+// shards themselves.
+func (c Coder) CanReconstructDataFrom(hasData, hasParity []bool) error {
+	_, _, _, err := c.chooseReconstructionRows(hasData, hasParity)
+	return err
+}
+
+// A Reconstructor reconstructs a fixed set of missing data shards
+// from a fixed set of available data and parity shards. Unlike
+// ReconstructData, it computes the reconstruction matrix only once,
+// so it can be used to reconstruct data in pieces without having
+// all of it in memory.
+type Reconstructor struct {
+	numGoroutines                              int
+	availableRows, missingRows, usedParityRows []int
+	reconstructionMatrix                       gf2p16.Matrix
+}
+
+// NewReconstructor takes whether each data and parity shard is
+// available, and returns a Reconstructor for the missing data
+// shards. If there aren't enough parity shards to reconstruct them,
+// NotEnoughParityShardsError is returned.
+func (c Coder) NewReconstructor(hasData, hasParity []bool) (Reconstructor, error) {
+	availableRows, missingRows, usedParityRows, err := c.chooseReconstructionRows(hasData, hasParity)
+	if err != nil {
+		return Reconstructor{}, err
+	}
+
+	var reconstructionMatrix gf2p16.Matrix
+	if len(missingRows) > 0 {
+		reconstructionMatrix, err = makeReconstructionMatrix(c.dataShards, availableRows, missingRows, usedParityRows, c.parityMatrix)
+		if err != nil {
+			return Reconstructor{}, err
+		}
+	}
+
+	return Reconstructor{c.numGoroutines, availableRows, missingRows, usedParityRows, reconstructionMatrix}, nil
+}
+
+// AvailableDataShards returns the indices of the available data
+// shards, in the order they should be passed to Reconstruct.
+func (r Reconstructor) AvailableDataShards() []int {
+	return r.availableRows
+}
+
+// MissingDataShards returns the indices of the missing data shards,
+// in the order they're filled in by Reconstruct.
+func (r Reconstructor) MissingDataShards() []int {
+	return r.missingRows
+}
+
+// UsedParityShards returns the indices of the parity shards used for
+// reconstruction, in the order they should be passed to
+// Reconstruct. It's empty if there are no missing data shards.
+func (r Reconstructor) UsedParityShards() []int {
+	return r.usedParityRows
+}
+
+// Reconstruct takes the available data shards and used parity shards,
+// or matching subslices of them, and fills in out with the
+// corresponding missing data shards or subslices. All of the byte
+// slices must have the same even length.
+func (r Reconstructor) Reconstruct(availableData, usedParity, out [][]byte) {
+	// This can't fail, since the context is never done.
+	_ = r.ReconstructContext(context.Background(), availableData, usedParity, out, nil)
+}
+
+// ReconstructContext is like Reconstruct, but it stops and returns
+// ctx.Err() if ctx is done before all of out is filled in, and it
+// calls progress, if it's non-nil, after each element of out is
+// filled in.
+func (r Reconstructor) ReconstructContext(ctx context.Context, availableData, usedParity, out [][]byte, progress ProgressFunc) error {
+	if len(availableData) != len(r.availableRows) {
+		panic("invalid available data shard count")
+	}
+	if len(usedParity) != len(r.usedParityRows) {
+		panic("invalid used parity shard count")
+	}
+	if len(out) != len(r.missingRows) {
+		panic("invalid output shard count")
+	}
+	if len(out) == 0 {
+		return nil
+	}
+
+	input := append(append([][]byte{}, availableData...), usedParity...)
+	return applyMatrixParallelData(ctx, r.reconstructionMatrix, input, out, r.numGoroutines, progress)
+}
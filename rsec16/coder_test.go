@@ -1,6 +1,7 @@
 package rsec16
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"testing"
@@ -176,6 +177,67 @@ func TestCoderGenerateParity(t *testing.T) {
 	testCoder(t, testCoderGenerateParity)
 }
 
+func testCoderGenerateParityContext(t *testing.T, newCoder func(int, int) (Coder, error)) {
+	data := makeTestData()
+	c, err := newCoder(5, 3)
+	require.NoError(t, err)
+	expectedParity := c.GenerateParity(data)
+
+	var progress [][2]int
+	parity, err := c.GenerateParityContext(context.Background(), data, func(rowsApplied, rowCount int) {
+		progress = append(progress, [2]int{rowsApplied, rowCount})
+	})
+	require.NoError(t, err)
+	require.Equal(t, expectedParity, parity)
+	require.Equal(t, [][2]int{{1, 3}, {2, 3}, {3, 3}}, progress)
+
+	// Cancel after the first parity shard is generated.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	progress = nil
+	_, err = c.GenerateParityContext(ctx, data, func(rowsApplied, rowCount int) {
+		progress = append(progress, [2]int{rowsApplied, rowCount})
+		cancel()
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, [][2]int{{1, 3}}, progress)
+}
+
+func TestCoderGenerateParityContext(t *testing.T) {
+	testCoder(t, testCoderGenerateParityContext)
+}
+
+func testCoderAccumulateParity(t *testing.T, newCoder func(int, int) (Coder, error)) {
+	data := makeTestData()
+	c, err := newCoder(5, 3)
+	require.NoError(t, err)
+	expectedParity := c.GenerateParity(data)
+
+	// Accumulate in uneven runs of data shards, and in two
+	// halves of each shard.
+	parity := make([][]byte, 3)
+	for i := range parity {
+		parity[i] = make([]byte, 4)
+	}
+	for _, r := range []struct{ start, end int }{{0, 2}, {2, 3}, {3, 5}} {
+		for _, h := range []struct{ start, end int }{{0, 2}, {2, 4}} {
+			var dataPieces, parityPieces [][]byte
+			for _, shard := range data[r.start:r.end] {
+				dataPieces = append(dataPieces, shard[h.start:h.end])
+			}
+			for _, shard := range parity {
+				parityPieces = append(parityPieces, shard[h.start:h.end])
+			}
+			c.AccumulateParity(r.start, dataPieces, parityPieces)
+		}
+	}
+	require.Equal(t, expectedParity, parity)
+}
+
+func TestCoderAccumulateParity(t *testing.T) {
+	testCoder(t, testCoderAccumulateParity)
+}
+
 func testCoderReconstructData(t *testing.T, newCoder func(int, int) (Coder, error)) {
 	data := makeTestData()
 	c, err := newCoder(5, 3)
@@ -278,3 +340,48 @@ func TestCoderReconstructDataNotEnough(t *testing.T) {
 }
 
 // TODO: Add tests demonstrating the flaws in the PAR2 Vandermonde matrix.
+
+func testCoderReconstructor(t *testing.T, newCoder func(int, int) (Coder, error)) {
+	data := makeTestData()
+	c, err := newCoder(5, 3)
+	require.NoError(t, err)
+	parity := c.GenerateParity(data)
+
+	hasData := []bool{false, true, true, true, false}
+	hasParity := []bool{false, true, true}
+	err = c.CanReconstructDataFrom(hasData, hasParity)
+	require.NoError(t, err)
+	r, err := c.NewReconstructor(hasData, hasParity)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, r.AvailableDataShards())
+	require.Equal(t, []int{0, 4}, r.MissingDataShards())
+	require.Equal(t, []int{1, 2}, r.UsedParityShards())
+
+	// Reconstruct in two halves of each shard.
+	out := [][]byte{make([]byte, 4), make([]byte, 4)}
+	for _, h := range []struct{ start, end int }{{0, 2}, {2, 4}} {
+		var dataPieces, parityPieces, outPieces [][]byte
+		for _, i := range r.AvailableDataShards() {
+			dataPieces = append(dataPieces, data[i][h.start:h.end])
+		}
+		for _, i := range r.UsedParityShards() {
+			parityPieces = append(parityPieces, parity[i][h.start:h.end])
+		}
+		for _, shard := range out {
+			outPieces = append(outPieces, shard[h.start:h.end])
+		}
+		r.Reconstruct(dataPieces, parityPieces, outPieces)
+	}
+	require.Equal(t, [][]byte{data[0], data[4]}, out)
+
+	hasParity = []bool{false, true, false}
+	expectedErr := NotEnoughParityShardsError{}
+	err = c.CanReconstructDataFrom(hasData, hasParity)
+	require.Equal(t, expectedErr, err)
+	_, err = c.NewReconstructor(hasData, hasParity)
+	require.Equal(t, expectedErr, err)
+}
+
+func TestCoderReconstructor(t *testing.T) {
+	testCoder(t, testCoderReconstructor)
+}
@@ -1,6 +1,7 @@
 package rsec16
 
 import (
+	"context"
 	"sync"
 
 	"github.com/akalin/gopar/gf2p16"
@@ -76,19 +77,75 @@ func applyMatrixParallelOut(m gf2p16.Matrix, in, out [][]byte, numGoroutines int
 	wg.Wait()
 }
 
-func applyMatrixParallelData(m gf2p16.Matrix, in, out [][]byte, numGoroutines int) {
+// applyMatrixParallelData is like applyMatrixSingle, except that it
+// splits the data among numGoroutines goroutines. It applies one row
+// of m at a time, returning ctx.Err() instead of starting a row if ctx
+// is done, and calling progress, if it's non-nil, after each row.
+func applyMatrixParallelData(ctx context.Context, m gf2p16.Matrix, in, out [][]byte, numGoroutines int, progress ProgressFunc) error {
 	if len(in[0]) != len(out[0]) {
 		panic("mismatched lengths")
 	}
 
+	for i := range out {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		runParallelData(len(out[0]), numGoroutines, func(start, end int) {
+			applyMatrixSlice(m, in, out, i, i+1, start, end)
+		})
+		if progress != nil {
+			progress(i+1, len(out))
+		}
+	}
+	return nil
+}
+
+// addMatrixColumnsSlice is like applyMatrixSlice, except that it
+// uses only the columns of m starting at columnStart, and it adds to
+// out instead of overwriting it.
+func addMatrixColumnsSlice(m gf2p16.Matrix, columnStart int, in, out [][]byte, outStart, outEnd, dataStart, dataEnd int) {
+	for i := outStart; i < outEnd; i++ {
+		outSlice := out[i][dataStart:dataEnd]
+		for j := range in {
+			c := m.At(i, columnStart+j)
+			inSlice := in[j][dataStart:dataEnd]
+			gf2p16.MulAndAddByteSliceLE(c, inSlice, outSlice)
+		}
+	}
+}
+
+// addMatrixColumnsParallelData is to addMatrixColumnsSlice what
+// applyMatrixParallelData is to applyMatrixSlice.
+func addMatrixColumnsParallelData(ctx context.Context, m gf2p16.Matrix, columnStart int, in, out [][]byte, numGoroutines int, progress ProgressFunc) error {
+	if len(in[0]) != len(out[0]) {
+		panic("mismatched lengths")
+	}
+
+	for i := range out {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		runParallelData(len(out[0]), numGoroutines, func(start, end int) {
+			addMatrixColumnsSlice(m, columnStart, in, out, i, i+1, start, end)
+		})
+		if progress != nil {
+			progress(i+1, len(out))
+		}
+	}
+	return nil
+}
+
+// runParallelData splits [0, dataLength) into at most numGoroutines
+// ranges and calls fn on each one in its own goroutine, returning
+// once they're all done.
+func runParallelData(dataLength, numGoroutines int, fn func(start, end int)) {
 	if numGoroutines < 1 {
 		panic("invalid numGoroutines value")
 	}
 
-	dataLength := len(out[0])
 	perGoroutineDataLength, numGoroutines := calculateParallelParams(dataLength, numGoroutines, 16, 16)
 	if numGoroutines < 2 {
-		applyMatrixSingle(m, in, out)
+		fn(0, dataLength)
 		return
 	}
 
@@ -102,7 +159,7 @@ func applyMatrixParallelData(m gf2p16.Matrix, in, out [][]byte, numGoroutines in
 			if end > dataLength {
 				end = dataLength
 			}
-			applyMatrixSlice(m, in, out, 0, len(out), start, end)
+			fn(start, end)
 		}(i)
 	}
 
@@ -1,6 +1,7 @@
 package rsec16
 
 import (
+	"context"
 	"fmt"
 	"runtime"
 	"testing"
@@ -91,6 +92,10 @@ func applyNumGoroutines(fn func(gf2p16.Matrix, [][]byte, [][]byte, int), numGoro
 	}
 }
 
+func applyMatrixParallelDataBackground(m gf2p16.Matrix, in, out [][]byte, numGoroutines int) {
+	_ = applyMatrixParallelData(context.Background(), m, in, out, numGoroutines, nil)
+}
+
 func runApplyMatrixTest(t *testing.T, fn func(*testing.T, applyMatrixFunc)) {
 	t.Run("Single", func(t *testing.T) { fn(t, applyMatrixSingle) })
 	var testNumGoroutines = []int{2, 4, 8}
@@ -105,7 +110,7 @@ func runApplyMatrixTest(t *testing.T, fn func(*testing.T, applyMatrixFunc)) {
 		// Capture range variable.
 		numGoroutines := numGoroutines
 		t.Run(fmt.Sprintf("DataParallel-%d", numGoroutines), func(t *testing.T) {
-			fn(t, applyNumGoroutines(applyMatrixParallelData, numGoroutines))
+			fn(t, applyNumGoroutines(applyMatrixParallelDataBackground, numGoroutines))
 		})
 	}
 }
@@ -165,7 +170,7 @@ func runApplyMatrixBenchmark(b *testing.B, fn func(*testing.B, applyMatrixFunc))
 		// Capture range variable.
 		numGoroutines := numGoroutines
 		b.Run(fmt.Sprintf("DataParallel-%d", numGoroutines), func(b *testing.B) {
-			fn(b, applyNumGoroutines(applyMatrixParallelData, numGoroutines))
+			fn(b, applyNumGoroutines(applyMatrixParallelDataBackground, numGoroutines))
 		})
 	}
 }